@@ -0,0 +1,78 @@
+// ratelimit-coprocess serves the rate limiting of the plugin as a Tyk gRPC coprocess plugin,
+// deployed and versioned apart from the gateway instead of the native plugin compiled against it.
+//
+//	ratelimit-coprocess -listen :5555 [-dir iac/api-definitions -env dev]
+//
+// The gateway is configured with the "coprocess_options" of tyk.conf pointing to the server
+// ("coprocess_grpc_server": "tcp://ratelimit-coprocess:5555") and the apis with the "grpc"
+// driver and the "SetRateLimit" auth_check of the bundle manifest, the config data of the
+// api definitions being sent by the gateway along with each request. The gateway does not send
+// the name nor the listen path of the apis: with -env, they are read from the api definitions
+// of the environment (merged the same way iacctl does) for the metrics and the admin endpoint.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/TykTechnologies/tyk/coprocess"
+	"google.golang.org/grpc"
+
+	"tyk-plugin-grpc/dispatcher"
+	"tyk-plugin/iac"
+	"tyk-plugin/ratelimit"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "ratelimit-coprocess:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer) error {
+	server, listener, err := newServer(args, stdout)
+	if err != nil {
+		return err
+	}
+	return server.Serve(listener)
+}
+
+// function returns the grpc server of the dispatcher and the listener it serves, to be started
+func newServer(args []string, stdout io.Writer) (*grpc.Server, net.Listener, error) {
+	flags := flag.NewFlagSet("ratelimit-coprocess", flag.ContinueOnError)
+	listen := flags.String("listen", ":5555", "address the grpc server listens on")
+	dir := flags.String("dir", "iac/api-definitions", "directory of the api definitions, holding base and env-overrides")
+	env := flags.String("env", "", "environment of the definitions giving the name and the listen path of the apis")
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	var definitions []ratelimit.ApiDefinition
+	if *env != "" {
+		found, missing, err := iac.FindDefinitions(*dir, *env)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(missing) > 0 {
+			fmt.Fprintf(stdout, "no %v override, named by their api id: %v\n", *env, strings.Join(missing, ", "))
+		}
+		for _, definition := range found {
+			definitions = append(definitions, definition.RateLimitDefinition())
+		}
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return nil, nil, err
+	}
+	server := grpc.NewServer()
+	coprocess.RegisterDispatcherServer(server, dispatcher.NewDispatcher(definitions...))
+
+	fmt.Fprintf(stdout, "listening on %v\n", listener.Addr())
+	return server, listener, nil
+}
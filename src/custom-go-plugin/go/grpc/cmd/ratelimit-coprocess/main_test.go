@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/TykTechnologies/tyk/coprocess"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func Test_ServeDispatcher_Success(t *testing.T) {
+	var stdout bytes.Buffer
+	server, listener, err := newServer([]string{"-listen", "127.0.0.1:0"}, &stdout)
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	if !strings.Contains(stdout.String(), listener.Addr().String()) {
+		t.Fatalf("Listen address was not printed: %v", stdout.String())
+	}
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+
+	returned, err := coprocess.NewDispatcherClient(conn).Dispatch(context.Background(), &coprocess.Object{
+		HookType: coprocess.HookType_CustomKeyCheck,
+		Request:  &coprocess.MiniRequestObject{Method: "GET", Url: "/orders/", Headers: map[string]string{"X-Tenant-Id": "milesahead1"}},
+		Spec: map[string]string{"APIID": "orders", "config_data": `{"rateLimiting": {"active": true, "requests": 3, "seconds": 10,
+			"strategy": {"name": "requestHeaders", "config": {"headerNames": ["x-tenant-id"], "separator": "::"}}}}`},
+	})
+	if err != nil {
+		t.Fatalf("Error dispatching object: %v", err)
+	}
+	if returned.GetSession().GetRate() != 3 || returned.GetMetadata()["token"] != "milesahead1" {
+		t.Fatalf("Session was not correct -- expected 3 for milesahead1 but was %v", returned.GetSession())
+	}
+}
+
+func Test_InvalidArgs_Success(t *testing.T) {
+	for _, args := range [][]string{{"-unknown"}, {"-listen", "invalid-address"}} {
+		if err := run(args, ioutil.Discard); err == nil {
+			t.Fatalf("Args %v should be rejected", args)
+		}
+	}
+}
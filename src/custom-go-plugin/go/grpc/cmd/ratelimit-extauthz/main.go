@@ -0,0 +1,84 @@
+// ratelimit-extauthz serves the Envoy external authorization gRPC api with the rate limiting of
+// the api definitions of an environment, for the workloads behind Envoy rather than the gateway.
+//
+//	ratelimit-extauthz -dir iac/api-definitions -env dev -listen :9191
+//
+// The definitions of the environment are loaded from iac/api-definitions, merged with their
+// override the same way iacctl does. Envoy is configured with an ext_authz http filter using the
+// grpc service of the server, with 'with_request_body' for the SOAP strategies and overrides, and
+// an "api" context extension on the routes not matching the listen path of their api definition.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc"
+
+	"tyk-plugin-grpc/extauthz"
+	"tyk-plugin/iac"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "ratelimit-extauthz:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer) error {
+	server, listener, err := newServer(args, stdout)
+	if err != nil {
+		return err
+	}
+	return server.Serve(listener)
+}
+
+// function returns the grpc server of the definitions and the listener it serves, to be started
+func newServer(args []string, stdout io.Writer) (*grpc.Server, net.Listener, error) {
+	flags := flag.NewFlagSet("ratelimit-extauthz", flag.ContinueOnError)
+	dir := flags.String("dir", "iac/api-definitions", "directory of the api definitions, holding base and env-overrides")
+	env := flags.String("env", "", "environment of the definitions")
+	listen := flags.String("listen", ":9191", "address the grpc server listens on")
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if *env == "" {
+		flags.Usage()
+		return nil, nil, errors.New("-env is required")
+	}
+
+	definitions, missing, err := iac.FindDefinitions(*dir, *env)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(stdout, "no %v override, not served: %v\n", *env, strings.Join(missing, ", "))
+	}
+	if len(definitions) == 0 {
+		return nil, nil, fmt.Errorf("no api definition for environment %q in %v", *env, *dir)
+	}
+	authorizationServer, err := extauthz.NewServer(definitions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return nil, nil, err
+	}
+	server := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(server, authorizationServer)
+
+	for _, definition := range definitions {
+		fmt.Fprintf(stdout, "%v\t%v\n", definition.Api, definition.ListenPath())
+	}
+	fmt.Fprintf(stdout, "listening on %v\n", listener.Addr())
+	return server, listener, nil
+}
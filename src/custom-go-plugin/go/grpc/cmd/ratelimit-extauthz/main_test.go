@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Error creating %v: %v", filepath.Dir(path), err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Error writing %v: %v", path, err)
+	}
+}
+
+func Test_ServeDefinitions_Success(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "base", "orders.json"), `{"api_definition": {"name": "Orders", "proxy": {"listen_path": "/orders/"},
+		"config_data": {"rateLimiting": {"active": true, "requests": 1, "seconds": 60,
+			"strategy": {"name": "requestHeaders", "config": {"headerNames": ["x-tenant-id"], "separator": "::"}}}}}}`)
+	writeFile(t, filepath.Join(dir, "env-overrides", "orders-dev.json"), `{"api_definition": {"name": "Orders DEV"}}`)
+
+	var stdout bytes.Buffer
+	server, listener, err := newServer([]string{"-dir", dir, "-env", "dev", "-listen", "127.0.0.1:0"}, &stdout)
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	if !strings.Contains(stdout.String(), "orders\t/orders/") {
+		t.Fatalf("Served definitions were not printed: %v", stdout.String())
+	}
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	client := authv3.NewAuthorizationClient(conn)
+
+	request := &authv3.CheckRequest{Attributes: &authv3.AttributeContext{Request: &authv3.AttributeContext_Request{
+		Http: &authv3.AttributeContext_HttpRequest{Method: "GET", Path: "/orders/1", Host: "orders", Headers: map[string]string{"x-tenant-id": "milesahead1"}},
+	}}}
+	expected := []codes.Code{codes.OK, codes.ResourceExhausted}
+	for _, code := range expected {
+		response, err := client.Check(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Error checking request: %v", err)
+		}
+		if codes.Code(response.GetStatus().GetCode()) != code {
+			t.Fatalf("Status was not correct -- expected %v but was %v", code, response.GetStatus().GetCode())
+		}
+	}
+}
+
+func Test_InvalidArgs_Success(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "base", "orders.json"), `{"api_definition": {"name": "Orders",
+		"config_data": {"rateLimiting": {"active": true, "strategy": {"name": "unknown"}}}}}`)
+	writeFile(t, filepath.Join(dir, "env-overrides", "orders-dev.json"), `{}`)
+
+	tests := [][]string{
+		{},
+		{"-unknown"},
+		{"-dir", dir, "-env", "qae"},
+		{"-dir", dir, "-env", "dev"},
+	}
+	for _, args := range tests {
+		if err := run(args, ioutil.Discard); err == nil {
+			t.Fatalf("Args %v should be rejected", args)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// Package dispatcher serves the rate limiting of the plugin as a Tyk gRPC coprocess plugin, the
+// alternative to the native plugin which does not have to be compiled against the version of the
+// gateway. The Dispatcher service runs the same strategies, access lists, overrides and admin
+// endpoint for the auth_check (custom key check) hook, and returns the session of the key for
+// the gateway to apply the limits, the requests denied by the plugin being answered with the
+// return overrides of the object. The other hooks are returned unchanged.
+//
+// The gateway only sends the id and the config data of the api: its name, used by the metrics
+// and the logs, and its listen path, after which the admin path is matched, are the ones of the
+// api definitions given to the dispatcher. The apis of no definition are named by their id and
+// their admin path is only matched at the root of the request paths.
+package dispatcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/TykTechnologies/tyk/coprocess"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"tyk-plugin/ratelimit"
+)
+
+// the gateway requires a token for the sessions set by a coprocess auth_check, the requests of no
+// key share the session of this token as they share the session of no KeyID with the native plugin
+const anonymousToken = "anonymous"
+
+// Dispatcher is the coprocess Dispatcher server of the plugin
+type Dispatcher struct {
+	coprocess.UnimplementedDispatcherServer
+	definitions map[string]ratelimit.ApiDefinition
+}
+
+// gateway context of an object sent by the gateway, keeping the session and
+// the response set by Handle
+type objectContext struct {
+	definition ratelimit.ApiDefinition
+	rw         *responseBuffer
+	session    *ratelimit.Session
+}
+
+// response of the plugin to a request, which the gateway writes from the return overrides
+type responseBuffer struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+// NewDispatcher returns the Dispatcher server of the plugin, the definitions giving the name
+// and the listen path of the apis by api id
+func NewDispatcher(definitions ...ratelimit.ApiDefinition) *Dispatcher {
+	dispatcher := &Dispatcher{definitions: map[string]ratelimit.ApiDefinition{}}
+	for _, definition := range definitions {
+		dispatcher.definitions[definition.APIID] = definition
+	}
+	return dispatcher
+}
+
+// Dispatch handles the hook of the object
+func (dispatcher *Dispatcher) Dispatch(ctx context.Context, object *coprocess.Object) (*coprocess.Object, error) {
+	if object.HookType != coprocess.HookType_CustomKeyCheck {
+		return object, nil
+	}
+
+	if object.Request == nil {
+		return nil, status.Error(codes.InvalidArgument, "no request in the object")
+	}
+	definition, err := dispatcher.apiDefinition(object.Spec)
+	if err != nil {
+		ratelimit.ErrorLog("Config data read error: ", err)
+		return internalError(object), nil
+	}
+	req, err := buildRequest(object.Request)
+	if err != nil {
+		ratelimit.ErrorLog("Invalid request: ", err)
+		return internalError(object), nil
+	}
+
+	gateway := &objectContext{definition: definition, rw: &responseBuffer{header: http.Header{}}}
+	ratelimit.Handle(gateway, req)
+
+	// Handle neither answers the request nor sets a session when the config cannot be used,
+	// the gateway would otherwise let the request through without limits
+	if gateway.rw.statusCode == 0 && gateway.session == nil {
+		return internalError(object), nil
+	}
+
+	// denied by the access lists or answered by the admin endpoint, the response being
+	// written by the gateway as is
+	if gateway.rw.statusCode != 0 {
+		headers := map[string]string{}
+		for name := range gateway.rw.header {
+			headers[name] = gateway.rw.header.Get(name)
+		}
+		object.Request.ReturnOverrides = &coprocess.ReturnOverrides{
+			ResponseCode:  int32(gateway.rw.statusCode),
+			ResponseBody:  gateway.rw.body.String(),
+			Headers:       headers,
+			OverrideError: true,
+		}
+		return object, nil
+	}
+
+	if gateway.session != nil {
+		object.Session = sessionState(*gateway.session)
+		object.Metadata = map[string]string{"token": object.Session.Metadata["token"]}
+	}
+	return object, nil
+}
+
+// DispatchEvent ignores the events of the gateway
+func (dispatcher *Dispatcher) DispatchEvent(ctx context.Context, event *coprocess.Event) (*coprocess.EventReply, error) {
+	return &coprocess.EventReply{}, nil
+}
+
+// function answers the request of the object with a 500, for the requests the plugin failed to
+// handle
+func internalError(object *coprocess.Object) *coprocess.Object {
+	body, _ := json.Marshal(map[string]string{"error": "the rate limiting of the request failed"})
+	object.Request.ReturnOverrides = &coprocess.ReturnOverrides{
+		ResponseCode:  http.StatusInternalServerError,
+		ResponseBody:  string(body),
+		Headers:       map[string]string{"Content-Type": "application/json"},
+		OverrideError: true,
+	}
+	return object
+}
+
+// function returns the api definition of the spec of the object, the gateway only sending
+// the api id and the config data of the api (with config_data_disabled unset), the name and
+// the listen path being the ones of the definition of the api if any
+func (dispatcher *Dispatcher) apiDefinition(spec map[string]string) (ratelimit.ApiDefinition, error) {
+	definition, ok := dispatcher.definitions[spec["APIID"]]
+	if !ok {
+		definition = ratelimit.ApiDefinition{APIID: spec["APIID"], Name: spec["APIID"]}
+	}
+	definition.ConfigData = nil
+	if configData := spec["config_data"]; configData != "" {
+		if err := json.Unmarshal([]byte(configData), &definition.ConfigData); err != nil {
+			return ratelimit.ApiDefinition{}, err
+		}
+	}
+	return definition, nil
+}
+
+// function returns the http request of the request object sent by the gateway
+func buildRequest(request *coprocess.MiniRequestObject) (*http.Request, error) {
+	sample := ratelimit.SampleRequest{
+		Method:  request.Method,
+		Path:    request.Url,
+		Headers: request.Headers,
+		Body:    request.Body,
+	}
+	if len(request.RawBody) > 0 {
+		sample.Body = string(request.RawBody)
+	}
+
+	host := request.Headers["Host"]
+	if host == "" {
+		host = "localhost"
+	}
+	req, err := sample.BuildRequest(host)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = host
+	return req, nil
+}
+
+// function returns the coprocess session of the session set by the plugin, its token being
+// the KeyID of the session
+func sessionState(session ratelimit.Session) *coprocess.SessionState {
+	token := session.KeyID
+	if token == "" {
+		token = anonymousToken
+	}
+
+	metadata := map[string]string{}
+	for key, value := range session.MetaData {
+		if text, ok := value.(string); ok {
+			metadata[key] = text
+			continue
+		}
+		content, _ := json.Marshal(value)
+		metadata[key] = string(content)
+	}
+	metadata["token"] = token
+
+	return &coprocess.SessionState{
+		Rate:            session.Rate,
+		Per:             session.Per,
+		Alias:           session.Alias,
+		Metadata:        metadata,
+		SessionLifetime: session.SessionLifetime,
+	}
+}
+
+func (gateway *objectContext) Definition() ratelimit.ApiDefinition {
+	return gateway.definition
+}
+
+func (gateway *objectContext) SetSession(session ratelimit.Session) {
+	gateway.session = &session
+}
+
+func (gateway *objectContext) ResponseWriter() http.ResponseWriter {
+	return gateway.rw
+}
+
+func (response *responseBuffer) Header() http.Header {
+	return response.header
+}
+
+func (response *responseBuffer) WriteHeader(statusCode int) {
+	if response.statusCode == 0 {
+		response.statusCode = statusCode
+	}
+}
+
+func (response *responseBuffer) Write(p []byte) (int, error) {
+	if response.statusCode == 0 {
+		response.statusCode = http.StatusOK
+	}
+	return response.body.Write(p)
+}
@@ -0,0 +1,192 @@
+package dispatcher
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/TykTechnologies/tyk/coprocess"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"tyk-plugin/ratelimit"
+)
+
+const loginSoapEnvelope = `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:log="http://xrs.com/login">
+      <soapenv:Body>
+          <log:Login>
+              <log:Username>acme|dispatcher</log:Username>
+          </log:Login>
+      </soapenv:Body>
+  </soapenv:Envelope>`
+
+// function serves the dispatcher on a local port and returns a client of the server
+func newTestClient(t *testing.T) coprocess.DispatcherClient {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	server := grpc.NewServer()
+	coprocess.RegisterDispatcherServer(server, NewDispatcher())
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return coprocess.NewDispatcherClient(conn)
+}
+
+// function returns the object the gateway sends for the auth_check hook of the plugin
+func authCheckObject(method string, url string, headers map[string]string, body string, configData string) *coprocess.Object {
+	return &coprocess.Object{
+		HookType: coprocess.HookType_CustomKeyCheck,
+		HookName: "SetRateLimit",
+		Request: &coprocess.MiniRequestObject{
+			Headers:         headers,
+			Url:             url,
+			Method:          method,
+			Body:            body,
+			RawBody:         []byte(body),
+			ReturnOverrides: &coprocess.ReturnOverrides{ResponseCode: -1},
+		},
+		Spec: map[string]string{"APIID": "orders-api", "OrgID": "org", "config_data": configData},
+	}
+}
+
+func Test_DispatchAuthCheck_Success(t *testing.T) {
+	client := newTestClient(t)
+	object := authCheckObject("GET", "/resource-2/?page=1", map[string]string{"Host": "xrs.example.com", "X-Tenant-Id": "milesahead2"}, "", `{"rateLimiting": {
+		"active": true, "requests": 2, "seconds": 10, "sessionTtlMin": 120,
+		"overrides": [{"method": "GET", "resource": "/resource-2/", "requests": 5, "seconds": 60}],
+		"strategy": {"name": "requestHeaders", "config": {"headerNames": ["x-tenant-id", "Host"], "separator": "::"}}}}`)
+
+	returned, err := client.Dispatch(context.Background(), object)
+	if err != nil {
+		t.Fatalf("Error dispatching object: %v", err)
+	}
+	session := returned.GetSession()
+	if session == nil {
+		t.Fatalf("Session should be set")
+	}
+	if session.Rate != 5 || session.Per != 60 || session.SessionLifetime != 120 {
+		t.Fatalf("Session limits were not correct -- expected 5/60 (120) but was %v/%v (%v)", session.Rate, session.Per, session.SessionLifetime)
+	}
+	if session.Alias != "milesahead2::xrs.example.com" || returned.GetMetadata()["token"] != "milesahead2::xrs.example.com" {
+		t.Fatalf("Session key was not correct -- was %v, token %v", session.Alias, returned.GetMetadata()["token"])
+	}
+	if session.Metadata["keyId"] != "milesahead2::xrs.example.com" {
+		t.Fatalf("Session metadata was not correct: %v", session.Metadata)
+	}
+	if returned.GetRequest().GetReturnOverrides().GetResponseCode() != -1 {
+		t.Fatalf("Request should not be answered -- was %v", returned.GetRequest().GetReturnOverrides())
+	}
+}
+
+func Test_DispatchDenied_Success(t *testing.T) {
+	client := newTestClient(t)
+	object := authCheckObject("POST", "/LoginService.svc", map[string]string{"Host": "xrs.example.com"}, loginSoapEnvelope, `{"rateLimiting": {
+		"active": true, "requests": 5, "seconds": 60,
+		"strategy": {"name": "soapRequestXRS"},
+		"accessLists": {"deny": {"keys": ["acme-soap"]}, "denyStatusCode": 401, "denyFormat": "json"}}}`)
+
+	returned, err := client.Dispatch(context.Background(), object)
+	if err != nil {
+		t.Fatalf("Error dispatching object: %v", err)
+	}
+	overrides := returned.GetRequest().GetReturnOverrides()
+	if overrides.GetResponseCode() != http.StatusUnauthorized || !overrides.GetOverrideError() || overrides.GetResponseBody() == "" {
+		t.Fatalf("Return overrides were not correct: %v", overrides)
+	}
+	if overrides.GetHeaders()["Content-Type"] != "application/json" {
+		t.Fatalf("Content type was not correct -- expected %v but was %v", "application/json", overrides.GetHeaders()["Content-Type"])
+	}
+	if returned.GetSession() != nil {
+		t.Fatalf("No session expected for a denied request: %v", returned.GetSession())
+	}
+}
+
+func Test_DispatchWithoutKey_Success(t *testing.T) {
+	client := newTestClient(t)
+	object := authCheckObject("GET", "/resource/", map[string]string{}, "", `{"rateLimiting": {"active": false, "requests": -1, "seconds": -1}}`)
+
+	returned, err := client.Dispatch(context.Background(), object)
+	if err != nil {
+		t.Fatalf("Error dispatching object: %v", err)
+	}
+	if returned.GetSession().GetRate() != -1 || returned.GetMetadata()["token"] != anonymousToken {
+		t.Fatalf("Session was not correct -- expected no limit for %v but was %v", anonymousToken, returned.GetSession())
+	}
+}
+
+func Test_DispatchOtherHooks_Success(t *testing.T) {
+	client := newTestClient(t)
+	object := authCheckObject("GET", "/resource/", map[string]string{"X-Tenant-Id": "milesahead1"}, "", `{"rateLimiting": {"active": true, "requests": 1, "seconds": 1,
+		"strategy": {"name": "requestHeaders", "config": {"headerNames": ["x-tenant-id"], "separator": "::"}}}}`)
+	object.HookType = coprocess.HookType_Pre
+
+	returned, err := client.Dispatch(context.Background(), object)
+	if err != nil {
+		t.Fatalf("Error dispatching object: %v", err)
+	}
+	if returned.GetSession() != nil || len(returned.GetMetadata()) != 0 {
+		t.Fatalf("Object of another hook should be returned unchanged: %v", returned)
+	}
+
+	// an invalid config data leaves the session unset, the gateway denying the request
+	object = authCheckObject("GET", "/resource/", map[string]string{}, "", `{"rateLimiting": `)
+	returned, err = client.Dispatch(context.Background(), object)
+	if err != nil || returned.GetSession() != nil {
+		t.Fatalf("No session expected for an invalid config data -- was %v, %v", returned.GetSession(), err)
+	}
+
+	if _, err := client.DispatchEvent(context.Background(), &coprocess.Event{Payload: "{}"}); err != nil {
+		t.Fatalf("Error dispatching event: %v", err)
+	}
+}
+
+func Test_DispatchInvalidConfig_Success(t *testing.T) {
+	client := newTestClient(t)
+	for _, configData := range []string{`not json`, `{"rateLimiting": {"active": true, "requests": "many"}}`} {
+		returned, err := client.Dispatch(context.Background(), authCheckObject("GET", "/resource/", map[string]string{}, "", configData))
+		if err != nil {
+			t.Fatalf("Error dispatching object: %v", err)
+		}
+		overrides := returned.GetRequest().GetReturnOverrides()
+		if overrides.GetResponseCode() != http.StatusInternalServerError || !overrides.GetOverrideError() {
+			t.Fatalf("Request of config %v should be answered with a %v -- was %v", configData, http.StatusInternalServerError, overrides)
+		}
+		if returned.GetSession() != nil {
+			t.Fatalf("No session expected for an invalid config: %v", returned.GetSession())
+		}
+	}
+
+	object := authCheckObject("GET", "/resource/", map[string]string{}, "", `{}`)
+	object.Request = nil
+	if _, err := client.Dispatch(context.Background(), object); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Object without request should be rejected -- expected %v but was %v", codes.InvalidArgument, err)
+	}
+}
+
+func Test_DispatchDefinitionAdmin_Success(t *testing.T) {
+	definition := ratelimit.ApiDefinition{APIID: "orders-api", Name: "Orders", ListenPath: "/orders/"}
+	object := authCheckObject("GET", "/orders/_ratelimit/config", map[string]string{"X-Admin-Secret": "s3cr3t", "X-Admin-User": "support-jane"}, "", `{"rateLimiting": {
+		"active": true, "requests": 1, "seconds": 1,
+		"strategy": {"name": "requestHeaders", "config": {"headerNames": ["x-tenant-id"], "separator": "::"}},
+		"admin": {"enabled": true, "secretHeader": "X-Admin-Secret", "secret": "s3cr3t", "userHeader": "X-Admin-User"}}}`)
+
+	returned, err := NewDispatcher(definition).Dispatch(context.Background(), object)
+	if err != nil {
+		t.Fatalf("Error dispatching object: %v", err)
+	}
+	overrides := returned.GetRequest().GetReturnOverrides()
+	if overrides.GetResponseCode() != http.StatusOK || !strings.Contains(overrides.GetResponseBody(), `"api":"Orders"`) {
+		t.Fatalf("Admin request should be answered with the name of the definition -- was %v", overrides)
+	}
+}
@@ -0,0 +1,218 @@
+// Package extauthz serves the Envoy external authorization (ext_authz) gRPC api with the rate
+// limiting of the plugin, for the workloads behind Envoy rather than the gateway.
+// The api definition of a request is the one named by the "api" context extension of the Envoy
+// route, or else the one whose listen path matches the longest start of the path, the requests
+// of a route naming an unknown api being denied. The request
+// goes through the same strategies, access lists, overrides and limiter as with the net/http
+// middleware: a throttled or denied request is answered with the denied response of the gateway,
+// and the rate limit headers are added to the response of the allowed ones.
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+
+	"tyk-plugin/iac"
+	"tyk-plugin/ratelimit"
+)
+
+// ContextExtensionApi is the context extension of the Envoy routes naming the api of their requests
+const ContextExtensionApi = "api"
+
+// Server is the ext_authz server of the api definitions of an environment
+type Server struct {
+	authv3.UnimplementedAuthorizationServer
+	router *iac.Router
+	apis   []api
+}
+
+// api definition served, its names being the name of its iac files and its api_id
+type api struct {
+	names      []string
+	middleware *ratelimit.Middleware
+}
+
+// response of the rate limiting of a request, which is not proxied by the middleware
+type responseBuffer struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+// NewServer returns the server of the definitions, their keys being counted
+// by the same limiter as the gateway shares the sessions between the apis
+func NewServer(definitions []iac.Definition) (*Server, error) {
+	router, err := iac.NewRouter(definitions)
+	if err != nil {
+		return nil, err
+	}
+	// unlike the reverse proxy, the requests of these apis can be routed with the context extension
+	if err := iac.DuplicateListenPaths(definitions); err != nil {
+		ratelimit.InfoLog("The routes of the apis must name them with the api context extension: ", err)
+	}
+	server := &Server{router: router}
+	limiter := ratelimit.NewLimiter()
+	for _, definition := range definitions {
+		rateLimitDefinition := definition.RateLimitDefinition()
+		// the request is passed on by Envoy and not by the middleware
+		middleware, err := ratelimit.NewMiddleware(rateLimitDefinition, limiter, http.NotFoundHandler())
+		if err != nil {
+			return nil, err
+		}
+		server.apis = append(server.apis, api{
+			names:      []string{definition.Api, rateLimitDefinition.APIID},
+			middleware: middleware,
+		})
+	}
+	return server, nil
+}
+
+// Check applies the rate limiting of the api of the request
+func (server *Server) Check(ctx context.Context, request *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	attributes := request.GetAttributes()
+	httpRequest := attributes.GetRequest().GetHttp()
+
+	req, err := buildRequest(attributes)
+	if err != nil {
+		ratelimit.ErrorLog("Invalid request: ", err)
+		return deniedResponse(http.StatusBadRequest, http.Header{}, "", codes.InvalidArgument), nil
+	}
+
+	name := attributes.GetContextExtensions()[ContextExtensionApi]
+	api := server.findApi(name, req.URL.Path)
+	if api == nil && name != "" {
+		// a typo in the route config would otherwise turn off the limiting of its requests
+		ratelimit.ErrorLog("Unknown api in the context extension of the route: ", name)
+		return deniedResponse(http.StatusInternalServerError, http.Header{}, "", codes.Internal), nil
+	}
+	if api == nil {
+		ratelimit.DebugLog("No api definition for the request: ", httpRequest.GetPath())
+		return okResponse(http.Header{}), nil
+	}
+
+	response := &responseBuffer{header: http.Header{}}
+	if api.middleware.Check(response, req) {
+		return okResponse(response.header), nil
+	}
+	code := codes.PermissionDenied
+	if response.statusCode == http.StatusTooManyRequests {
+		code = codes.ResourceExhausted
+	}
+	return deniedResponse(response.statusCode, response.header, response.body.String(), code), nil
+}
+
+// function returns the api named by the context extension of the route or, if none is,
+// the api whose listen path matches the longest start of the path, as the gateway does
+func (server *Server) findApi(name string, path string) *api {
+	for i, api := range server.apis {
+		for _, apiName := range api.names {
+			if name != "" && apiName == name {
+				return &server.apis[i]
+			}
+		}
+	}
+	if name != "" {
+		return nil
+	}
+	if index := server.router.Route(path); index >= 0 {
+		return &server.apis[index]
+	}
+	return nil
+}
+
+// function returns the http request of the attributes sent by Envoy, with its body if
+// the filter is configured with 'with_request_body'
+func buildRequest(attributes *authv3.AttributeContext) (*http.Request, error) {
+	httpRequest := attributes.GetRequest().GetHttp()
+	sample := ratelimit.SampleRequest{
+		Method:  httpRequest.GetMethod(),
+		Path:    httpRequest.GetPath(),
+		Headers: map[string]string{},
+		Body:    httpRequest.GetBody(),
+	}
+	if rawBody := httpRequest.GetRawBody(); len(rawBody) > 0 {
+		sample.Body = string(rawBody)
+	}
+	for name, value := range httpRequest.GetHeaders() {
+		// HTTP/2 pseudo headers (":authority"...)
+		if !strings.HasPrefix(name, ":") {
+			sample.Headers[name] = value
+		}
+	}
+	if address := attributes.GetSource().GetAddress().GetSocketAddress(); address != nil {
+		sample.RemoteAddr = net.JoinHostPort(address.GetAddress(), strconv.FormatUint(uint64(address.GetPortValue()), 10))
+	}
+
+	req, err := sample.BuildRequest(httpRequest.GetHost())
+	if err != nil {
+		return nil, err
+	}
+	req.Host = httpRequest.GetHost()
+	return req, nil
+}
+
+func okResponse(header http.Header) *authv3.CheckResponse {
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{OkResponse: &authv3.OkHttpResponse{
+			ResponseHeadersToAdd: headerOptions(header),
+		}},
+	}
+}
+
+func deniedResponse(statusCode int, header http.Header, body string, code codes.Code) *authv3.CheckResponse {
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(code)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{DeniedResponse: &authv3.DeniedHttpResponse{
+			Status:  &typev3.HttpStatus{Code: typev3.StatusCode(statusCode)},
+			Headers: headerOptions(header),
+			Body:    body,
+		}},
+	}
+}
+
+// function returns the headers replacing the ones of the response, sorted by name
+func headerOptions(header http.Header) []*corev3.HeaderValueOption {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var options []*corev3.HeaderValueOption
+	for _, name := range names {
+		options = append(options, &corev3.HeaderValueOption{
+			Header:       &corev3.HeaderValue{Key: name, Value: strings.Join(header[name], ",")},
+			AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		})
+	}
+	return options
+}
+
+func (response *responseBuffer) Header() http.Header {
+	return response.header
+}
+
+func (response *responseBuffer) WriteHeader(statusCode int) {
+	if response.statusCode == 0 {
+		response.statusCode = statusCode
+	}
+}
+
+func (response *responseBuffer) Write(p []byte) (int, error) {
+	if response.statusCode == 0 {
+		response.statusCode = http.StatusOK
+	}
+	return response.body.Write(p)
+}
@@ -0,0 +1,217 @@
+package extauthz
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"tyk-plugin/iac"
+)
+
+const sessionSoapEnvelope = `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:dat="http://roadnet.com/apex/DataServices/">
+      <soapenv:Header>
+          <dat:SessionHeader>
+              <dat:SessionGuid>33d9b8d0-58ba-4400-87af-bdf5f79c0f9b</dat:SessionGuid>
+          </dat:SessionHeader>
+      </soapenv:Header>
+      <soapenv:Body>
+          <dat:SaveRoutes>
+              <dat:Routes/>
+          </dat:SaveRoutes>
+      </soapenv:Body>
+  </soapenv:Envelope>`
+
+const loginSoapEnvelope = `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:log="http://xrs.com/login">
+      <soapenv:Body>
+          <log:Login>
+              <log:Username>acme|dispatcher</log:Username>
+          </log:Login>
+      </soapenv:Body>
+  </soapenv:Envelope>`
+
+func newDefinition(t *testing.T, api string, listenPath string, configData string) iac.Definition {
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(configData), &config); err != nil {
+		t.Fatalf("Invalid config data: %v", err)
+	}
+	return iac.Definition{Api: api, Content: map[string]interface{}{
+		"api_definition": map[string]interface{}{
+			"api_id":      api + "-id",
+			"name":        api,
+			"proxy":       map[string]interface{}{"listen_path": listenPath},
+			"config_data": config,
+		},
+	}}
+}
+
+// function serves the definitions on a local port and returns a client of the server
+func newTestClient(t *testing.T, definitions ...iac.Definition) authv3.AuthorizationClient {
+	server, err := NewServer(definitions)
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	grpcServer := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(grpcServer, server)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return authv3.NewAuthorizationClient(conn)
+}
+
+func checkRequest(method string, path string, headers map[string]string, body string, extensions map[string]string) *authv3.CheckRequest {
+	return &authv3.CheckRequest{Attributes: &authv3.AttributeContext{
+		Source: &authv3.AttributeContext_Peer{Address: &corev3.Address{Address: &corev3.Address_SocketAddress{
+			SocketAddress: &corev3.SocketAddress{Address: "10.0.0.1", PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: 51000}},
+		}}},
+		Request: &authv3.AttributeContext_Request{Http: &authv3.AttributeContext_HttpRequest{
+			Method:  method,
+			Path:    path,
+			Host:    "xrs.example.com",
+			Headers: headers,
+			Body:    body,
+		}},
+		ContextExtensions: extensions,
+	}}
+}
+
+func headerValue(options []*corev3.HeaderValueOption, name string) string {
+	for _, option := range options {
+		if http.CanonicalHeaderKey(option.GetHeader().GetKey()) == http.CanonicalHeaderKey(name) {
+			return option.GetHeader().GetValue()
+		}
+	}
+	return ""
+}
+
+func Test_CheckRequestHeaders_Success(t *testing.T) {
+	client := newTestClient(t, newDefinition(t, "rest", "/rest/", `{"rateLimiting": {
+		"active": true, "requests": 2, "seconds": 60,
+		"strategy": {"name": "requestHeaders", "config": {"headerNames": ["x-tenant-id"], "separator": "::"}}}}`))
+
+	request := checkRequest("GET", "/rest/orders?page=2", map[string]string{":authority": "xrs.example.com", "x-tenant-id": "milesahead1"}, "", nil)
+	for i := 2; i > 0; i-- {
+		response, err := client.Check(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Error checking request: %v", err)
+		}
+		if codes.Code(response.GetStatus().GetCode()) != codes.OK {
+			t.Fatalf("Request should be allowed -- was %v", response.GetStatus().GetCode())
+		}
+		headers := response.GetOkResponse().GetResponseHeadersToAdd()
+		if headerValue(headers, "X-RateLimit-Limit") != "2" || headerValue(headers, "X-RateLimit-Remaining") != strconv.Itoa(i-1) {
+			t.Fatalf("Rate limit headers were not correct: %v", headers)
+		}
+	}
+
+	response, err := client.Check(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Error checking request: %v", err)
+	}
+	if codes.Code(response.GetStatus().GetCode()) != codes.ResourceExhausted {
+		t.Fatalf("Status was not correct -- expected %v but was %v", codes.ResourceExhausted, response.GetStatus().GetCode())
+	}
+	denied := response.GetDeniedResponse()
+	if denied.GetStatus().GetCode() != http.StatusTooManyRequests {
+		t.Fatalf("Http status was not correct -- expected %v but was %v", http.StatusTooManyRequests, denied.GetStatus().GetCode())
+	}
+	if headerValue(denied.GetHeaders(), "Retry-After") == "" || headerValue(denied.GetHeaders(), "X-RateLimit-Remaining") != "0" {
+		t.Fatalf("Denied headers were not correct: %v", denied.GetHeaders())
+	}
+
+	// another key has its own window
+	request.Attributes.Request.Http.Headers["x-tenant-id"] = "milesahead2"
+	response, _ = client.Check(context.Background(), request)
+	if codes.Code(response.GetStatus().GetCode()) != codes.OK {
+		t.Fatalf("Request of another key should be allowed -- was %v", response.GetStatus().GetCode())
+	}
+}
+
+func Test_CheckSessionGuid_Success(t *testing.T) {
+	client := newTestClient(t,
+		newDefinition(t, "rest", "/", `{"rateLimiting": {"active": true, "requests": 5, "seconds": 60,
+			"strategy": {"name": "requestHeaders", "config": {"headerNames": ["x-tenant-id"], "separator": "::"}}}}`),
+		newDefinition(t, "soap", "/{?:(?i)Routing/RoutingService.svc}", `{"rateLimiting": {"active": true, "requests": 1, "seconds": 60,
+			"strategy": {"name": "sessionGuid"}}}`))
+
+	// the route names the api, the path matching the listen path of the other api
+	request := checkRequest("POST", "/RoutingService.svc", map[string]string{"content-type": "text/xml"}, sessionSoapEnvelope, map[string]string{ContextExtensionApi: "soap"})
+	response, err := client.Check(context.Background(), request)
+	if err != nil || codes.Code(response.GetStatus().GetCode()) != codes.OK {
+		t.Fatalf("First request should be allowed -- was %v, %v", response.GetStatus().GetCode(), err)
+	}
+	response, _ = client.Check(context.Background(), request)
+	if response.GetDeniedResponse().GetStatus().GetCode() != http.StatusTooManyRequests {
+		t.Fatalf("Second request of the session should be throttled -- was %v", response.GetStatus().GetCode())
+	}
+
+	// same session, selected by the case insensitive listen path
+	request = checkRequest("POST", "/routing/routingservice.svc", map[string]string{"content-type": "text/xml"}, sessionSoapEnvelope, nil)
+	response, _ = client.Check(context.Background(), request)
+	if response.GetDeniedResponse().GetStatus().GetCode() != http.StatusTooManyRequests {
+		t.Fatalf("Request selected by listen path should be throttled -- was %v", response.GetStatus().GetCode())
+	}
+}
+
+func Test_CheckSoapRequestXRSDenied_Success(t *testing.T) {
+	client := newTestClient(t, newDefinition(t, "xrs-soap", "/xrs/", `{"rateLimiting": {"active": true, "requests": 5, "seconds": 60,
+		"strategy": {"name": "soapRequestXRS"},
+		"accessLists": {"deny": {"keys": ["acme-soap"]}, "denyFormat": "json"}}}`))
+
+	request := checkRequest("POST", "/xrs/LoginService", nil, loginSoapEnvelope, nil)
+	response, err := client.Check(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Error checking request: %v", err)
+	}
+	if codes.Code(response.GetStatus().GetCode()) != codes.PermissionDenied {
+		t.Fatalf("Status was not correct -- expected %v but was %v", codes.PermissionDenied, response.GetStatus().GetCode())
+	}
+	denied := response.GetDeniedResponse()
+	if denied.GetStatus().GetCode() != http.StatusForbidden || denied.GetBody() == "" {
+		t.Fatalf("Denied response was not correct: %v", denied)
+	}
+}
+
+func Test_CheckUnknownApi_Success(t *testing.T) {
+	client := newTestClient(t, newDefinition(t, "rest", "/rest/", `{"rateLimiting": {"active": true, "requests": 1, "seconds": 60,
+		"strategy": {"name": "requestHeaders", "config": {"headerNames": ["x-tenant-id"], "separator": "::"}}}}`))
+
+	response, err := client.Check(context.Background(), checkRequest("GET", "/other/", nil, "", nil))
+	if err != nil || codes.Code(response.GetStatus().GetCode()) != codes.OK {
+		t.Fatalf("Request of no api should be allowed -- was %v, %v", response.GetStatus().GetCode(), err)
+	}
+	if len(response.GetOkResponse().GetResponseHeadersToAdd()) != 0 {
+		t.Fatalf("No rate limit headers expected: %v", response.GetOkResponse().GetResponseHeadersToAdd())
+	}
+
+	// the route names an api which is not served, its limits would silently be turned off
+	response, err = client.Check(context.Background(), checkRequest("GET", "/rest/", nil, "", map[string]string{ContextExtensionApi: "other"}))
+	if err != nil || codes.Code(response.GetStatus().GetCode()) != codes.Internal || response.GetDeniedResponse().GetStatus().GetCode() != http.StatusInternalServerError {
+		t.Fatalf("Request of an unknown api should be denied -- was %v, %v", response.GetStatus().GetCode(), err)
+	}
+}
+
+func Test_NewServerInvalidConfig_Success(t *testing.T) {
+	_, err := NewServer([]iac.Definition{newDefinition(t, "rest", "/rest/", `{"rateLimiting": {"active": true, "strategy": {"name": "unknown"}}}`)})
+	if err == nil {
+		t.Fatalf("Invalid config data should be rejected")
+	}
+}
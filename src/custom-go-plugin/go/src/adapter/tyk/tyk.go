@@ -0,0 +1,89 @@
+// Package tyk adapts the rate limiting to the Tyk gateway, the only package of the plugin
+// depending on the Tyk packages: it reads the api definition from the request context and
+// passes the session to the SessionStore of the plugin, the request context in the gateway
+// for it to apply the limits.
+// Supporting another major version of the gateway only changes this package.
+package tyk
+
+import (
+	"net/http"
+
+	"github.com/TykTechnologies/tyk/ctx"
+	"github.com/TykTechnologies/tyk/user"
+
+	"tyk-plugin/ratelimit"
+)
+
+// SessionStore receives the Tyk session of each request handled by the plugin
+type SessionStore interface {
+	StoreSession(r *http.Request, session *user.SessionState)
+}
+
+// ContextSessionStore sets the sessions in the request context, the gateway
+// scheduling the update of the session of the key in redis
+type ContextSessionStore struct{}
+
+// Plugin runs the hooks of the plugin, passing the sessions to its store
+type Plugin struct {
+	store SessionStore
+}
+
+// gateway context of a request handled by Tyk
+type gatewayContext struct {
+	rw    http.ResponseWriter
+	r     *http.Request
+	store SessionStore
+}
+
+// NewPlugin returns the plugin passing the sessions to the store,
+// ContextSessionStore in the gateway
+func NewPlugin(store SessionStore) *Plugin {
+	return &Plugin{store: store}
+}
+
+// SetRateLimit is the auth_check hook of the plugin, setting the session of the request
+func (plugin *Plugin) SetRateLimit(rw http.ResponseWriter, r *http.Request) {
+	ratelimit.Handle(gatewayContext{rw: rw, r: r, store: plugin.store}, r)
+}
+
+// RecordResponse is the response hook of the plugin
+func (plugin *Plugin) RecordResponse(rw http.ResponseWriter, res *http.Response, req *http.Request) {
+	ratelimit.RecordResponse(rw, res, req)
+}
+
+// Definition returns the api definition the gateway set in the request context,
+// an empty one (no rate limiting) if there is none
+func (gateway gatewayContext) Definition() ratelimit.ApiDefinition {
+	apidef := ctx.GetDefinition(gateway.r)
+	if apidef == nil {
+		return ratelimit.ApiDefinition{}
+	}
+	return ratelimit.ApiDefinition{
+		APIID:      apidef.APIID,
+		Name:       apidef.Name,
+		ListenPath: apidef.Proxy.ListenPath,
+		ConfigData: apidef.ConfigData,
+		Tags:       apidef.Tags,
+		TagHeaders: apidef.TagHeaders,
+	}
+}
+
+// SetSession passes the Tyk session of the request to the store
+func (gateway gatewayContext) SetSession(session ratelimit.Session) {
+	gateway.store.StoreSession(gateway.r, &user.SessionState{
+		Alias:           session.Alias,
+		Rate:            session.Rate,
+		Per:             session.Per,
+		MetaData:        session.MetaData,
+		KeyID:           session.KeyID,
+		SessionLifetime: session.SessionLifetime,
+	})
+}
+
+func (store ContextSessionStore) StoreSession(r *http.Request, session *user.SessionState) {
+	ctx.SetSession(r, session, true)
+}
+
+func (gateway gatewayContext) ResponseWriter() http.ResponseWriter {
+	return gateway.rw
+}
@@ -0,0 +1,76 @@
+package tyk
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/TykTechnologies/tyk/apidef"
+	"github.com/TykTechnologies/tyk/config"
+	"github.com/TykTechnologies/tyk/ctx"
+	"github.com/TykTechnologies/tyk/user"
+)
+
+// session store of the tests, recording the sessions set by the plugin
+type recordingStore struct {
+	sessions []*user.SessionState
+}
+
+func (store *recordingStore) StoreSession(r *http.Request, session *user.SessionState) {
+	store.sessions = append(store.sessions, session)
+}
+
+func ordersRequest() *http.Request {
+	req := httptest.NewRequest("GET", "http://localhost:8080/orders/", nil)
+	req.Header.Set("x-tenant-id", "milesahead2")
+	ctx.SetDefinition(req, &apidef.APIDefinition{APIID: "tyk-adapter", Name: "Orders API", ConfigData: map[string]interface{}{
+		"rateLimiting": map[string]interface{}{
+			"active": true, "requests": 3, "seconds": 15, "sessionTtlMin": 60,
+			"strategy": map[string]interface{}{"name": "requestHeaders", "config": map[string]interface{}{"headerNames": []interface{}{"x-tenant-id"}}},
+		},
+	}})
+	return req
+}
+
+func Test_SetRateLimit_Success(t *testing.T) {
+	store := &recordingStore{}
+
+	NewPlugin(store).SetRateLimit(httptest.NewRecorder(), ordersRequest())
+
+	if len(store.sessions) != 1 {
+		t.Fatalf("Session was not set -- expected 1 session but was %v", len(store.sessions))
+	}
+	session := store.sessions[0]
+	if session.Rate != 3 || session.Per != 15 || session.SessionLifetime != 60 || session.KeyID != "milesahead2" || session.Alias != "milesahead2" {
+		t.Fatalf("Session was not correct -- expected 3/15s (60) for milesahead2 but was %v/%vs (%v) for %v", session.Rate, session.Per, session.SessionLifetime, session.KeyID)
+	}
+	if expected := map[string]interface{}{"keyId": "milesahead2", "meta2": "meta2"}; !reflect.DeepEqual(session.MetaData, expected) {
+		t.Fatalf("Session metadata was not correct -- expected %v but was %v", expected, session.MetaData)
+	}
+}
+
+func Test_ContextSessionStore_Success(t *testing.T) {
+	// the config of the gateway is read when the session is set (hashing of the keys)
+	previous := config.Global
+	config.Global = func() config.Config { return config.Config{} }
+	defer func() { config.Global = previous }()
+
+	req := ordersRequest()
+	NewPlugin(ContextSessionStore{}).SetRateLimit(httptest.NewRecorder(), req)
+
+	session := ctx.GetSession(req)
+	if session == nil {
+		t.Fatalf("Session was not set in the request context")
+	}
+	if session.Rate != 3 || session.Per != 15 || session.KeyID != "milesahead2" {
+		t.Fatalf("Session was not correct -- expected 3/15s for milesahead2 but was %v/%vs for %v", session.Rate, session.Per, session.KeyID)
+	}
+}
+
+func Test_DefinitionMissing_Success(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost:8080/orders/", nil)
+	if definition := (gatewayContext{r: req}).Definition(); definition.Name != "" || definition.ConfigData != nil {
+		t.Fatalf("Definition should be empty without an api definition in the context -- was %v", definition)
+	}
+}
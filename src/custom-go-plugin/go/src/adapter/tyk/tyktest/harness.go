@@ -0,0 +1,184 @@
+// Package tyktest runs the plugin the way the gateway does, for the integration tests: the
+// requests are given the Tyk api definition in their context and go through the auth_check hook
+// of the plugin, the session it sets being applied by a rolling window as the gateway applies it
+// in redis, and the allowed requests through the response hook. The clock of the harness is
+// only moved by the tests, so that throttling can be asserted over any number of requests.
+//
+// The harness replaces the clock of the rate limiting until the end of the test, the tests
+// using it must not run in parallel.
+package tyktest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk/apidef"
+	"github.com/TykTechnologies/tyk/ctx"
+	"github.com/TykTechnologies/tyk/user"
+
+	"tyk-plugin/adapter/tyk"
+	"tyk-plugin/iac"
+	"tyk-plugin/ratelimit"
+)
+
+// body of the responses of the gateway to the throttled requests
+const rateLimitExceededBody = "{\n    \"error\": \"Rate limit exceeded\"\n}"
+
+// Harness is a fake gateway running the hooks of the plugin, the sessions
+// of the keys being shared by the apis as they are by the gateway
+type Harness struct {
+	t       testing.TB
+	clock   *fakeClock
+	limiter *ratelimit.Limiter
+	store   *recordingStore
+	plugin  *tyk.Plugin
+}
+
+// Result is the outcome of a request through the harness
+type Result struct {
+	// session set by the plugin, nil if it set none
+	Session *user.SessionState
+	// response of the plugin to the requests it answered (denied, admin), of the gateway to the
+	// throttled requests, or else of the upstream, with the X-RateLimit headers of the gateway
+	Response *http.Response
+	// whether the plugin answered the request itself
+	Answered  bool
+	Throttled bool
+}
+
+// clock of the harness, only moved by the tests
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// response writer recording whether the plugin answered the request
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+// session store keeping the last session set by the plugin
+type recordingStore struct {
+	session *user.SessionState
+}
+
+// New returns the harness of the test, its clock starting at start
+func New(t testing.TB, start time.Time) *Harness {
+	store := &recordingStore{}
+	harness := &Harness{t: t, clock: &fakeClock{now: start}, limiter: ratelimit.NewLimiter(), store: store, plugin: tyk.NewPlugin(store)}
+	previousClock := ratelimit.SetClock(harness.clock)
+	t.Cleanup(func() { ratelimit.SetClock(previousClock) })
+	return harness
+}
+
+// LoadDefinition returns the Tyk api definition of the iac base definition merged with the
+// env override, if any, its api_id being the name of the iac files if it has none
+func LoadDefinition(t testing.TB, basePath string, overridePath string) *apidef.APIDefinition {
+	definition, err := iac.LoadDefinition(basePath, overridePath)
+	if err != nil {
+		t.Fatalf("Error loading the definition %v: %v", basePath, err)
+	}
+
+	content, err := json.Marshal(definition.ApiDefinition())
+	if err != nil {
+		t.Fatalf("Error encoding the definition %v: %v", basePath, err)
+	}
+	var apiDefinition apidef.APIDefinition
+	if err := json.Unmarshal(content, &apiDefinition); err != nil {
+		t.Fatalf("Definition %v is not a Tyk api definition: %v", basePath, err)
+	}
+	if apiDefinition.APIID == "" {
+		apiDefinition.APIID = definition.Api
+	}
+	return &apiDefinition
+}
+
+// Now returns the time of the clock of the harness
+func (harness *Harness) Now() time.Time {
+	return harness.clock.Now()
+}
+
+// Advance moves the clock of the harness
+func (harness *Harness) Advance(d time.Duration) {
+	harness.clock.mutex.Lock()
+	defer harness.clock.mutex.Unlock()
+	harness.clock.now = harness.clock.now.Add(d)
+}
+
+// Do runs the request to the api through the hooks of the plugin, the upstream answering the
+// allowed requests with an empty 200
+func (harness *Harness) Do(definition *apidef.APIDefinition, req *http.Request) Result {
+	ctx.SetDefinition(req, definition)
+	harness.store.session = nil
+
+	rw := httptest.NewRecorder()
+	recorder := &statusRecorder{ResponseWriter: rw}
+	harness.plugin.SetRateLimit(recorder, req)
+
+	result := Result{Session: harness.store.session}
+	if recorder.statusCode != 0 {
+		result.Answered = true
+		result.Response = rw.Result()
+		return result
+	}
+
+	rw = httptest.NewRecorder()
+	if result.Session != nil {
+		limit := harness.limiter.Allow(ratelimit.Session{KeyID: result.Session.KeyID, Rate: result.Session.Rate, Per: result.Session.Per})
+		if limit.Limit >= 0 {
+			ratelimit.WriteRateLimitHeaders(rw, limit)
+		}
+		if !limit.Allowed {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusTooManyRequests)
+			rw.Write([]byte(rateLimitExceededBody))
+			result.Throttled = true
+			result.Response = rw.Result()
+			return result
+		}
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	result.Response = rw.Result()
+	harness.plugin.RecordResponse(rw, result.Response, req)
+	return result
+}
+
+// Simulate runs n requests to the api, the clock being moved by interval after each request
+func (harness *Harness) Simulate(definition *apidef.APIDefinition, n int, interval time.Duration, newRequest func(i int) *http.Request) []Result {
+	results := make([]Result, n)
+	for i := 0; i < n; i++ {
+		results[i] = harness.Do(definition, newRequest(i))
+		harness.Advance(interval)
+	}
+	return results
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (recorder *statusRecorder) WriteHeader(statusCode int) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = statusCode
+	}
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (recorder *statusRecorder) Write(p []byte) (int, error) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(p)
+}
+
+func (store *recordingStore) StoreSession(r *http.Request, session *user.SessionState) {
+	store.session = session
+}
@@ -0,0 +1,148 @@
+package tyktest
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TykTechnologies/tyk/apidef"
+)
+
+const definitionsDir = "../../../../../../../iac/api-definitions"
+
+const routingSoapEnvelope = `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:dat="http://roadnet.com/apex/DataServices/">
+      <soapenv:Header>
+          <dat:SessionHeader>
+              <dat:SessionGuid>33d9b8d0-58ba-4400-87af-bdf5f79c0f9b</dat:SessionGuid>
+          </dat:SessionHeader>
+      </soapenv:Header>
+      <soapenv:Body>
+          <dat:SaveRoutes>
+              <dat:Routes/>
+          </dat:SaveRoutes>
+      </soapenv:Body>
+  </soapenv:Envelope>`
+
+const driverSoapEnvelope = `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:web="http://xrs.com/webservices">
+      <soapenv:Header>
+          <web:AuthenticationHeader>
+              <web:Username>acme|dispatcher</web:Username>
+          </web:AuthenticationHeader>
+      </soapenv:Header>
+      <soapenv:Body>
+          <web:GetDrivers/>
+      </soapenv:Body>
+  </soapenv:Envelope>`
+
+var start = time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)
+
+func loadDevDefinition(t *testing.T, api string) *apidef.APIDefinition {
+	return LoadDefinition(t, filepath.Join(definitionsDir, "base", api+".json"), filepath.Join(definitionsDir, "env-overrides", api+"-dev.json"))
+}
+
+// function returns the outcomes of the results, "allowed", "throttled" or "answered"
+func outcomes(results []Result) []string {
+	var outcomes []string
+	for _, result := range results {
+		switch {
+		case result.Answered:
+			outcomes = append(outcomes, "answered")
+		case result.Throttled:
+			outcomes = append(outcomes, "throttled")
+		default:
+			outcomes = append(outcomes, "allowed")
+		}
+	}
+	return outcomes
+}
+
+func Test_HarnessThrottlesSessionGuid_Success(t *testing.T) {
+	harness := New(t, start)
+	definition := loadDevDefinition(t, "ot1-rna-soap-routing01")
+
+	newRequest := func(i int) *http.Request {
+		return httptest.NewRequest("POST", "http://localhost:8080/Routing/RoutingService.svc", strings.NewReader(routingSoapEnvelope))
+	}
+	results := harness.Simulate(definition, 4, time.Second, newRequest)
+
+	if got := strings.Join(outcomes(results), ","); got != "allowed,allowed,throttled,throttled" {
+		t.Fatalf("Outcomes were not correct -- expected allowed,allowed,throttled,throttled but was %v", got)
+	}
+	session := results[0].Session
+	if session.KeyID != "33d9b8d0-58ba-4400-87af-bdf5f79c0f9b" || session.Rate != 2 || session.Per != 15 || session.SessionLifetime != 1440 {
+		t.Fatalf("Session was not correct -- expected 2/15s (1440) but was %v/%vs (%v) for %v", session.Rate, session.Per, session.SessionLifetime, session.KeyID)
+	}
+	if results[1].Response.Header.Get("X-RateLimit-Remaining") != "0" || results[2].Response.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Responses were not correct -- was %v then %v", results[1].Response.Header, results[2].Response.StatusCode)
+	}
+	body, _ := ioutil.ReadAll(results[2].Response.Body)
+	if !strings.Contains(string(body), "Rate limit exceeded") {
+		t.Fatalf("Throttled body was not correct -- was %v", string(body))
+	}
+
+	// the throttled attempts count in the rolling window too, a request is allowed
+	// again once the attempts at 1s and 2s left it, 15 seconds later
+	harness.Advance(13 * time.Second)
+	if result := harness.Do(definition, newRequest(0)); result.Throttled {
+		t.Fatalf("Request should be allowed once the window moved at %v", harness.Now())
+	}
+}
+
+func Test_HarnessSharesXRSSessions_Success(t *testing.T) {
+	harness := New(t, start)
+	rest := loadDevDefinition(t, "ot1-xrs-rest")
+	soap := loadDevDefinition(t, "ot1-xrs-soap")
+
+	restRequest := func() *http.Request {
+		req := httptest.NewRequest("GET", "http://localhost:8080/DriverWebService/drivers", nil)
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("acme|dispatcher:secret")))
+		return req
+	}
+	soapRequest := func() *http.Request {
+		return httptest.NewRequest("POST", "http://localhost:8080/DriverWebService.svc/soap", strings.NewReader(driverSoapEnvelope))
+	}
+
+	// rest and soap share the key of the company, and its 2 requests per 10 seconds
+	results := []Result{harness.Do(rest, restRequest()), harness.Do(soap, soapRequest()), harness.Do(rest, restRequest())}
+	if got := strings.Join(outcomes(results), ","); got != "allowed,allowed,throttled" {
+		t.Fatalf("Outcomes were not correct -- expected allowed,allowed,throttled but was %v", got)
+	}
+	if results[0].Session.KeyID != "acme" || results[1].Session.KeyID != "acme" {
+		t.Fatalf("Keys were not correct -- expected acme but was %v and %v", results[0].Session.KeyID, results[1].Session.KeyID)
+	}
+
+	harness.Advance(10 * time.Second)
+	if result := harness.Do(soap, soapRequest()); result.Throttled {
+		t.Fatalf("Request should be allowed once the window moved at %v", harness.Now())
+	}
+}
+
+func Test_HarnessAnswered_Success(t *testing.T) {
+	harness := New(t, start)
+	definition := &apidef.APIDefinition{APIID: "harness-denied", Name: "Denied API", ConfigData: map[string]interface{}{
+		"rateLimiting": map[string]interface{}{
+			"active": true, "requests": 5, "seconds": 60,
+			"strategy":    map[string]interface{}{"name": "requestHeaders", "config": map[string]interface{}{"headerNames": []interface{}{"x-tenant-id"}}},
+			"accessLists": map[string]interface{}{"deny": map[string]interface{}{"keys": []interface{}{"blocked"}}},
+		},
+	}}
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/orders/", nil)
+	req.Header.Set("x-tenant-id", "blocked")
+	result := harness.Do(definition, req)
+	if !result.Answered || result.Response.StatusCode != http.StatusForbidden || result.Session != nil {
+		t.Fatalf("Request should be denied by the plugin -- was %v (session %v)", result.Response.StatusCode, result.Session)
+	}
+
+	req = httptest.NewRequest("GET", "http://localhost:8080/orders/", nil)
+	req.Header.Set("x-tenant-id", "milesahead1")
+	result = harness.Do(definition, req)
+	if result.Answered || result.Throttled || result.Response.Header.Get("X-RateLimit-Limit") != "5" {
+		t.Fatalf("Request should be passed to the upstream -- was %v %v", result.Response.StatusCode, result.Response.Header)
+	}
+}
@@ -0,0 +1,130 @@
+// Package bundle builds the plugin bundles loaded by the gateway, as the Tyk bundler
+// ('tyk bundle build') does: a zip of the files of the manifest file list along with the
+// manifest, its checksum being the MD5 of the content of the files in the order of the list.
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// placeholder of the plugin file name in tyk/bundle/manifest.json
+const PluginPlaceholder = "plugin_name_placeholder"
+
+// name of the manifest in the bundle
+const ManifestFile = "manifest.json"
+
+// Manifest is the manifest of a bundle, the custom middleware section being kept as written
+type Manifest struct {
+	FileList         []string        `json:"file_list"`
+	CustomMiddleware json.RawMessage `json:"custom_middleware"`
+	Checksum         string          `json:"checksum"`
+	Signature        string          `json:"signature"`
+}
+
+// Bundle is a manifest and the content of the files of its file list
+type Bundle struct {
+	Manifest Manifest
+	Files    map[string][]byte
+}
+
+// PluginFileName returns the versioned file name of the plugin, e.g.
+// "RateLimitingPlugin_v5.0.3_linux_amd64_v1.0.3-dev.so"
+func PluginFileName(tykVersion string, pluginVersion string, env string) string {
+	return fmt.Sprintf("RateLimitingPlugin_%v_linux_amd64_%v-%v.so", tykVersion, pluginVersion, env)
+}
+
+// New returns the bundle of the compiled plugin, the placeholder of the manifest template
+// being replaced with the plugin file name
+func New(manifestTemplatePath string, pluginPath string, pluginFileName string) (*Bundle, error) {
+	template, err := ioutil.ReadFile(manifestTemplatePath)
+	if err != nil {
+		return nil, err
+	}
+	plugin, err := ioutil.ReadFile(pluginPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	content := strings.ReplaceAll(string(template), PluginPlaceholder, pluginFileName)
+	if err := json.Unmarshal([]byte(content), &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %v: %v", manifestTemplatePath, err)
+	}
+
+	bundle := &Bundle{Manifest: manifest, Files: map[string][]byte{pluginFileName: plugin}}
+	for _, file := range manifest.FileList {
+		if _, ok := bundle.Files[file]; !ok {
+			return nil, fmt.Errorf("file %q of the manifest file list is not the plugin %q", file, pluginFileName)
+		}
+	}
+	return bundle, nil
+}
+
+// Checksum returns the hex MD5 of the content of the files of the file list
+func (bundle *Bundle) Checksum() (string, error) {
+	content, err := bundle.fileListContent()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", md5.Sum(content)), nil
+}
+
+// Zip sets the checksum of the manifest and returns the zip of the bundle
+func (bundle *Bundle) Zip() ([]byte, error) {
+	checksum, err := bundle.Checksum()
+	if err != nil {
+		return nil, err
+	}
+	bundle.Manifest.Checksum = checksum
+
+	manifest, err := json.MarshalIndent(bundle.Manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	zipWriter := zip.NewWriter(&buffer)
+	for _, file := range bundle.Manifest.FileList {
+		writer, err := zipWriter.Create(file)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write(bundle.Files[file]); err != nil {
+			return nil, err
+		}
+	}
+	writer, err := zipWriter.Create(ManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(manifest); err != nil {
+		return nil, err
+	}
+	if err := zipWriter.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// function returns the content of the files of the file list, one after the other
+func (bundle *Bundle) fileListContent() ([]byte, error) {
+	if len(bundle.Manifest.FileList) == 0 {
+		return nil, errors.New("the manifest file list is empty")
+	}
+	var content bytes.Buffer
+	for _, file := range bundle.Manifest.FileList {
+		fileContent, ok := bundle.Files[file]
+		if !ok {
+			return nil, fmt.Errorf("file %q of the manifest file list is missing", file)
+		}
+		content.Write(fileContent)
+	}
+	return content.Bytes(), nil
+}
@@ -0,0 +1,111 @@
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const manifestTemplate = `{
+  "file_list": ["plugin_name_placeholder"],
+  "custom_middleware": {
+    "auth_check": {"name": "SetRateLimit", "path": "plugin_name_placeholder", "require_session": true},
+    "response": [{"name": "RecordResponse", "path": "plugin_name_placeholder"}],
+    "driver": "goplugin"
+  },
+  "checksum": "",
+  "signature": ""
+}`
+
+// function writes the manifest template and a fake compiled plugin, returning their paths
+func writeBundleFiles(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	manifestPath := filepath.Join(dir, "manifest.json")
+	pluginPath := filepath.Join(dir, "RateLimitingPlugin.so")
+	if err := ioutil.WriteFile(manifestPath, []byte(manifestTemplate), 0644); err != nil {
+		t.Fatalf("Error writing the manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(pluginPath, []byte("compiled plugin"), 0644); err != nil {
+		t.Fatalf("Error writing the plugin: %v", err)
+	}
+	return manifestPath, pluginPath
+}
+
+func Test_PluginFileName_Success(t *testing.T) {
+	expected := "RateLimitingPlugin_v5.0.3_linux_amd64_v1.0.3-dev.so"
+	if name := PluginFileName("v5.0.3", "v1.0.3", "dev"); name != expected {
+		t.Fatalf("Plugin file name was not correct -- expected %v but was %v", expected, name)
+	}
+}
+
+func Test_Zip_Success(t *testing.T) {
+	manifestPath, pluginPath := writeBundleFiles(t)
+	pluginFileName := PluginFileName("v5.0.3", "v1.0.3", "dev")
+
+	bundle, err := New(manifestPath, pluginPath, pluginFileName)
+	if err != nil {
+		t.Fatalf("Error creating the bundle: %v", err)
+	}
+	content, err := bundle.Zip()
+	if err != nil {
+		t.Fatalf("Error zipping the bundle: %v", err)
+	}
+
+	zipReader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatalf("Invalid zip: %v", err)
+	}
+	files := map[string]string{}
+	for _, file := range zipReader.File {
+		reader, _ := file.Open()
+		fileContent, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		files[file.Name] = string(fileContent)
+	}
+
+	if files[pluginFileName] != "compiled plugin" {
+		t.Fatalf("Plugin was not correct -- expected %v in %v", pluginFileName, files)
+	}
+	var manifest struct {
+		FileList         []string `json:"file_list"`
+		Checksum         string   `json:"checksum"`
+		CustomMiddleware struct {
+			AuthCheck struct {
+				Path string `json:"path"`
+			} `json:"auth_check"`
+		} `json:"custom_middleware"`
+	}
+	if err := json.Unmarshal([]byte(files[ManifestFile]), &manifest); err != nil {
+		t.Fatalf("Invalid manifest: %v", err)
+	}
+	expectedChecksum := fmt.Sprintf("%x", md5.Sum([]byte("compiled plugin")))
+	if manifest.Checksum != expectedChecksum {
+		t.Fatalf("Checksum was not correct -- expected %v but was %v", expectedChecksum, manifest.Checksum)
+	}
+	if manifest.CustomMiddleware.AuthCheck.Path != pluginFileName || strings.Contains(files[ManifestFile], PluginPlaceholder) {
+		t.Fatalf("Placeholder was not replaced:\n%v", files[ManifestFile])
+	}
+}
+
+func Test_NewInvalidFiles_Success(t *testing.T) {
+	manifestPath, pluginPath := writeBundleFiles(t)
+	invalidManifest := filepath.Join(t.TempDir(), "manifest.json")
+	ioutil.WriteFile(invalidManifest, []byte(`{"file_list": ["other.so"]}`), 0644)
+
+	tests := [][]string{
+		{filepath.Join(t.TempDir(), "missing.json"), pluginPath},
+		{manifestPath, filepath.Join(t.TempDir(), "missing.so")},
+		{invalidManifest, pluginPath},
+	}
+	for _, test := range tests {
+		if _, err := New(test[0], test[1], "RateLimitingPlugin.so"); err == nil {
+			t.Fatalf("An error was expected for %v", test)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Signing of the bundles, as the Tyk bundler does with its -key flag: the signature is the
+// base64 of the RSA PKCS #1 v1.5 signature of the SHA-256 of the content of the files of the
+// file list. The gateway checks it with the public key of its 'public_key_path' setting.
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Sign sets the checksum and the signature of the manifest
+func (bundle *Bundle) Sign(key *rsa.PrivateKey) error {
+	content, err := bundle.fileListContent()
+	if err != nil {
+		return err
+	}
+	if bundle.Manifest.Checksum, err = bundle.Checksum(); err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(content)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return err
+	}
+	bundle.Manifest.Signature = base64.StdEncoding.EncodeToString(signature)
+	return nil
+}
+
+// Verify checks the checksum of the manifest and, if a key is given, its signature,
+// as the gateway does before loading the bundle
+func (bundle *Bundle) Verify(key *rsa.PublicKey) error {
+	content, err := bundle.fileListContent()
+	if err != nil {
+		return err
+	}
+	checksum, err := bundle.Checksum()
+	if err != nil {
+		return err
+	}
+	if checksum != bundle.Manifest.Checksum {
+		return fmt.Errorf("invalid checksum, expected %q but the manifest has %q", checksum, bundle.Manifest.Checksum)
+	}
+	if key == nil {
+		return nil
+	}
+
+	if bundle.Manifest.Signature == "" {
+		return errors.New("the bundle is not signed")
+	}
+	signature, err := base64.StdEncoding.DecodeString(bundle.Manifest.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	hash := sha256.Sum256(content)
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	return nil
+}
+
+// Open returns the bundle of the zip
+func Open(content []byte) (*Bundle, error) {
+	zipReader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle: %v", err)
+	}
+
+	bundle := &Bundle{Files: map[string][]byte{}}
+	for _, file := range zipReader.File {
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		fileContent, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		bundle.Files[file.Name] = fileContent
+	}
+
+	manifest, ok := bundle.Files[ManifestFile]
+	if !ok {
+		return nil, errors.New("invalid bundle: no manifest.json")
+	}
+	if err := json.Unmarshal(manifest, &bundle.Manifest); err != nil {
+		return nil, fmt.Errorf("invalid bundle manifest: %v", err)
+	}
+	delete(bundle.Files, ManifestFile)
+	return bundle, nil
+}
+
+// LoadPrivateKey reads a PEM encoded RSA private key, PKCS #1 or PKCS #8
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key %v: %v", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid private key %v: not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+// LoadPublicKey reads a PEM encoded RSA public key, PKIX or PKCS #1, or certificate
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate %v: %v", path, err)
+		}
+		key = certificate.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %v: %v", path, err)
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid public key %v: not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%v is not PEM encoded", path)
+	}
+	return block, nil
+}
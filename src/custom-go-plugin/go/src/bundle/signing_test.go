@@ -0,0 +1,137 @@
+package bundle
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// function generates an RSA key and writes it in the given PEM encodings, returning their paths
+func writeKeys(t *testing.T) (*rsa.PrivateKey, map[string]string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating the key: %v", err)
+	}
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+	pkix, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	dir := t.TempDir()
+	blocks := map[string]*pem.Block{
+		"pkcs1-private.pem": {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+		"pkcs8-private.pem": {Type: "PRIVATE KEY", Bytes: pkcs8},
+		"pkcs1-public.pem":  {Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)},
+		"pkix-public.pem":   {Type: "PUBLIC KEY", Bytes: pkix},
+	}
+	paths := map[string]string{}
+	for name, block := range blocks {
+		paths[name] = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(paths[name], pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatalf("Error writing %v: %v", name, err)
+		}
+	}
+	return key, paths
+}
+
+func newSignedBundle(t *testing.T, key *rsa.PrivateKey) *Bundle {
+	manifestPath, pluginPath := writeBundleFiles(t)
+	bundle, err := New(manifestPath, pluginPath, PluginFileName("v5.0.3", "v1.0.3", "dev"))
+	if err != nil {
+		t.Fatalf("Error creating the bundle: %v", err)
+	}
+	if err := bundle.Sign(key); err != nil {
+		t.Fatalf("Error signing the bundle: %v", err)
+	}
+	return bundle
+}
+
+func Test_SignAndVerify_Success(t *testing.T) {
+	key, paths := writeKeys(t)
+	bundle := newSignedBundle(t, key)
+
+	content, err := bundle.Zip()
+	if err != nil {
+		t.Fatalf("Error zipping the bundle: %v", err)
+	}
+	opened, err := Open(content)
+	if err != nil {
+		t.Fatalf("Error opening the bundle: %v", err)
+	}
+	if opened.Manifest.Signature == "" || opened.Manifest.Signature != bundle.Manifest.Signature {
+		t.Fatalf("Signature was not zipped -- expected %v but was %v", bundle.Manifest.Signature, opened.Manifest.Signature)
+	}
+
+	for _, name := range []string{"pkcs1-public.pem", "pkix-public.pem"} {
+		publicKey, err := LoadPublicKey(paths[name])
+		if err != nil {
+			t.Fatalf("Error loading %v: %v", name, err)
+		}
+		if err := opened.Verify(publicKey); err != nil {
+			t.Fatalf("Bundle should be valid with %v: %v", name, err)
+		}
+	}
+	for _, name := range []string{"pkcs1-private.pem", "pkcs8-private.pem"} {
+		privateKey, err := LoadPrivateKey(paths[name])
+		if err != nil || privateKey.N.Cmp(key.N) != 0 {
+			t.Fatalf("Private key %v was not loaded: %v", name, err)
+		}
+	}
+}
+
+func Test_VerifyInvalidBundle_Success(t *testing.T) {
+	key, _ := writeKeys(t)
+	otherKey, _ := writeKeys(t)
+
+	tamperedPlugin := newSignedBundle(t, key)
+	tamperedPlugin.Files[PluginFileName("v5.0.3", "v1.0.3", "dev")] = []byte("tampered plugin")
+	tamperedSignature := newSignedBundle(t, key)
+	tamperedSignature.Manifest.Signature = newSignedBundle(t, otherKey).Manifest.Signature
+	unsigned := newSignedBundle(t, key)
+	unsigned.Manifest.Signature = ""
+
+	tests := []struct {
+		bundle   *Bundle
+		key      *rsa.PublicKey
+		expected string
+	}{
+		{tamperedPlugin, nil, "invalid checksum"},
+		{tamperedSignature, &key.PublicKey, "invalid signature"},
+		{newSignedBundle(t, key), &otherKey.PublicKey, "invalid signature"},
+		{unsigned, &key.PublicKey, "the bundle is not signed"},
+	}
+	for _, test := range tests {
+		if err := test.bundle.Verify(test.key); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("Bundle should be invalid -- expected %q but was %v", test.expected, err)
+		}
+	}
+
+	// the checksum alone is checked without a key
+	if err := unsigned.Verify(nil); err != nil {
+		t.Fatalf("Unsigned bundle should have a valid checksum: %v", err)
+	}
+}
+
+func Test_LoadInvalidKeys_Success(t *testing.T) {
+	_, paths := writeKeys(t)
+	notPEM := filepath.Join(t.TempDir(), "key.txt")
+	ioutil.WriteFile(notPEM, []byte("not a key"), 0600)
+
+	if _, err := LoadPrivateKey(paths["pkix-public.pem"]); err == nil {
+		t.Fatalf("A public key should not be loaded as a private key")
+	}
+	if _, err := LoadPublicKey(paths["pkcs8-private.pem"]); err == nil {
+		t.Fatalf("A private key should not be loaded as a public key")
+	}
+	for _, path := range []string{notPEM, filepath.Join(t.TempDir(), "missing.pem")} {
+		if _, err := LoadPrivateKey(path); err == nil {
+			t.Fatalf("An error was expected for %v", path)
+		}
+	}
+	if _, err := Open([]byte("not a zip")); err == nil {
+		t.Fatalf("An error was expected for an invalid zip")
+	}
+}
@@ -0,0 +1,237 @@
+// iacctl manages the api definitions of iac/api-definitions.
+//
+//	iacctl merge -base iac/api-definitions/base/ot1-xrs-soap.json \
+//	  -override iac/api-definitions/env-overrides/ot1-xrs-soap-dev.json
+//
+// prints the base definition merged with the env override, after validating it.
+//
+//	iacctl build -dir iac/api-definitions -env-values iac/env-values.json -out build/api-definitions
+//
+// writes the deployable definitions of every environment of env-values.json (or only the ones
+// given with -env) to '<out>/<env>/<api>.json', along with an 'environment.json' manifest
+// holding the endpoints of the environment, the list of its definitions and the apis with no
+// override for it. An environment given with -env which is not in env-values.json is built
+// from its env overrides alone, its manifest having no endpoints.
+//
+//	TYK_API_KEY=... iacctl diff -dir iac/api-definitions -env-values iac/env-values.json -env dev
+//
+// compares the definitions deployed to the dashboard of the environment with the ones of the
+// iac files, the rate limiting config changes being listed apart from the other changes.
+// It fails if any api is not deployed or differs from its iac files.
+//
+// Objects are merged recursively and arrays are replaced by the ones of the override, except
+// for the rate limiting overrides and schedules that are merged by key: an override item
+// changes the base item with the same method, resource and soapOperation (or name for the
+// schedules), is added after the base items if there is none, and removes it when it has
+// "$remove": true.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"tyk-plugin/iac"
+)
+
+const usage = `usage: iacctl <command> [flags]
+
+commands:
+  merge   print a base definition merged with an env override
+  build   write the deployable definitions of each environment
+  diff    compare the deployed definitions of an environment with the iac files`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "iacctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	switch args[0] {
+	case "merge":
+		return runMerge(args[1:], stdout)
+	case "build":
+		return runBuild(args[1:], stdout)
+	case "diff":
+		return runDiff(args[1:], stdout)
+	}
+	return fmt.Errorf("unknown command %q\n%v", args[0], usage)
+}
+
+func runMerge(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("merge", flag.ContinueOnError)
+	basePath := flags.String("base", "", "base api definition (iac/api-definitions/base/*.json)")
+	overridePath := flags.String("override", "", "env override merged into the base definition (iac/api-definitions/env-overrides/*.json)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *basePath == "" {
+		flags.Usage()
+		return errors.New("-base is required")
+	}
+
+	definition, err := iac.LoadDefinition(*basePath, *overridePath)
+	if err != nil {
+		return err
+	}
+	if err := validationError(definition); err != nil {
+		return err
+	}
+	return definition.Encode(stdout)
+}
+
+func runBuild(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	dir := flags.String("dir", "iac/api-definitions", "directory of the base definitions and env overrides")
+	envValuesPath := flags.String("env-values", "iac/env-values.json", "endpoints of the environments")
+	outDir := flags.String("out", "", "output directory of the deployable definitions")
+	envNames := flags.String("env", "", "comma separated environments to build (all the ones of env-values.json by default)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *outDir == "" {
+		flags.Usage()
+		return errors.New("-out is required")
+	}
+
+	environments, err := iac.LoadEnvironments(*envValuesPath)
+	if err != nil {
+		return err
+	}
+	if *envNames != "" {
+		var selected []iac.Environment
+		for _, name := range strings.Split(*envNames, ",") {
+			env, found := findEnvironment(environments, name)
+			if !found {
+				fmt.Fprintf(stdout, "%v: not in %v, built from the env overrides without endpoints\n", env.Name, *envValuesPath)
+			}
+			selected = append(selected, env)
+		}
+		environments = selected
+	}
+
+	failed := 0
+	for _, env := range environments {
+		definitions, missing, err := iac.Build(*dir, env, *outDir)
+		if err != nil {
+			fmt.Fprintf(stdout, "%v: %v\n", env.Name, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(stdout, "%v: %d definitions written\n", env.Name, len(definitions))
+		for _, definition := range definitions {
+			fmt.Fprintf(stdout, "  %v (%v)\n", definition.Api, definition.Name())
+		}
+		printMissing(stdout, env.Name, missing, "not built")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d environments could not be built", failed)
+	}
+	return nil
+}
+
+func runDiff(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	dir := flags.String("dir", "iac/api-definitions", "directory of the base definitions and env overrides")
+	envValuesPath := flags.String("env-values", "iac/env-values.json", "endpoints of the environments")
+	envName := flags.String("env", "", "environment to compare")
+	endpoint := flags.String("endpoint", "", "api definitions endpoint of the dashboard (the one of env-values.json by default)")
+	apiKeyEnv := flags.String("api-key-env", "TYK_API_KEY", "environment variable holding the dashboard api key")
+	api := flags.String("api", "", "only compare this api (name of its base definition file)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *envName == "" {
+		flags.Usage()
+		return errors.New("-env is required")
+	}
+
+	dashboard := iac.Dashboard{Url: *endpoint, ApiKey: os.Getenv(*apiKeyEnv)}
+	if dashboard.Url == "" {
+		environments, err := iac.LoadEnvironments(*envValuesPath)
+		if err != nil {
+			return err
+		}
+		env, found := findEnvironment(environments, *envName)
+		if !found {
+			return fmt.Errorf("unknown environment %q", *envName)
+		}
+		dashboard.Url = env.ApiDefEndpointUrl
+	}
+	if dashboard.Url == "" {
+		return fmt.Errorf("no dashboard endpoint for environment %q", *envName)
+	}
+
+	definitions, missing, err := iac.FindDefinitions(*dir, *envName)
+	if err != nil {
+		return err
+	}
+	if *api == "" {
+		printMissing(stdout, *envName, missing, "not compared")
+	}
+
+	compared, differ := 0, 0
+	for _, definition := range definitions {
+		if *api != "" && definition.Api != *api {
+			continue
+		}
+		deployed, err := dashboard.FindApi(definition)
+		if err != nil {
+			return err
+		}
+		drift := iac.Diff(definition, deployed)
+		drift.Print(stdout)
+		compared++
+		if !drift.InSync() {
+			differ++
+		}
+	}
+	if compared == 0 {
+		return fmt.Errorf("no definitions found for environment %q", *envName)
+	}
+	if differ > 0 {
+		return fmt.Errorf("%d of %d apis differ from the iac files", differ, compared)
+	}
+	return nil
+}
+
+// function returns the environment of env-values.json with the name, or an environment
+// with no endpoints and false if there is none
+func findEnvironment(environments []iac.Environment, name string) (iac.Environment, bool) {
+	name = strings.TrimSpace(name)
+	for _, env := range environments {
+		if env.Name == name {
+			return env, true
+		}
+	}
+	return iac.Environment{Name: name}, false
+}
+
+// function prints the apis which have no override for the environment
+func printMissing(stdout io.Writer, env string, missing []string, action string) {
+	if len(missing) > 0 {
+		fmt.Fprintf(stdout, "  no %v override, %v: %v\n", env, action, strings.Join(missing, ", "))
+	}
+}
+
+// function returns an error listing the problems of the definition, nil if it is valid
+func validationError(definition iac.Definition) error {
+	problems := definition.Validate()
+	if len(problems) == 0 {
+		return nil
+	}
+	messages := make([]string, len(problems))
+	for i, problem := range problems {
+		messages[i] = problem.Error()
+	}
+	return fmt.Errorf("invalid definition %v:\n  %v", definition.Api, strings.Join(messages, "\n  "))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const baseDefinition = `{
+  "api_definition": {
+    "name": "Orders",
+    "slug": "orders",
+    "proxy": {"listen_path": "/orders/", "target_url": ""},
+    "config_data": {
+      "rateLimiting": {
+        "active": true,
+        "requests": 3,
+        "seconds": 15,
+        "overrides": [{"method": "GET", "resource": "/ping", "requests": -1, "seconds": -1}],
+        "strategy": {"name": "requestHeaders", "config": {"headerNames": ["x-tenant-id"], "separator": "::"}}
+      }
+    }
+  }
+}`
+
+func writeFile(t *testing.T, path string, content string) string {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Error creating %v: %v", filepath.Dir(path), err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Error writing %v: %v", path, err)
+	}
+	return path
+}
+
+func Test_Merge_Success(t *testing.T) {
+	dir := t.TempDir()
+	base := writeFile(t, filepath.Join(dir, "orders.json"), baseDefinition)
+	override := writeFile(t, filepath.Join(dir, "orders-dev.json"), `{"api_definition": {"name": "Orders DEV", "proxy": {"target_url": "https://orders.dev"},
+		"config_data": {"rateLimiting": {"overrides": [{"method": "POST", "resource": "/orders", "requests": 1, "seconds": 60}]}}}}`)
+
+	var stdout bytes.Buffer
+	if err := run([]string{"merge", "-base", base, "-override", override}, &stdout); err != nil {
+		t.Fatalf("Error merging: %v", err)
+	}
+
+	var merged struct {
+		ApiDefinition struct {
+			Name       string `json:"name"`
+			ConfigData struct {
+				RateLimiting struct {
+					Overrides []struct {
+						Resource string `json:"resource"`
+					} `json:"overrides"`
+				} `json:"rateLimiting"`
+			} `json:"config_data"`
+		} `json:"api_definition"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &merged); err != nil {
+		t.Fatalf("Invalid merged definition: %v\n%v", err, stdout.String())
+	}
+	overrides := merged.ApiDefinition.ConfigData.RateLimiting.Overrides
+	if merged.ApiDefinition.Name != "Orders DEV" || len(overrides) != 2 || overrides[1].Resource != "/orders" {
+		t.Fatalf("Merged definition was not correct:\n%v", stdout.String())
+	}
+}
+
+func Test_MergeInvalidDefinition_Success(t *testing.T) {
+	base := writeFile(t, filepath.Join(t.TempDir(), "orders.json"), baseDefinition)
+
+	err := run([]string{"merge", "-base", base}, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "api_definition.proxy.target_url is required") {
+		t.Fatalf("Merge should fail -- expected an invalid target_url but was %v", err)
+	}
+}
+
+func Test_Build_Success(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "api-definitions", "base", "orders.json"), baseDefinition)
+	writeFile(t, filepath.Join(dir, "api-definitions", "env-overrides", "orders-dev.json"), `{"api_definition": {"name": "Orders DEV", "proxy": {"target_url": "https://orders.dev"}}}`)
+	writeFile(t, filepath.Join(dir, "api-definitions", "env-overrides", "orders-qae.json"), `{"api_definition": {"name": "Orders QAE", "proxy": {"target_url": "https://orders.qae"}}}`)
+	envValues := writeFile(t, filepath.Join(dir, "env-values.json"), `{
+		"Tyk_ApiDefEndpoint_Url_dev": "https://dev-adm/api/apis", "Tyk_MservFileServer_dev": "https://dev-mgw/mserv",
+		"Tyk_ApiDefEndpoint_Url_qae": "https://qae-adm/api/apis", "Tyk_MservFileServer_qae": "https://qae-mgw/mserv"
+	}`)
+	outDir := filepath.Join(dir, "out")
+
+	var stdout bytes.Buffer
+	args := []string{"build", "-dir", filepath.Join(dir, "api-definitions"), "-env-values", envValues, "-out", outDir, "-env", "dev"}
+	if err := run(args, &stdout); err != nil {
+		t.Fatalf("Error building: %v\n%v", err, stdout.String())
+	}
+
+	if !strings.Contains(stdout.String(), "dev: 1 definitions written") || !strings.Contains(stdout.String(), "orders (Orders DEV)") {
+		t.Fatalf("Output was not correct:\n%v", stdout.String())
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "dev", "orders.json")); err != nil {
+		t.Fatalf("Definition was not written: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "qae")); !os.IsNotExist(err) {
+		t.Fatalf("Only the selected environment should be built")
+	}
+}
+
+func Test_BuildEnvironmentNotInEnvValues_Success(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "api-definitions", "base", "orders.json"), baseDefinition)
+	writeFile(t, filepath.Join(dir, "api-definitions", "base", "invoices.json"), baseDefinition)
+	writeFile(t, filepath.Join(dir, "api-definitions", "env-overrides", "orders-te-prod.json"), `{"api_definition": {"name": "Orders TE", "proxy": {"target_url": "https://orders.te"}}}`)
+	envValues := writeFile(t, filepath.Join(dir, "env-values.json"), `{"Tyk_ApiDefEndpoint_Url_dev": "https://dev-adm/api/apis"}`)
+	outDir := filepath.Join(dir, "out")
+
+	var stdout bytes.Buffer
+	args := []string{"build", "-dir", filepath.Join(dir, "api-definitions"), "-env-values", envValues, "-out", outDir, "-env", "te-prod"}
+	if err := run(args, &stdout); err != nil {
+		t.Fatalf("Error building: %v\n%v", err, stdout.String())
+	}
+
+	for _, expected := range []string{"te-prod: not in " + envValues, "te-prod: 1 definitions written", "no te-prod override, not built: invoices"} {
+		if !strings.Contains(stdout.String(), expected) {
+			t.Fatalf("Output was not correct -- expected %q in\n%v", expected, stdout.String())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "te-prod", "orders.json")); err != nil {
+		t.Fatalf("Definition was not written: %v", err)
+	}
+}
+
+func Test_Diff_Success(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "base", "orders.json"), baseDefinition)
+	writeFile(t, filepath.Join(dir, "base", "items.json"), baseDefinition)
+	writeFile(t, filepath.Join(dir, "env-overrides", "orders-dev.json"), `{"api_definition": {"name": "Orders DEV", "proxy": {"target_url": "https://orders.dev"}}}`)
+	writeFile(t, filepath.Join(dir, "env-overrides", "items-dev.json"), `{"api_definition": {"name": "Items DEV", "proxy": {"target_url": "https://items.dev"}}}`)
+
+	dashboard := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("authorization") != "secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Query().Get("q") {
+		case "Orders DEV":
+			rw.Write([]byte(`{"apis": [{"api_definition": {"api_id": "1", "name": "Orders DEV", "slug": "orders",
+				"proxy": {"listen_path": "/orders/", "target_url": "https://orders.dev"},
+				"config_data": {"rateLimiting": {"active": true, "requests": 10, "seconds": 15,
+					"overrides": [{"method": "GET", "resource": "/ping", "requests": -1, "seconds": -1}],
+					"strategy": {"name": "requestHeaders", "config": {"headerNames": ["x-tenant-id"], "separator": "::"}}}}}}]}`))
+		default:
+			rw.Write([]byte(`{"apis": []}`))
+		}
+	}))
+	defer dashboard.Close()
+	os.Setenv("IACCTL_TEST_API_KEY", "secret")
+	defer os.Unsetenv("IACCTL_TEST_API_KEY")
+
+	var stdout bytes.Buffer
+	err := run([]string{"diff", "-dir", dir, "-env", "dev", "-endpoint", dashboard.URL + "/api/apis", "-api-key-env", "IACCTL_TEST_API_KEY"}, &stdout)
+	if err == nil || err.Error() != "2 of 2 apis differ from the iac files" {
+		t.Fatalf("Diff should fail -- expected 2 apis to differ but was %v", err)
+	}
+
+	expected := `items (Items DEV): not deployed
+orders (Orders DEV): drifted
+  rate limiting:
+    ~ requests: 3 -> 10
+`
+	if stdout.String() != expected {
+		t.Fatalf("Output was not correct -- expected\n%v\nbut was\n%v", expected, stdout.String())
+	}
+}
+
+func Test_InvalidArguments_Success(t *testing.T) {
+	tests := [][]string{
+		{},
+		{"unknown"},
+		{"merge"},
+		{"build"},
+		{"build", "-out", t.TempDir(), "-env-values", filepath.Join(t.TempDir(), "missing.json")},
+		{"diff"},
+		{"diff", "-env", "dev", "-env-values", filepath.Join(t.TempDir(), "missing.json")},
+	}
+
+	for _, args := range tests {
+		if err := run(args, ioutil.Discard); err == nil {
+			t.Fatalf("An error was expected for %v", args)
+		}
+	}
+}
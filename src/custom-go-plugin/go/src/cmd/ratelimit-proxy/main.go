@@ -0,0 +1,141 @@
+// ratelimit-proxy is a reverse proxy applying the rate limiting of the api definitions of an
+// environment, to reproduce the behavior of the gateway locally or run small deployments
+// without the Tyk stack and its dashboard.
+//
+//	ratelimit-proxy -dir iac/api-definitions -env dev -listen :8080
+//
+// The definitions of the environment are loaded from iac/api-definitions, merged with their
+// override the same way iacctl does. A request is routed to the api whose listen path matches
+// the longest start of its path, the listen paths using the {name:pattern} variables of the
+// gateway, and passed to the target_url of the api if the rate limiting config_data of the api
+// allows it. Only the strip_listen_path and preserve_host_header proxy settings of the gateway
+// are applied. The keys are counted by a limiter shared by the apis, as the gateway shares the
+// sessions of the keys between the apis. Definitions having the same listen path are rejected,
+// the requests of all of them would be routed to the first one.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+
+	"tyk-plugin/iac"
+	"tyk-plugin/ratelimit"
+)
+
+// proxy routes the requests to the api they match, the handlers being in the order of the
+// definitions of the router
+type proxy struct {
+	router   *iac.Router
+	handlers []http.Handler
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "ratelimit-proxy:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer) error {
+	handler, listen, err := newProxy(args, stdout)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "listening on %v\n", listen)
+	return http.ListenAndServe(listen, handler)
+}
+
+// function returns the proxy of the definitions and the address it must listen on
+func newProxy(args []string, stdout io.Writer) (http.Handler, string, error) {
+	flags := flag.NewFlagSet("ratelimit-proxy", flag.ContinueOnError)
+	dir := flags.String("dir", "iac/api-definitions", "directory of the api definitions, holding base and env-overrides")
+	env := flags.String("env", "", "environment of the definitions")
+	listen := flags.String("listen", ":8080", "address the proxy listens on")
+	if err := flags.Parse(args); err != nil {
+		return nil, "", err
+	}
+	if *env == "" {
+		flags.Usage()
+		return nil, "", errors.New("-env is required")
+	}
+
+	definitions, missing, err := iac.FindDefinitions(*dir, *env)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(stdout, "no %v override, not proxied: %v\n", *env, strings.Join(missing, ", "))
+	}
+	if len(definitions) == 0 {
+		return nil, "", fmt.Errorf("no api definition for environment %q in %v", *env, *dir)
+	}
+
+	if err := iac.DuplicateListenPaths(definitions); err != nil {
+		return nil, "", err
+	}
+	router, err := iac.NewRouter(definitions)
+	if err != nil {
+		return nil, "", err
+	}
+
+	proxy := &proxy{router: router}
+	limiter := ratelimit.NewLimiter()
+	for _, definition := range definitions {
+		handler, err := newHandler(definition, limiter)
+		if err != nil {
+			return nil, "", fmt.Errorf("%v: %v", definition.Api, err)
+		}
+		proxy.handlers = append(proxy.handlers, handler)
+		fmt.Fprintf(stdout, "%v\t%v -> %v\n", definition.Api, definition.ListenPath(), definition.TargetUrl())
+	}
+	return proxy, *listen, nil
+}
+
+// function returns the handler of the definition, passing the requests allowed
+// by the rate limiting of the api to its target
+func newHandler(definition iac.Definition, limiter *ratelimit.Limiter) (http.Handler, error) {
+	listenPath, err := definition.ListenPathMatcher()
+	if err != nil {
+		return nil, err
+	}
+	if listenPath == nil {
+		return nil, errors.New("api_definition.proxy.listen_path is required")
+	}
+	target, err := url.Parse(definition.TargetUrl())
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("invalid target_url %q", definition.TargetUrl())
+	}
+
+	upstream := httputil.NewSingleHostReverseProxy(target)
+	director := upstream.Director
+	strip, preserveHost := definition.StripListenPath(), definition.PreserveHostHeader()
+	upstream.Director = func(r *http.Request) {
+		if strip {
+			r.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, listenPath.FindString(r.URL.Path)), "/")
+			r.URL.RawPath = ""
+		}
+		director(r)
+		if !preserveHost {
+			r.Host = target.Host
+		}
+	}
+
+	return ratelimit.NewMiddleware(definition.RateLimitDefinition(), limiter, upstream)
+}
+
+func (proxy *proxy) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	index := proxy.router.Route(r.URL.Path)
+	if index < 0 {
+		ratelimit.DebugLog("No api definition for the request: ", r.URL.Path)
+		http.NotFound(rw, r)
+		return
+	}
+	proxy.handlers[index].ServeHTTP(rw, r)
+}
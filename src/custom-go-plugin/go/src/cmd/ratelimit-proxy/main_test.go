@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Error creating %v: %v", filepath.Dir(path), err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Error writing %v: %v", path, err)
+	}
+}
+
+// function starts the proxy of the definitions of the directory
+func startProxy(t *testing.T, dir string) (*httptest.Server, string) {
+	var stdout bytes.Buffer
+	handler, _, err := newProxy([]string{"-dir", dir, "-env", "dev"}, &stdout)
+	if err != nil {
+		t.Fatalf("Error creating proxy: %v", err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server, stdout.String()
+}
+
+func get(t *testing.T, url string, tenant string) (*http.Response, string) {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("x-tenant-id", tenant)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error requesting %v: %v", url, err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	return res, string(body)
+}
+
+func Test_ProxyDefinitions_Success(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(rw, "%v %v", r.Host, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "base", "orders.json"), `{"api_definition": {"name": "Orders",
+		"proxy": {"listen_path": "/orders/", "strip_listen_path": true},
+		"config_data": {"rateLimiting": {"active": true, "requests": 2, "seconds": 60,
+			"strategy": {"name": "requestHeaders", "config": {"headerNames": ["x-tenant-id"], "separator": "::"}}}}}}`)
+	writeFile(t, filepath.Join(dir, "env-overrides", "orders-dev.json"), `{"api_definition": {"proxy": {"target_url": "`+upstream.URL+`/v1"}}}`)
+	writeFile(t, filepath.Join(dir, "base", "login.json"), `{"api_definition": {"name": "Login",
+		"proxy": {"listen_path": "/{?:(?i)Login/LoginService.svc}", "preserve_host_header": true},
+		"config_data": {"rateLimiting": {"active": true, "requests": -1, "seconds": -1, "strategy": {"name": "sessionGuid"}}}}}`)
+	writeFile(t, filepath.Join(dir, "env-overrides", "login-dev.json"), `{"api_definition": {"proxy": {"target_url": "`+upstream.URL+`"}}}`)
+
+	server, printed := startProxy(t, dir)
+	if !strings.Contains(printed, "orders\t/orders/ -> "+upstream.URL+"/v1") {
+		t.Fatalf("Routes were not printed: %v", printed)
+	}
+
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+	for i := 1; i <= 2; i++ {
+		res, body := get(t, server.URL+"/orders/42", "milesahead1")
+		if res.StatusCode != http.StatusOK || body != upstreamHost+" /v1/42" {
+			t.Fatalf("Request %v was not proxied -- was %v %v", i, res.StatusCode, body)
+		}
+		if res.Header.Get("X-RateLimit-Remaining") != fmt.Sprint(2-i) {
+			t.Fatalf("Remaining was not correct -- expected %v but was %v", 2-i, res.Header.Get("X-RateLimit-Remaining"))
+		}
+	}
+	res, _ := get(t, server.URL+"/orders/42", "milesahead1")
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Status was not correct -- expected %v but was %v", http.StatusTooManyRequests, res.StatusCode)
+	}
+	res, _ = get(t, server.URL+"/orders/42", "milesahead2")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Request of another key should be proxied -- was %v", res.StatusCode)
+	}
+
+	// not limited, the listen path and host being kept
+	serverHost := strings.TrimPrefix(server.URL, "http://")
+	for i := 0; i < 3; i++ {
+		res, body := get(t, server.URL+"/login/loginservice.svc/soap", "milesahead1")
+		if res.StatusCode != http.StatusOK || body != serverHost+" /login/loginservice.svc/soap" {
+			t.Fatalf("Login request was not proxied -- was %v %v", res.StatusCode, body)
+		}
+	}
+
+	res, _ = get(t, server.URL+"/invoices/", "milesahead1")
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Status was not correct -- expected %v but was %v", http.StatusNotFound, res.StatusCode)
+	}
+}
+
+func Test_InvalidArgs_Success(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "base", "orders.json"), `{"api_definition": {"name": "Orders", "proxy": {"listen_path": "/orders/"},
+		"config_data": {"rateLimiting": {"active": false}}}}`)
+	writeFile(t, filepath.Join(dir, "env-overrides", "orders-dev.json"), `{}`)
+	writeFile(t, filepath.Join(dir, "env-overrides", "orders-qa2.json"), `{"api_definition": {"proxy": {"target_url": "http://orders"},
+		"config_data": {"rateLimiting": {"active": true, "strategy": {"name": "unknown"}}}}}`)
+	writeFile(t, filepath.Join(dir, "env-overrides", "orders-qae.json"), `{"api_definition": {"proxy": {"target_url": "http://orders"}}}`)
+	writeFile(t, filepath.Join(dir, "base", "orders-copy.json"), `{"api_definition": {"name": "Orders", "proxy": {"listen_path": "/orders/"},
+		"config_data": {"rateLimiting": {"active": false}}}}`)
+	writeFile(t, filepath.Join(dir, "env-overrides", "orders-copy-qae.json"), `{"api_definition": {"proxy": {"target_url": "http://orders-copy"}}}`)
+
+	tests := [][]string{
+		{},
+		{"-unknown"},
+		{"-dir", dir, "-env", "prod"},
+		// no target_url
+		{"-dir", dir, "-env", "dev"},
+		{"-dir", dir, "-env", "qa2"},
+	}
+	for _, args := range tests {
+		if err := run(args, ioutil.Discard); err == nil {
+			t.Fatalf("Args %v should be rejected", args)
+		}
+	}
+
+	// the requests of orders-copy would all be routed to orders
+	if err := run([]string{"-dir", dir, "-env", "qae"}, ioutil.Discard); err == nil || !strings.Contains(err.Error(), `orders-copy, orders have the same listen path "/orders/"`) {
+		t.Fatalf("Duplicate listen paths should be rejected -- was %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+// ratelimit-sim replays captured requests through the rate limiting logic of the plugin.
+// the api definition is loaded from iac/api-definitions (a base definition, optionally merged
+// with an env override the same way iacctl does) and the requests are
+// read from a JSONL file of sample requests or from a HAR file exported by a browser or proxy.
+// For each request the strategy, key, matched override and limits are printed, along with
+// whether the gateway would have throttled it given the requests of the same key before it.
+//
+//	ratelimit-sim -base iac/api-definitions/base/ot1-xrs-soap.json \
+//	  -override iac/api-definitions/env-overrides/ot1-xrs-soap-dev.json -requests captured.har
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"tyk-plugin/iac"
+	"tyk-plugin/ratelimit"
+)
+
+// structure of the HAR files, limited to what is replayed
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			StartedDateTime time.Time `json:"startedDateTime"`
+			Request         struct {
+				Method  string `json:"method"`
+				Url     string `json:"url"`
+				Headers []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+				PostData *struct {
+					Text string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+// requests of each key over the limit period, every attempt being counted as the rolling
+// window of the gateway does
+type simulator struct {
+	windows map[string][]time.Time
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "ratelimit-sim:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("ratelimit-sim", flag.ContinueOnError)
+	basePath := flags.String("base", "", "base api definition (iac/api-definitions/base/*.json)")
+	overridePath := flags.String("override", "", "env override merged into the base definition (iac/api-definitions/env-overrides/*.json)")
+	requestsPath := flags.String("requests", "", "captured requests, JSONL of sample requests or HAR ('-' for JSONL on stdin)")
+	format := flags.String("format", "", "format of the requests, 'jsonl' or 'har' (guessed from the file extension by default)")
+	verbose := flags.Bool("v", false, "print the logs of the plugin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *basePath == "" || *requestsPath == "" {
+		flags.Usage()
+		return errors.New("-base and -requests are required")
+	}
+
+	if !*verbose {
+		ratelimit.SetLogLevel(ratelimit.Error)
+	}
+
+	definition, err := iac.LoadDefinition(*basePath, *overridePath)
+	if err != nil {
+		return err
+	}
+	rateLimitingConfig, err := ratelimit.ParseConfig(definition.ConfigData())
+	if err != nil {
+		return fmt.Errorf("invalid config_data of %v: %v", *basePath, err)
+	}
+
+	samples, err := readRequests(*requestsPath, *format, stdin)
+	if err != nil {
+		return err
+	}
+
+	previousClock := ratelimit.SetClock(fixedClock(time.Now()))
+	defer ratelimit.SetClock(previousClock)
+
+	sim := &simulator{windows: map[string][]time.Time{}}
+	throttled := map[string]int{}
+	total := map[string]int{}
+
+	fmt.Fprintf(stdout, "api: %v (%v), strategy: %v\n\n", definition.Name(), definition.ApiID(), rateLimitingConfig.RateLimiting.Strategy.Name)
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tMETHOD\tPATH\tKEY\tOVERRIDE\tLIMIT\tRESULT")
+
+	for _, sample := range samples {
+		req, err := sample.BuildRequest("localhost")
+		if err != nil {
+			return fmt.Errorf("invalid request %v %v: %v", sample.Method, sample.Path, err)
+		}
+
+		// schedules are resolved at the time the request was captured
+		ratelimit.SetClock(fixedClock(sample.Time))
+		decision := ratelimit.Resolve(rateLimitingConfig, definition.ApiID(), req)
+
+		result := sim.result(rateLimitingConfig, decision, sample.Time)
+		if decision.KeyID != "" {
+			total[decision.KeyID]++
+			if result == "throttled" {
+				throttled[decision.KeyID]++
+			}
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", sample.Time.Format(time.RFC3339), req.Method, req.URL.Path,
+			decision.KeyID, ratelimit.OverrideLabel(decision.Override), formatLimit(decision), result)
+	}
+	w.Flush()
+
+	keys := make([]string, 0, len(total))
+	for key := range total {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintln(stdout)
+	w = tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tREQUESTS\tTHROTTLED")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%v\t%v\t%v\n", key, total[key], throttled[key])
+	}
+	return w.Flush()
+}
+
+// function reads the captured requests, sorted by time
+func readRequests(path string, format string, stdin io.Reader) ([]ratelimit.SampleRequest, error) {
+	var reader io.Reader = stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	if format == "" {
+		format = "jsonl"
+		if strings.EqualFold(filepath.Ext(path), ".har") {
+			format = "har"
+		}
+	}
+
+	var samples []ratelimit.SampleRequest
+	var err error
+	switch format {
+	case "jsonl":
+		samples, err = readJSONL(reader)
+	case "har":
+		samples, err = readHAR(reader)
+	default:
+		err = fmt.Errorf("unknown requests format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// requests without a time are considered sent right after the previous one
+	now := time.Now()
+	for i := range samples {
+		if samples[i].Time.IsZero() {
+			samples[i].Time = now
+		}
+		now = samples[i].Time
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Time.Before(samples[j].Time)
+	})
+	return samples, nil
+}
+
+func readJSONL(reader io.Reader) ([]ratelimit.SampleRequest, error) {
+	var samples []ratelimit.SampleRequest
+
+	scanner := bufio.NewScanner(reader)
+	// SOAP bodies can be larger than the default token size
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var sample ratelimit.SampleRequest
+		if err := json.Unmarshal([]byte(text), &sample); err != nil {
+			return nil, fmt.Errorf("invalid request on line %d: %v", line, err)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, scanner.Err()
+}
+
+func readHAR(reader io.Reader) ([]ratelimit.SampleRequest, error) {
+	var har harFile
+	if err := json.NewDecoder(reader).Decode(&har); err != nil {
+		return nil, fmt.Errorf("invalid HAR file: %v", err)
+	}
+
+	samples := make([]ratelimit.SampleRequest, 0, len(har.Log.Entries))
+	for _, entry := range har.Log.Entries {
+		requestUrl, err := url.Parse(entry.Request.Url)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HAR request url %v: %v", entry.Request.Url, err)
+		}
+
+		sample := ratelimit.SampleRequest{
+			Time:    entry.StartedDateTime,
+			Method:  entry.Request.Method,
+			Path:    requestUrl.RequestURI(),
+			Headers: map[string]string{"Host": requestUrl.Host},
+		}
+		for _, header := range entry.Request.Headers {
+			// HTTP/2 pseudo headers (":authority"...)
+			if !strings.HasPrefix(header.Name, ":") {
+				sample.Headers[header.Name] = header.Value
+			}
+		}
+		if entry.Request.PostData != nil {
+			sample.Body = entry.Request.PostData.Text
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// function returns what the gateway would have done with the request
+func (sim *simulator) result(rateLimitingConfig ratelimit.RateLimitingConfig, decision ratelimit.Decision, now time.Time) string {
+	switch {
+	case decision.Error != "":
+		return "error: " + decision.Error
+	case decision.Access == "denied":
+		return "denied"
+	case decision.KeyID == "":
+		return "no key"
+	case !rateLimitingConfig.RateLimiting.Active || decision.Requests < 0 || decision.Seconds <= 0:
+		return "unlimited"
+	}
+
+	if sim.allow(decision.KeyID, decision.Requests, decision.Seconds, now) {
+		return "allowed"
+	}
+	return "throttled"
+}
+
+// function adds the request to the window of the key and returns whether it is within the limit
+func (sim *simulator) allow(keyID string, requests float64, seconds float64, now time.Time) bool {
+	start := now.Add(-time.Duration(seconds * float64(time.Second)))
+
+	window := sim.windows[keyID][:0]
+	for _, t := range sim.windows[keyID] {
+		if t.After(start) {
+			window = append(window, t)
+		}
+	}
+	window = append(window, now)
+	sim.windows[keyID] = window
+
+	return float64(len(window)) <= requests
+}
+
+func formatLimit(decision ratelimit.Decision) string {
+	if decision.Access == "denied" || decision.Error != "" {
+		return "-"
+	}
+	if decision.Requests < 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%v/%vs", decision.Requests, decision.Seconds)
+}
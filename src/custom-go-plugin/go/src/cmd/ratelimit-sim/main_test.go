@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const baseDefinition = `{
+  "api_definition": {
+    "api_id": "sim-api",
+    "name": "Sim API",
+    "config_data": {
+      "rateLimiting": {
+        "active": true,
+        "requests": 2,
+        "seconds": 10,
+        "sessionTtlMin": 120,
+        "overrides": [
+          {"method": "POST", "resource": "/orders", "requests": 1, "seconds": 60}
+        ],
+        "strategy": {"name": "requestHeaders", "config": {"headerNames": ["x-tenant-id"], "separator": "::"}}
+      }
+    }
+  }
+}`
+
+const envOverride = `{
+  "api_definition": {
+    "name": "Sim API DEV",
+    "config_data": {"rateLimiting": {"requests": 3}}
+  }
+}`
+
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Error writing %v: %v", name, err)
+	}
+	return path
+}
+
+// function returns the RESULT column of the printed requests
+func results(output string) []string {
+	var results []string
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "2024-") {
+			results = append(results, fields[len(fields)-1])
+		}
+	}
+	return results
+}
+
+func Test_SimulateJSONL_Success(t *testing.T) {
+	dir := t.TempDir()
+	base := writeFile(t, dir, "sim-api.json", baseDefinition)
+	override := writeFile(t, dir, "sim-api-dev.json", envOverride)
+	requests := writeFile(t, dir, "requests.jsonl", `
+{"time": "2024-03-13T12:00:00Z", "method": "GET", "path": "/items", "headers": {"x-tenant-id": "tenant-a"}}
+{"time": "2024-03-13T12:00:01Z", "method": "GET", "path": "/items", "headers": {"x-tenant-id": "tenant-a"}}
+{"time": "2024-03-13T12:00:02Z", "method": "GET", "path": "/items", "headers": {"x-tenant-id": "tenant-b"}}
+{"time": "2024-03-13T12:00:03Z", "method": "GET", "path": "/items", "headers": {"x-tenant-id": "tenant-a"}}
+{"time": "2024-03-13T12:00:04Z", "method": "GET", "path": "/items", "headers": {"x-tenant-id": "tenant-a"}}
+{"time": "2024-03-13T12:00:20Z", "method": "GET", "path": "/items", "headers": {"x-tenant-id": "tenant-a"}}
+{"time": "2024-03-13T12:00:21Z", "method": "GET", "path": "/items"}
+`)
+
+	var stdout bytes.Buffer
+	if err := run([]string{"-base", base, "-override", override, "-requests", requests}, nil, &stdout); err != nil {
+		t.Fatalf("Error running the simulation: %v", err)
+	}
+
+	expected := []string{"allowed", "allowed", "allowed", "allowed", "throttled", "allowed", "key"}
+	if result := results(stdout.String()); !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Results were not correct -- expected %v but was %v\n%v", expected, result, stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "Sim API DEV") || !strings.Contains(stdout.String(), "3/10s") {
+		t.Fatalf("Env override was not merged:\n%v", stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "tenant-a  5         1") {
+		t.Fatalf("Summary was not correct:\n%v", stdout.String())
+	}
+}
+
+func Test_SimulateHAR_Success(t *testing.T) {
+	dir := t.TempDir()
+	base := writeFile(t, dir, "sim-api.json", baseDefinition)
+	har := writeFile(t, dir, "captured.har", `{
+  "log": {
+    "entries": [
+      {
+        "startedDateTime": "2024-03-13T12:00:30Z",
+        "request": {"method": "POST", "url": "https://gateway.example.com/sim/orders?id=2", "headers": [{"name": "x-tenant-id", "value": "tenant-a"}], "postData": {"text": "{}"}}
+      },
+      {
+        "startedDateTime": "2024-03-13T12:00:00Z",
+        "request": {"method": "POST", "url": "https://gateway.example.com/sim/orders?id=1", "headers": [{"name": ":authority", "value": "gateway.example.com"}, {"name": "x-tenant-id", "value": "tenant-a"}]}
+      }
+    ]
+  }
+}`)
+
+	var stdout bytes.Buffer
+	if err := run([]string{"-base", base, "-requests", har}, nil, &stdout); err != nil {
+		t.Fatalf("Error running the simulation: %v", err)
+	}
+
+	expected := []string{"allowed", "throttled"}
+	if result := results(stdout.String()); !reflect.DeepEqual(result, expected) {
+		t.Fatalf("Results were not correct -- expected %v but was %v\n%v", expected, result, stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "POST /orders") || !strings.Contains(stdout.String(), "1/60s") {
+		t.Fatalf("Override was not matched:\n%v", stdout.String())
+	}
+}
+
+func Test_SimulateStdin_Success(t *testing.T) {
+	base := writeFile(t, t.TempDir(), "sim-api.json", baseDefinition)
+	stdin := strings.NewReader(`{"time": "2024-03-13T12:00:00Z", "path": "/items", "headers": {"x-tenant-id": "tenant-a"}}`)
+
+	var stdout bytes.Buffer
+	if err := run([]string{"-base", base, "-requests", "-"}, stdin, &stdout); err != nil {
+		t.Fatalf("Error running the simulation: %v", err)
+	}
+	if result := results(stdout.String()); !reflect.DeepEqual(result, []string{"allowed"}) {
+		t.Fatalf("Results were not correct:\n%v", stdout.String())
+	}
+}
+
+func Test_SimulateInvalidArguments_Success(t *testing.T) {
+	dir := t.TempDir()
+	base := writeFile(t, dir, "sim-api.json", baseDefinition)
+	invalid := writeFile(t, dir, "invalid.jsonl", "not json")
+
+	tests := [][]string{
+		{"-base", base},
+		{"-base", filepath.Join(dir, "missing.json"), "-requests", invalid},
+		{"-base", base, "-requests", invalid},
+		{"-base", base, "-requests", invalid, "-format", "csv"},
+	}
+
+	for _, args := range tests {
+		if err := run(args, nil, ioutil.Discard); err == nil {
+			t.Fatalf("An error was expected for %v", args)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+// tykdeploy publishes the plugin bundle and the api definitions of an environment,
+// replacing the bundle, mservctl and api definition stages of the Jenkins pipeline.
+//
+//	TYK_API_KEY=... MSERV_TOKEN=... tykdeploy plan -env dev \
+//	  -plugin src/custom-go-plugin/tyk/middleware/RateLimitingPlugin.so -plugin-version v1.0.3
+//
+// builds the bundle of the compiled plugin, named after the gateway and plugin versions
+// (RateLimitingPlugin_v5.0.3_linux_amd64_v1.0.3-dev.so), and prints the api definitions
+// that would be created or updated. 'apply' with the same flags uploads the bundle to mserv and
+// creates or updates the api definitions with their custom_middleware_bundle set to it, writing
+// a record of the changes to the -records directory. Without -plugin the deployed bundle is kept.
+//
+//	TYK_API_KEY=... MSERV_TOKEN=... tykdeploy rollback -env dev
+//
+// restores the api definitions changed by the last deployment to the environment
+// (or by the one of -record) and deletes its bundle.
+//
+//	tykdeploy bundle -env dev -plugin RateLimitingPlugin.so -plugin-version v1.0.3 -sign-key bundle-key.pem
+//	tykdeploy verify -bundle RateLimitingPlugin_v5.0.3_linux_amd64_v1.0.3-dev.zip -public-key bundle-public.pem
+//
+// writes the bundle signed with the -sign-key private key, which plan and apply also take, and
+// checks the checksum and the signature of a bundle offline, as the gateway does before loading it.
+// The endpoints of the environments are the ones of iac/env-values.json.
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"tyk-plugin/bundle"
+	"tyk-plugin/deploy"
+	"tyk-plugin/iac"
+)
+
+const usage = `usage: tykdeploy <command> [flags]
+
+commands:
+  plan       print what a deployment to an environment would change
+  apply      deploy the plugin bundle and the api definitions to an environment
+  rollback   restore the api definitions changed by a deployment
+  bundle     write the plugin bundle of an environment
+  verify     check the checksum and the signature of a bundle`
+
+// flags shared by the commands
+type targetFlags struct {
+	envValuesPath *string
+	env           *string
+	dashboard     *string
+	mserv         *string
+	apiKeyEnv     *string
+	mservTokenEnv *string
+}
+
+// flags of the plugin bundle
+type bundleFlags struct {
+	manifestPath  *string
+	pluginPath    *string
+	tykVersion    *string
+	pluginVersion *string
+	signKeyPath   *string
+	publicKeyPath *string
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "tykdeploy:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	switch args[0] {
+	case "plan":
+		return runPlan(args[1:], stdout, false)
+	case "apply":
+		return runPlan(args[1:], stdout, true)
+	case "rollback":
+		return runRollback(args[1:], stdout)
+	case "bundle":
+		return runBundle(args[1:], stdout)
+	case "verify":
+		return runVerify(args[1:], stdout)
+	}
+	return fmt.Errorf("unknown command %q\n%v", args[0], usage)
+}
+
+func runPlan(args []string, stdout io.Writer, apply bool) error {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	target := addTargetFlags(flags)
+	dir := flags.String("dir", "iac/api-definitions", "directory of the base definitions and env overrides")
+	bundleOptions := addBundleFlags(flags, "compiled plugin to bundle (the deployed bundle is kept if not set)")
+	recordsDir := flags.String("records", "deployments", "directory of the deployment records")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *target.env == "" {
+		flags.Usage()
+		return errors.New("-env is required")
+	}
+
+	deployTarget, err := target.resolve()
+	if err != nil {
+		return err
+	}
+
+	var pluginBundle *bundle.Bundle
+	var publicKey *rsa.PublicKey
+	bundleFileName := ""
+	if *bundleOptions.pluginPath != "" {
+		if pluginBundle, bundleFileName, publicKey, err = bundleOptions.build(*target.env); err != nil {
+			return err
+		}
+	}
+
+	definitions, missing, err := iac.FindDefinitions(*dir, *target.env)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(stdout, "no %v override, not deployed: %v\n", *target.env, strings.Join(missing, ", "))
+	}
+	if len(definitions) == 0 {
+		return fmt.Errorf("no definitions found for environment %q", *target.env)
+	}
+
+	plan, err := deploy.NewPlan(deployTarget, definitions, pluginBundle, bundleFileName)
+	if err != nil {
+		return err
+	}
+	plan.PublicKey = publicKey
+	if err := plan.Print(stdout); err != nil {
+		return err
+	}
+	if !apply {
+		return nil
+	}
+	if !plan.HasChanges() {
+		fmt.Fprintln(stdout, "\nnothing to deploy")
+		return nil
+	}
+
+	record, err := deploy.Apply(deployTarget, plan, *recordsDir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "\ndeployed:")
+	record.Print(stdout)
+	return nil
+}
+
+func runRollback(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	target := addTargetFlags(flags)
+	recordsDir := flags.String("records", "deployments", "directory of the deployment records")
+	recordPath := flags.String("record", "", "record of the deployment to roll back (the last one of the environment by default)")
+	keepBundle := flags.Bool("keep-bundle", false, "do not delete the bundle of the deployment from mserv")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	path := *recordPath
+	if path == "" {
+		if *target.env == "" {
+			flags.Usage()
+			return errors.New("-env or -record is required")
+		}
+		var err error
+		if path, err = deploy.LatestRecord(*recordsDir, *target.env); err != nil {
+			return err
+		}
+	}
+	record, err := deploy.LoadRecord(path)
+	if err != nil {
+		return err
+	}
+	if *target.env == "" {
+		*target.env = record.Env
+	}
+	if *target.env != record.Env {
+		return fmt.Errorf("record %v is a deployment to %v, not %v", path, record.Env, *target.env)
+	}
+
+	deployTarget, err := target.resolve()
+	if err != nil {
+		return err
+	}
+	if err := deploy.Rollback(deployTarget, record, !*keepBundle); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "rolled back %v:\n", path)
+	record.Print(stdout)
+	return nil
+}
+
+func runBundle(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("bundle", flag.ContinueOnError)
+	env := flags.String("env", "", "environment of the bundle")
+	bundleOptions := addBundleFlags(flags, "compiled plugin to bundle")
+	outDir := flags.String("out", ".", "directory the bundle is written to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *env == "" || *bundleOptions.pluginPath == "" {
+		flags.Usage()
+		return errors.New("-env and -plugin are required")
+	}
+
+	pluginBundle, bundleFileName, publicKey, err := bundleOptions.build(*env)
+	if err != nil {
+		return err
+	}
+	content, err := pluginBundle.Zip()
+	if err != nil {
+		return err
+	}
+	if err := verifyZip(content, publicKey); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(*outDir, strings.TrimSuffix(bundleFileName, ".so")+".zip")
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%v (checksum %v, %v)\n", path, pluginBundle.Manifest.Checksum, signedOf(pluginBundle))
+	return nil
+}
+
+func runVerify(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	bundlePath := flags.String("bundle", "", "zip of the bundle")
+	publicKeyPath := flags.String("public-key", "", "public key the signature is checked with (only the checksum is checked if not set)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *bundlePath == "" {
+		flags.Usage()
+		return errors.New("-bundle is required")
+	}
+
+	var publicKey *rsa.PublicKey
+	if *publicKeyPath != "" {
+		var err error
+		if publicKey, err = bundle.LoadPublicKey(*publicKeyPath); err != nil {
+			return err
+		}
+	}
+	content, err := ioutil.ReadFile(*bundlePath)
+	if err != nil {
+		return err
+	}
+	if err := verifyZip(content, publicKey); err != nil {
+		return fmt.Errorf("%v: %v", *bundlePath, err)
+	}
+
+	if publicKey == nil {
+		fmt.Fprintf(stdout, "%v: valid checksum, signature not checked\n", *bundlePath)
+	} else {
+		fmt.Fprintf(stdout, "%v: valid checksum and signature\n", *bundlePath)
+	}
+	return nil
+}
+
+// function checks the checksum of the zip of a bundle and, if a key is given, its signature
+func verifyZip(content []byte, publicKey *rsa.PublicKey) error {
+	zipped, err := bundle.Open(content)
+	if err != nil {
+		return err
+	}
+	return zipped.Verify(publicKey)
+}
+
+func signedOf(pluginBundle *bundle.Bundle) string {
+	if pluginBundle.Manifest.Signature == "" {
+		return "unsigned"
+	}
+	return "signed"
+}
+
+func addBundleFlags(flags *flag.FlagSet, pluginUsage string) bundleFlags {
+	return bundleFlags{
+		manifestPath:  flags.String("manifest", "src/custom-go-plugin/tyk/bundle/manifest.json", "manifest template of the bundle"),
+		pluginPath:    flags.String("plugin", "", pluginUsage),
+		tykVersion:    flags.String("tyk-version", "v5.0.3", "version of the gateway the plugin was compiled for"),
+		pluginVersion: flags.String("plugin-version", "", "version of the plugin"),
+		signKeyPath:   flags.String("sign-key", "", "PEM encoded RSA private key the bundle is signed with (unsigned if not set)"),
+		publicKeyPath: flags.String("public-key", "", "public key the signature is checked with before the upload (the one of -sign-key by default)"),
+	}
+}
+
+// function returns the bundle of the environment, signed if a key is given,
+// with the public key its signature is to be checked with
+func (options bundleFlags) build(env string) (*bundle.Bundle, string, *rsa.PublicKey, error) {
+	if *options.pluginVersion == "" {
+		return nil, "", nil, errors.New("-plugin-version is required with -plugin")
+	}
+	bundleFileName := bundle.PluginFileName(*options.tykVersion, *options.pluginVersion, env)
+	pluginBundle, err := bundle.New(*options.manifestPath, *options.pluginPath, bundleFileName)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	var publicKey *rsa.PublicKey
+	if *options.signKeyPath != "" {
+		key, err := bundle.LoadPrivateKey(*options.signKeyPath)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		if err := pluginBundle.Sign(key); err != nil {
+			return nil, "", nil, err
+		}
+		publicKey = &key.PublicKey
+	}
+	if *options.publicKeyPath != "" {
+		if publicKey, err = bundle.LoadPublicKey(*options.publicKeyPath); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	return pluginBundle, bundleFileName, publicKey, nil
+}
+
+func addTargetFlags(flags *flag.FlagSet) targetFlags {
+	return targetFlags{
+		envValuesPath: flags.String("env-values", "iac/env-values.json", "endpoints of the environments"),
+		env:           flags.String("env", "", "environment to deploy to"),
+		dashboard:     flags.String("dashboard", "", "api definitions endpoint of the dashboard (the one of env-values.json by default)"),
+		mserv:         flags.String("mserv", "", "mserv file server (the one of env-values.json by default)"),
+		apiKeyEnv:     flags.String("api-key-env", "TYK_API_KEY", "environment variable holding the dashboard api key"),
+		mservTokenEnv: flags.String("mserv-token-env", "MSERV_TOKEN", "environment variable holding the mserv token"),
+	}
+}
+
+// function returns the target of the environment, the endpoints not given
+// as flags being read from env-values.json
+func (target targetFlags) resolve() (deploy.Target, error) {
+	result := deploy.Target{
+		Env:       *target.env,
+		Dashboard: iac.Dashboard{Url: *target.dashboard, ApiKey: os.Getenv(*target.apiKeyEnv)},
+		Mserv:     deploy.Mserv{Url: *target.mserv, Token: os.Getenv(*target.mservTokenEnv)},
+	}
+
+	if result.Dashboard.Url == "" || result.Mserv.Url == "" {
+		environments, err := iac.LoadEnvironments(*target.envValuesPath)
+		if err != nil {
+			return result, err
+		}
+		for _, env := range environments {
+			if env.Name != *target.env {
+				continue
+			}
+			if result.Dashboard.Url == "" {
+				result.Dashboard.Url = env.ApiDefEndpointUrl
+			}
+			if result.Mserv.Url == "" {
+				result.Mserv.Url = env.MservFileServer
+			}
+		}
+	}
+
+	if result.Dashboard.Url == "" || result.Mserv.Url == "" {
+		return result, fmt.Errorf("no dashboard or mserv endpoint for environment %q", *target.env)
+	}
+	return result, nil
+}
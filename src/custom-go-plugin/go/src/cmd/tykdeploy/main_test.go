@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func writeFile(t *testing.T, path string, content string) string {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Error creating %v: %v", filepath.Dir(path), err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Error writing %v: %v", path, err)
+	}
+	return path
+}
+
+// function starts a stub of the dashboard with no api deployed and of mserv,
+// returning the env-values.json of the dev environment and the deployed definitions
+func startStubs(t *testing.T) (string, map[string]map[string]interface{}) {
+	var mutex sync.Mutex
+	apis := map[string]map[string]interface{}{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		switch {
+		case r.URL.Path == "/mserv/api/mw" && r.Header.Get("X-Api-Key") == "mserv-secret":
+			rw.Write([]byte(`{"Status": "ok", "Payload": {"BundleID": "bundle-1"}}`))
+		case strings.HasPrefix(r.URL.Path, "/mserv/api/mw/"):
+			rw.Write([]byte(`{"Status": "ok"}`))
+		case r.Header.Get("authorization") != "dashboard-secret":
+			rw.WriteHeader(http.StatusUnauthorized)
+		case r.Method == http.MethodGet:
+			json.NewEncoder(rw).Encode(map[string]interface{}{"apis": []interface{}{}})
+		case r.Method == http.MethodPost:
+			var content map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&content)
+			apis["id-1"] = content
+			rw.Write([]byte(`{"Status": "OK", "Meta": "id-1"}`))
+		case r.Method == http.MethodDelete:
+			delete(apis, strings.TrimPrefix(r.URL.Path, "/api/apis/"))
+			rw.Write([]byte(`{"Status": "OK"}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	envValues := writeFile(t, filepath.Join(t.TempDir(), "env-values.json"), `{
+		"Tyk_ApiDefEndpoint_Url_dev": "`+server.URL+`/api/apis", "Tyk_MservFileServer_dev": "`+server.URL+`/mserv"
+	}`)
+	os.Setenv("TYKDEPLOY_TEST_API_KEY", "dashboard-secret")
+	os.Setenv("TYKDEPLOY_TEST_MSERV_TOKEN", "mserv-secret")
+	t.Cleanup(func() {
+		os.Unsetenv("TYKDEPLOY_TEST_API_KEY")
+		os.Unsetenv("TYKDEPLOY_TEST_MSERV_TOKEN")
+	})
+	return envValues, apis
+}
+
+func Test_PlanApplyRollback_Success(t *testing.T) {
+	envValues, apis := startStubs(t)
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "api-definitions", "base", "orders.json"), `{"api_definition": {"name": "Orders", "slug": "orders", "custom_middleware_bundle": "",
+		"proxy": {"listen_path": "/orders/", "target_url": ""},
+		"config_data": {"rateLimiting": {"active": true, "requests": 3, "seconds": 15, "strategy": {"name": "sessionGuid"}}}}}`)
+	writeFile(t, filepath.Join(dir, "api-definitions", "env-overrides", "orders-dev.json"), `{"api_definition": {"name": "Orders DEV", "proxy": {"target_url": "https://orders.dev"}}}`)
+	manifest := writeFile(t, filepath.Join(dir, "bundle", "manifest.json"), `{"file_list": ["plugin_name_placeholder"], "custom_middleware": {"driver": "goplugin"}}`)
+	plugin := writeFile(t, filepath.Join(dir, "RateLimitingPlugin.so"), "compiled plugin")
+	records := filepath.Join(dir, "deployments")
+
+	args := []string{"-dir", filepath.Join(dir, "api-definitions"), "-env-values", envValues, "-env", "dev",
+		"-api-key-env", "TYKDEPLOY_TEST_API_KEY", "-mserv-token-env", "TYKDEPLOY_TEST_MSERV_TOKEN",
+		"-manifest", manifest, "-plugin", plugin, "-plugin-version", "v1.0.3", "-records", records}
+
+	var stdout bytes.Buffer
+	if err := run(append([]string{"plan"}, args...), &stdout); err != nil {
+		t.Fatalf("Error planning: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "bundle: upload RateLimitingPlugin_v5.0.3_linux_amd64_v1.0.3-dev.so") || !strings.Contains(stdout.String(), "create orders (Orders DEV)") {
+		t.Fatalf("Plan was not correct:\n%v", stdout.String())
+	}
+	if len(apis) != 0 {
+		t.Fatalf("Plan should not deploy anything")
+	}
+
+	stdout.Reset()
+	if err := run(append([]string{"apply"}, args...), &stdout); err != nil {
+		t.Fatalf("Error applying: %v", err)
+	}
+	if bundleID := apis["id-1"]["api_definition"].(map[string]interface{})["custom_middleware_bundle"]; bundleID != "bundle-1" {
+		t.Fatalf("Api was not deployed with the bundle -- expected bundle-1 but was %v", bundleID)
+	}
+
+	stdout.Reset()
+	rollbackArgs := []string{"rollback", "-env-values", envValues, "-env", "dev", "-records", records,
+		"-api-key-env", "TYKDEPLOY_TEST_API_KEY", "-mserv-token-env", "TYKDEPLOY_TEST_MSERV_TOKEN"}
+	if err := run(rollbackArgs, &stdout); err != nil {
+		t.Fatalf("Error rolling back: %v", err)
+	}
+	if len(apis) != 0 || !strings.Contains(stdout.String(), "create orders (Orders DEV) id id-1") {
+		t.Fatalf("Deployment was not rolled back:\n%v", stdout.String())
+	}
+}
+
+// function generates an RSA key, returning the paths of its PEM encoded private and public keys
+func writeKey(t *testing.T, dir string, name string) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating the key: %v", err)
+	}
+	public, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	privatePath := writeFile(t, filepath.Join(dir, name+".pem"), string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+	publicPath := writeFile(t, filepath.Join(dir, name+"-public.pem"), string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})))
+	return privatePath, publicPath
+}
+
+func Test_BundleAndVerify_Success(t *testing.T) {
+	dir := t.TempDir()
+	manifest := writeFile(t, filepath.Join(dir, "bundle", "manifest.json"), `{"file_list": ["plugin_name_placeholder"], "custom_middleware": {"driver": "goplugin"}, "checksum": "", "signature": ""}`)
+	plugin := writeFile(t, filepath.Join(dir, "RateLimitingPlugin.so"), "compiled plugin")
+	signKey, publicKey := writeKey(t, dir, "bundle-key")
+	_, otherPublicKey := writeKey(t, dir, "other-key")
+
+	var stdout bytes.Buffer
+	bundleArgs := []string{"bundle", "-env", "dev", "-manifest", manifest, "-plugin", plugin, "-plugin-version", "v1.0.3", "-sign-key", signKey, "-out", filepath.Join(dir, "out")}
+	if err := run(bundleArgs, &stdout); err != nil {
+		t.Fatalf("Error bundling: %v", err)
+	}
+	zipPath := filepath.Join(dir, "out", "RateLimitingPlugin_v5.0.3_linux_amd64_v1.0.3-dev.zip")
+	if !strings.Contains(stdout.String(), zipPath) || !strings.Contains(stdout.String(), ", signed)") {
+		t.Fatalf("Bundle was not written:\n%v", stdout.String())
+	}
+
+	stdout.Reset()
+	if err := run([]string{"verify", "-bundle", zipPath, "-public-key", publicKey}, &stdout); err != nil {
+		t.Fatalf("Error verifying: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "valid checksum and signature") {
+		t.Fatalf("Bundle was not verified:\n%v", stdout.String())
+	}
+	if err := run([]string{"verify", "-bundle", zipPath, "-public-key", otherPublicKey}, ioutil.Discard); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Fatalf("Verify should fail with another key -- expected an invalid signature but was %v", err)
+	}
+}
+
+func Test_InvalidArguments_Success(t *testing.T) {
+	envValues := writeFile(t, filepath.Join(t.TempDir(), "env-values.json"), `{"Tyk_ApiDefEndpoint_Url_prod": "", "Tyk_MservFileServer_prod": ""}`)
+
+	tests := [][]string{
+		{},
+		{"unknown"},
+		{"plan"},
+		{"plan", "-env", "dev", "-plugin", "RateLimitingPlugin.so"},
+		{"plan", "-env", "prod", "-env-values", envValues},
+		{"rollback"},
+		{"rollback", "-env", "dev", "-records", t.TempDir()},
+		{"bundle", "-env", "dev"},
+		{"bundle", "-env", "dev", "-plugin", "RateLimitingPlugin.so"},
+		{"verify"},
+		{"verify", "-bundle", "missing.zip"},
+	}
+
+	for _, args := range tests {
+		if err := run(args, ioutil.Discard); err == nil {
+			t.Fatalf("An error was expected for %v", args)
+		}
+	}
+}
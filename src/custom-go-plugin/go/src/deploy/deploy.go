@@ -0,0 +1,324 @@
+// Package deploy publishes the plugin bundle and the api definitions of an environment.
+// A plan compares the definitions of the iac files with the ones deployed to the dashboard.
+// Applying it uploads the bundle to mserv, then creates or updates the api definitions with
+// their custom_middleware_bundle set to the uploaded bundle, and writes a record of what was
+// changed so that the deployment can be rolled back, which is done right away if it fails.
+package deploy
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"tyk-plugin/bundle"
+	"tyk-plugin/iac"
+)
+
+// actions of the plan on the api definitions
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionNone   = "none"
+)
+
+// format of the time in the name of the records, sorting them by time
+const recordTimeFormat = "20060102T150405Z"
+
+// Target is the dashboard and the mserv file server of an environment
+type Target struct {
+	Env       string
+	Dashboard iac.Dashboard
+	Mserv     Mserv
+}
+
+// Plan is what a deployment to an environment changes
+type Plan struct {
+	Env string
+	// bundle to upload, nil if only the api definitions are deployed
+	Bundle         *bundle.Bundle
+	BundleFileName string
+	// key the signature of the bundle is verified with before it is uploaded, nil to only verify its checksum
+	PublicKey *rsa.PublicKey
+	Apis      []ApiPlan
+}
+
+// ApiPlan is what a deployment changes on an api definition
+type ApiPlan struct {
+	Action     string
+	Definition iac.Definition
+	// nil if the api is not deployed
+	Deployed *iac.Definition
+	Drift    iac.Drift
+}
+
+// Record is what a deployment changed, to roll it back
+type Record struct {
+	Env            string      `json:"env"`
+	Time           time.Time   `json:"time"`
+	BundleID       string      `json:"bundleId"`
+	BundleFileName string      `json:"bundleFileName"`
+	Checksum       string      `json:"checksum"`
+	Apis           []ApiRecord `json:"apis"`
+}
+
+// ApiRecord is what a deployment changed on an api definition
+type ApiRecord struct {
+	Api    string `json:"api"`
+	Name   string `json:"name"`
+	Action string `json:"action"`
+	// dashboard id of the api definition
+	ID string `json:"id"`
+	// deployed definition before the update
+	Previous map[string]interface{} `json:"previous,omitempty"`
+}
+
+// NewPlan compares the definitions with the deployed ones, the bundle being uploaded
+// unless it is nil. The definitions must be valid.
+func NewPlan(target Target, definitions []iac.Definition, pluginBundle *bundle.Bundle, bundleFileName string) (*Plan, error) {
+	plan := &Plan{Env: target.Env, Bundle: pluginBundle, BundleFileName: bundleFileName}
+
+	var problems []string
+	for _, definition := range definitions {
+		for _, problem := range definition.Validate() {
+			problems = append(problems, fmt.Sprintf("%v (%v): %v", definition.Api, target.Env, problem))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, errors.New("invalid definitions:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	for _, definition := range definitions {
+		deployed, err := target.Dashboard.FindApi(definition)
+		if err != nil {
+			return nil, err
+		}
+
+		apiPlan := ApiPlan{Definition: definition, Deployed: deployed, Drift: iac.Diff(definition, deployed)}
+		switch {
+		case deployed == nil:
+			apiPlan.Action = ActionCreate
+		case pluginBundle != nil || !apiPlan.Drift.InSync():
+			apiPlan.Action = ActionUpdate
+		default:
+			apiPlan.Action = ActionNone
+		}
+		plan.Apis = append(plan.Apis, apiPlan)
+	}
+	return plan, nil
+}
+
+// HasChanges returns whether applying the plan changes anything
+func (plan *Plan) HasChanges() bool {
+	if plan.Bundle != nil {
+		return true
+	}
+	for _, apiPlan := range plan.Apis {
+		if apiPlan.Action != ActionNone {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes the changes of the plan
+func (plan *Plan) Print(w io.Writer) error {
+	fmt.Fprintf(w, "environment: %v\n", plan.Env)
+	if plan.Bundle != nil {
+		checksum, err := plan.Bundle.Checksum()
+		if err != nil {
+			return err
+		}
+		signed := "unsigned"
+		if plan.Bundle.Manifest.Signature != "" {
+			signed = "signed"
+		}
+		fmt.Fprintf(w, "bundle: upload %v (checksum %v, %v)\n", plan.BundleFileName, checksum, signed)
+	} else {
+		fmt.Fprintln(w, "bundle: unchanged")
+	}
+
+	for _, apiPlan := range plan.Apis {
+		fmt.Fprintf(w, "%-6v %v (%v)\n", apiPlan.Action, apiPlan.Definition.Api, apiPlan.Definition.Name())
+		if apiPlan.Action == ActionUpdate {
+			if plan.Bundle != nil {
+				fmt.Fprintf(w, "  custom_middleware_bundle: %q -> uploaded bundle\n", bundleOf(*apiPlan.Deployed))
+			}
+			apiPlan.Drift.PrintChanges(w, "  ")
+		}
+	}
+	return nil
+}
+
+// Apply uploads the bundle and creates or updates the api definitions, the record of the changes
+// being written to the records directory. The changes already done are rolled back if any fails.
+func Apply(target Target, plan *Plan, recordsDir string) (*Record, error) {
+	record := &Record{Env: plan.Env, Time: time.Now().UTC()}
+
+	if plan.Bundle != nil {
+		content, err := plan.Bundle.Zip()
+		if err != nil {
+			return nil, err
+		}
+		// the zip is checked as the gateway will check it
+		zipped, err := bundle.Open(content)
+		if err != nil {
+			return nil, err
+		}
+		if err := zipped.Verify(plan.PublicKey); err != nil {
+			return nil, fmt.Errorf("bundle verification failed: %v", err)
+		}
+		bundleID, err := target.Mserv.Upload(plan.BundleFileName, content)
+		if err != nil {
+			return nil, fmt.Errorf("bundle upload failed: %v", err)
+		}
+		record.BundleID, record.BundleFileName, record.Checksum = bundleID, plan.BundleFileName, plan.Bundle.Manifest.Checksum
+	}
+
+	for _, apiPlan := range plan.Apis {
+		if apiPlan.Action == ActionNone {
+			continue
+		}
+		if err := applyApi(target, apiPlan, record); err != nil {
+			err = fmt.Errorf("%v of %v failed: %v", apiPlan.Action, apiPlan.Definition.Api, err)
+			if rollbackErr := Rollback(target, record, true); rollbackErr != nil {
+				return record, fmt.Errorf("%v, rollback failed: %v", err, rollbackErr)
+			}
+			return record, fmt.Errorf("%v, the deployment was rolled back", err)
+		}
+	}
+
+	if err := record.write(recordsDir); err != nil {
+		return record, fmt.Errorf("the deployment succeeded but its record could not be written: %v", err)
+	}
+	return record, nil
+}
+
+// function creates or updates the api definition with the bundle of the record,
+// or keeps the deployed bundle if none was uploaded
+func applyApi(target Target, apiPlan ApiPlan, record *Record) error {
+	fields := map[string]interface{}{}
+	if record.BundleID != "" {
+		fields["custom_middleware_bundle"] = record.BundleID
+	}
+
+	if apiPlan.Action == ActionCreate {
+		id, err := target.Dashboard.CreateApi(apiPlan.Definition.WithFields(fields))
+		if err != nil {
+			return err
+		}
+		record.Apis = append(record.Apis, ApiRecord{Api: apiPlan.Definition.Api, Name: apiPlan.Definition.Name(), Action: ActionCreate, ID: id})
+		return nil
+	}
+
+	deployed := *apiPlan.Deployed
+	fields["id"] = deployed.ID()
+	fields["api_id"] = deployed.ApiID()
+	if record.BundleID == "" {
+		fields["custom_middleware_bundle"] = bundleOf(deployed)
+	}
+	if err := target.Dashboard.UpdateApi(deployed.ID(), apiPlan.Definition.WithFields(fields)); err != nil {
+		return err
+	}
+	record.Apis = append(record.Apis, ApiRecord{Api: apiPlan.Definition.Api, Name: apiPlan.Definition.Name(), Action: ActionUpdate, ID: deployed.ID(), Previous: deployed.Content})
+	return nil
+}
+
+// Rollback restores the api definitions changed by the deployment, in reverse order: the updated
+// ones are replaced by their previous definition and the created ones are deleted.
+// The uploaded bundle is deleted if deleteBundle is set, once no api definition uses it.
+func Rollback(target Target, record *Record, deleteBundle bool) error {
+	var problems []string
+	for i := len(record.Apis) - 1; i >= 0; i-- {
+		apiRecord := record.Apis[i]
+		var err error
+		switch apiRecord.Action {
+		case ActionCreate:
+			err = target.Dashboard.DeleteApi(apiRecord.ID)
+		case ActionUpdate:
+			err = target.Dashboard.UpdateApi(apiRecord.ID, iac.Definition{Api: apiRecord.Api, Content: apiRecord.Previous})
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v of %v: %v", apiRecord.Action, apiRecord.Api, err))
+		}
+	}
+
+	if deleteBundle && record.BundleID != "" && len(problems) == 0 {
+		if err := target.Mserv.Delete(record.BundleID); err != nil {
+			problems = append(problems, fmt.Sprintf("bundle %v: %v", record.BundleID, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Print writes the changes of the record
+func (record *Record) Print(w io.Writer) {
+	fmt.Fprintf(w, "environment: %v\n", record.Env)
+	if record.BundleID != "" {
+		fmt.Fprintf(w, "bundle: %v (%v)\n", record.BundleID, record.BundleFileName)
+	}
+	for _, apiRecord := range record.Apis {
+		fmt.Fprintf(w, "%-6v %v (%v) id %v\n", apiRecord.Action, apiRecord.Api, apiRecord.Name, apiRecord.ID)
+	}
+}
+
+// function writes the record to '<dir>/<env>-<time>.json'
+func (record *Record) write(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, record.Env+"-"+record.Time.Format(recordTimeFormat)+".json"), content, 0644)
+}
+
+// LoadRecord reads the record of a deployment
+func LoadRecord(path string) (*Record, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var record Record
+	if err := json.Unmarshal(content, &record); err != nil {
+		return nil, fmt.Errorf("invalid record %v: %v", path, err)
+	}
+	return &record, nil
+}
+
+// LatestRecord returns the path of the record of the last deployment to the environment
+func LatestRecord(dir string, env string) (string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, env+"-*.json"))
+	if err != nil {
+		return "", err
+	}
+	var records []string
+	for _, path := range paths {
+		// the environment names can be prefixes of each other (qa, qa2)
+		if _, err := time.Parse(recordTimeFormat, strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), env+"-"), ".json")); err == nil {
+			records = append(records, path)
+		}
+	}
+	if len(records) == 0 {
+		return "", fmt.Errorf("no deployment record of %v in %v", env, dir)
+	}
+	sort.Strings(records)
+	return records[len(records)-1], nil
+}
+
+func bundleOf(definition iac.Definition) string {
+	bundleID, _ := definition.ApiDefinition()["custom_middleware_bundle"].(string)
+	return bundleID
+}
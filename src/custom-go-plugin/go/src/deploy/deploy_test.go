@@ -0,0 +1,304 @@
+package deploy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"tyk-plugin/bundle"
+	"tyk-plugin/iac"
+)
+
+// stub of the api definitions endpoint of the dashboard keeping the definitions in memory
+type fakeDashboard struct {
+	mutex sync.Mutex
+	apis  map[string]map[string]interface{}
+	// path of the requests failing with a 500
+	failing string
+	nextID  int
+}
+
+func (dashboard *fakeDashboard) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+
+	if r.Header.Get("authorization") != "dashboard-secret" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method+" "+r.URL.Path == dashboard.failing {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/apis/")
+	var content map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&content)
+
+	switch r.Method {
+	case http.MethodGet:
+		apis := []map[string]interface{}{}
+		for _, api := range dashboard.apis {
+			if api["api_definition"].(map[string]interface{})["name"] == r.URL.Query().Get("q") {
+				apis = append(apis, api)
+			}
+		}
+		json.NewEncoder(rw).Encode(map[string]interface{}{"apis": apis})
+	case http.MethodPost:
+		dashboard.nextID++
+		id = fmt.Sprintf("id-%d", dashboard.nextID)
+		apiDefinition := content["api_definition"].(map[string]interface{})
+		apiDefinition["id"], apiDefinition["api_id"] = id, "api-"+id
+		dashboard.apis[id] = content
+		rw.Write([]byte(`{"Status": "OK", "Message": "API created", "Meta": "` + id + `"}`))
+	case http.MethodPut:
+		dashboard.apis[id] = content
+		rw.Write([]byte(`{"Status": "OK", "Message": "Api updated"}`))
+	case http.MethodDelete:
+		delete(dashboard.apis, id)
+		rw.Write([]byte(`{"Status": "OK", "Message": "API deleted"}`))
+	}
+}
+
+func (dashboard *fakeDashboard) api(id string) map[string]interface{} {
+	dashboard.mutex.Lock()
+	defer dashboard.mutex.Unlock()
+	if dashboard.apis[id] == nil {
+		return nil
+	}
+	return dashboard.apis[id]["api_definition"].(map[string]interface{})
+}
+
+// stub of the mserv api keeping the uploaded bundles in memory
+type fakeMserv struct {
+	mutex   sync.Mutex
+	bundles map[string][]byte
+	nextID  int
+}
+
+func (mserv *fakeMserv) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	mserv.mutex.Lock()
+	defer mserv.mutex.Unlock()
+
+	if r.Header.Get("X-Api-Key") != "mserv-secret" {
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/mserv/api/mw":
+		file, _, err := r.FormFile("uploadfile")
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		content, _ := ioutil.ReadAll(file)
+		mserv.nextID++
+		id := fmt.Sprintf("bundle-%d", mserv.nextID)
+		mserv.bundles[id] = content
+		rw.Write([]byte(`{"Status": "ok", "Payload": {"BundleID": "` + id + `"}}`))
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/mserv/api/mw/"):
+		delete(mserv.bundles, strings.TrimPrefix(r.URL.Path, "/mserv/api/mw/"))
+		rw.Write([]byte(`{"Status": "ok"}`))
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (mserv *fakeMserv) count() int {
+	mserv.mutex.Lock()
+	defer mserv.mutex.Unlock()
+	return len(mserv.bundles)
+}
+
+// function starts the stubs with the orders api deployed with the given requests limit
+func startTarget(t *testing.T, deployedRequests int) (Target, *fakeDashboard, *fakeMserv) {
+	dashboard := &fakeDashboard{apis: map[string]map[string]interface{}{
+		"id-orders": {"api_definition": map[string]interface{}{
+			"id": "id-orders", "api_id": "api-orders", "name": "Orders DEV", "slug": "orders",
+			"custom_middleware_bundle": "bundle-previous",
+			"proxy":                    map[string]interface{}{"listen_path": "/orders/", "target_url": "https://orders.dev"},
+			"config_data":              map[string]interface{}{"rateLimiting": map[string]interface{}{"active": true, "requests": deployedRequests, "seconds": 15, "strategy": map[string]interface{}{"name": "sessionGuid"}}},
+		}},
+	}}
+	mserv := &fakeMserv{bundles: map[string][]byte{"bundle-previous": []byte("zip")}}
+
+	dashboardServer := httptest.NewServer(dashboard)
+	mservServer := httptest.NewServer(mserv)
+	t.Cleanup(dashboardServer.Close)
+	t.Cleanup(mservServer.Close)
+
+	target := Target{
+		Env:       "dev",
+		Dashboard: iac.Dashboard{Url: dashboardServer.URL + "/api/apis", ApiKey: "dashboard-secret"},
+		Mserv:     Mserv{Url: mservServer.URL + "/mserv", Token: "mserv-secret"},
+	}
+	return target, dashboard, mserv
+}
+
+func definitionOf(api string, name string, requests int) iac.Definition {
+	return iac.Definition{Api: api, Env: "dev", Content: map[string]interface{}{"api_definition": map[string]interface{}{
+		"api_id": "", "name": name, "slug": api, "custom_middleware_bundle": "",
+		"proxy":       map[string]interface{}{"listen_path": "/" + api + "/", "target_url": "https://" + api + ".dev"},
+		"config_data": map[string]interface{}{"rateLimiting": map[string]interface{}{"active": true, "requests": requests, "seconds": 15, "strategy": map[string]interface{}{"name": "sessionGuid"}}},
+	}}}
+}
+
+func newBundle(t *testing.T) *bundle.Bundle {
+	dir := t.TempDir()
+	manifestPath := filepath.Join(dir, "manifest.json")
+	pluginPath := filepath.Join(dir, "RateLimitingPlugin.so")
+	ioutil.WriteFile(manifestPath, []byte(`{"file_list": ["plugin_name_placeholder"], "custom_middleware": {"driver": "goplugin"}}`), 0644)
+	ioutil.WriteFile(pluginPath, []byte("compiled plugin"), 0644)
+
+	pluginBundle, err := bundle.New(manifestPath, pluginPath, "RateLimitingPlugin_v5.0.3_linux_amd64_v1.0.3-dev.so")
+	if err != nil {
+		t.Fatalf("Error creating the bundle: %v", err)
+	}
+	return pluginBundle
+}
+
+func Test_Plan_Success(t *testing.T) {
+	target, _, _ := startTarget(t, 3)
+	definitions := []iac.Definition{definitionOf("orders", "Orders DEV", 5), definitionOf("items", "Items DEV", 3)}
+
+	plan, err := NewPlan(target, definitions, newBundle(t), "RateLimitingPlugin_v5.0.3_linux_amd64_v1.0.3-dev.so")
+	if err != nil {
+		t.Fatalf("Error planning: %v", err)
+	}
+
+	var output bytes.Buffer
+	plan.Print(&output)
+	checksum, _ := plan.Bundle.Checksum()
+	expected := `environment: dev
+bundle: upload RateLimitingPlugin_v5.0.3_linux_amd64_v1.0.3-dev.so (checksum ` + checksum + `, unsigned)
+update orders (Orders DEV)
+  custom_middleware_bundle: "bundle-previous" -> uploaded bundle
+  rate limiting:
+    ~ requests: 5 -> 3
+create items (Items DEV)
+`
+	if output.String() != expected {
+		t.Fatalf("Plan was not correct -- expected\n%v\nbut was\n%v", expected, output.String())
+	}
+}
+
+func Test_PlanWithoutBundle_Success(t *testing.T) {
+	target, _, _ := startTarget(t, 3)
+
+	plan, err := NewPlan(target, []iac.Definition{definitionOf("orders", "Orders DEV", 3)}, nil, "")
+	if err != nil {
+		t.Fatalf("Error planning: %v", err)
+	}
+	if plan.HasChanges() || plan.Apis[0].Action != ActionNone {
+		t.Fatalf("Plan should have no changes -- expected %v but was %v", ActionNone, plan.Apis[0].Action)
+	}
+
+	if _, err := NewPlan(target, []iac.Definition{definitionOf("orders", "", 3)}, nil, ""); err == nil || !strings.Contains(err.Error(), "api_definition.name is required") {
+		t.Fatalf("Invalid definitions should not be planned -- expected an invalid name but was %v", err)
+	}
+}
+
+func Test_ApplyAndRollback_Success(t *testing.T) {
+	target, dashboard, mserv := startTarget(t, 3)
+	recordsDir := t.TempDir()
+	definitions := []iac.Definition{definitionOf("orders", "Orders DEV", 5), definitionOf("items", "Items DEV", 3)}
+
+	plan, err := NewPlan(target, definitions, newBundle(t), "RateLimitingPlugin_v5.0.3_linux_amd64_v1.0.3-dev.so")
+	if err != nil {
+		t.Fatalf("Error planning: %v", err)
+	}
+	record, err := Apply(target, plan, recordsDir)
+	if err != nil {
+		t.Fatalf("Error applying: %v", err)
+	}
+
+	orders := dashboard.api("id-orders")
+	if orders["custom_middleware_bundle"] != record.BundleID || orders["api_id"] != "api-orders" || fmt.Sprint(orders["config_data"]) != "map[rateLimiting:map[active:true requests:5 seconds:15 strategy:map[name:sessionGuid]]]" {
+		t.Fatalf("Orders was not updated: %v", orders)
+	}
+	items := dashboard.api(record.Apis[1].ID)
+	if items == nil || items["custom_middleware_bundle"] != record.BundleID || mserv.count() != 2 {
+		t.Fatalf("Items was not created with the bundle %v: %v", record.BundleID, items)
+	}
+
+	path, err := LatestRecord(recordsDir, "dev")
+	if err != nil {
+		t.Fatalf("Record was not written: %v", err)
+	}
+	written, err := LoadRecord(path)
+	if err != nil || written.BundleID != record.BundleID || len(written.Apis) != 2 {
+		t.Fatalf("Record was not correct -- expected %v but was %v (%v)", record, written, err)
+	}
+
+	if err := Rollback(target, written, true); err != nil {
+		t.Fatalf("Error rolling back: %v", err)
+	}
+	orders = dashboard.api("id-orders")
+	if orders["custom_middleware_bundle"] != "bundle-previous" || fmt.Sprint(orders["config_data"]) != "map[rateLimiting:map[active:true requests:3 seconds:15 strategy:map[name:sessionGuid]]]" {
+		t.Fatalf("Orders was not restored: %v", orders)
+	}
+	if dashboard.api(record.Apis[1].ID) != nil || mserv.count() != 1 {
+		t.Fatalf("Items and the bundle should be deleted")
+	}
+}
+
+func Test_ApplyFailure_Success(t *testing.T) {
+	target, dashboard, mserv := startTarget(t, 3)
+	recordsDir := t.TempDir()
+	// items is created before the update of orders fails
+	definitions := []iac.Definition{definitionOf("items", "Items DEV", 3), definitionOf("orders", "Orders DEV", 5)}
+
+	plan, err := NewPlan(target, definitions, newBundle(t), "RateLimitingPlugin_v5.0.3_linux_amd64_v1.0.3-dev.so")
+	if err != nil {
+		t.Fatalf("Error planning: %v", err)
+	}
+	dashboard.failing = "PUT /api/apis/id-orders"
+
+	_, err = Apply(target, plan, recordsDir)
+	if err == nil || !strings.Contains(err.Error(), "update of orders failed") || !strings.Contains(err.Error(), "the deployment was rolled back") {
+		t.Fatalf("Apply should fail and be rolled back -- expected an update error but was %v", err)
+	}
+	if len(dashboard.apis) != 1 || mserv.count() != 1 || dashboard.api("id-orders")["custom_middleware_bundle"] != "bundle-previous" {
+		t.Fatalf("Deployment was not rolled back: %v", dashboard.apis)
+	}
+	if _, err := LatestRecord(recordsDir, "dev"); err == nil {
+		t.Fatalf("No record should be written for a failed deployment")
+	}
+}
+
+func Test_ApplyUnverifiedBundle_Success(t *testing.T) {
+	target, dashboard, mserv := startTarget(t, 3)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating the key: %v", err)
+	}
+
+	plan, err := NewPlan(target, []iac.Definition{definitionOf("orders", "Orders DEV", 5)}, newBundle(t), "RateLimitingPlugin_v5.0.3_linux_amd64_v1.0.3-dev.so")
+	if err != nil {
+		t.Fatalf("Error planning: %v", err)
+	}
+	plan.PublicKey = &key.PublicKey
+
+	if _, err := Apply(target, plan, t.TempDir()); err == nil || !strings.Contains(err.Error(), "bundle verification failed: the bundle is not signed") {
+		t.Fatalf("Apply should fail before the upload -- expected an unsigned bundle but was %v", err)
+	}
+	if mserv.count() != 1 || dashboard.api("id-orders")["custom_middleware_bundle"] != "bundle-previous" {
+		t.Fatalf("Nothing should be deployed")
+	}
+
+	if err := plan.Bundle.Sign(key); err != nil {
+		t.Fatalf("Error signing the bundle: %v", err)
+	}
+	if _, err := Apply(target, plan, t.TempDir()); err != nil {
+		t.Fatalf("Error applying the signed bundle: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Mserv is the mserv file server of an environment the plugin bundles are uploaded to, e.g.
+// "https://dusty-colt-mgw.aws-use1.cloud-ara.tyk.io/mserv"
+type Mserv struct {
+	Url string
+	// token of the mserv api, sent in the X-Api-Key header
+	Token  string
+	Client *http.Client
+}
+
+// response of the mserv api
+type mservResponse struct {
+	Status  string `json:"Status"`
+	Error   string `json:"Error"`
+	Payload struct {
+		BundleID string `json:"BundleID"`
+	} `json:"Payload"`
+}
+
+const mservTimeout = 5 * time.Minute
+
+// Upload stores the bundle zip and returns the id of the bundle,
+// the value of custom_middleware_bundle in the api definitions
+func (mserv Mserv) Upload(fileName string, content []byte) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("uploadfile", fileName)
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(content); err != nil {
+		return "", err
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	var response mservResponse
+	if err := mserv.do(http.MethodPost, "/api/mw?store_only=true", form.FormDataContentType(), &body, &response); err != nil {
+		return "", err
+	}
+	if response.Payload.BundleID == "" {
+		return "", fmt.Errorf("POST %v/api/mw: no bundle id in the response: %v", mserv.Url, response.Error)
+	}
+	return response.Payload.BundleID, nil
+}
+
+// Delete deletes the bundle
+func (mserv Mserv) Delete(bundleID string) error {
+	return mserv.do(http.MethodDelete, "/api/mw/"+url.PathEscape(bundleID), "", nil, nil)
+}
+
+func (mserv Mserv) do(method string, path string, contentType string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequest(method, mserv.Url+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Api-Key", mserv.Token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	client := mserv.Client
+	if client == nil {
+		client = &http.Client{Timeout: mservTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%v %v: status %d: %s", method, mserv.Url+path, resp.StatusCode, bytes.TrimSpace(content))
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(content, result); err != nil {
+		return fmt.Errorf("%v %v: invalid response: %v", method, mserv.Url+path, err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package deploy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_Upload_Success(t *testing.T) {
+	mserv := &fakeMserv{bundles: map[string][]byte{}}
+	server := httptest.NewServer(mserv)
+	defer server.Close()
+
+	bundleID, err := Mserv{Url: server.URL + "/mserv", Token: "mserv-secret"}.Upload("bundle.zip", []byte("zip content"))
+	if err != nil {
+		t.Fatalf("Error uploading the bundle: %v", err)
+	}
+	if string(mserv.bundles[bundleID]) != "zip content" {
+		t.Fatalf("Bundle was not uploaded -- expected zip content but was %q", mserv.bundles[bundleID])
+	}
+}
+
+func Test_UploadFailure_Success(t *testing.T) {
+	mserv := httptest.NewServer(&fakeMserv{bundles: map[string][]byte{}})
+	defer mserv.Close()
+	noBundleID := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`{"Status": "error", "Error": "storage unavailable"}`))
+	}))
+	defer noBundleID.Close()
+
+	tests := []struct {
+		mserv    Mserv
+		expected string
+	}{
+		{Mserv{Url: mserv.URL + "/mserv", Token: "wrong"}, "status 401"},
+		{Mserv{Url: noBundleID.URL, Token: "mserv-secret"}, "no bundle id in the response: storage unavailable"},
+	}
+
+	for _, test := range tests {
+		if _, err := test.mserv.Upload("bundle.zip", []byte("zip content")); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("Upload should fail -- expected %q but was %v", test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package iac
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"tyk-plugin/ratelimit"
+)
+
+// go test ./iac -run Contract -update rewrites the golden files with the current results
+var update = flag.Bool("update", false, "rewrite the golden files of the contract tests")
+
+// api definitions of the repository and the fixtures and golden files of their contract
+const definitionsDir = "../../../../../iac/api-definitions"
+const contractDir = "testdata/contract"
+
+// fixture request of an api, '<api>.requests.json' holding the list of its fixtures
+type contractFixture struct {
+	Name string `json:"name"`
+	ratelimit.SampleRequest
+}
+
+// result of a fixture request for a merged definition, as written to '<api>.golden.json'
+type contractResult struct {
+	Name       string  `json:"name"`
+	Routed     bool    `json:"routed"`
+	Strategy   string  `json:"strategy"`
+	KeyID      string  `json:"keyId"`
+	Access     string  `json:"access"`
+	Override   string  `json:"override"`
+	Requests   float64 `json:"requests"`
+	Seconds    float64 `json:"seconds"`
+	SessionTtl int64   `json:"sessionTtl"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+// function returns the environments of the overrides of each base definition, an override
+// belonging to the base with the longest name it starts with (ot1-xrs-rest-copy-qae.json is
+// the qae override of ot1-xrs-rest-copy and not the copy-qae override of ot1-xrs-rest)
+func findOverrides(t *testing.T, dir string) map[string][]string {
+	basePaths, _ := filepath.Glob(filepath.Join(dir, "base", "*.json"))
+	overridePaths, _ := filepath.Glob(filepath.Join(dir, "env-overrides", "*.json"))
+	if len(basePaths) == 0 {
+		t.Fatalf("No base definition found in %v", dir)
+	}
+
+	var apis []string
+	envs := map[string][]string{}
+	for _, basePath := range basePaths {
+		api := strings.TrimSuffix(filepath.Base(basePath), ".json")
+		apis = append(apis, api)
+		envs[api] = nil
+	}
+	sort.Slice(apis, func(i, j int) bool { return len(apis[i]) > len(apis[j]) })
+
+	for _, overridePath := range overridePaths {
+		name := strings.TrimSuffix(filepath.Base(overridePath), ".json")
+		found := false
+		for _, api := range apis {
+			if strings.HasPrefix(name, api+"-") {
+				envs[api] = append(envs[api], strings.TrimPrefix(name, api+"-"))
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("Override %v has no base definition", overridePath)
+		}
+	}
+	return envs
+}
+
+// function returns the results of the fixtures for the definition, or false if the definition
+// cannot be deployed, its problems being reported and no result being locked in for it
+func runContract(t *testing.T, definition Definition, fixtures []contractFixture) ([]contractResult, bool) {
+	if problems := definition.Validate(); len(problems) != 0 {
+		for _, problem := range problems {
+			t.Logf("Skipping %v %v, it cannot be deployed: %v", definition.Api, definition.Env, problem)
+		}
+		return nil, false
+	}
+	rateLimitingConfig, err := ratelimit.ParseConfig(definition.ConfigData())
+	if err != nil {
+		t.Fatalf("Invalid config data of %v %v: %v", definition.Api, definition.Env, err)
+	}
+	listenPath, err := definition.ListenPathMatcher()
+	if err != nil {
+		t.Fatalf("Invalid listen path of %v %v: %v", definition.Api, definition.Env, err)
+	}
+
+	var results []contractResult
+	for _, fixture := range fixtures {
+		req, err := fixture.BuildRequest("localhost:8080")
+		if err != nil {
+			t.Fatalf("Invalid fixture %v of %v: %v", fixture.Name, definition.Api, err)
+		}
+		decision := ratelimit.Resolve(rateLimitingConfig, definition.RateLimitDefinition().APIID, req)
+		results = append(results, contractResult{
+			Name:       fixture.Name,
+			Routed:     listenPath != nil && listenPath.MatchString(req.URL.Path),
+			Strategy:   decision.Strategy,
+			KeyID:      decision.KeyID,
+			Access:     decision.Access,
+			Override:   ratelimit.OverrideLabel(decision.Override),
+			Requests:   decision.Requests,
+			Seconds:    decision.Seconds,
+			SessionTtl: decision.SessionTtl,
+			Error:      decision.Error,
+		})
+	}
+	return results, true
+}
+
+// function returns the differences between the expected and actual results of each environment
+func diffContract(expected map[string][]contractResult, actual map[string][]contractResult) []string {
+	envs := map[string]bool{}
+	for env := range expected {
+		envs[env] = true
+	}
+	for env := range actual {
+		envs[env] = true
+	}
+	var sortedEnvs []string
+	for env := range envs {
+		sortedEnvs = append(sortedEnvs, env)
+	}
+	sort.Strings(sortedEnvs)
+
+	var diff []string
+	for _, env := range sortedEnvs {
+		expectedResults, actualResults := expected[env], actual[env]
+		for i := 0; i < len(expectedResults) || i < len(actualResults); i++ {
+			switch {
+			case i >= len(actualResults):
+				diff = append(diff, fmt.Sprintf("%v %v: expected %+v but was missing", env, expectedResults[i].Name, expectedResults[i]))
+			case i >= len(expectedResults):
+				diff = append(diff, fmt.Sprintf("%v %v: expected nothing but was %+v", env, actualResults[i].Name, actualResults[i]))
+			case expectedResults[i] != actualResults[i]:
+				diff = append(diff, fmt.Sprintf("%v %v: expected %+v but was %+v", env, actualResults[i].Name, expectedResults[i], actualResults[i]))
+			}
+		}
+	}
+	return diff
+}
+
+func Test_ContractGolden_Success(t *testing.T) {
+	previous := ratelimit.SetClock(fixedClock(time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)))
+	defer ratelimit.SetClock(previous)
+
+	overrides := findOverrides(t, definitionsDir)
+	var apis []string
+	for api := range overrides {
+		apis = append(apis, api)
+	}
+	sort.Strings(apis)
+
+	for _, api := range apis {
+		envs := overrides[api]
+		t.Run(api, func(t *testing.T) {
+			content, err := ioutil.ReadFile(filepath.Join(contractDir, api+".requests.json"))
+			if err != nil {
+				t.Fatalf("No fixture requests for %v, every api must have '%v/%v.requests.json': %v", api, contractDir, api, err)
+			}
+			var fixtures []contractFixture
+			if err := json.Unmarshal(content, &fixtures); err != nil || len(fixtures) == 0 {
+				t.Fatalf("Invalid fixture requests for %v: %v", api, err)
+			}
+
+			results := map[string][]contractResult{}
+			for _, env := range envs {
+				definition, err := LoadDefinition(filepath.Join(definitionsDir, "base", api+".json"), filepath.Join(definitionsDir, "env-overrides", api+"-"+env+".json"))
+				if err != nil {
+					t.Fatalf("Error loading %v %v: %v", api, env, err)
+				}
+				definition.Env = env
+				if envResults, ok := runContract(t, definition, fixtures); ok {
+					results[env] = envResults
+				}
+			}
+
+			var actual bytes.Buffer
+			if err := encodeJSON(&actual, results); err != nil {
+				t.Fatalf("Error encoding the results of %v: %v", api, err)
+			}
+			goldenPath := filepath.Join(contractDir, api+".golden.json")
+			if *update {
+				if err := ioutil.WriteFile(goldenPath, actual.Bytes(), 0644); err != nil {
+					t.Fatalf("Error writing %v: %v", goldenPath, err)
+				}
+				return
+			}
+
+			content, err = ioutil.ReadFile(goldenPath)
+			if os.IsNotExist(err) {
+				t.Fatalf("No golden file for %v, run 'go test ./iac -run Contract -update' and review it", api)
+			}
+			var expected map[string][]contractResult
+			if err := json.Unmarshal(content, &expected); err != nil {
+				t.Fatalf("Invalid golden file %v: %v", goldenPath, err)
+			}
+			for _, difference := range diffContract(expected, results) {
+				t.Errorf("Result differs from %v -- %v", goldenPath, difference)
+			}
+			if !t.Failed() && !bytes.Equal(content, actual.Bytes()) {
+				t.Errorf("Golden file %v is not formatted, run 'go test ./iac -run Contract -update'", goldenPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package iac
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Dashboard is the api definitions endpoint of a Tyk Dashboard, e.g.
+// "https://dusty-colt-adm.aws-use1.cloud-ara.tyk.io/api/apis"
+type Dashboard struct {
+	Url string
+	// api key of a dashboard user, sent in the authorization header
+	ApiKey string
+	Client *http.Client
+}
+
+// response of the list and search requests of the api definitions endpoint
+type dashboardApis struct {
+	Apis []map[string]interface{} `json:"apis"`
+}
+
+// response of the create, update and delete requests
+type dashboardStatus struct {
+	Status  string `json:"Status"`
+	Message string `json:"Message"`
+	// id of the created api definition
+	Meta interface{} `json:"Meta"`
+}
+
+const dashboardTimeout = 30 * time.Second
+
+// FindApi returns the deployed definition having the name of the api definition,
+// or the same slug if none has the same name. nil is returned if the api is not deployed.
+func (dashboard Dashboard) FindApi(definition Definition) (*Definition, error) {
+	var response dashboardApis
+	if err := dashboard.do(http.MethodGet, "?q="+url.QueryEscape(definition.Name()), nil, &response); err != nil {
+		return nil, err
+	}
+
+	var sameSlug *Definition
+	for _, content := range response.Apis {
+		deployed := Definition{Api: definition.Api, Env: definition.Env, Content: content}
+		if deployed.Name() == definition.Name() {
+			return &deployed, nil
+		}
+		if deployed.slug() != "" && deployed.slug() == definition.slug() && sameSlug == nil {
+			sameSlug = &deployed
+		}
+	}
+	return sameSlug, nil
+}
+
+// CreateApi creates the api definition and returns its dashboard id
+func (dashboard Dashboard) CreateApi(definition Definition) (string, error) {
+	var response dashboardStatus
+	if err := dashboard.do(http.MethodPost, "", definition.Content, &response); err != nil {
+		return "", err
+	}
+	id, _ := response.Meta.(string)
+	if id == "" {
+		return "", fmt.Errorf("POST %v: no id in the response: %v", dashboard.Url, response.Message)
+	}
+	return id, nil
+}
+
+// UpdateApi replaces the api definition having the dashboard id
+func (dashboard Dashboard) UpdateApi(id string, definition Definition) error {
+	return dashboard.do(http.MethodPut, "/"+url.PathEscape(id), definition.Content, nil)
+}
+
+// DeleteApi deletes the api definition having the dashboard id
+func (dashboard Dashboard) DeleteApi(id string) error {
+	return dashboard.do(http.MethodDelete, "/"+url.PathEscape(id), nil, nil)
+}
+
+// function sends the request to the endpoint, the path being added to its url,
+// and decodes the json response into the result unless it is nil
+func (dashboard Dashboard) do(method string, path string, body interface{}, result interface{}) error {
+	var requestBody bytes.Buffer
+	if body != nil {
+		if err := encodeJSON(&requestBody, body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, dashboard.Url+path, &requestBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("authorization", dashboard.ApiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := dashboard.Client
+	if client == nil {
+		client = &http.Client{Timeout: dashboardTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%v %v: status %d: %s", method, dashboard.Url+path, resp.StatusCode, bytes.TrimSpace(content))
+	}
+	if result == nil {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	if err := decoder.Decode(result); err != nil {
+		return fmt.Errorf("%v %v: invalid response: %v", method, dashboard.Url+path, err)
+	}
+	return nil
+}
+
+func (definition Definition) slug() string {
+	slug, _ := definition.ApiDefinition()["slug"].(string)
+	return slug
+}
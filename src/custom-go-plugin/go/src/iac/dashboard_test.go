@@ -0,0 +1,66 @@
+package iac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// function starts a stub of the api definitions endpoint of the dashboard
+// answering the search requests with the given apis
+func startDashboard(t *testing.T, apis string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("authorization") != "secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			rw.Write([]byte(`{"Status": "Error", "Message": "Not authorised"}`))
+			return
+		}
+		if r.Method != http.MethodGet || r.URL.Path != "/api/apis" || r.URL.Query().Get("q") != "Orders DEV" {
+			t.Errorf("Unexpected request %v %v", r.Method, r.URL)
+		}
+		rw.Write([]byte(`{"apis": [` + apis + `], "pages": 1}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func Test_FindApi_Success(t *testing.T) {
+	definition := definitionOf(t, `{"api_definition": {"name": "Orders DEV", "slug": "orders-dev"}}`)
+
+	tests := []struct {
+		apis     string
+		expected string
+	}{
+		{`{"api_definition": {"api_id": "1", "name": "Orders DEV 2"}}, {"api_definition": {"api_id": "2", "name": "Orders DEV"}}`, "2"},
+		{`{"api_definition": {"api_id": "1", "name": "Orders", "slug": "orders-dev"}}`, "1"},
+		{`{"api_definition": {"api_id": "1", "name": "Orders DEV 2", "slug": "orders-dev-2"}}`, ""},
+	}
+
+	for _, test := range tests {
+		server := startDashboard(t, test.apis)
+		dashboard := Dashboard{Url: server.URL + "/api/apis", ApiKey: "secret"}
+
+		deployed, err := dashboard.FindApi(definition)
+		if err != nil {
+			t.Fatalf("Error finding the api: %v", err)
+		}
+		apiID := ""
+		if deployed != nil {
+			apiID = deployed.ApiID()
+		}
+		if apiID != test.expected {
+			t.Fatalf("Deployed api was not correct -- expected %q but was %q", test.expected, apiID)
+		}
+	}
+}
+
+func Test_FindApiUnauthorized_Success(t *testing.T) {
+	server := startDashboard(t, "")
+	dashboard := Dashboard{Url: server.URL + "/api/apis", ApiKey: "wrong"}
+
+	_, err := dashboard.FindApi(definitionOf(t, `{"api_definition": {"name": "Orders DEV"}}`))
+	if err == nil || !strings.Contains(err.Error(), "status 401") {
+		t.Fatalf("An unauthorized error was expected but was %v", err)
+	}
+}
@@ -0,0 +1,359 @@
+package iac
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"tyk-plugin/ratelimit"
+)
+
+// Definition is an api definition file, merged with an env override if any
+type Definition struct {
+	// name of the base definition file without extension, e.g. "ot1-xrs-soap"
+	Api string
+	// environment of the override, empty for a base definition alone
+	Env          string
+	BasePath     string
+	OverridePath string
+	Content      map[string]interface{}
+}
+
+// Environment is an environment of env-values.json
+type Environment struct {
+	Name              string `json:"name"`
+	ApiDefEndpointUrl string `json:"apiDefEndpointUrl"`
+	MservFileServer   string `json:"mservFileServer"`
+}
+
+// manifest written along with the definitions of an environment, listing the
+// apis which have no override for the environment and were not built
+type environmentManifest struct {
+	Environment
+	Definitions []string `json:"definitions"`
+	Missing     []string `json:"missing,omitempty"`
+}
+
+// prefixes of the keys of env-values.json, followed by the environment name
+const apiDefEndpointUrlPrefix = "Tyk_ApiDefEndpoint_Url_"
+const mservFileServerPrefix = "Tyk_MservFileServer_"
+
+// name of the manifest written in the output directory of each environment
+const ManifestFile = "environment.json"
+
+// LoadDefinition returns the base definition merged with the env override, if any,
+// using the default array rules
+func LoadDefinition(basePath string, overridePath string) (Definition, error) {
+	definition := Definition{
+		Api:          strings.TrimSuffix(filepath.Base(basePath), filepath.Ext(basePath)),
+		BasePath:     basePath,
+		OverridePath: overridePath,
+	}
+
+	base, err := readJSON(basePath)
+	if err != nil {
+		return definition, err
+	}
+	merged := base
+	if overridePath != "" {
+		override, err := readJSON(overridePath)
+		if err != nil {
+			return definition, err
+		}
+		merged, err = Merge(base, override, DefaultArrayRules)
+		if err != nil {
+			return definition, fmt.Errorf("cannot merge %v into %v: %v", overridePath, basePath, err)
+		}
+	}
+
+	content, ok := merged.(map[string]interface{})
+	if !ok {
+		return definition, fmt.Errorf("%v is not a json object", basePath)
+	}
+	definition.Content = content
+	return definition, nil
+}
+
+// FindDefinitions returns the definitions of the environment found in the directory
+// (iac/api-definitions), merged with their override, along with the apis which have
+// no override for the environment, which cannot be deployed to it and are reported
+// by the callers.
+func FindDefinitions(dir string, env string) ([]Definition, []string, error) {
+	basePaths, err := filepath.Glob(filepath.Join(dir, "base", "*.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(basePaths)
+
+	var definitions []Definition
+	var missing []string
+	for _, basePath := range basePaths {
+		api := strings.TrimSuffix(filepath.Base(basePath), ".json")
+		overridePath := filepath.Join(dir, "env-overrides", api+"-"+env+".json")
+		if _, err := os.Stat(overridePath); os.IsNotExist(err) {
+			missing = append(missing, api)
+			continue
+		}
+
+		definition, err := LoadDefinition(basePath, overridePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		definition.Env = env
+		definitions = append(definitions, definition)
+	}
+	return definitions, missing, nil
+}
+
+// ApiDefinition returns the "api_definition" object of the definition
+func (definition Definition) ApiDefinition() map[string]interface{} {
+	apiDefinition, _ := definition.Content["api_definition"].(map[string]interface{})
+	return apiDefinition
+}
+
+// ID returns the dashboard "id" of the api definition, only set on deployed definitions
+func (definition Definition) ID() string {
+	id, _ := definition.ApiDefinition()["id"].(string)
+	return id
+}
+
+// ApiID returns the "api_id" of the api definition
+func (definition Definition) ApiID() string {
+	apiID, _ := definition.ApiDefinition()["api_id"].(string)
+	return apiID
+}
+
+// Name returns the "name" of the api definition
+func (definition Definition) Name() string {
+	name, _ := definition.ApiDefinition()["name"].(string)
+	return name
+}
+
+// ConfigData returns the "config_data" of the api definition
+func (definition Definition) ConfigData() interface{} {
+	return definition.ApiDefinition()["config_data"]
+}
+
+// ListenPath returns the "proxy.listen_path" of the api definition
+func (definition Definition) ListenPath() string {
+	listenPath, _ := definition.proxy()["listen_path"].(string)
+	return listenPath
+}
+
+// TargetUrl returns the "proxy.target_url" of the api definition, the upstream of the api
+func (definition Definition) TargetUrl() string {
+	targetUrl, _ := definition.proxy()["target_url"].(string)
+	return targetUrl
+}
+
+// StripListenPath returns the "proxy.strip_listen_path" of the api definition, whether the
+// listen path is removed from the path of the requests passed to the upstream
+func (definition Definition) StripListenPath() bool {
+	strip, _ := definition.proxy()["strip_listen_path"].(bool)
+	return strip
+}
+
+// PreserveHostHeader returns the "proxy.preserve_host_header" of the api definition, whether
+// the requests are passed to the upstream with their Host header rather than the upstream one
+func (definition Definition) PreserveHostHeader() bool {
+	preserve, _ := definition.proxy()["preserve_host_header"].(bool)
+	return preserve
+}
+
+// function returns the "proxy" object of the api definition
+func (definition Definition) proxy() map[string]interface{} {
+	proxy, _ := definition.ApiDefinition()["proxy"].(map[string]interface{})
+	return proxy
+}
+
+// RateLimitDefinition returns the api definition as seen by the rate limiting, the api
+// being identified by its api_id or, if it has none yet, by the name of its iac files
+func (definition Definition) RateLimitDefinition() ratelimit.ApiDefinition {
+	apiID := definition.ApiID()
+	if apiID == "" {
+		apiID = definition.Api
+	}
+	configData, _ := definition.ConfigData().(map[string]interface{})
+	return ratelimit.ApiDefinition{APIID: apiID, Name: definition.Name(), ListenPath: definition.ListenPath(), ConfigData: configData}
+}
+
+// WithFields returns a copy of the definition with the fields of its api_definition set to the values
+func (definition Definition) WithFields(fields map[string]interface{}) Definition {
+	content := copyValue(definition.Content).(map[string]interface{})
+	apiDefinition, ok := content["api_definition"].(map[string]interface{})
+	if !ok {
+		apiDefinition = map[string]interface{}{}
+		content["api_definition"] = apiDefinition
+	}
+	for field, value := range fields {
+		apiDefinition[field] = value
+	}
+	definition.Content = content
+	return definition
+}
+
+// Encode writes the indented json of the definition
+func (definition Definition) Encode(w io.Writer) error {
+	return encodeJSON(w, definition.Content)
+}
+
+// Validate returns the problems found in the definition, none if it can be deployed
+func (definition Definition) Validate() []error {
+	apiDefinition := definition.ApiDefinition()
+	if apiDefinition == nil {
+		return []error{errors.New("api_definition is required")}
+	}
+
+	var problems []error
+	for _, field := range []string{"name", "slug"} {
+		if value, _ := apiDefinition[field].(string); value == "" {
+			problems = append(problems, fmt.Errorf("api_definition.%v is required", field))
+		}
+	}
+	proxy, _ := apiDefinition["proxy"].(map[string]interface{})
+	for _, field := range []string{"listen_path", "target_url"} {
+		if value, _ := proxy[field].(string); value == "" {
+			problems = append(problems, fmt.Errorf("api_definition.proxy.%v is required", field))
+		}
+	}
+	if _, err := definition.ListenPathMatcher(); err != nil {
+		problems = append(problems, fmt.Errorf("api_definition.proxy.listen_path: %v", err))
+	}
+
+	configData, _ := apiDefinition["config_data"].(map[string]interface{})
+	rateLimiting, ok := configData["rateLimiting"]
+	if !ok {
+		return append(problems, errors.New("api_definition.config_data.rateLimiting is required"))
+	}
+
+	// the plugin ignores the unknown fields, a misspelled field would silently be left out
+	content, err := json.Marshal(rateLimiting)
+	if err != nil {
+		return append(problems, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	var rateLimitingConfig ratelimit.RateLimitingConfig
+	if err := decoder.Decode(&rateLimitingConfig.RateLimiting); err != nil {
+		return append(problems, fmt.Errorf("api_definition.config_data.rateLimiting: %v", err))
+	}
+	for _, problem := range ratelimit.Validate(rateLimitingConfig) {
+		problems = append(problems, fmt.Errorf("api_definition.config_data.rateLimiting: %v", problem))
+	}
+	return problems
+}
+
+// LoadEnvironments returns the environments of env-values.json, sorted by name
+func LoadEnvironments(path string) ([]Environment, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]string
+	if err := json.Unmarshal(content, &values); err != nil {
+		return nil, fmt.Errorf("invalid json in %v: %v", path, err)
+	}
+
+	environments := map[string]*Environment{}
+	environment := func(name string) *Environment {
+		if environments[name] == nil {
+			environments[name] = &Environment{Name: name}
+		}
+		return environments[name]
+	}
+	for key, value := range values {
+		switch {
+		case strings.HasPrefix(key, apiDefEndpointUrlPrefix):
+			environment(strings.TrimPrefix(key, apiDefEndpointUrlPrefix)).ApiDefEndpointUrl = value
+		case strings.HasPrefix(key, mservFileServerPrefix):
+			environment(strings.TrimPrefix(key, mservFileServerPrefix)).MservFileServer = value
+		}
+	}
+
+	result := make([]Environment, 0, len(environments))
+	for _, env := range environments {
+		result = append(result, *env)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// Build writes the definitions of the environment found in the directory to
+// '<outDir>/<env>/<api>.json', along with a manifest of the environment, and returns
+// them with the apis which have no override for the environment.
+// Nothing is written unless all the definitions are valid.
+func Build(dir string, env Environment, outDir string) ([]Definition, []string, error) {
+	definitions, missing, err := FindDefinitions(dir, env.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var problems []string
+	for _, definition := range definitions {
+		for _, problem := range definition.Validate() {
+			problems = append(problems, fmt.Sprintf("%v (%v): %v", definition.Api, env.Name, problem))
+		}
+	}
+	if len(problems) > 0 {
+		return definitions, missing, errors.New("invalid definitions:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	envDir := filepath.Join(outDir, env.Name)
+	if err := os.MkdirAll(envDir, 0755); err != nil {
+		return definitions, missing, err
+	}
+
+	manifest := environmentManifest{Environment: env, Definitions: []string{}, Missing: missing}
+	for _, definition := range definitions {
+		fileName := definition.Api + ".json"
+		if err := writeJSON(filepath.Join(envDir, fileName), definition.Content); err != nil {
+			return definitions, missing, err
+		}
+		manifest.Definitions = append(manifest.Definitions, fileName)
+	}
+	return definitions, missing, writeJSON(filepath.Join(envDir, ManifestFile), manifest)
+}
+
+func readJSON(path string) (interface{}, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// numbers are kept as written rather than converted to float64
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid json in %v: %v", path, err)
+	}
+	return value, nil
+}
+
+func writeJSON(path string, value interface{}) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := encodeJSON(file, value); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// function writes the indented json of the value, leaving '<', '>' and '&' unescaped
+func encodeJSON(w io.Writer, value interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
@@ -0,0 +1,186 @@
+package iac
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const baseDefinition = `{
+  "api_definition": {
+    "api_id": "",
+    "name": "Orders",
+    "slug": "orders",
+    "proxy": {"listen_path": "/orders/", "target_url": ""},
+    "config_data": {
+      "rateLimiting": {
+        "LogLevel": 0,
+        "active": true,
+        "requests": 3,
+        "seconds": 15,
+        "sessionTtlMin": 1440,
+        "overrides": [{"method": "GET", "resource": "/ping", "requests": -1, "seconds": -1}],
+        "strategy": {"name": "requestHeaders", "config": {"headerNames": ["x-tenant-id"], "separator": "::"}}
+      }
+    }
+  }
+}`
+
+func writeFile(t *testing.T, path string, content string) string {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Error creating %v: %v", filepath.Dir(path), err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Error writing %v: %v", path, err)
+	}
+	return path
+}
+
+// function creates an api-definitions directory with the orders api, its dev override
+// and an override of an environment missing from env-values.json
+func buildDefinitionsDir(t *testing.T, devOverride string) string {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "base", "orders.json"), baseDefinition)
+	writeFile(t, filepath.Join(dir, "env-overrides", "orders-dev.json"), devOverride)
+	writeFile(t, filepath.Join(dir, "env-overrides", "orders-te-prod.json"), `{"api_definition": {"name": "Orders TE"}}`)
+	return dir
+}
+
+func Test_LoadDefinition_Success(t *testing.T) {
+	dir := buildDefinitionsDir(t, `{"api_definition": {"name": "Orders DEV", "proxy": {"target_url": "https://orders.dev"}}}`)
+
+	definition, err := LoadDefinition(filepath.Join(dir, "base", "orders.json"), filepath.Join(dir, "env-overrides", "orders-dev.json"))
+	if err != nil {
+		t.Fatalf("Error loading the definition: %v", err)
+	}
+	if definition.Api != "orders" || definition.Name() != "Orders DEV" {
+		t.Fatalf("Definition was not correct -- expected orders (Orders DEV) but was %v (%v)", definition.Api, definition.Name())
+	}
+	if problems := definition.Validate(); len(problems) != 0 {
+		t.Fatalf("Definition should be valid -- expected no problems but was %v", problems)
+	}
+	rateLimitDefinition := definition.RateLimitDefinition()
+	if definition.ListenPath() != "/orders/" || rateLimitDefinition.APIID != "orders" || rateLimitDefinition.Name != "Orders DEV" || rateLimitDefinition.ConfigData["rateLimiting"] == nil {
+		t.Fatalf("Rate limiting definition was not correct -- expected orders (Orders DEV) on /orders/ but was %v on %v", rateLimitDefinition, definition.ListenPath())
+	}
+	if definition.TargetUrl() != "https://orders.dev" || definition.StripListenPath() || definition.PreserveHostHeader() {
+		t.Fatalf("Proxy was not correct -- expected https://orders.dev but was %v", definition.TargetUrl())
+	}
+
+	var expected interface{}
+	json.Unmarshal([]byte(`{"rateLimiting": {"LogLevel": 0, "active": true, "requests": 3, "seconds": 15, "sessionTtlMin": 1440,
+		"overrides": [{"method": "GET", "resource": "/ping", "requests": -1, "seconds": -1}],
+		"strategy": {"name": "requestHeaders", "config": {"headerNames": ["x-tenant-id"], "separator": "::"}}}}`), &expected)
+	content, _ := json.Marshal(definition.ConfigData())
+	var configData interface{}
+	json.Unmarshal(content, &configData)
+	if !reflect.DeepEqual(configData, expected) {
+		t.Fatalf("Config data was not correct -- expected %v but was %v", expected, configData)
+	}
+}
+
+func Test_ValidateDefinition_Success(t *testing.T) {
+	tests := []struct {
+		override string
+		expected []string
+	}{
+		{`{"api_definition": {"name": "", "proxy": {"target_url": "https://orders.dev"}}}`, []string{"api_definition.name is required"}},
+		{`{"api_definition": {"name": "Orders DEV"}}`, []string{"api_definition.proxy.target_url is required"}},
+		{`{"api_definition": {"proxy": {"target_url": "https://orders.dev"}, "config_data": {"rateLimiting": {"overides": []}}}}`, []string{`unknown field "overides"`}},
+		{`{"api_definition": {"proxy": {"target_url": "https://orders.dev"}, "config_data": {"rateLimiting": {"strategy": {"name": "sessionGUID"}}}}}`, []string{`unknown strategy name "sessionGUID"`}},
+		{`{"api_definition": {"proxy": {"target_url": "https://orders.dev"}, "config_data": null}}`, []string{"api_definition.config_data.rateLimiting is required"}},
+	}
+
+	for _, test := range tests {
+		dir := buildDefinitionsDir(t, test.override)
+		definition, err := LoadDefinition(filepath.Join(dir, "base", "orders.json"), filepath.Join(dir, "env-overrides", "orders-dev.json"))
+		if err != nil {
+			t.Fatalf("Error loading the definition: %v", err)
+		}
+
+		problems := definition.Validate()
+		if len(problems) != len(test.expected) {
+			t.Fatalf("%v -- expected %v but was %v", test.override, test.expected, problems)
+		}
+		for i, problem := range problems {
+			if !strings.Contains(problem.Error(), test.expected[i]) {
+				t.Fatalf("%v -- expected %v but was %v", test.override, test.expected, problems)
+			}
+		}
+	}
+}
+
+func Test_LoadEnvironments_Success(t *testing.T) {
+	path := writeFile(t, filepath.Join(t.TempDir(), "env-values.json"), `{
+		"Tyk_ApiDefEndpoint_Url_qae": "https://qae-adm/api/apis",
+		"Tyk_MservFileServer_qae": "https://qae-mgw/mserv",
+		"Tyk_ApiDefEndpoint_Url_dev": "https://dev-adm/api/apis",
+		"Tyk_MservFileServer_dev": "https://dev-mgw/mserv",
+		"Tyk_ApiDefEndpoint_Url_prod": ""
+	}`)
+
+	environments, err := LoadEnvironments(path)
+	if err != nil {
+		t.Fatalf("Error loading the environments: %v", err)
+	}
+	expected := []Environment{
+		{Name: "dev", ApiDefEndpointUrl: "https://dev-adm/api/apis", MservFileServer: "https://dev-mgw/mserv"},
+		{Name: "prod"},
+		{Name: "qae", ApiDefEndpointUrl: "https://qae-adm/api/apis", MservFileServer: "https://qae-mgw/mserv"},
+	}
+	if !reflect.DeepEqual(environments, expected) {
+		t.Fatalf("Environments were not correct -- expected %v but was %v", expected, environments)
+	}
+}
+
+func Test_Build_Success(t *testing.T) {
+	dir := buildDefinitionsDir(t, `{"api_definition": {"name": "Orders DEV", "proxy": {"target_url": "https://orders.dev/?a=1&b=2"}}}`)
+	// no dev override
+	writeFile(t, filepath.Join(dir, "base", "invoices.json"), baseDefinition)
+	outDir := t.TempDir()
+	env := Environment{Name: "dev", ApiDefEndpointUrl: "https://dev-adm/api/apis"}
+
+	definitions, missing, err := Build(dir, env, outDir)
+	if err != nil {
+		t.Fatalf("Error building the definitions: %v", err)
+	}
+	if len(definitions) != 1 || definitions[0].Env != "dev" {
+		t.Fatalf("Definitions were not correct -- expected the dev definition of orders but was %v", definitions)
+	}
+	if !reflect.DeepEqual(missing, []string{"invoices"}) {
+		t.Fatalf("Missing overrides were not correct -- expected [invoices] but was %v", missing)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(outDir, "dev", "orders.json"))
+	if err != nil {
+		t.Fatalf("Definition was not written: %v", err)
+	}
+	if !strings.Contains(string(content), `"target_url": "https://orders.dev/?a=1&b=2"`) || !strings.Contains(string(content), `"requests": 3,`) {
+		t.Fatalf("Definition was not correct:\n%v", content)
+	}
+
+	var manifest environmentManifest
+	content, _ = ioutil.ReadFile(filepath.Join(outDir, "dev", ManifestFile))
+	json.Unmarshal(content, &manifest)
+	expected := environmentManifest{Environment: env, Definitions: []string{"orders.json"}, Missing: []string{"invoices"}}
+	if !reflect.DeepEqual(manifest, expected) {
+		t.Fatalf("Manifest was not correct -- expected %v but was %v", expected, manifest)
+	}
+}
+
+func Test_BuildInvalidDefinition_Success(t *testing.T) {
+	dir := buildDefinitionsDir(t, `{"api_definition": {"name": "Orders DEV"}}`)
+	outDir := t.TempDir()
+
+	_, _, err := Build(dir, Environment{Name: "dev"}, outDir)
+	if err == nil || !strings.Contains(err.Error(), "orders (dev): api_definition.proxy.target_url is required") {
+		t.Fatalf("Build should fail -- expected an invalid target_url but was %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "dev")); !os.IsNotExist(err) {
+		t.Fatalf("Nothing should be written for invalid definitions")
+	}
+}
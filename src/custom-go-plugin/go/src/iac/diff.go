@@ -0,0 +1,332 @@
+package iac
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// kinds of the differences between the expected and the deployed definitions
+const (
+	// the field is in the iac files but not in the deployed definition
+	ChangeMissing = "-"
+	// the field is only in the deployed definition
+	ChangeUnexpected = "+"
+	// the field has a different value
+	ChangeModified = "~"
+	// the items of an array merged by key are in a different order
+	ChangeReordered = "order"
+)
+
+// Change is a difference between the expected and the deployed api definition
+type Change struct {
+	Kind string
+	// path of the field from the api_definition object, the items of the arrays merged by key
+	// being identified by their keys, e.g. "config_data.rateLimiting.overrides[GET /ping].requests"
+	Path     string
+	Expected interface{}
+	Deployed interface{}
+}
+
+// Drift is the result of the comparison of a definition with the deployed one
+type Drift struct {
+	Definition Definition
+	// false if the api is not deployed
+	Deployed bool
+	// changes of the rate limiting config and of the rest of the api definition
+	RateLimiting []Change
+	Other        []Change
+}
+
+// fields of the api definition set by the dashboard or by the deployment
+var DriftIgnoredPaths = map[string]bool{
+	"id":                       true,
+	"api_id":                   true,
+	"custom_middleware_bundle": true,
+}
+
+const rateLimitingPath = "config_data.rateLimiting"
+
+// Diff compares the api definition of the iac files with the deployed one, nil if not deployed.
+// Only the api_definition objects are compared. The fields the dashboard adds with an empty
+// value are left out, as well as the ones of DriftIgnoredPaths.
+func Diff(definition Definition, deployed *Definition) Drift {
+	drift := Drift{Definition: definition, Deployed: deployed != nil}
+	if deployed == nil {
+		return drift
+	}
+
+	var changes []Change
+	diffValues("", definition.ApiDefinition(), deployed.ApiDefinition(), &changes)
+
+	for _, change := range changes {
+		if change.Path == rateLimitingPath || strings.HasPrefix(change.Path, rateLimitingPath+".") || strings.HasPrefix(change.Path, rateLimitingPath+"[") {
+			drift.RateLimiting = append(drift.RateLimiting, change)
+		} else {
+			drift.Other = append(drift.Other, change)
+		}
+	}
+	return drift
+}
+
+// InSync returns whether the deployed definition is the one of the iac files
+func (drift Drift) InSync() bool {
+	return drift.Deployed && len(drift.RateLimiting) == 0 && len(drift.Other) == 0
+}
+
+// Print writes the status and the changes of the drift
+func (drift Drift) Print(w io.Writer) {
+	status := "in sync"
+	switch {
+	case !drift.Deployed:
+		status = "not deployed"
+	case !drift.InSync():
+		status = "drifted"
+	}
+	fmt.Fprintf(w, "%v (%v): %v\n", drift.Definition.Api, drift.Definition.Name(), status)
+	drift.PrintChanges(w, "  ")
+}
+
+// PrintChanges writes the changes of the drift with the given indentation, the paths
+// of the rate limiting changes being relative to the rateLimiting object
+func (drift Drift) PrintChanges(w io.Writer, indent string) {
+	if len(drift.RateLimiting) > 0 {
+		fmt.Fprintf(w, "%vrate limiting:\n", indent)
+		for _, change := range drift.RateLimiting {
+			change.Path = strings.TrimPrefix(strings.TrimPrefix(change.Path, rateLimitingPath), ".")
+			fmt.Fprintf(w, "%v  %v\n", indent, change)
+		}
+	}
+	if len(drift.Other) > 0 {
+		fmt.Fprintf(w, "%vapi definition:\n", indent)
+		for _, change := range drift.Other {
+			fmt.Fprintf(w, "%v  %v\n", indent, change)
+		}
+	}
+}
+
+func (change Change) String() string {
+	path := change.Path
+	if path == "" {
+		path = "rateLimiting"
+	}
+	switch change.Kind {
+	case ChangeMissing:
+		return fmt.Sprintf("- %v: %v", path, formatValue(change.Expected))
+	case ChangeUnexpected:
+		return fmt.Sprintf("+ %v: %v", path, formatValue(change.Deployed))
+	case ChangeReordered:
+		return fmt.Sprintf("~ %v: order %v -> %v", path, formatValue(change.Expected), formatValue(change.Deployed))
+	}
+	return fmt.Sprintf("~ %v: %v -> %v", path, formatValue(change.Expected), formatValue(change.Deployed))
+}
+
+func diffValues(path string, expected interface{}, deployed interface{}, changes *[]Change) {
+	if DriftIgnoredPaths[path] {
+		return
+	}
+
+	expectedObject, expectedIsObject := expected.(map[string]interface{})
+	deployedObject, deployedIsObject := deployed.(map[string]interface{})
+	if expectedIsObject && deployedIsObject {
+		keys := make([]string, 0, len(expectedObject)+len(deployedObject))
+		for key := range expectedObject {
+			keys = append(keys, key)
+		}
+		for key := range deployedObject {
+			if _, ok := expectedObject[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			childPath := joinPath(path, key)
+			expectedValue, inExpected := expectedObject[key]
+			deployedValue, inDeployed := deployedObject[key]
+			switch {
+			case DriftIgnoredPaths[childPath]:
+			case !inDeployed:
+				*changes = append(*changes, Change{Kind: ChangeMissing, Path: childPath, Expected: expectedValue})
+			case !inExpected:
+				if !isEmptyValue(deployedValue) {
+					*changes = append(*changes, Change{Kind: ChangeUnexpected, Path: childPath, Deployed: deployedValue})
+				}
+			default:
+				diffValues(childPath, expectedValue, deployedValue, changes)
+			}
+		}
+		return
+	}
+
+	expectedArray, expectedIsArray := expected.([]interface{})
+	deployedArray, deployedIsArray := deployed.([]interface{})
+	if rule, ok := DefaultArrayRules["api_definition."+arrayRulePath(path)]; ok && rule.Mode == ArrayMergeByKey && expectedIsArray && deployedIsArray {
+		diffArraysByKey(path, expectedArray, deployedArray, rule.Keys, changes)
+		return
+	}
+
+	if !equalValues(expected, deployed) {
+		*changes = append(*changes, Change{Kind: ChangeModified, Path: path, Expected: expected, Deployed: deployed})
+	}
+}
+
+// function compares the items having the same keys, whatever their position
+func diffArraysByKey(path string, expected []interface{}, deployed []interface{}, keys []string, changes *[]Change) {
+	var expectedOrder, deployedOrder []string
+	matched := make([]bool, len(deployed))
+
+	for _, expectedItem := range expected {
+		expectedObject, _ := expectedItem.(map[string]interface{})
+		label := itemLabel(expectedObject, keys)
+		itemPath := path + "[" + label + "]"
+
+		index := -1
+		for i, deployedItem := range deployed {
+			deployedObject, ok := deployedItem.(map[string]interface{})
+			if ok && !matched[i] && expectedObject != nil && sameKeys(expectedObject, deployedObject, keys) {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			*changes = append(*changes, Change{Kind: ChangeMissing, Path: itemPath, Expected: expectedItem})
+			continue
+		}
+		matched[index] = true
+		expectedOrder = append(expectedOrder, label)
+		diffValues(itemPath, expectedItem, deployed[index], changes)
+	}
+
+	for i, deployedItem := range deployed {
+		deployedObject, _ := deployedItem.(map[string]interface{})
+		if matched[i] {
+			deployedOrder = append(deployedOrder, itemLabel(deployedObject, keys))
+			continue
+		}
+		*changes = append(*changes, Change{Kind: ChangeUnexpected, Path: path + "[" + itemLabel(deployedObject, keys) + "]", Deployed: deployedItem})
+	}
+
+	// the first matching override applies, the order of the items matters
+	if !reflect.DeepEqual(expectedOrder, deployedOrder) {
+		*changes = append(*changes, Change{Kind: ChangeReordered, Path: path, Expected: expectedOrder, Deployed: deployedOrder})
+	}
+}
+
+// function returns the values of the keys of the item, e.g. "GET /ping"
+func itemLabel(item map[string]interface{}, keys []string) string {
+	var values []string
+	for _, key := range keys {
+		if value := item[key]; value != nil && value != "" {
+			values = append(values, fmt.Sprint(value))
+		}
+	}
+	return strings.Join(values, " ")
+}
+
+// function returns the path of the array rules, the keys of the items being replaced by "[]"
+func arrayRulePath(path string) string {
+	var result strings.Builder
+	depth := 0
+	for _, c := range path {
+		switch {
+		case c == '[':
+			if depth == 0 {
+				result.WriteString("[]")
+			}
+			depth++
+		case c == ']':
+			depth--
+		case depth == 0:
+			result.WriteRune(c)
+		}
+	}
+	return result.String()
+}
+
+// function compares the json values, numbers being compared by value
+// whether they were decoded as float64 or json.Number or are ints
+func equalValues(expected interface{}, deployed interface{}) bool {
+	expectedNumber, expectedIsNumber := toNumber(expected)
+	deployedNumber, deployedIsNumber := toNumber(deployed)
+	if expectedIsNumber && deployedIsNumber {
+		return expectedNumber.Cmp(deployedNumber) == 0
+	}
+
+	expectedArray, expectedIsArray := expected.([]interface{})
+	deployedArray, deployedIsArray := deployed.([]interface{})
+	if expectedIsArray && deployedIsArray {
+		if len(expectedArray) != len(deployedArray) {
+			return false
+		}
+		for i := range expectedArray {
+			if !equalValues(expectedArray[i], deployedArray[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	expectedObject, expectedIsObject := expected.(map[string]interface{})
+	deployedObject, deployedIsObject := deployed.(map[string]interface{})
+	if expectedIsObject && deployedIsObject {
+		if len(expectedObject) != len(deployedObject) {
+			return false
+		}
+		for key, value := range expectedObject {
+			if deployedValue, ok := deployedObject[key]; !ok || !equalValues(value, deployedValue) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(expected, deployed)
+}
+
+func toNumber(value interface{}) (*big.Float, bool) {
+	switch number := value.(type) {
+	case json.Number:
+		parsed, ok := new(big.Float).SetString(string(number))
+		return parsed, ok
+	case float64:
+		return big.NewFloat(number), true
+	case int:
+		return big.NewFloat(float64(number)), true
+	}
+	return nil, false
+}
+
+// function checks whether the value is the zero value of its json type
+func isEmptyValue(value interface{}) bool {
+	if number, ok := toNumber(value); ok {
+		return number.Sign() == 0
+	}
+	switch typedValue := value.(type) {
+	case nil:
+		return true
+	case string:
+		return typedValue == ""
+	case bool:
+		return !typedValue
+	case []interface{}:
+		return len(typedValue) == 0
+	case map[string]interface{}:
+		return len(typedValue) == 0
+	}
+	return false
+}
+
+func formatValue(value interface{}) string {
+	var content strings.Builder
+	encoder := json.NewEncoder(&content)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return fmt.Sprint(value)
+	}
+	return strings.TrimSpace(content.String())
+}
@@ -0,0 +1,67 @@
+package iac
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func definitionOf(t *testing.T, content string) Definition {
+	return Definition{Api: "orders", Env: "dev", Content: decode(t, content).(map[string]interface{})}
+}
+
+func Test_DiffInSync_Success(t *testing.T) {
+	definition := definitionOf(t, `{"api_definition": {"name": "Orders DEV", "api_id": "", "custom_middleware_bundle": "",
+		"config_data": {"rateLimiting": {"requests": 3, "seconds": 15}}}}`)
+	// ids and bundle set by the dashboard and the deployment, empty fields added by the dashboard
+	deployed := definitionOf(t, `{"api_definition": {"name": "Orders DEV", "api_id": "7f1c", "id": "65a0", "custom_middleware_bundle": "d793c617",
+		"config_data": {"rateLimiting": {"requests": 3.0, "seconds": 15}}, "tags": [], "domain": ""}, "created_at": "2024-03-13T12:00:00Z"}`)
+
+	drift := Diff(definition, &deployed)
+	if !drift.InSync() {
+		t.Fatalf("Definitions should be in sync -- expected no changes but was %v %v", drift.RateLimiting, drift.Other)
+	}
+}
+
+func Test_DiffDrifted_Success(t *testing.T) {
+	definition := definitionOf(t, `{"api_definition": {"name": "Orders DEV", "proxy": {"target_url": "https://orders.dev", "listen_path": "/orders/"},
+		"config_data": {"rateLimiting": {"requests": 3, "seconds": 15, "overrides": [
+			{"method": "GET", "resource": "/ping", "requests": -1, "seconds": -1},
+			{"method": "POST", "resource": "/orders", "requests": 1, "seconds": 60},
+			{"method": "POST", "resource": "/soap", "soapOperation": "SaveRoutes", "requests": 5, "seconds": 60}
+		]}}}}`)
+	deployed := definitionOf(t, `{"api_definition": {"name": "Orders DEV", "proxy": {"target_url": "https://orders.qae", "listen_path": "/orders/"}, "active": true,
+		"config_data": {"rateLimiting": {"requests": 5, "seconds": 15, "overrides": [
+			{"method": "POST", "resource": "/orders", "requests": 1, "seconds": 60},
+			{"method": "GET", "resource": "/ping", "requests": -1, "seconds": -1},
+			{"method": "GET", "resource": "/health", "requests": -1, "seconds": -1}
+		]}}}}`)
+
+	drift := Diff(definition, &deployed)
+
+	var output bytes.Buffer
+	drift.Print(&output)
+	expected := `orders (Orders DEV): drifted
+  rate limiting:
+    - overrides[POST /soap SaveRoutes]: {"method":"POST","requests":5,"resource":"/soap","seconds":60,"soapOperation":"SaveRoutes"}
+    + overrides[GET /health]: {"method":"GET","requests":-1,"resource":"/health","seconds":-1}
+    ~ overrides: order ["GET /ping","POST /orders"] -> ["POST /orders","GET /ping"]
+    ~ requests: 3 -> 5
+  api definition:
+    + active: true
+    ~ proxy.target_url: "https://orders.dev" -> "https://orders.qae"
+`
+	if output.String() != expected {
+		t.Fatalf("Drift was not correct -- expected\n%v\nbut was\n%v", expected, output.String())
+	}
+}
+
+func Test_DiffNotDeployed_Success(t *testing.T) {
+	drift := Diff(definitionOf(t, `{"api_definition": {"name": "Orders DEV"}}`), nil)
+
+	var output bytes.Buffer
+	drift.Print(&output)
+	if drift.InSync() || !strings.Contains(output.String(), "orders (Orders DEV): not deployed") {
+		t.Fatalf("Api should not be deployed:\n%v", output.String())
+	}
+}
@@ -0,0 +1,13 @@
+package iac
+
+import (
+	"regexp"
+
+	"tyk-plugin/ratelimit"
+)
+
+// ListenPathMatcher returns the regular expression matching the request paths starting with the
+// listen path of the definition, nil if it has none (see ratelimit.ListenPathMatcher)
+func (definition Definition) ListenPathMatcher() (*regexp.Regexp, error) {
+	return ratelimit.ListenPathMatcher(definition.ListenPath())
+}
@@ -0,0 +1,51 @@
+package iac
+
+import (
+	"testing"
+)
+
+func Test_ListenPathMatcher_Success(t *testing.T) {
+	tests := []struct {
+		listenPath string
+		path       string
+		matched    string
+	}{
+		{"/orders/", "/orders/1", "/orders/"},
+		{"/orders/", "/invoices/1", ""},
+		{"/{?:(?i)Login/LoginService.svc}", "/login/loginservice.svc/soap", "/login/loginservice.svc"},
+		{"/{?:(?i)DeviceWebService|(?i)DriverWebService}", "/DriverWebService/drivers", "/DriverWebService"},
+		{"/api/{?:(?i)1.0|diag}", "/api/diag/health", "/api/diag"},
+		{"/tenants/{tenant}/orders", "/tenants/acme/orders/1", "/tenants/acme/orders"},
+		{"/years/{year:[0-9]{4}}/", "/years/2024/", "/years/2024/"},
+		{"/years/{year:[0-9]{4}}/", "/years/24/", ""},
+	}
+
+	for _, test := range tests {
+		definition := Definition{Content: map[string]interface{}{"api_definition": map[string]interface{}{
+			"proxy": map[string]interface{}{"listen_path": test.listenPath},
+		}}}
+		matcher, err := definition.ListenPathMatcher()
+		if err != nil {
+			t.Fatalf("Error compiling listen path %v: %v", test.listenPath, err)
+		}
+		if matched := matcher.FindString(test.path); matched != test.matched {
+			t.Fatalf("Match of %v on %v was not correct -- expected %q but was %q", test.path, test.listenPath, test.matched, matched)
+		}
+	}
+}
+
+func Test_ListenPathMatcherInvalid_Success(t *testing.T) {
+	for _, listenPath := range []string{"/{?:(?i)Login", "/{?:(}"} {
+		definition := Definition{Content: map[string]interface{}{"api_definition": map[string]interface{}{
+			"proxy": map[string]interface{}{"listen_path": listenPath},
+		}}}
+		if _, err := definition.ListenPathMatcher(); err == nil {
+			t.Fatalf("Listen path %v should be rejected", listenPath)
+		}
+	}
+
+	matcher, err := Definition{}.ListenPathMatcher()
+	if matcher != nil || err != nil {
+		t.Fatalf("No matcher expected without listen path -- was %v, %v", matcher, err)
+	}
+}
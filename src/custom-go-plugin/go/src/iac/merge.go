@@ -0,0 +1,198 @@
+// Package iac handles the api definitions of iac/api-definitions.
+// Each api has a base definition in 'base/<api>.json' and one override per environment in
+// 'env-overrides/<api>-<env>.json', the deployable definition of an environment being the
+// base definition merged with the override of that environment.
+package iac
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ArrayMode tells how an array of the override is merged into the array of the base
+type ArrayMode int
+
+const (
+	// the array of the override replaces the array of the base, as jq's '*' operator does
+	ArrayReplace ArrayMode = iota
+	// the items of the override are added after the items of the base
+	ArrayAppend
+	// the items of the override are merged into the item of the base having the same keys,
+	// or added after the items of the base if there is none. An item with "$remove": true
+	// removes the item of the base having the same keys.
+	ArrayMergeByKey
+)
+
+// ArrayRule is the merge mode of the array at a path of the definition
+type ArrayRule struct {
+	Mode ArrayMode
+	// fields identifying the items for ArrayMergeByKey
+	Keys []string
+}
+
+// marker of the override items removing an item of the base
+const removeMarker = "$remove"
+
+// DefaultArrayRules are the rules of the arrays merged other than by replacement.
+// Paths are the dot separated names of the fields from the root of the definition file,
+// "[]" standing for the items of an array.
+// An env override only lists the overrides and schedules it adds or changes, the ones of the
+// base being kept in the same order so that the first matching override stays the same.
+var DefaultArrayRules = map[string]ArrayRule{
+	"api_definition.config_data.rateLimiting.overrides":             {Mode: ArrayMergeByKey, Keys: []string{"method", "resource", "soapOperation"}},
+	"api_definition.config_data.rateLimiting.overrides[].schedules": {Mode: ArrayMergeByKey, Keys: []string{"name"}},
+	"api_definition.config_data.rateLimiting.schedules":             {Mode: ArrayMergeByKey, Keys: []string{"name"}},
+}
+
+// Merge returns the override merged into the base. Objects are merged recursively,
+// arrays according to the rules of their path and any other value of the override
+// replaces the value of the base. The base and the override are left unchanged.
+func Merge(base interface{}, override interface{}, rules map[string]ArrayRule) (interface{}, error) {
+	return merge("", base, override, rules)
+}
+
+func merge(path string, base interface{}, override interface{}, rules map[string]ArrayRule) (interface{}, error) {
+	switch overrideValue := override.(type) {
+	case map[string]interface{}:
+		baseObject, ok := base.(map[string]interface{})
+		if !ok {
+			return copyValue(override), nil
+		}
+
+		merged := make(map[string]interface{}, len(baseObject))
+		for key, value := range baseObject {
+			merged[key] = copyValue(value)
+		}
+		for key, value := range overrideValue {
+			baseValue, ok := baseObject[key]
+			if !ok {
+				merged[key] = copyValue(value)
+				continue
+			}
+			mergedValue, err := merge(joinPath(path, key), baseValue, value, rules)
+			if err != nil {
+				return nil, err
+			}
+			merged[key] = mergedValue
+		}
+		return merged, nil
+
+	case []interface{}:
+		baseArray, ok := base.([]interface{})
+		if !ok {
+			return copyValue(override), nil
+		}
+
+		rule := rules[path]
+		switch rule.Mode {
+		case ArrayAppend:
+			return copyValue(append(append([]interface{}{}, baseArray...), overrideValue...)), nil
+		case ArrayMergeByKey:
+			return mergeByKey(path, baseArray, overrideValue, rule.Keys, rules)
+		}
+		return copyValue(override), nil
+	}
+
+	return override, nil
+}
+
+// function merges the items of the arrays having the same keys
+func mergeByKey(path string, base []interface{}, override []interface{}, keys []string, rules map[string]ArrayRule) ([]interface{}, error) {
+	merged := copyValue(base).([]interface{})
+	removed := make([]bool, len(merged))
+
+	for i, item := range override {
+		object, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%v[%d]: items must be objects to be merged by %v", path, i, strings.Join(keys, ", "))
+		}
+
+		index := -1
+		for j, baseItem := range merged {
+			if baseObject, ok := baseItem.(map[string]interface{}); ok && !removed[j] && sameKeys(baseObject, object, keys) {
+				index = j
+				break
+			}
+		}
+
+		if remove, _ := object[removeMarker].(bool); remove {
+			if index < 0 {
+				return nil, fmt.Errorf("%v[%d]: no item of the base to remove with the same %v", path, i, strings.Join(keys, ", "))
+			}
+			removed[index] = true
+			continue
+		}
+
+		if index < 0 {
+			merged = append(merged, copyValue(object))
+			removed = append(removed, false)
+			continue
+		}
+		mergedItem, err := merge(path+"[]", merged[index], object, rules)
+		if err != nil {
+			return nil, err
+		}
+		merged[index] = mergedItem
+	}
+
+	result := make([]interface{}, 0, len(merged))
+	for i, item := range merged {
+		if !removed[i] {
+			result = append(result, item)
+		}
+	}
+	return result, nil
+}
+
+// function checks whether both items have the same values for the keys,
+// a missing key being the same as an empty string
+func sameKeys(first map[string]interface{}, second map[string]interface{}, keys []string) bool {
+	for _, key := range keys {
+		firstValue, secondValue := first[key], second[key]
+		if firstValue == nil {
+			firstValue = ""
+		}
+		if secondValue == nil {
+			secondValue = ""
+		}
+		// http methods are not case sensitive
+		if key == "method" {
+			firstString, _ := firstValue.(string)
+			secondString, _ := secondValue.(string)
+			if strings.EqualFold(firstString, secondString) {
+				continue
+			}
+		}
+		if !reflect.DeepEqual(firstValue, secondValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// function returns a deep copy of the decoded json value
+func copyValue(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(typedValue))
+		for key, item := range typedValue {
+			copied[key] = copyValue(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(typedValue))
+		for i, item := range typedValue {
+			copied[i] = copyValue(item)
+		}
+		return copied
+	}
+	return value
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,91 @@
+package iac
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decode(t *testing.T, content string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(content), &value); err != nil {
+		t.Fatalf("Invalid json %v: %v", content, err)
+	}
+	return value
+}
+
+func Test_MergeReplace_Success(t *testing.T) {
+	base := decode(t, `{"name": "base", "proxy": {"listen_path": "/a", "target_url": "http://base"}, "tags": ["a", "b"]}`)
+	override := decode(t, `{"name": "dev", "proxy": {"target_url": "http://dev"}, "tags": ["c"]}`)
+	expected := decode(t, `{"name": "dev", "proxy": {"listen_path": "/a", "target_url": "http://dev"}, "tags": ["c"]}`)
+
+	merged, err := Merge(base, override, DefaultArrayRules)
+	if err != nil {
+		t.Fatalf("Error merging: %v", err)
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("Merge was not correct -- expected %v but was %v", expected, merged)
+	}
+	if base.(map[string]interface{})["name"] != "base" {
+		t.Fatalf("Base was changed by the merge")
+	}
+}
+
+func Test_MergeAppend_Success(t *testing.T) {
+	rules := map[string]ArrayRule{"tags": {Mode: ArrayAppend}}
+	merged, err := Merge(decode(t, `{"tags": ["a", "b"]}`), decode(t, `{"tags": ["c"]}`), rules)
+	if err != nil {
+		t.Fatalf("Error merging: %v", err)
+	}
+	if expected := decode(t, `{"tags": ["a", "b", "c"]}`); !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("Merge was not correct -- expected %v but was %v", expected, merged)
+	}
+}
+
+func Test_MergeOverridesByKey_Success(t *testing.T) {
+	base := decode(t, `{"api_definition": {"config_data": {"rateLimiting": {"requests": 3, "overrides": [
+		{"method": "GET", "resource": "/ping", "requests": -1, "seconds": -1},
+		{"method": "POST", "resource": "/orders", "requests": 10, "seconds": 60, "schedules": [{"name": "nightly", "cron": "* 0-5 * * *", "requests": 50, "seconds": 60}]},
+		{"method": "POST", "resource": "/soap", "soapOperation": "SaveRoutes", "requests": 5, "seconds": 60},
+		{"method": "POST", "resource": "/soap", "requests": 20, "seconds": 60}
+	]}}}}`)
+	override := decode(t, `{"api_definition": {"config_data": {"rateLimiting": {"overrides": [
+		{"method": "post", "resource": "/orders", "requests": 20, "schedules": [{"name": "nightly", "requests": 100}]},
+		{"method": "POST", "resource": "/soap", "soapOperation": "SaveRoutes", "$remove": true},
+		{"method": "GET", "resource": "/health", "requests": -1, "seconds": -1}
+	]}}}}`)
+	expected := decode(t, `{"api_definition": {"config_data": {"rateLimiting": {"requests": 3, "overrides": [
+		{"method": "GET", "resource": "/ping", "requests": -1, "seconds": -1},
+		{"method": "post", "resource": "/orders", "requests": 20, "seconds": 60, "schedules": [{"name": "nightly", "cron": "* 0-5 * * *", "requests": 100, "seconds": 60}]},
+		{"method": "POST", "resource": "/soap", "requests": 20, "seconds": 60},
+		{"method": "GET", "resource": "/health", "requests": -1, "seconds": -1}
+	]}}}}`)
+
+	merged, err := Merge(base, override, DefaultArrayRules)
+	if err != nil {
+		t.Fatalf("Error merging: %v", err)
+	}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("Merge was not correct -- expected %v but was %v", expected, merged)
+	}
+}
+
+func Test_MergeByKeyInvalidItems_Success(t *testing.T) {
+	rules := map[string]ArrayRule{"overrides": {Mode: ArrayMergeByKey, Keys: []string{"resource"}}}
+
+	tests := []struct {
+		override string
+		expected string
+	}{
+		{`{"overrides": ["/ping"]}`, "overrides[0]: items must be objects"},
+		{`{"overrides": [{"resource": "/health", "$remove": true}]}`, "overrides[0]: no item of the base to remove"},
+	}
+
+	for _, test := range tests {
+		_, err := Merge(decode(t, `{"overrides": [{"resource": "/ping"}]}`), decode(t, test.override), rules)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("Merge of %v -- expected an error containing %q but was %v", test.override, test.expected, err)
+		}
+	}
+}
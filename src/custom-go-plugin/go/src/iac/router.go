@@ -0,0 +1,68 @@
+package iac
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Router finds the api definition of the requests as the gateway does, the one whose listen
+// path matches the longest start of the request path. It is shared by the servers running the
+// rate limiting of the definitions without the gateway so that they route the requests alike.
+type Router struct {
+	listenPaths []*regexp.Regexp
+}
+
+// NewRouter returns the router of the definitions, a definition with no listen path matching
+// no request
+func NewRouter(definitions []Definition) (*Router, error) {
+	router := &Router{}
+	for _, definition := range definitions {
+		listenPath, err := definition.ListenPathMatcher()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", definition.Api, err)
+		}
+		router.listenPaths = append(router.listenPaths, listenPath)
+	}
+	return router, nil
+}
+
+// Route returns the index of the definition of the request path in the definitions of the router,
+// -1 if no listen path matches it. Of the listen paths matching as much of the path, the one of
+// the first definition wins, see DuplicateListenPaths.
+func (router *Router) Route(path string) int {
+	found, longest := -1, -1
+	for i, listenPath := range router.listenPaths {
+		if listenPath == nil {
+			continue
+		}
+		if match := listenPath.FindStringIndex(path); match != nil && match[1] > longest {
+			found, longest = i, match[1]
+		}
+	}
+	return found
+}
+
+// DuplicateListenPaths returns an error naming the definitions having the same listen path, the
+// requests of all of them being routed to the first one (e.g. an api and its '-copy')
+func DuplicateListenPaths(definitions []Definition) error {
+	apis := map[string][]string{}
+	for _, definition := range definitions {
+		if listenPath := definition.ListenPath(); listenPath != "" {
+			apis[listenPath] = append(apis[listenPath], definition.Api)
+		}
+	}
+
+	var duplicates []string
+	for listenPath, names := range apis {
+		if len(names) > 1 {
+			duplicates = append(duplicates, fmt.Sprintf("%v have the same listen path %q", strings.Join(names, ", "), listenPath))
+		}
+	}
+	if len(duplicates) == 0 {
+		return nil
+	}
+	sort.Strings(duplicates)
+	return fmt.Errorf("duplicate listen paths: %v", strings.Join(duplicates, "; "))
+}
@@ -0,0 +1,58 @@
+package iac
+
+import (
+	"strings"
+	"testing"
+)
+
+func listenPathDefinition(api string, listenPath string) Definition {
+	return Definition{Api: api, Content: map[string]interface{}{
+		"api_definition": map[string]interface{}{"proxy": map[string]interface{}{"listen_path": listenPath}},
+	}}
+}
+
+func Test_Route_Success(t *testing.T) {
+	router, err := NewRouter([]Definition{
+		listenPathDefinition("api", "/api/"),
+		listenPathDefinition("login", "/{?:(?i)Login/LoginService.svc}"),
+		listenPathDefinition("api-v1", "/api/{?:(?i)1.0|diag}"),
+		listenPathDefinition("none", ""),
+	})
+	if err != nil {
+		t.Fatalf("Error creating the router: %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		expected int
+	}{
+		{"/api/orders", 0},
+		{"/api/1.0/orders", 2},
+		{"/login/loginservice.svc/soap", 1},
+		{"/orders", -1},
+	}
+	for _, test := range tests {
+		if index := router.Route(test.path); index != test.expected {
+			t.Fatalf("Route of %v was not correct -- expected %v but was %v", test.path, test.expected, index)
+		}
+	}
+
+	if _, err := NewRouter([]Definition{listenPathDefinition("invalid", "/{id")}); err == nil || !strings.Contains(err.Error(), "invalid:") {
+		t.Fatalf("Invalid listen path should be rejected -- was %v", err)
+	}
+}
+
+func Test_DuplicateListenPaths_Success(t *testing.T) {
+	definitions := []Definition{
+		listenPathDefinition("ot1-xrs-rest", "/{?:(?i)DriverWebService}"),
+		listenPathDefinition("ot1-rna-rest", "/api/"),
+		listenPathDefinition("ot1-xrs-rest-copy", "/{?:(?i)DriverWebService}"),
+	}
+	err := DuplicateListenPaths(definitions)
+	if err == nil || !strings.Contains(err.Error(), `ot1-xrs-rest, ot1-xrs-rest-copy have the same listen path "/{?:(?i)DriverWebService}"`) {
+		t.Fatalf("Duplicate listen paths were not correct -- was %v", err)
+	}
+	if err := DuplicateListenPaths(definitions[:2]); err != nil {
+		t.Fatalf("No duplicate listen path expected -- was %v", err)
+	}
+}
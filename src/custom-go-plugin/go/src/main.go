@@ -0,0 +1,30 @@
+// the main entry point for Tyk.io custom plugins for API Gateway
+// the hooks configured in the bundle manifest are looked up by name in the main package of the
+// plugin, they delegate to the Tyk adapter of the ratelimit package holding the actual rate limiting logic
+package main
+
+import (
+	"net/http"
+
+	"tyk-plugin/adapter/tyk"
+	"tyk-plugin/ratelimit"
+)
+
+// the plugin run by the gateway, setting the sessions in the request context
+var plugin = tyk.NewPlugin(tyk.ContextSessionStore{})
+
+// SetRateLimit is the auth_check hook of the bundle manifest
+func SetRateLimit(rw http.ResponseWriter, r *http.Request) {
+	plugin.SetRateLimit(rw, r)
+}
+
+// RecordResponse is the response hook of the bundle manifest
+func RecordResponse(rw http.ResponseWriter, res *http.Response, req *http.Request) {
+	plugin.RecordResponse(rw, res, req)
+}
+
+func main() {}
+
+func init() {
+	ratelimit.DebugLog("--- Rate limiting plugin init success! ---- ")
+}
@@ -1,4 +1,6 @@
-// the main entry point for Tyk.io custom plugins for API Gateway
+// the rate limiting logic of the Tyk.io custom plugin for API Gateway, the plugin entry points
+// being in the main package and the Tyk adapter so that the logic can also be used by the
+// command line tools and without the Tyk packages
 // this was extended from the base/standard Tyk github repo for custom plugin dev
 // this will serve as just a starting point for the actual implementation
 // of the plugin that will implememnt rate limiting logic for the phase 1 legacy implementation
@@ -7,19 +9,20 @@
 // therfore, the custom rate limiting functionality will utlize data from the request, headers and
 // even the request body, to generate a unique id that will act as the rate limiting key to which
 // the rate limiting will be applied
-package main
+package ratelimit
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
-
-	"github.com/TykTechnologies/tyk/ctx"
-	"github.com/TykTechnologies/tyk/user"
 )
 
 type RateLimitingConfig struct {
@@ -27,21 +30,45 @@ type RateLimitingConfig struct {
 }
 
 type RateLimit struct {
-	Active        bool       `json:"active"`
-	Overrides     []Override `json:"overrides"`
-	Requests      int        `json:"requests"`
-	Seconds       int        `json:"seconds"`
-	SessionTtlMin int        `json:"sessionTtlMin"`
-	Strategy      Strategy   `json:"strategy"`
-	LogLevel      LogLevel   `json:"logLevel"`
-	IsUnitTest    bool       `json:"isUnitTest"`
+	Active        bool        `json:"active"`
+	Overrides     []Override  `json:"overrides"`
+	Requests      int         `json:"requests"`
+	Seconds       int         `json:"seconds"`
+	Schedules     []Schedule  `json:"schedules"`
+	SessionTtlMin int         `json:"sessionTtlMin"`
+	Strategy      Strategy    `json:"strategy"`
+	AccessLists   AccessLists `json:"accessLists"`
+	Adaptive      Adaptive    `json:"adaptive"`
+	Metrics       Metrics     `json:"metrics"`
+	Tracing       Tracing     `json:"tracing"`
+	Events        Events      `json:"events"`
+	Admin         Admin       `json:"admin"`
+	LogLevel      LogLevel    `json:"logLevel"`
+	MaxBodySize   int64       `json:"maxBodySize"`
 }
 
 type Override struct {
-	Method   string `json:"method"`
-	Requests int    `json:"requests"`
-	Resource string `json:"resource"`
-	Seconds  int    `json:"seconds"`
+	Method        string         `json:"method"`
+	Requests      int            `json:"requests"`
+	Resource      string         `json:"resource"`
+	Seconds       int            `json:"seconds"`
+	Schedules     []Schedule     `json:"schedules"`
+	SoapOperation string         `json:"soapOperation"`
+	Match         *OverrideMatch `json:"match"`
+}
+
+// OverrideMatch holds optional predicates an override requires on top of 'resource' and 'method'.
+// All the predicates set on the same object must match (AND), every entry of 'all' must match (AND)
+// and at least one entry of 'any' must match (OR), so that predicates can be nested as needed.
+type OverrideMatch struct {
+	All         []OverrideMatch `json:"all"`
+	Any         []OverrideMatch `json:"any"`
+	Query       string          `json:"query"`
+	Header      string          `json:"header"`
+	Value       string          `json:"value"`
+	ContentType string          `json:"contentType"`
+	MinBodySize int64           `json:"minBodySize"`
+	MaxBodySize int64           `json:"maxBodySize"`
 }
 
 type Strategy struct {
@@ -60,6 +87,20 @@ const requestHeadersXRS = "requestHeadersXRS"
 const sessionGuid = "sessionGuid"
 const soapRequestXRS = "soapRequestXRS"
 
+// size of the start of the request bodies read by the strategies and overrides
+// when the config data sets no 'maxBodySize'
+const defaultMaxBodySize = 1 << 20
+
+// body of a request whose start was read by the plugin, the start being kept so that the
+// strategies and overrides do not read it again
+type readBody struct {
+	io.Reader
+	io.Closer
+	start     []byte
+	truncated bool
+	err       error
+}
+
 // The rate limiter function that will be configured to be invoked for each api definition that is
 // a part of the legacy phase 1 implementation.
 // Sets a custom rate limit for inbound requests based on a unique identier for a given
@@ -69,9 +110,13 @@ const soapRequestXRS = "soapRequestXRS"
 //
 //	requestHeader={header-name} for example "apiRateLimiterType::requestHeader=x-tenant-id"
 //	soapBody ... more to document here
-func SetRateLimit(rw http.ResponseWriter, r *http.Request) {
+//
+// The api definition of the request is read from the gateway context, and the resulting
+// session set on it for the gateway to apply the limits.
+func Handle(gateway GatewayContext, r *http.Request) {
 
-	apidef := ctx.GetDefinition(r)
+	apidef := gateway.Definition()
+	rw := gateway.ResponseWriter()
 
 	apiDefConfigData, err := json.Marshal(apidef.ConfigData)
 	if err != nil {
@@ -86,12 +131,18 @@ func SetRateLimit(rw http.ResponseWriter, r *http.Request) {
 	rateLimitingConfig, err := generateStructFromJSON(apiDefinitionJson)
 	if err != nil {
 		ErrorLog("Error:", err)
+		recordDecision(apidef.Name, "", nil, outcomeError)
 		return
 	}
 
 	// Set log level based on api definition config data
 	SetLogLevel(rateLimitingConfig.RateLimiting.LogLevel)
 
+	// requests to the admin endpoint are answered by the plugin and not proxied
+	if handleAdminRequest(rw, r, apidef, rateLimitingConfig) {
+		return
+	}
+
 	DebugLog("api-name", apidef.Name, "custom plugin BEGIN processing @ ", time.Now().String())
 
 	DebugLog("config data: ", apidef.ConfigData)
@@ -99,27 +150,80 @@ func SetRateLimit(rw http.ResponseWriter, r *http.Request) {
 	DebugLog("apidef tags: ", apidef.Tags)
 	DebugLog("apidef tagHeaders: ", apidef.TagHeaders)
 
-	keyID := selectStrategy(rateLimitingConfig, r)
+	startMetricsExporters(rateLimitingConfig.RateLimiting.Metrics)
+	strategyName := rateLimitingConfig.RateLimiting.Strategy.Name
 
-	overridePath := lookForOverridesInRequest(r.URL.Path, rateLimitingConfig)
-	DebugLog("Path: ", overridePath)
+	requestSpan := startRequestSpan(rateLimitingConfig.RateLimiting.Tracing, r, "SetRateLimit")
+	defer requestSpan.end()
+	requestSpan.setAttribute("api.name", apidef.Name)
+	requestSpan.setAttribute("ratelimit.strategy", strategyName)
 
-	requestsValue, secondsValue, sessionTtl, err := getRateLimits(rateLimitingConfig, overridePath, r.Method, keyID)
-	if err != nil {
-		ErrorLog("Error: ", err)
+	state := &requestState{apiID: apidef.APIID, received: clock.Now()}
+	setRequestState(r, state)
+
+	// the controller of the api is created here, the limits being scaled by resolve
+	if rateLimitingConfig.RateLimiting.Adaptive.Enabled {
+		getAdaptiveController(apidef.APIID, rateLimitingConfig.RateLimiting.Adaptive)
+	}
+
+	result := resolve(rateLimitingConfig, apidef.APIID, r, requestSpan)
+	keyID, override := result.KeyID, result.Override
+	strategyDuration.observe(result.strategyDuration.Seconds(), apidef.Name, strategyName)
+	state.keyID = keyID
+	requestSpan.setAttribute("ratelimit.key_hash", result.KeyHash)
+
+	if result.access == accessDenied {
+		InfoLog("Request denied for KeyID: ", keyID)
+		writeAccessDenied(rw, r, rateLimitingConfig.RateLimiting.AccessLists)
+		recordDecision(apidef.Name, strategyName, nil, outcomeDenied)
+		requestSpan.setAttribute("ratelimit.outcome", outcomeDenied)
+		return
+	}
+	DebugLog("Path: ", r.URL.Path)
+
+	if result.err != nil {
+		ErrorLog("Error: ", result.err)
+		recordDecision(apidef.Name, strategyName, override, outcomeError)
+		requestSpan.setError(result.err)
 		return
 	}
 
+	requestsValue, secondsValue, sessionTtl := result.Requests, result.Seconds, result.SessionTtl
+	if result.access == accessAllowed {
+		InfoLog("KeyID is allowed, no rate limit will be applied: ", keyID)
+	}
+
+	outcome := outcomeLimited
+	switch {
+	case !rateLimitingConfig.RateLimiting.Active:
+		outcome = outcomeAllowed
+	case keyID == "":
+		outcome = outcomeNoKey
+	case requestsValue < 0:
+		outcome = outcomeAllowed
+	}
+	recordDecision(apidef.Name, strategyName, override, outcome)
+	if outcome == outcomeLimited {
+		trackThrottling(rateLimitingConfig.RateLimiting, apidef.Name, apidef.APIID, keyID, requestsValue, secondsValue)
+	}
+	requestSpan.setAttribute("ratelimit.override", overrideLabel(override))
+	requestSpan.setAttribute("ratelimit.outcome", outcome)
+	requestSpan.setAttribute("ratelimit.requests", strconv.FormatFloat(requestsValue, 'f', -1, 64))
+	requestSpan.setAttribute("ratelimit.seconds", strconv.FormatFloat(secondsValue, 'f', -1, 64))
+
 	DebugLog("Requests value: ", requestsValue)
 	DebugLog("Seconds value: ", secondsValue)
 	DebugLog("SessionTtl value: ", sessionTtl)
 
 	InfoLog("Unique KeyID: ", keyID)
 
+	// the KeyID of the session changes when the counters of the key are reset
+	sessionKeyID := getSessionKeyID(rateLimitingConfig.RateLimiting.Admin, apidef.APIID, keyID)
+
 	// where the actual rate limiting is applied based on a customer's unique identifier
 	// the actual rate setting should be expernally configurable such as using tag values or configs
 	// this is IF ploicies are still not working -- see below
-	session := &user.SessionState{
+	session := Session{
 		Alias: keyID,
 
 		//the following do not seem to be working as expected using policy?
@@ -134,43 +238,23 @@ func SetRateLimit(rw http.ResponseWriter, r *http.Request) {
 			"keyId": keyID,
 			"meta2": "meta2",
 		},
-		KeyID:           keyID,      //this value should be the unique value for the redis key (hashed)
-		SessionLifetime: sessionTtl, //redis TTL -- rate liiting will be "reset" after key expires
+		KeyID:           sessionKeyID, //this value should be the unique value for the redis key (hashed)
+		SessionLifetime: sessionTtl,   //redis TTL -- rate liiting will be "reset" after key expires
 	}
 
-	// check if we are in a unit test context or real world application
-	if rateLimitingConfig.RateLimiting.IsUnitTest {
-		DebugLog("Session will not be set as this is in a unit testing context")
-		reachedSessionState := true
-		DebugLog("Reached end of SetRateLimit without errors ", reachedSessionState)
-		return
-	}
-	ctx.SetSession(r, session, true)
+	sessionSpan := requestSpan.startChild("SetSession")
+	gateway.SetSession(session)
+	sessionSpan.end()
 
 	DebugLog("api-name", apidef.Name, "Rate limiting plugin END processing @ ", time.Now().String())
 }
 
-// function takes an HTTP request URL Path and the api definition as input
-// loops through the 'overrides' to find a matching 'resource' in the request
-// output: string formed by the request match
-// if no overrides were found an empty string is returned
-func lookForOverridesInRequest(requestUrl string, rateLimitingConfig RateLimitingConfig) string {
-	for _, override := range rateLimitingConfig.RateLimiting.Overrides {
-		resourceValue := override.Resource
-
-		if caseInsensitiveContains(requestUrl, resourceValue) {
-			DebugLog("Override found for request: ", resourceValue)
-			return resourceValue
-		}
-	}
-	return ""
-}
-
-// The function parses the JSON string and retrieves the values of "requests" and "seconds" from the nested objects
-// inside the "overrides" array. It parses the JSON string, iterates over each override object,
-// and extracts the "requests" and "seconds" values.
-// The function returns a slice of integers containing the "requests" and "seconds" values from all overrides.
-func getRateLimits(rateLimitingConfig RateLimitingConfig, resource string, method string, keyID string) (float64, float64, int64, error) {
+// The function resolves the "requests" and "seconds" values to apply to the request.
+// The override matched by lookForOverridesInRequest (if any) takes precedence over the
+// 'default' values set in the api definition config, and in both cases the schedule active
+// at the time given by the clock takes precedence over the regular values.
+// The function returns the "requests", "seconds" and "sessionTtl" values.
+func getRateLimits(rateLimitingConfig RateLimitingConfig, override *Override, keyID string) (float64, float64, int64, error) {
 
 	if keyID == "" {
 		return -1, -1, int64(-1), nil
@@ -178,20 +262,24 @@ func getRateLimits(rateLimitingConfig RateLimitingConfig, resource string, metho
 
 	// if active is true then look for overrides
 	if rateLimitingConfig.RateLimiting.Active {
-
-		// loop through overrides to look for a matching resource and method
-		// between http request and the overrides config data
-		for _, override := range rateLimitingConfig.RateLimiting.Overrides {
-
-			// if a match is found then set the values from the overrides config
-			// for the 'requests', 'seconds' and 'sessionTtl'
-			if strings.EqualFold(override.Resource, resource) && strings.EqualFold(override.Method, method) {
-				return float64(override.Requests), float64(override.Seconds), int64(rateLimitingConfig.RateLimiting.SessionTtlMin), nil
+		sessionTtl := int64(rateLimitingConfig.RateLimiting.SessionTtlMin)
+
+		// if a match was found then set the values from the overrides config
+		// for the 'requests', 'seconds' and 'sessionTtl'
+		if override != nil {
+			requests, seconds, err := resolveSchedule(override.Schedules, override.Requests, override.Seconds, clock.Now())
+			if err != nil {
+				return -1, -1, int64(-1), err
 			}
+			return float64(requests), float64(seconds), sessionTtl, nil
 		}
 		// if no overrides found to be matching then use
 		// the 'default' values set in the api definition config
-		return float64(rateLimitingConfig.RateLimiting.Requests), float64(rateLimitingConfig.RateLimiting.Seconds), int64(rateLimitingConfig.RateLimiting.SessionTtlMin), nil
+		requests, seconds, err := resolveSchedule(rateLimitingConfig.RateLimiting.Schedules, rateLimitingConfig.RateLimiting.Requests, rateLimitingConfig.RateLimiting.Seconds, clock.Now())
+		if err != nil {
+			return -1, -1, int64(-1), err
+		}
+		return float64(requests), float64(seconds), sessionTtl, nil
 	}
 	// If active is false or not found then set no rate limit
 	return -1, -1, int64(-1), nil
@@ -217,7 +305,7 @@ func selectStrategy(rateLimitingConfig RateLimitingConfig, req *http.Request) st
 			return keyID
 		case sessionGuid:
 			InfoLog("strategy to be applied: ", name)
-			keyID := createUniqueKeyIDSessionGuid(req)
+			keyID := createUniqueKeyIDSessionGuid(rateLimitingConfig, req)
 
 			return keyID
 		case soapRequestXRS:
@@ -267,9 +355,12 @@ func createUniqueKeyIdHeadersXRS(rateLimitingConfig RateLimitingConfig, req *htt
 	authBase64 := req.Header.Get("Authorization")
 	authBase64WithoutBasic := strings.ReplaceAll(authBase64, "Basic ", "")
 
+	// the header comes from the client, a value which is not base64 gives no key instead of
+	// failing the request
 	rawDecodedAuth, err := base64.StdEncoding.DecodeString(authBase64WithoutBasic)
 	if err != nil {
-		panic(err)
+		DebugLog("Invalid Authorization header: ", err)
+		return ""
 	}
 
 	customerId := extractStringBeforeSeparator(string(rawDecodedAuth), "|")
@@ -287,8 +378,8 @@ func createUniqueKeyIdHeadersXRS(rateLimitingConfig RateLimitingConfig, req *htt
 // the SessionGuid element from the request body using a regular expression.
 // Returns: The extracted SessionGuid value as a string, if found in the request body.
 // An error, if encountered during the reading or parsing of the request body.
-func createUniqueKeyIDSessionGuid(req *http.Request) string {
-	body, err := ioutil.ReadAll(req.Body)
+func createUniqueKeyIDSessionGuid(rateLimitingConfig RateLimitingConfig, req *http.Request) string {
+	body, err := readRequestBody(req, rateLimitingConfig.RateLimiting.bodyLimit())
 	if err == nil {
 		sb := string(body)
 		DebugLog("request body: ", sb)
@@ -313,7 +404,7 @@ func createUniqueKeyIDSessionGuid(req *http.Request) string {
 // from the xml body and takes the companyId
 // Returns: The extracted companyId value as string.
 func createUniqueKeyIdSoapRequestXRS(rateLimitingConfig RateLimitingConfig, req *http.Request) string {
-	body, err := ioutil.ReadAll(req.Body)
+	body, err := readRequestBody(req, rateLimitingConfig.RateLimiting.bodyLimit())
 	if err == nil {
 		sb := string(body)
 		DebugLog("request body: ", sb)
@@ -337,6 +428,36 @@ func createUniqueKeyIdSoapRequestXRS(rateLimitingConfig RateLimitingConfig, req
 	return ""
 }
 
+// function returns the start of the request body, at most maxBodySize bytes, and puts it back
+// on the request for the upstream. The body is only read once per request, the strategy and the
+// override lookups getting the start read first, and the rest of the body is left unread.
+func readRequestBody(req *http.Request, maxBodySize int64) ([]byte, error) {
+	if req.Body == nil {
+		return nil, errors.New("request has no body")
+	}
+	if body, ok := req.Body.(*readBody); ok {
+		return body.start, body.err
+	}
+
+	// one more byte tells a body of exactly maxBodySize bytes from a longer one
+	start, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodySize+1))
+	body := &readBody{Reader: io.MultiReader(bytes.NewReader(start), req.Body), Closer: req.Body, start: start, err: err}
+	if int64(len(start)) > maxBodySize {
+		body.start = start[:maxBodySize]
+		body.truncated = true
+	}
+	req.Body = body
+	return body.start, body.err
+}
+
+// function returns the size of the start of the request bodies read by the strategies and overrides
+func (rateLimit RateLimit) bodyLimit() int64 {
+	if rateLimit.MaxBodySize > 0 {
+		return rateLimit.MaxBodySize
+	}
+	return defaultMaxBodySize
+}
+
 // Parses the provided JSON string into a RateLimitingConfig struct
 // Returns a struct of type RateLimitingConfig that mirrors the structure of the JSON.
 func generateStructFromJSON(jsonStr string) (RateLimitingConfig, error) {
@@ -376,9 +497,3 @@ func appendApiType(keyId string, name string) string {
 	}
 	return keyId
 }
-
-func main() {}
-
-func init() {
-	DebugLog("--- Rate limiting plugin init success! ---- ")
-}
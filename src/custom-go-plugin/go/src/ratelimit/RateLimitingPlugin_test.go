@@ -1,16 +1,14 @@
-package main
+package ratelimit
 
 import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
-
-	"github.com/TykTechnologies/tyk/apidef"
-	"github.com/TykTechnologies/tyk/ctx"
 )
 
 func BuildStruct() RateLimitingConfig {
@@ -29,8 +27,7 @@ func BuildStruct() RateLimitingConfig {
 	}
 
 	rateLimit := RateLimit{
-		Active:     true,
-		IsUnitTest: true,
+		Active: true,
 		Overrides: []Override{
 			{
 				Method:   "GET",
@@ -90,20 +87,17 @@ func Test_SetRateLimit_Success(t *testing.T) {
 		return
 	}
 
-	// Directly initializing a pointer to apidef.APIDefinition
-	apiDef := &apidef.APIDefinition{
+	apiDef := ApiDefinition{
 		Name:       "Another API",
 		ConfigData: configData,
 	}
 
-	ctx.SetDefinition(req, apiDef)
-
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("x-tenant-id", "milesahead2")
 	req.Header.Set("Authorization", "Bearer 12345abcd")
 	w := httptest.NewRecorder()
 
-	SetRateLimit(w, req)
+	Handle(&fakeGateway{definition: apiDef, rw: w}, req)
 }
 
 func Test_ErrorLog_Success(t *testing.T) {
@@ -144,20 +138,17 @@ func Test_SetRateLimitSelectStrategyActiveFalse_Success(t *testing.T) {
 		return
 	}
 
-	// Directly initializing a pointer to apidef.APIDefinition
-	apiDef := &apidef.APIDefinition{
+	apiDef := ApiDefinition{
 		Name:       "Another API",
 		ConfigData: configData,
 	}
 
-	ctx.SetDefinition(req, apiDef)
-
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("x-tenant-id", "milesahead2")
 	req.Header.Set("Authorization", "Bearer12345abcd")
 	w := httptest.NewRecorder()
 
-	SetRateLimit(w, req)
+	Handle(&fakeGateway{definition: apiDef, rw: w}, req)
 }
 
 func Test_GenerateStructFromJSON_Success(t *testing.T) {
@@ -218,7 +209,10 @@ func Test_GetRateLimitsDefaultValues_Success(t *testing.T) {
 	rateLimiting := BuildStruct()
 	rateLimiting.RateLimiting.Overrides[0].Resource = "/products/"
 
-	resultRequestValue, resultSecondsValue, resultSessionTtl, err := getRateLimits(rateLimiting, resource, method, "milesahead1")
+	req := httptest.NewRequest(method, "http://localhost:8080"+resource, nil)
+	override := lookForOverridesInRequest(req, rateLimiting)
+
+	resultRequestValue, resultSecondsValue, resultSessionTtl, err := getRateLimits(rateLimiting, override, "milesahead1")
 
 	if resultRequestValue != expectedResultRequestValue {
 		t.Fatalf("RateLimit values was not correct -- expected %v but was %v", expectedResultRequestValue, resultRequestValue)
@@ -248,7 +242,10 @@ func Test_GetRateLimitsResourceValues_Success(t *testing.T) {
 	rateLimiting := BuildStruct()
 	rateLimiting.RateLimiting.Overrides[0].Resource = "/products/"
 
-	resultRequestValue, resultSecondsValue, resultSessionTtl, err := getRateLimits(rateLimiting, resource, method, "milesahead1")
+	req := httptest.NewRequest(method, "http://localhost:8080"+resource, nil)
+	override := lookForOverridesInRequest(req, rateLimiting)
+
+	resultRequestValue, resultSecondsValue, resultSessionTtl, err := getRateLimits(rateLimiting, override, "milesahead1")
 
 	if resultRequestValue != expectedResultRequestValue {
 		t.Fatalf("RateLimit values was not correct -- expected %v but was %v", expectedResultRequestValue, resultRequestValue)
@@ -275,7 +272,10 @@ func Test_GetRateLimitsActiveIsFalse_Success(t *testing.T) {
 	rateLimiting := BuildStruct()
 	rateLimiting.RateLimiting.Active = false
 
-	resultRequestValue, resultSecondsValue, resultSessionTtl, err := getRateLimits(rateLimiting, resource, method, "milesahead1")
+	req := httptest.NewRequest(method, "http://localhost:8080"+resource, nil)
+	override := lookForOverridesInRequest(req, rateLimiting)
+
+	resultRequestValue, resultSecondsValue, resultSessionTtl, err := getRateLimits(rateLimiting, override, "milesahead1")
 
 	if (resultRequestValue == -1) && (resultSecondsValue == -1) &&
 		(resultSessionTtl == -1) && err == nil {
@@ -332,7 +332,10 @@ func Test_GetRateLimitsErrorParsingJson_Success(t *testing.T) {
 		return
 	}
 
-	resultRequestValue, resultSecondsValue, resultSessionTtl, err := getRateLimits(rateLimitingConfig, resource, method, "milesaheadtest")
+	req := httptest.NewRequest(method, "http://localhost:8080"+resource, nil)
+	override := lookForOverridesInRequest(req, rateLimitingConfig)
+
+	resultRequestValue, resultSecondsValue, resultSessionTtl, err := getRateLimits(rateLimitingConfig, override, "milesaheadtest")
 
 	if (err != nil) && err.Error() == "invalid character ',' looking for beginning of value" {
 		fmt.Println("Test passed, returning values: ", resultRequestValue, resultSecondsValue, resultSessionTtl)
@@ -372,6 +375,21 @@ func Test_SelectStrategyRequestHeadersXRSPath_Success(t *testing.T) {
 	}
 }
 
+func Test_SelectStrategyRequestHeadersXRSInvalidBase64_Success(t *testing.T) {
+	rateLimiting := BuildStruct()
+	rateLimiting.RateLimiting.Strategy.Name = "requestHeadersXRS"
+
+	for _, authorization := range []string{"Basic not-base64!", "Bearer 123456abcd", "Basic TUlMRVNBSE"} {
+		req := httptest.NewRequest("GET", "http://localhost:8080/testing/", nil)
+		req.Header.Set("Authorization", authorization)
+
+		keyID := selectStrategy(rateLimiting, req)
+		if keyID != "" {
+			t.Fatalf("KeyId value was not correct for %v -- expected no key but was %v", authorization, keyID)
+		}
+	}
+}
+
 func TestSelectStrategy_RequestHeadersPathBasic_Success(t *testing.T) {
 
 	body := `{
@@ -466,3 +484,43 @@ func Test_SelectStrategySessionGuidNotFound_Success(t *testing.T) {
 		t.Fatalf("There is an error")
 	}
 }
+
+// reader of a request body counting the bytes read from it
+type countingReader struct {
+	reader *strings.Reader
+	read   int
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.read += n
+	return n, err
+}
+
+func Test_ReadRequestBodyOnce_Success(t *testing.T) {
+	rateLimiting := BuildSoapOverridesStruct()
+	rateLimiting.RateLimiting.Strategy.Name = sessionGuid
+	rateLimiting.RateLimiting.MaxBodySize = 64
+	rateLimiting.RateLimiting.Overrides = append(rateLimiting.RateLimiting.Overrides, Override{
+		Method: "POST", Resource: "/Routing/", Requests: 1, Seconds: 1, Match: &OverrideMatch{MaxBodySize: 64},
+	})
+
+	envelope := routingSoapEnvelope + strings.Repeat(" ", 100)
+	counter := &countingReader{reader: strings.NewReader(envelope)}
+	req := httptest.NewRequest("POST", "http://localhost:8080/Routing/RoutingService.svc", ioutil.NopCloser(counter))
+	req.ContentLength = -1
+
+	// the strategy, the SOAP operation and the body size all get the start read first
+	selectStrategy(rateLimiting, req)
+	lookForOverridesInRequest(req, rateLimiting)
+	if counter.read != 65 {
+		t.Fatalf("Body was not read once -- expected 65 bytes read but was %v", counter.read)
+	}
+	if size := getBodySize(req, 64); size != 65 {
+		t.Fatalf("Body size was not correct -- expected 65 but was %v", size)
+	}
+
+	if body, _ := ioutil.ReadAll(req.Body); string(body) != envelope {
+		t.Fatalf("Body was not restored -- expected %q but was %q", envelope, body)
+	}
+}
@@ -0,0 +1,216 @@
+// Allow and deny lists for the rate limiting plugin.
+// the lists are evaluated once the unique key has been derived from the request: allowed keys
+// skip rate limiting altogether while denied keys are blocked right away with a configurable
+// error (json or SOAP fault). Entries can be exact keys, key prefixes or CIDRs matching the
+// client ip, and come from the api definition config and/or an external file that is
+// reloaded whenever it changes.
+package ratelimit
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AccessLists struct {
+	Allow             AccessList `json:"allow"`
+	Deny              AccessList `json:"deny"`
+	File              string     `json:"file"`
+	DenyStatusCode    int        `json:"denyStatusCode"`
+	DenyMessage       string     `json:"denyMessage"`
+	DenyFormat        string     `json:"denyFormat"`
+	TrustForwardedFor bool       `json:"trustForwardedFor"`
+}
+
+type AccessList struct {
+	Keys     []string `json:"keys"`
+	Prefixes []string `json:"prefixes"`
+	Cidrs    []string `json:"cidrs"`
+}
+
+// structure of the external access lists file
+type accessListsFile struct {
+	Allow AccessList `json:"allow"`
+	Deny  AccessList `json:"deny"`
+}
+
+type accessResult int
+
+const (
+	accessDefault accessResult = iota
+	accessAllowed
+	accessDenied
+)
+
+const defaultDenyStatusCode = http.StatusForbidden
+const defaultDenyMessage = "Access to this API has been disallowed"
+
+// the external file is checked for changes at most once per interval
+const accessListsFileCheckInterval = time.Second
+
+type cachedAccessListsFile struct {
+	lists accessListsFile
+	file  *watchedFile
+}
+
+var accessListsFilesMutex sync.Mutex
+var accessListsFiles = map[string]*cachedAccessListsFile{}
+
+// function checks the key and client ip of the request against the deny and allow lists,
+// the deny list taking precedence over the allow list.
+// Returns accessDefault when the request is in none of the lists.
+func checkAccessLists(accessLists AccessLists, keyID string, req *http.Request) accessResult {
+	allow := accessLists.Allow
+	deny := accessLists.Deny
+
+	if accessLists.File != "" {
+		fileLists, err := loadAccessListsFile(accessLists.File)
+		if err != nil {
+			ErrorLog("Access lists file read error: ", err)
+		}
+		allow = mergeAccessLists(allow, fileLists.Allow)
+		deny = mergeAccessLists(deny, fileLists.Deny)
+	}
+
+	clientIP := getClientIP(req, accessLists.TrustForwardedFor)
+
+	if accessListContains(deny, keyID, clientIP) {
+		return accessDenied
+	}
+	if accessListContains(allow, keyID, clientIP) {
+		return accessAllowed
+	}
+	return accessDefault
+}
+
+// function checks if the key matches one of the exact keys or prefixes of the list
+// or if the client ip is within one of its CIDRs
+func accessListContains(accessList AccessList, keyID string, clientIP net.IP) bool {
+	if keyID != "" {
+		for _, key := range accessList.Keys {
+			if key == keyID {
+				return true
+			}
+		}
+		for _, prefix := range accessList.Prefixes {
+			if prefix != "" && strings.HasPrefix(keyID, prefix) {
+				return true
+			}
+		}
+	}
+
+	if clientIP != nil {
+		for _, cidr := range accessList.Cidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				ErrorLog("Invalid CIDR in access list: ", cidr)
+				continue
+			}
+			if network.Contains(clientIP) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func mergeAccessLists(first AccessList, second AccessList) AccessList {
+	return AccessList{
+		Keys:     append(append([]string{}, first.Keys...), second.Keys...),
+		Prefixes: append(append([]string{}, first.Prefixes...), second.Prefixes...),
+		Cidrs:    append(append([]string{}, first.Cidrs...), second.Cidrs...),
+	}
+}
+
+// function returns the access lists of the external file, reading it again only when
+// its modification time changed so that lists can be updated without redeploying the api.
+// The last successfully read lists are kept if the file cannot be read anymore.
+func loadAccessListsFile(path string) (accessListsFile, error) {
+	accessListsFilesMutex.Lock()
+	defer accessListsFilesMutex.Unlock()
+
+	cached, ok := accessListsFiles[path]
+	if !ok {
+		cached = &cachedAccessListsFile{}
+		cached.file = newWatchedFile(path, accessListsFileCheckInterval, func(content []byte) error {
+			var lists accessListsFile
+			if err := json.Unmarshal(content, &lists); err != nil {
+				return err
+			}
+			cached.lists = lists
+			return nil
+		})
+		accessListsFiles[path] = cached
+	}
+
+	reloaded, err := cached.file.refresh()
+	if reloaded {
+		InfoLog("Access lists file reloaded: ", path)
+	}
+	return cached.lists, err
+}
+
+// function returns the ip of the client, taken from the first X-Forwarded-For entry
+// when the header is trusted and from the connection remote address otherwise
+func getClientIP(req *http.Request, trustForwardedFor bool) net.IP {
+	if trustForwardedFor {
+		if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+			return net.ParseIP(strings.TrimSpace(strings.Split(forwardedFor, ",")[0]))
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// function writes the error response for a denied request, as a SOAP fault for SOAP requests
+// (or when 'denyFormat' is "soap") and as a json error otherwise
+func writeAccessDenied(rw http.ResponseWriter, req *http.Request, accessLists AccessLists) {
+	statusCode := accessLists.DenyStatusCode
+	if statusCode == 0 {
+		statusCode = defaultDenyStatusCode
+	}
+	message := accessLists.DenyMessage
+	if message == "" {
+		message = defaultDenyMessage
+	}
+
+	format := accessLists.DenyFormat
+	if format == "" && isSoapRequest(req) {
+		format = "soap"
+	}
+
+	if format == "soap" {
+		var escaped strings.Builder
+		xml.EscapeText(&escaped, []byte(message))
+
+		rw.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		rw.WriteHeader(statusCode)
+		rw.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>` +
+			`<faultcode>s:Client</faultcode><faultstring>` + escaped.String() + `</faultstring>` +
+			`</s:Fault></s:Body></s:Envelope>`))
+		return
+	}
+
+	body, _ := json.Marshal(map[string]string{"error": message})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	rw.Write(body)
+}
+
+// function checks if the request is a SOAP request based on its headers
+func isSoapRequest(req *http.Request) bool {
+	if req.Header.Get("SOAPAction") != "" {
+		return true
+	}
+	contentType := strings.ToLower(req.Header.Get("Content-Type"))
+	return strings.Contains(contentType, "text/xml") || strings.Contains(contentType, "application/soap+xml")
+}
@@ -0,0 +1,158 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func BuildAccessListsStruct() AccessLists {
+	return AccessLists{
+		Allow: AccessList{
+			Keys:     []string{"monitoring"},
+			Prefixes: []string{"internal-"},
+			Cidrs:    []string{"10.0.0.0/8"},
+		},
+		Deny: AccessList{
+			Keys:  []string{"abusive-tenant"},
+			Cidrs: []string{"10.6.6.0/24"},
+		},
+	}
+}
+
+func Test_CheckAccessLists_Success(t *testing.T) {
+	accessLists := BuildAccessListsStruct()
+
+	tests := []struct {
+		keyID      string
+		remoteAddr string
+		expected   accessResult
+	}{
+		{"monitoring", "192.168.1.1:1234", accessAllowed},
+		{"internal-reporting", "192.168.1.1:1234", accessAllowed},
+		{"milesahead1", "10.1.2.3:1234", accessAllowed},
+		{"abusive-tenant", "192.168.1.1:1234", accessDenied},
+		// deny takes precedence over allow
+		{"monitoring", "10.6.6.6:1234", accessDenied},
+		{"milesahead1", "192.168.1.1:1234", accessDefault},
+		{"", "192.168.1.1:1234", accessDefault},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://localhost:8080/resource/", nil)
+		req.RemoteAddr = test.remoteAddr
+
+		result := checkAccessLists(accessLists, test.keyID, req)
+		if result != test.expected {
+			t.Fatalf("Access for %v from %v was not correct -- expected %v but was %v", test.keyID, test.remoteAddr, test.expected, result)
+		}
+	}
+}
+
+func Test_CheckAccessListsForwardedFor_Success(t *testing.T) {
+	accessLists := BuildAccessListsStruct()
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/resource/", nil)
+	req.RemoteAddr = "192.168.1.1:1234"
+	req.Header.Set("X-Forwarded-For", "10.6.6.6, 192.168.1.1")
+
+	if result := checkAccessLists(accessLists, "milesahead1", req); result != accessDefault {
+		t.Fatalf("X-Forwarded-For should not be trusted by default but access was %v", result)
+	}
+
+	accessLists.TrustForwardedFor = true
+	if result := checkAccessLists(accessLists, "milesahead1", req); result != accessDenied {
+		t.Fatalf("Access was not correct -- expected %v but was %v", accessDenied, result)
+	}
+}
+
+func Test_CheckAccessListsFileReload_Success(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access-lists.json")
+
+	writeFile := func(lists accessListsFile, modTime time.Time) {
+		content, _ := json.Marshal(lists)
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatalf("Error writing access lists file: %v", err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("Error setting access lists file time: %v", err)
+		}
+		// do not wait for the check interval
+		accessListsFilesMutex.Lock()
+		if cached, ok := accessListsFiles[path]; ok {
+			cached.file.lastChecked = time.Time{}
+		}
+		accessListsFilesMutex.Unlock()
+	}
+
+	accessLists := AccessLists{File: path}
+	req := httptest.NewRequest("GET", "http://localhost:8080/resource/", nil)
+
+	writeFile(accessListsFile{Deny: AccessList{Keys: []string{"milesahead1"}}}, time.Now().Add(-time.Minute))
+	if result := checkAccessLists(accessLists, "milesahead1", req); result != accessDenied {
+		t.Fatalf("Access was not correct -- expected %v but was %v", accessDenied, result)
+	}
+
+	writeFile(accessListsFile{Allow: AccessList{Keys: []string{"milesahead1"}}}, time.Now())
+	if result := checkAccessLists(accessLists, "milesahead1", req); result != accessAllowed {
+		t.Fatalf("Access was not correct after reload -- expected %v but was %v", accessAllowed, result)
+	}
+
+	// the last lists read are kept if the file is gone
+	os.Remove(path)
+	accessListsFilesMutex.Lock()
+	accessListsFiles[path].file.lastChecked = time.Time{}
+	accessListsFilesMutex.Unlock()
+	if result := checkAccessLists(accessLists, "milesahead1", req); result != accessAllowed {
+		t.Fatalf("Access was not correct after removal -- expected %v but was %v", accessAllowed, result)
+	}
+}
+
+func Test_SetRateLimitDenied_Success(t *testing.T) {
+	rateLimiting := BuildStruct()
+	rateLimiting.RateLimiting.Strategy.Name = sessionGuid
+	rateLimiting.RateLimiting.AccessLists = AccessLists{
+		Deny:           AccessList{Keys: []string{"33d9b8d0-58ba-4400-87af-bdf5f79c0f9b"}},
+		DenyStatusCode: http.StatusTooManyRequests,
+		DenyMessage:    "Tenant <blocked>",
+	}
+
+	var configData map[string]interface{}
+	marshalledConfig, _ := json.Marshal(rateLimiting)
+	json.Unmarshal(marshalledConfig, &configData)
+
+	req, err := http.NewRequest("POST", "http://localhost:8080/Routing/RoutingService.svc", strings.NewReader(routingSoapEnvelope))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	w := httptest.NewRecorder()
+	Handle(&fakeGateway{definition: ApiDefinition{Name: "Routing API", ConfigData: configData}, rw: w}, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Status code was not correct -- expected %v but was %v", http.StatusTooManyRequests, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "<faultstring>Tenant &lt;blocked&gt;</faultstring>") {
+		t.Fatalf("SOAP fault was expected but was %v", w.Body.String())
+	}
+}
+
+func Test_WriteAccessDeniedJson_Success(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost:8080/resource/", nil)
+	w := httptest.NewRecorder()
+
+	writeAccessDenied(w, req, AccessLists{})
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Status code was not correct -- expected %v but was %v", http.StatusForbidden, w.Code)
+	}
+	if w.Body.String() != `{"error":"`+defaultDenyMessage+`"}` {
+		t.Fatalf("Body was not correct -- was %v", w.Body.String())
+	}
+}
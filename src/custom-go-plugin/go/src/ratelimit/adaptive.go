@@ -0,0 +1,160 @@
+// Adaptive rate limits driven by upstream health.
+// when 'adaptive' is enabled for an api, the responses recorded by the response hook feed
+// a controller that keeps a scale applied to the configured 'requests' values.
+// At the end of each window the scale is multiplied by 'decreaseFactor' if the upstream
+// was unhealthy (error rate or average latency above their thresholds) and increased by
+// 'increaseStep' otherwise (AIMD), always staying within the 'floor' and 'ceiling' bounds.
+package ratelimit
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Adaptive struct {
+	Enabled            bool    `json:"enabled"`
+	LatencyThresholdMs int     `json:"latencyThresholdMs"`
+	ErrorRateThreshold float64 `json:"errorRateThreshold"`
+	WindowSec          int     `json:"windowSec"`
+	MinSamples         int     `json:"minSamples"`
+	DecreaseFactor     float64 `json:"decreaseFactor"`
+	IncreaseStep       float64 `json:"increaseStep"`
+	Floor              float64 `json:"floor"`
+	Ceiling            float64 `json:"ceiling"`
+}
+
+// default values used for the settings left empty in the api definition config
+const defaultAdaptiveWindowSec = 10
+const defaultAdaptiveMinSamples = 10
+const defaultAdaptiveDecreaseFactor = 0.5
+const defaultAdaptiveIncreaseStep = 0.1
+const defaultAdaptiveFloor = 0.1
+const defaultAdaptiveCeiling = 1.0
+
+type adaptiveController struct {
+	mutex        sync.Mutex
+	config       Adaptive
+	scale        float64
+	windowStart  time.Time
+	samples      int
+	errors       int
+	totalLatency time.Duration
+}
+
+var adaptiveControllersMutex sync.Mutex
+var adaptiveControllers = map[string]*adaptiveController{}
+
+// function returns the controller of the api, creating it when needed, and updates
+// its settings with the ones of the current api definition config
+func getAdaptiveController(apiID string, config Adaptive) *adaptiveController {
+	config = withAdaptiveDefaults(config)
+
+	adaptiveControllersMutex.Lock()
+	controller, ok := adaptiveControllers[apiID]
+	if !ok {
+		controller = &adaptiveController{scale: config.Ceiling, windowStart: clock.Now()}
+		adaptiveControllers[apiID] = controller
+	}
+	adaptiveControllersMutex.Unlock()
+
+	controller.mutex.Lock()
+	controller.config = config
+	controller.scale = math.Max(config.Floor, math.Min(config.Ceiling, controller.scale))
+	controller.mutex.Unlock()
+
+	return controller
+}
+
+// function returns the controller of the api if adaptive limits were enabled for it
+func findAdaptiveController(apiID string) *adaptiveController {
+	adaptiveControllersMutex.Lock()
+	defer adaptiveControllersMutex.Unlock()
+	return adaptiveControllers[apiID]
+}
+
+func withAdaptiveDefaults(config Adaptive) Adaptive {
+	if config.WindowSec <= 0 {
+		config.WindowSec = defaultAdaptiveWindowSec
+	}
+	if config.MinSamples <= 0 {
+		config.MinSamples = defaultAdaptiveMinSamples
+	}
+	if config.DecreaseFactor <= 0 || config.DecreaseFactor >= 1 {
+		config.DecreaseFactor = defaultAdaptiveDecreaseFactor
+	}
+	if config.IncreaseStep <= 0 {
+		config.IncreaseStep = defaultAdaptiveIncreaseStep
+	}
+	if config.Ceiling <= 0 {
+		config.Ceiling = defaultAdaptiveCeiling
+	}
+	if config.Floor <= 0 || config.Floor > config.Ceiling {
+		config.Floor = math.Min(defaultAdaptiveFloor, config.Ceiling)
+	}
+	return config
+}
+
+// function records the outcome of an upstream response
+func (controller *adaptiveController) observe(statusCode int, latency time.Duration) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	controller.evaluate(clock.Now())
+
+	controller.samples++
+	controller.totalLatency += latency
+	if statusCode >= http.StatusInternalServerError {
+		controller.errors++
+	}
+}
+
+// function returns the current scale applied to the configured limits
+func (controller *adaptiveController) currentScale() float64 {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	controller.evaluate(clock.Now())
+	return controller.scale
+}
+
+// function closes the current window if it has elapsed and adjusts the scale based on the
+// upstream health observed during that window, the scale is left unchanged when there
+// were not enough samples to tell. Must be called with the mutex held.
+func (controller *adaptiveController) evaluate(now time.Time) {
+	window := time.Duration(controller.config.WindowSec) * time.Second
+	if now.Sub(controller.windowStart) < window {
+		return
+	}
+
+	if controller.samples >= controller.config.MinSamples {
+		errorRate := float64(controller.errors) / float64(controller.samples)
+		averageLatency := controller.totalLatency / time.Duration(controller.samples)
+
+		unhealthy := (controller.config.ErrorRateThreshold > 0 && errorRate > controller.config.ErrorRateThreshold) ||
+			(controller.config.LatencyThresholdMs > 0 && averageLatency > time.Duration(controller.config.LatencyThresholdMs)*time.Millisecond)
+
+		if unhealthy {
+			controller.scale = math.Max(controller.config.Floor, controller.scale*controller.config.DecreaseFactor)
+			InfoLog("Upstream unhealthy, adaptive scale decreased to ", controller.scale)
+		} else {
+			controller.scale = math.Min(controller.config.Ceiling, controller.scale+controller.config.IncreaseStep)
+			DebugLog("Upstream healthy, adaptive scale: ", controller.scale)
+		}
+	}
+
+	controller.windowStart = now
+	controller.samples = 0
+	controller.errors = 0
+	controller.totalLatency = 0
+}
+
+// function scales the 'requests' value with the current scale of the controller,
+// unlimited values are left as is and at least one request is always allowed
+func (controller *adaptiveController) scaleRequests(requests float64) float64 {
+	if requests <= 0 {
+		return requests
+	}
+	return math.Max(1, math.Floor(requests*controller.currentScale()))
+}
@@ -0,0 +1,177 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type manualClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// fake upstream whose latency (measured on the manual clock) and status code can be changed
+type fakeUpstream struct {
+	*httptest.Server
+	mutex      sync.Mutex
+	latency    time.Duration
+	statusCode int
+}
+
+func newFakeUpstream(t *testing.T, clk *manualClock) *fakeUpstream {
+	upstream := &fakeUpstream{statusCode: http.StatusOK}
+	upstream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.mutex.Lock()
+		defer upstream.mutex.Unlock()
+		clk.Advance(upstream.latency)
+		w.WriteHeader(upstream.statusCode)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func (upstream *fakeUpstream) set(latency time.Duration, statusCode int) {
+	upstream.mutex.Lock()
+	defer upstream.mutex.Unlock()
+	upstream.latency = latency
+	upstream.statusCode = statusCode
+}
+
+// sends n requests to the fake upstream and records each response with the response hook
+func (upstream *fakeUpstream) send(t *testing.T, clk *manualClock, apiID string, n int) {
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest("GET", "http://localhost:8080/DeviceWebService", nil)
+		setRequestState(req, &requestState{apiID: apiID, received: clk.Now()})
+
+		res, err := http.Get(upstream.URL)
+		if err != nil {
+			t.Fatalf("Error calling fake upstream: %v", err)
+		}
+		res.Body.Close()
+
+		RecordResponse(httptest.NewRecorder(), res, req)
+	}
+}
+
+func BuildAdaptiveStruct() Adaptive {
+	return Adaptive{
+		Enabled:            true,
+		LatencyThresholdMs: 100,
+		ErrorRateThreshold: 0.2,
+		WindowSec:          10,
+		MinSamples:         5,
+		DecreaseFactor:     0.5,
+		IncreaseStep:       0.25,
+		Floor:              0.2,
+		Ceiling:            1,
+	}
+}
+
+func Test_AdaptiveScaleWithFakeUpstream_Success(t *testing.T) {
+	clk := &manualClock{now: time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)}
+	previous := clock
+	clock = clk
+	t.Cleanup(func() { clock = previous })
+
+	upstream := newFakeUpstream(t, clk)
+	controller := getAdaptiveController("adaptive-fake-upstream", BuildAdaptiveStruct())
+
+	steps := []struct {
+		name          string
+		latency       time.Duration
+		statusCode    int
+		requests      int
+		expectedScale float64
+	}{
+		{"healthy", 10 * time.Millisecond, http.StatusOK, 5, 1},
+		{"errors", 10 * time.Millisecond, http.StatusBadGateway, 5, 0.5},
+		{"slow", 300 * time.Millisecond, http.StatusOK, 5, 0.25},
+		{"still slow, floor reached", 300 * time.Millisecond, http.StatusOK, 5, 0.2},
+		{"not enough samples", 300 * time.Millisecond, http.StatusOK, 4, 0.2},
+		{"recovering", 10 * time.Millisecond, http.StatusOK, 5, 0.45},
+		{"recovering", 10 * time.Millisecond, http.StatusOK, 5, 0.7},
+		{"recovering", 10 * time.Millisecond, http.StatusOK, 5, 0.95},
+		{"recovered, ceiling reached", 10 * time.Millisecond, http.StatusOK, 5, 1},
+	}
+
+	for _, step := range steps {
+		upstream.set(step.latency, step.statusCode)
+		upstream.send(t, clk, "adaptive-fake-upstream", step.requests)
+		clk.Advance(10 * time.Second)
+
+		scale := controller.currentScale()
+		if scale < step.expectedScale-0.0001 || scale > step.expectedScale+0.0001 {
+			t.Fatalf("Scale was not correct after %v -- expected %v but was %v", step.name, step.expectedScale, scale)
+		}
+	}
+}
+
+func Test_AdaptiveScaleRequests_Success(t *testing.T) {
+	controller := getAdaptiveController("adaptive-scale-requests", BuildAdaptiveStruct())
+	controller.mutex.Lock()
+	controller.scale = 0.25
+	controller.mutex.Unlock()
+
+	tests := []struct {
+		requests float64
+		expected float64
+	}{
+		{10, 2},
+		{2, 1},
+		{-1, -1},
+	}
+
+	for _, test := range tests {
+		if result := controller.scaleRequests(test.requests); result != test.expected {
+			t.Fatalf("Scaled requests was not correct -- expected %v but was %v", test.expected, result)
+		}
+	}
+}
+
+func Test_AdaptiveDefaults_Success(t *testing.T) {
+	config := withAdaptiveDefaults(Adaptive{Enabled: true, Ceiling: 0.05})
+
+	if config.WindowSec != defaultAdaptiveWindowSec || config.MinSamples != defaultAdaptiveMinSamples ||
+		config.DecreaseFactor != defaultAdaptiveDecreaseFactor || config.IncreaseStep != defaultAdaptiveIncreaseStep {
+		t.Fatalf("Defaults were not applied: %v", config)
+	}
+	if config.Floor > config.Ceiling {
+		t.Fatalf("Floor %v should not be above ceiling %v", config.Floor, config.Ceiling)
+	}
+}
+
+func Test_SetRateLimitStoresRequestState_Success(t *testing.T) {
+	var configData map[string]interface{}
+	rateLimiting := BuildStruct()
+	rateLimiting.RateLimiting.Adaptive = BuildAdaptiveStruct()
+	marshalledConfig, _ := json.Marshal(rateLimiting)
+	json.Unmarshal(marshalledConfig, &configData)
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/resource-3/", nil)
+	req.Header.Set("x-tenant-id", "milesahead2")
+	Handle(&fakeGateway{definition: ApiDefinition{APIID: "adaptive-set-rate-limit", Name: "Adaptive API", ConfigData: configData}, rw: httptest.NewRecorder()}, req)
+
+	state := getRequestState(req)
+	if state == nil || state.apiID != "adaptive-set-rate-limit" {
+		t.Fatalf("Request state was not correct: %v", state)
+	}
+	if findAdaptiveController("adaptive-set-rate-limit") == nil {
+		t.Fatalf("Adaptive controller was expected for the api")
+	}
+}
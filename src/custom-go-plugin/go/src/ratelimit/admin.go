@@ -0,0 +1,333 @@
+// Admin endpoint of the rate limiting plugin.
+// when enabled in the 'admin' section of the api definition config, requests to the admin
+// path of the api are answered by the plugin itself instead of being proxied upstream.
+// Every admin request must identify its user for the audit log: either with the secret of
+// the user in the secret header, or with the shared secret along with the name of the user in
+// the user header. The admin path comes right after the listen path of the api, the other
+// paths being proxied as usual.
+//
+//	GET  {path}/config            the parsed rate limiting config of the api
+//	POST {path}/dry-run           key extraction and limits resolution for a sample request
+//	GET  {path}/counters?key=...  the current counters of a key
+//	POST {path}/reset             reset the counters of a key
+//	GET  {path}/grants            the active grants of the api
+//	POST {path}/grants            grant temporary limits to a key
+//	DELETE {path}/grants?key=...  revoke the grant of a key
+//	GET  {path}/audit             the last admin operations on the api
+package ratelimit
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type Admin struct {
+	Enabled      bool   `json:"enabled"`
+	Path         string `json:"path"`
+	SecretHeader string `json:"secretHeader"`
+	// the secret itself or the name of the environment variable of the gateway holding it
+	Secret    string `json:"secret"`
+	SecretEnv string `json:"secretEnv"`
+	// header holding the name of the user making the request, required with the shared secret
+	UserHeader string      `json:"userHeader"`
+	Users      []AdminUser `json:"users"`
+	StateFile  string      `json:"stateFile"`
+	AuditFile  string      `json:"auditFile"`
+}
+
+// AdminUser is a user of the admin endpoint having its own secret, the requests sent with the
+// secret being audited under the name of the user
+type AdminUser struct {
+	Name      string `json:"name"`
+	Secret    string `json:"secret"`
+	SecretEnv string `json:"secretEnv"`
+}
+
+const defaultAdminPath = "/_ratelimit"
+const defaultAdminSecretHeader = "X-RateLimit-Admin-Secret"
+const defaultAdminUserHeader = "X-RateLimit-Admin-User"
+const redactedValue = "REDACTED"
+
+// body of the reset and grant requests
+type adminKeyRequest struct {
+	Key         string  `json:"key"`
+	Multiplier  float64 `json:"multiplier"`
+	Requests    float64 `json:"requests"`
+	Seconds     float64 `json:"seconds"`
+	DurationSec int     `json:"durationSec"`
+	Reason      string  `json:"reason"`
+}
+
+type adminConfigResponse struct {
+	Api    string             `json:"api"`
+	ApiID  string             `json:"apiId"`
+	Config RateLimitingConfig `json:"config"`
+}
+
+type adminCountersResponse struct {
+	KeyID        string            `json:"keyId"`
+	KeyHash      string            `json:"keyHash"`
+	SessionKeyID string            `json:"sessionKeyId"`
+	Usage        *keyUsageSnapshot `json:"usage"`
+	Responses    *keyOutcomes      `json:"responses"`
+	Grant        *grant            `json:"grant"`
+}
+
+type adminErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// function answers the request when it is sent to the admin endpoint of the config.
+// Returns false when the request is not an admin request and must be rate limited as usual.
+func handleAdminRequest(rw http.ResponseWriter, req *http.Request, apidef ApiDefinition, rateLimitingConfig RateLimitingConfig) bool {
+	admin := rateLimitingConfig.RateLimiting.Admin
+	if !admin.Enabled {
+		return false
+	}
+
+	apiName, apiID := apidef.Name, apidef.APIID
+	route, ok := getAdminRoute(req.URL.Path, apidef.ListenPath, admin)
+	if !ok {
+		return false
+	}
+
+	user, err := authenticateAdmin(req, admin)
+	if err != nil {
+		InfoLog("Unauthorized admin request: " + req.URL.Path)
+		writeAdminResponse(rw, http.StatusUnauthorized, adminErrorResponse{Error: err.Error()})
+		return true
+	}
+
+	DebugLog("Admin request: " + req.Method + " " + route + " by " + user)
+	switch {
+	case route == "config" && req.Method == http.MethodGet:
+		writeAdminResponse(rw, http.StatusOK, adminConfigResponse{Api: apiName, ApiID: apiID, Config: redactConfig(rateLimitingConfig)})
+
+	case route == "dry-run" && req.Method == http.MethodPost:
+		var sample SampleRequest
+		if err := json.NewDecoder(req.Body).Decode(&sample); err != nil {
+			writeAdminResponse(rw, http.StatusBadRequest, adminErrorResponse{Error: "invalid sample request: " + err.Error()})
+			return true
+		}
+		sampleRequest, err := sample.BuildRequest(req.Host)
+		if err != nil {
+			writeAdminResponse(rw, http.StatusBadRequest, adminErrorResponse{Error: "invalid sample request: " + err.Error()})
+			return true
+		}
+		writeAdminResponse(rw, http.StatusOK, Resolve(rateLimitingConfig, apiID, sampleRequest))
+
+	case route == "counters" && req.Method == http.MethodGet:
+		keyID := req.URL.Query().Get("key")
+		if keyID == "" {
+			writeAdminResponse(rw, http.StatusBadRequest, adminErrorResponse{Error: "missing 'key' query parameter"})
+			return true
+		}
+		writeAdminResponse(rw, http.StatusOK, getCounters(admin, apiID, keyID))
+
+	case route == "reset" && req.Method == http.MethodPost:
+		var keyRequest adminKeyRequest
+		if err := json.NewDecoder(req.Body).Decode(&keyRequest); err != nil || keyRequest.Key == "" {
+			writeAdminResponse(rw, http.StatusBadRequest, adminErrorResponse{Error: "a json body with the 'key' to reset is required"})
+			return true
+		}
+		now := clock.Now()
+		expires := now.Add(resetRetention(rateLimitingConfig.RateLimiting, apiID, keyRequest.Key, now))
+		if err := getAdminStore(admin.StateFile).reset(apiID, keyRequest.Key, now, expires); err != nil {
+			ErrorLog("Admin state file error: ", err)
+			writeAdminResponse(rw, http.StatusInternalServerError, adminErrorResponse{Error: "the reset could not be saved"})
+			return true
+		}
+		resetKeyCounters(apiID, keyRequest.Key)
+		audit(admin, auditEntry{Time: now, User: user, Action: auditReset, Api: apiName, ApiID: apiID, KeyID: keyRequest.Key, RemoteAddr: req.RemoteAddr})
+		writeAdminResponse(rw, http.StatusOK, getCounters(admin, apiID, keyRequest.Key))
+
+	case route == "grants" && req.Method == http.MethodGet:
+		writeAdminResponse(rw, http.StatusOK, getAdminStore(admin.StateFile).activeGrants(apiID, clock.Now()))
+
+	case route == "grants" && req.Method == http.MethodPost:
+		var keyRequest adminKeyRequest
+		if err := json.NewDecoder(req.Body).Decode(&keyRequest); err != nil {
+			writeAdminResponse(rw, http.StatusBadRequest, adminErrorResponse{Error: "invalid grant request: " + err.Error()})
+			return true
+		}
+		now := clock.Now()
+		newGrant := grant{
+			ApiID:      apiID,
+			KeyID:      keyRequest.Key,
+			Multiplier: keyRequest.Multiplier,
+			Requests:   keyRequest.Requests,
+			Seconds:    keyRequest.Seconds,
+			Reason:     keyRequest.Reason,
+			GrantedBy:  user,
+			Granted:    now,
+			Expires:    now.Add(time.Duration(keyRequest.DurationSec) * time.Second),
+		}
+		if err := newGrant.validate(); err != nil {
+			writeAdminResponse(rw, http.StatusBadRequest, adminErrorResponse{Error: "invalid grant request: " + err.Error()})
+			return true
+		}
+		if err := getAdminStore(admin.StateFile).addGrant(newGrant, now); err != nil {
+			ErrorLog("Admin state file error: ", err)
+			writeAdminResponse(rw, http.StatusInternalServerError, adminErrorResponse{Error: "the grant could not be saved"})
+			return true
+		}
+		audit(admin, auditEntry{Time: now, User: newGrant.GrantedBy, Action: auditGrant, Api: apiName, ApiID: apiID, KeyID: newGrant.KeyID, Grant: &newGrant, RemoteAddr: req.RemoteAddr})
+		writeAdminResponse(rw, http.StatusCreated, newGrant)
+
+	case route == "grants" && req.Method == http.MethodDelete:
+		keyID := req.URL.Query().Get("key")
+		if keyID == "" {
+			writeAdminResponse(rw, http.StatusBadRequest, adminErrorResponse{Error: "missing 'key' query parameter"})
+			return true
+		}
+		now := clock.Now()
+		revoked, err := getAdminStore(admin.StateFile).revokeGrant(apiID, keyID, now)
+		if err != nil {
+			ErrorLog("Admin state file error: ", err)
+			writeAdminResponse(rw, http.StatusInternalServerError, adminErrorResponse{Error: "the revocation could not be saved"})
+			return true
+		}
+		if !revoked {
+			writeAdminResponse(rw, http.StatusNotFound, adminErrorResponse{Error: "no active grant for key " + keyID})
+			return true
+		}
+		audit(admin, auditEntry{Time: now, User: user, Action: auditRevoke, Api: apiName, ApiID: apiID, KeyID: keyID, RemoteAddr: req.RemoteAddr})
+		rw.WriteHeader(http.StatusNoContent)
+
+	case route == "audit" && req.Method == http.MethodGet:
+		writeAdminResponse(rw, http.StatusOK, getAuditEntries(apiID))
+
+	default:
+		writeAdminResponse(rw, http.StatusNotFound, adminErrorResponse{Error: "unknown admin operation " + req.Method + " " + route})
+	}
+	return true
+}
+
+// function returns the admin operation of the path ("config", "dry-run"...) and whether the
+// path is under the admin path at all, the admin path coming right after the listen path of the
+// api so that the upstream paths holding the same segment (e.g. /api/v1/admin/users) are proxied
+func getAdminRoute(path string, listenPath string, admin Admin) (string, bool) {
+	adminPath := admin.Path
+	if adminPath == "" {
+		adminPath = defaultAdminPath
+	}
+	adminPath = "/" + strings.Trim(adminPath, "/")
+
+	path = trimListenPath(path, listenPath)
+	if path != adminPath && !strings.HasPrefix(path, adminPath+"/") {
+		return "", false
+	}
+	return strings.Trim(path[len(adminPath):], "/"), true
+}
+
+// function returns the user making the admin request: the user whose secret is sent in the
+// secret header, or the user named in the user header when the shared secret is sent
+func authenticateAdmin(req *http.Request, admin Admin) (string, error) {
+	header := admin.SecretHeader
+	if header == "" {
+		header = defaultAdminSecretHeader
+	}
+	sent := []byte(req.Header.Get(header))
+
+	configured := false
+	for _, user := range admin.Users {
+		secret := getSecret(user.Secret, user.SecretEnv)
+		if secret == "" || user.Name == "" {
+			continue
+		}
+		configured = true
+		if subtle.ConstantTimeCompare(sent, []byte(secret)) == 1 {
+			return user.Name, nil
+		}
+	}
+
+	if secret := getSecret(admin.Secret, admin.SecretEnv); secret != "" {
+		configured = true
+		if subtle.ConstantTimeCompare(sent, []byte(secret)) == 1 {
+			userHeader := admin.UserHeader
+			if userHeader == "" {
+				userHeader = defaultAdminUserHeader
+			}
+			if user := req.Header.Get(userHeader); user != "" {
+				return user, nil
+			}
+			return "", fmt.Errorf("the %v header is required with the shared admin secret", userHeader)
+		}
+	}
+
+	if !configured {
+		ErrorLog("Admin endpoint is enabled without a secret, every admin request is rejected")
+	}
+	return "", errors.New("missing or invalid admin secret")
+}
+
+// function returns the secret itself or the value of the environment variable holding it
+func getSecret(secret string, secretEnv string) string {
+	if secret == "" && secretEnv != "" {
+		return os.Getenv(secretEnv)
+	}
+	return secret
+}
+
+// function returns a copy of the config without its secrets
+func redactConfig(rateLimitingConfig RateLimitingConfig) RateLimitingConfig {
+	redacted := rateLimitingConfig
+	if redacted.RateLimiting.Admin.Secret != "" {
+		redacted.RateLimiting.Admin.Secret = redactedValue
+	}
+	users := make([]AdminUser, len(redacted.RateLimiting.Admin.Users))
+	for i, user := range redacted.RateLimiting.Admin.Users {
+		if user.Secret != "" {
+			user.Secret = redactedValue
+		}
+		users[i] = user
+	}
+	redacted.RateLimiting.Admin.Users = users
+
+	sinks := make([]EventSink, len(redacted.RateLimiting.Events.Sinks))
+	for i, sink := range redacted.RateLimiting.Events.Sinks {
+		if sink.Headers != nil {
+			headers := make(map[string]string, len(sink.Headers))
+			for name := range sink.Headers {
+				headers[name] = redactedValue
+			}
+			sink.Headers = headers
+		}
+		sinks[i] = sink
+	}
+	redacted.RateLimiting.Events.Sinks = sinks
+	return redacted
+}
+
+func getCounters(admin Admin, apiID string, keyID string) adminCountersResponse {
+	now := clock.Now()
+	counters := adminCountersResponse{KeyID: keyID, KeyHash: hashKeyID(keyID), SessionKeyID: getSessionKeyID(admin, apiID, keyID)}
+	if usage, ok := getKeyUsage(apiID, keyID, now); ok {
+		counters.Usage = &usage
+	}
+	if outcome, ok := getKeyOutcomes(apiID, keyID); ok {
+		counters.Responses = &outcome
+	}
+	if g, ok := getAdminStore(admin.StateFile).findGrant(apiID, keyID, now); ok {
+		counters.Grant = &g
+	}
+	return counters
+}
+
+func writeAdminResponse(rw http.ResponseWriter, statusCode int, response interface{}) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		ErrorLog("Admin response error: ", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	rw.Write(body)
+}
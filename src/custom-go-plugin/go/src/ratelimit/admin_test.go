@@ -0,0 +1,229 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func BuildAdminStruct() RateLimitingConfig {
+	rateLimiting := BuildStruct()
+	rateLimiting.RateLimiting.Admin = Admin{
+		Enabled:      true,
+		Path:         "/_ratelimit",
+		SecretHeader: "x-admin-secret",
+		Secret:       "s3cr3t",
+	}
+	rateLimiting.RateLimiting.Events = Events{
+		Sinks: []EventSink{{Type: "webhook", Url: "http://localhost:1", Headers: map[string]string{"x-api-key": "webhook-secret"}}},
+	}
+	return rateLimiting
+}
+
+func adminRequest(method string, path string, body string, secret string) *http.Request {
+	req := httptest.NewRequest(method, "http://localhost:8080"+path, strings.NewReader(body))
+	if secret != "" {
+		req.Header.Set("x-admin-secret", secret)
+		req.Header.Set("X-RateLimit-Admin-User", "support-test")
+	}
+	return req
+}
+
+func Test_AdminUnauthorized_Success(t *testing.T) {
+	for _, secret := range []string{"", "wrong"} {
+		w := runHandle(t, "admin-unauthorized", BuildAdminStruct(), adminRequest("GET", "/my-api/_ratelimit/config", "", secret))
+
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("Status code was not correct -- expected %v but was %v", http.StatusUnauthorized, w.Code)
+		}
+		if strings.Contains(w.Body.String(), "s3cr3t") {
+			t.Fatalf("Secret should not be returned: %v", w.Body.String())
+		}
+	}
+}
+
+func Test_AdminConfig_Success(t *testing.T) {
+	w := runHandle(t, "admin-config", BuildAdminStruct(), adminRequest("GET", "/my-api/_ratelimit/config", "", "s3cr3t"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status code was not correct -- expected %v but was %v", http.StatusOK, w.Code)
+	}
+
+	var response adminConfigResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Response was not valid json: %v", err)
+	}
+	if response.ApiID != "admin-config" || response.Config.RateLimiting.Requests != 2 || len(response.Config.RateLimiting.Overrides) != 2 {
+		t.Fatalf("Config was not correct: %v", w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "s3cr3t") || strings.Contains(w.Body.String(), "webhook-secret") {
+		t.Fatalf("Secrets should be redacted: %v", w.Body.String())
+	}
+}
+
+func Test_AdminDryRun_Success(t *testing.T) {
+	sample := `{"method": "GET", "path": "/resource-2/?debug=true", "headers": {"x-tenant-id": "milesahead2", "Authorization": "Bearer abc"}}`
+	w := runHandle(t, "admin-dry-run", BuildAdminStruct(), adminRequest("POST", "/_ratelimit/dry-run", sample, "s3cr3t"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status code was not correct -- expected %v but was %v: %v", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var response Decision
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Strategy != "requestHeaders" || response.KeyID != "milesahead2::::::abc" || response.Access != "default" {
+		t.Fatalf("Key extraction was not correct: %v", w.Body.String())
+	}
+	if response.Override == nil || response.Override.Resource != "/resource-2/" {
+		t.Fatalf("Override was not correct: %v", w.Body.String())
+	}
+	if response.Requests != 5 || response.Seconds != 60 || response.SessionTtl != 120 {
+		t.Fatalf("Limits were not correct: %v", w.Body.String())
+	}
+
+	// the sample request must not be counted
+	if _, ok := getKeyUsage("admin-dry-run", response.KeyID, clock.Now()); ok {
+		t.Fatalf("Dry run should not be counted")
+	}
+}
+
+func Test_AdminDryRunInvalidRequest_Success(t *testing.T) {
+	w := runHandle(t, "admin-dry-run-invalid", BuildAdminStruct(), adminRequest("POST", "/_ratelimit/dry-run", "not json", "s3cr3t"))
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Status code was not correct -- expected %v but was %v", http.StatusBadRequest, w.Code)
+	}
+}
+
+func Test_AdminCounters_Success(t *testing.T) {
+	clk := &manualClock{now: time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)}
+	previous := clock
+	clock = clk
+	t.Cleanup(func() { clock = previous })
+
+	rateLimiting := BuildAdminStruct()
+	rateLimiting.RateLimiting.Events = Events{}
+
+	var lastRequest *http.Request
+	for i := 0; i < 3; i++ {
+		lastRequest = httptest.NewRequest("GET", "http://localhost:8080/resource-3/", nil)
+		lastRequest.Header.Set("x-tenant-id", "milesahead4")
+		runHandle(t, "admin-counters", rateLimiting, lastRequest)
+	}
+	RecordResponse(httptest.NewRecorder(), &http.Response{StatusCode: http.StatusOK, ContentLength: 10, Body: http.NoBody}, lastRequest)
+
+	w := runHandle(t, "admin-counters", rateLimiting, adminRequest("GET", "/_ratelimit/counters?key=milesahead4::::::", "", "s3cr3t"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status code was not correct -- expected %v but was %v", http.StatusOK, w.Code)
+	}
+
+	var response adminCountersResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Usage == nil || response.Usage.Usage != 3 || !response.Usage.Throttled || response.Usage.Requests != 2 {
+		t.Fatalf("Usage was not correct: %v", w.Body.String())
+	}
+	if response.Responses == nil || response.Responses.Responses != 1 {
+		t.Fatalf("Responses were not correct: %v", w.Body.String())
+	}
+
+	w = runHandle(t, "admin-counters", rateLimiting, adminRequest("GET", "/_ratelimit/counters", "", "s3cr3t"))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Status code was not correct -- expected %v but was %v", http.StatusBadRequest, w.Code)
+	}
+}
+
+func Test_AdminUpstreamPath_Success(t *testing.T) {
+	rateLimiting := BuildAdminStruct()
+	rateLimiting.RateLimiting.Admin.Path = "/admin"
+
+	var configData map[string]interface{}
+	marshalledConfig, _ := json.Marshal(rateLimiting)
+	json.Unmarshal(marshalledConfig, &configData)
+
+	// a route of the upstream under the listen path, not the admin endpoint
+	req := adminRequest("GET", "/my-api/v1/admin/users", "", "")
+	req.Header.Set("x-tenant-id", "milesahead1")
+	w := httptest.NewRecorder()
+	gateway := &fakeGateway{definition: ApiDefinition{APIID: "admin-upstream", Name: "admin-upstream", ListenPath: "/my-api/", ConfigData: configData}, rw: w}
+	Handle(gateway, req)
+
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || len(gateway.sessions) != 1 {
+		t.Fatalf("Request should be proxied -- expected a session but was %v %v", w.Code, w.Body.String())
+	}
+}
+
+func Test_AdminDisabled_Success(t *testing.T) {
+	rateLimiting := BuildAdminStruct()
+	rateLimiting.RateLimiting.Admin.Enabled = false
+
+	req := adminRequest("GET", "/_ratelimit/config", "", "s3cr3t")
+	if handleAdminRequest(httptest.NewRecorder(), req, ApiDefinition{APIID: "admin-disabled", Name: "admin-disabled"}, rateLimiting) {
+		t.Fatalf("Admin request should not be handled when the endpoint is disabled")
+	}
+}
+
+func Test_GetAdminRoute_Success(t *testing.T) {
+	tests := []struct {
+		path     string
+		route    string
+		expected bool
+	}{
+		{"/_ratelimit/config", "config", true},
+		{"/my-api/_ratelimit/counters/", "counters", true},
+		{"/my-api/_ratelimit", "", true},
+		{"/My-Api/_ratelimit", "", true},
+		{"/my-api/resource", "", false},
+		{"/my-api/_ratelimiting/config", "", false},
+		// upstream paths holding the admin path
+		{"/my-api/v1/_ratelimit/config", "", false},
+		{"/my-api/orders/_ratelimit", "", false},
+	}
+
+	for _, test := range tests {
+		route, ok := getAdminRoute(test.path, "/{?:(?i)my-api}/", Admin{Path: "_ratelimit/"})
+		if route != test.route || ok != test.expected {
+			t.Fatalf("Route of %v was not correct -- expected %v/%v but was %v/%v", test.path, test.route, test.expected, route, ok)
+		}
+	}
+}
+
+func Test_AdminUserSecret_Success(t *testing.T) {
+	rateLimiting := BuildAdminStruct()
+	rateLimiting.RateLimiting.Admin.Users = []AdminUser{{Name: "support-ann", Secret: "ann-s3cr3t"}}
+
+	// the user of a personal secret cannot be changed by the user header
+	req := adminRequest("POST", "/_ratelimit/grants", `{"key": "milesahead12::::::", "multiplier": 2, "durationSec": 600}`, "ann-s3cr3t")
+	req.Header.Set("X-RateLimit-Admin-User", "someone-else")
+	w := runHandle(t, "admin-user-secret", rateLimiting, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Status code was not correct -- expected %v but was %v: %v", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	w = runHandle(t, "admin-user-secret", rateLimiting, adminRequest("GET", "/_ratelimit/audit", "", "s3cr3t"))
+	var entries []auditEntry
+	json.Unmarshal(w.Body.Bytes(), &entries)
+	if len(entries) != 1 || entries[0].User != "support-ann" {
+		t.Fatalf("Audit log was not correct -- expected user support-ann but was %v", w.Body.String())
+	}
+
+	w = runHandle(t, "admin-user-secret", rateLimiting, adminRequest("GET", "/_ratelimit/config", "", "ann-s3cr3t"))
+	if strings.Contains(w.Body.String(), "ann-s3cr3t") {
+		t.Fatalf("User secret should be redacted: %v", w.Body.String())
+	}
+}
+
+func Test_AdminSharedSecretWithoutUser_Success(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost:8080/my-api/_ratelimit/config", nil)
+	req.Header.Set("x-admin-secret", "s3cr3t")
+	w := runHandle(t, "admin-without-user", BuildAdminStruct(), req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Status code was not correct -- expected %v but was %v", http.StatusUnauthorized, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "X-RateLimit-Admin-User") {
+		t.Fatalf("Error should name the user header: %v", w.Body.String())
+	}
+}
@@ -0,0 +1,156 @@
+// Rate limiting decisions outside of the gateway.
+// Resolve runs the key extraction and limits resolution of SetRateLimit against a request
+// without counting it nor setting any session, for the dry-run of the admin endpoint and
+// the command line tools replaying captured requests.
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Decision is the result of the key extraction and limits resolution for a request
+type Decision struct {
+	Strategy   string    `json:"strategy"`
+	KeyID      string    `json:"keyId"`
+	KeyHash    string    `json:"keyHash"`
+	Access     string    `json:"access"`
+	Override   *Override `json:"override"`
+	Requests   float64   `json:"requests"`
+	Seconds    float64   `json:"seconds"`
+	SessionTtl int64     `json:"sessionTtl"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// SampleRequest is a request described in json, as posted to the admin endpoint or captured
+type SampleRequest struct {
+	Time       time.Time         `json:"time"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+	RemoteAddr string            `json:"remoteAddr"`
+}
+
+// ParseConfig returns the rate limiting config of the config data of an api definition
+func ParseConfig(configData interface{}) (RateLimitingConfig, error) {
+	marshalledConfig, err := json.Marshal(configData)
+	if err != nil {
+		return RateLimitingConfig{}, err
+	}
+	return generateStructFromJSON(string(marshalledConfig))
+}
+
+// SetClock replaces the clock used to resolve the schedules and expire the grants,
+// returning the previous clock
+func SetClock(c Clock) Clock {
+	previous := clock
+	clock = c
+	return previous
+}
+
+// OverrideLabel returns a short description of the override, "none" if nil
+func OverrideLabel(override *Override) string {
+	return overrideLabel(override)
+}
+
+// BuildRequest returns the http request of the sample, sent to the given host
+// unless the sample has a Host header
+func (sample SampleRequest) BuildRequest(host string) (*http.Request, error) {
+	method := sample.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	path := sample.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	req, err := http.NewRequest(method, "http://"+host+path, bytes.NewReader([]byte(sample.Body)))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range sample.Headers {
+		req.Header.Set(name, value)
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+		}
+	}
+	req.RemoteAddr = sample.RemoteAddr
+	return req, nil
+}
+
+// Resolve runs the key extraction and limits resolution of SetRateLimit against the request
+func Resolve(rateLimitingConfig RateLimitingConfig, apiID string, req *http.Request) Decision {
+	return resolve(rateLimitingConfig, apiID, req, nil).Decision
+}
+
+// resolution of a request by resolve, along with what Handle needs to apply it
+type resolution struct {
+	Decision
+	access           accessResult
+	strategyDuration time.Duration
+	err              error
+}
+
+// function runs the key extraction and limits resolution shared by Handle and Resolve, the
+// steps being traced as children of the given span (nil when not tracing). The limits are
+// scaled by the adaptive controller of the api only when Handle created it.
+func resolve(rateLimitingConfig RateLimitingConfig, apiID string, req *http.Request, parent *span) resolution {
+	result := resolution{Decision: Decision{Strategy: rateLimitingConfig.RateLimiting.Strategy.Name}}
+
+	strategySpan := parent.startChild("selectStrategy")
+	strategySpan.setAttribute("ratelimit.strategy", result.Strategy)
+	strategyStart := time.Now()
+	result.KeyID = selectStrategy(rateLimitingConfig, req)
+	result.strategyDuration = time.Since(strategyStart)
+	result.KeyHash = hashKeyID(result.KeyID)
+	strategySpan.setAttribute("ratelimit.key_hash", result.KeyHash)
+	strategySpan.end()
+
+	result.access = checkAccessLists(rateLimitingConfig.RateLimiting.AccessLists, result.KeyID, req)
+	switch result.access {
+	case accessAllowed:
+		result.Access = "allowed"
+	case accessDenied:
+		result.Access = "denied"
+		return result
+	default:
+		result.Access = "default"
+	}
+
+	overrideSpan := parent.startChild("lookForOverridesInRequest")
+	result.Override = lookForOverridesInRequest(req, rateLimitingConfig)
+	overrideSpan.setAttribute("ratelimit.override", overrideLabel(result.Override))
+	overrideSpan.end()
+
+	limitsSpan := parent.startChild("getRateLimits")
+	requests, seconds, sessionTtl, err := getRateLimits(rateLimitingConfig, result.Override, result.KeyID)
+	limitsSpan.setError(err)
+	limitsSpan.end()
+	if err != nil {
+		result.err = err
+		result.Error = err.Error()
+		return result
+	}
+
+	// the temporary grant of the key, if any, takes precedence over the resolved limits
+	requests, seconds = applyGrant(rateLimitingConfig.RateLimiting.Admin, apiID, result.KeyID, requests, seconds)
+
+	// scale the limits down while the upstream is unhealthy
+	if rateLimitingConfig.RateLimiting.Adaptive.Enabled {
+		if controller := findAdaptiveController(apiID); controller != nil {
+			requests = controller.scaleRequests(requests)
+		}
+	}
+
+	if result.access == accessAllowed {
+		requests, seconds = -1, -1
+	}
+
+	result.Requests, result.Seconds, result.SessionTtl = requests, seconds, sessionTtl
+	return result
+}
@@ -0,0 +1,398 @@
+// Throttling events of the rate limiting plugin.
+// the requests of every rate limited key are counted over the 'seconds' of its limit (sliding
+// window estimate, the plugin running before the rate limiter of the gateway sees every
+// attempt) so that the plugin knows when a tenant starts being throttled.
+// Structured events are then published to the sinks configured in the 'events' section of
+// the api definition config: an HTTP webhook, an append-only JSONL file or stdout.
+// Events are debounced per key: a key goes back to normal only once it has not been
+// throttled for 'debounceSec' and a sustained event is published at most once per
+// 'debounceSec' while it is throttled, so a throttling storm results in a handful of events.
+// The throttled keys are swept periodically so that a tenant which stops sending requests
+// once throttled goes back to normal as well.
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type Events struct {
+	Sinks       []EventSink `json:"sinks"`
+	DebounceSec int         `json:"debounceSec"`
+	IncludeKey  bool        `json:"includeKey"`
+}
+
+type EventSink struct {
+	// webhook, file or stdout
+	Type    string            `json:"type"`
+	Url     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Path    string            `json:"path"`
+}
+
+// types of the throttling events
+const (
+	// the key went over its limit
+	eventThrottleStarted = "throttle_started"
+	// the key is still over its limit 'debounceSec' after the previous event
+	eventThrottleSustained = "throttle_sustained"
+	// the key has not been over its limit for 'debounceSec'
+	eventThrottleRecovered = "throttle_recovered"
+)
+
+const defaultEventsDebounceSec = 60
+
+// events waiting to be published by a sink, newer events are dropped when full
+const eventsQueueSize = 1000
+
+// interval of the sweep of the throttled keys which stopped sending requests
+const recoverySweepInterval = 10 * time.Second
+
+type throttleEvent struct {
+	Type           string    `json:"type"`
+	Time           time.Time `json:"time"`
+	Api            string    `json:"api"`
+	ApiID          string    `json:"apiId"`
+	KeyHash        string    `json:"keyHash"`
+	KeyID          string    `json:"keyId,omitempty"`
+	Requests       float64   `json:"requests"`
+	Seconds        float64   `json:"seconds"`
+	Usage          float64   `json:"usage"`
+	ThrottledSince time.Time `json:"throttledSince"`
+}
+
+// requests counted for a given api and key, and its throttling state
+type keyUsage struct {
+	apiName        string
+	events         Events
+	debounce       time.Duration
+	requests       float64
+	period         time.Duration
+	windowStart    time.Time
+	current        float64
+	previous       float64
+	throttled      bool
+	throttledSince time.Time
+	lastThrottled  time.Time
+	lastEvent      time.Time
+	lastSeen       time.Time
+}
+
+var usagesMutex sync.Mutex
+var usages = map[outcomesKey]*keyUsage{}
+var usagesRecency = newRecencyList()
+
+// throttled keys of the configs with sinks, swept for the keys which stopped sending requests
+var throttledUsages = map[outcomesKey]*keyUsage{}
+var recoverySweep sync.Once
+
+// sinks already started, by type and destination
+var eventSinksMutex sync.Mutex
+var eventSinks = map[string]*eventSinkWorker{}
+
+// stdout sink writer, replaced in the unit tests
+var eventsStdout io.Writer = os.Stdout
+
+// function counts the request against the limit of the key and publishes an event
+// to the sinks of the config when the throttling state of the key changes.
+// the requests are only counted when there are sinks or when the admin endpoint is enabled
+func trackThrottling(rateLimit RateLimit, apiName string, apiID string, keyID string, requests float64, seconds float64) {
+	events := rateLimit.Events
+	if (len(events.Sinks) == 0 && !rateLimit.Admin.Enabled) || keyID == "" || requests < 0 || seconds <= 0 {
+		return
+	}
+
+	debounce := time.Duration(events.DebounceSec) * time.Second
+	if debounce <= 0 {
+		debounce = defaultEventsDebounceSec * time.Second
+	}
+
+	if len(events.Sinks) > 0 {
+		recoverySweep.Do(func() { go sweepRecoveredKeysPeriodically() })
+	}
+
+	now := clock.Now()
+	eventType, usage, throttledSince := trackUsage(apiName, apiID, keyID, events, requests, time.Duration(seconds*float64(time.Second)), debounce, now)
+	if eventType == "" || len(events.Sinks) == 0 {
+		return
+	}
+	publishThrottleEvent(events, eventType, apiName, apiID, keyID, requests, seconds, usage, throttledSince, now)
+}
+
+// function publishes the event of the key to the sinks of the config
+func publishThrottleEvent(events Events, eventType string, apiName string, apiID string, keyID string, requests float64, seconds float64, usage float64, throttledSince time.Time, now time.Time) {
+	event := throttleEvent{
+		Type:           eventType,
+		Time:           now,
+		Api:            apiName,
+		ApiID:          apiID,
+		KeyHash:        hashKeyID(keyID),
+		Requests:       requests,
+		Seconds:        seconds,
+		Usage:          usage,
+		ThrottledSince: throttledSince,
+	}
+	// the key is only logged when the sinks receive it
+	logged := "key hash " + event.KeyHash
+	if events.IncludeKey {
+		event.KeyID = keyID
+		logged = "key " + keyID + " (" + event.KeyHash + ")"
+	}
+
+	InfoLog("Throttling event: " + eventType + " " + logged)
+	for _, sink := range events.Sinks {
+		getEventSinkWorker(sink).enqueue(event)
+	}
+}
+
+// function adds the request to the usage of the key and returns the event to publish if any,
+// along with the estimated number of requests in the last period and the throttling start
+func trackUsage(apiName string, apiID string, keyID string, events Events, requests float64, period time.Duration, debounce time.Duration, now time.Time) (string, float64, time.Time) {
+	usagesMutex.Lock()
+	defer usagesMutex.Unlock()
+
+	key := outcomesKey{apiID: apiID, keyID: keyID}
+	usage, ok := usages[key]
+	if !ok {
+		if len(usages) >= maxTrackedKeys {
+			evictOldestUsage()
+		}
+		usage = &keyUsage{windowStart: now}
+		usages[key] = usage
+	}
+	usagesRecency.touch(key)
+	usage.apiName = apiName
+	usage.events = events
+	usage.debounce = debounce
+	usage.lastSeen = now
+	usage.requests = requests
+	usage.period = period
+
+	// the count of the previous window is weighted by how much it overlaps the last period
+	elapsed := now.Sub(usage.windowStart)
+	if elapsed >= 2*period {
+		usage.windowStart, usage.current, usage.previous = now, 0, 0
+	} else if elapsed >= period {
+		usage.windowStart, usage.previous, usage.current = usage.windowStart.Add(period), usage.current, 0
+	}
+	usage.current++
+	estimate := usage.previous*(1-float64(now.Sub(usage.windowStart))/float64(period)) + usage.current
+
+	if estimate > requests {
+		usage.lastThrottled = now
+		if !usage.throttled {
+			usage.throttled = true
+			usage.throttledSince = now
+			usage.lastEvent = now
+			if len(events.Sinks) > 0 {
+				throttledUsages[key] = usage
+			}
+			return eventThrottleStarted, estimate, usage.throttledSince
+		}
+		if now.Sub(usage.lastEvent) >= debounce {
+			usage.lastEvent = now
+			return eventThrottleSustained, estimate, usage.throttledSince
+		}
+	} else if usage.throttled && now.Sub(usage.lastThrottled) >= debounce {
+		usage.throttled = false
+		usage.lastEvent = now
+		delete(throttledUsages, key)
+		return eventThrottleRecovered, estimate, usage.throttledSince
+	}
+	return "", estimate, usage.throttledSince
+}
+
+// function sweeps the throttled keys at the sweep interval, for as long as the gateway runs
+func sweepRecoveredKeysPeriodically() {
+	ticker := time.NewTicker(recoverySweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sweepRecoveredKeys(clock.Now())
+	}
+}
+
+// function publishes the recovered event of the throttled keys which have not been over
+// their limit for 'debounceSec', as their own requests would if they had sent any
+func sweepRecoveredKeys(now time.Time) {
+	type recoveredKey struct {
+		key   outcomesKey
+		usage keyUsage
+		value float64
+	}
+
+	usagesMutex.Lock()
+	var recovered []recoveredKey
+	for key, usage := range throttledUsages {
+		if now.Sub(usage.lastThrottled) < usage.debounce {
+			continue
+		}
+		usage.throttled = false
+		usage.lastEvent = now
+		delete(throttledUsages, key)
+		recovered = append(recovered, recoveredKey{key: key, usage: *usage, value: usage.estimate(now)})
+	}
+	usagesMutex.Unlock()
+
+	for _, r := range recovered {
+		publishThrottleEvent(r.usage.events, eventThrottleRecovered, r.usage.apiName, r.key.apiID, r.key.keyID,
+			r.usage.requests, r.usage.period.Seconds(), r.value, r.usage.throttledSince, now)
+	}
+}
+
+// usage of a key as returned by the admin endpoint
+type keyUsageSnapshot struct {
+	Requests       float64   `json:"requests"`
+	Seconds        float64   `json:"seconds"`
+	Usage          float64   `json:"usage"`
+	Throttled      bool      `json:"throttled"`
+	ThrottledSince time.Time `json:"throttledSince"`
+	LastSeen       time.Time `json:"lastSeen"`
+}
+
+// function returns the usage of the key estimated at the given time
+func getKeyUsage(apiID string, keyID string, now time.Time) (keyUsageSnapshot, bool) {
+	usagesMutex.Lock()
+	defer usagesMutex.Unlock()
+
+	usage, ok := usages[outcomesKey{apiID: apiID, keyID: keyID}]
+	if !ok {
+		return keyUsageSnapshot{}, false
+	}
+
+	snapshot := keyUsageSnapshot{
+		Requests:       usage.requests,
+		Seconds:        usage.period.Seconds(),
+		Throttled:      usage.throttled,
+		ThrottledSince: usage.throttledSince,
+		LastSeen:       usage.lastSeen,
+		Usage:          usage.estimate(now),
+	}
+	return snapshot, true
+}
+
+// function returns the number of requests of the key in the period ending at the given time
+func (usage *keyUsage) estimate(now time.Time) float64 {
+	elapsed := now.Sub(usage.windowStart)
+	switch {
+	case elapsed >= 2*usage.period:
+		return 0
+	case elapsed >= usage.period:
+		return usage.current * (1 - float64(elapsed-usage.period)/float64(usage.period))
+	default:
+		return usage.previous*(1-float64(elapsed)/float64(usage.period)) + usage.current
+	}
+}
+
+// function removes the least recently seen key, must be called with the mutex held
+func evictOldestUsage() {
+	if key, ok := usagesRecency.removeOldest(); ok {
+		delete(usages, key.(outcomesKey))
+		delete(throttledUsages, key.(outcomesKey))
+	}
+}
+
+// events are published by a goroutine per sink so that the requests are not slowed down
+type eventSinkWorker struct {
+	sink    EventSink
+	events  chan throttleEvent
+	pending sync.WaitGroup
+	mutex   sync.Mutex
+}
+
+// function returns the worker of the sink, starting it the first time it is requested
+func getEventSinkWorker(sink EventSink) *eventSinkWorker {
+	eventSinksMutex.Lock()
+	defer eventSinksMutex.Unlock()
+
+	key := sink.Type + "|" + sink.Url + "|" + sink.Path
+	worker, ok := eventSinks[key]
+	if !ok {
+		worker = &eventSinkWorker{sink: sink, events: make(chan throttleEvent, eventsQueueSize)}
+		eventSinks[key] = worker
+		go worker.run()
+	}
+	return worker
+}
+
+func (worker *eventSinkWorker) enqueue(event throttleEvent) {
+	worker.pending.Add(1)
+	select {
+	case worker.events <- event:
+	default:
+		worker.pending.Done()
+		ErrorLog("Event queue full, event dropped: " + event.Type)
+	}
+}
+
+func (worker *eventSinkWorker) run() {
+	for event := range worker.events {
+		if err := worker.publish(event); err != nil {
+			ErrorLog("Event publish error: ", err)
+		}
+		worker.pending.Done()
+	}
+}
+
+// function publishes the event to the sink as a single line of json
+func (worker *eventSinkWorker) publish(event throttleEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	switch worker.sink.Type {
+	case "webhook":
+		return publishWebhook(worker.sink, line)
+	case "file":
+		worker.mutex.Lock()
+		defer worker.mutex.Unlock()
+		return appendLine(worker.sink.Path, line)
+	case "stdout":
+		worker.mutex.Lock()
+		defer worker.mutex.Unlock()
+		_, err = fmt.Fprintln(eventsStdout, string(line))
+		return err
+	default:
+		return fmt.Errorf("unknown event sink type %q", worker.sink.Type)
+	}
+}
+
+func publishWebhook(sink EventSink, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, sink.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range sink.Headers {
+		req.Header.Set(name, value)
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status code %d from webhook", res.StatusCode)
+	}
+	return nil
+}
+
+func appendLine(path string, line []byte) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,217 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_TrackUsageDebounced_Success(t *testing.T) {
+	now := time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)
+	period := 10 * time.Second
+	debounce := 60 * time.Second
+
+	// sends requests at the given interval and returns the events published
+	send := func(n int, interval time.Duration) []string {
+		var events []string
+		for i := 0; i < n; i++ {
+			if event, _, _ := trackUsage("Events API", "events-debounce", "milesahead1", Events{}, 5, period, debounce, now); event != "" {
+				events = append(events, event)
+			}
+			now = now.Add(interval)
+		}
+		return events
+	}
+
+	steps := []struct {
+		name     string
+		requests int
+		interval time.Duration
+		expected []string
+	}{
+		{"under the limit", 5, time.Second, nil},
+		{"throttling storm", 200, 100 * time.Millisecond, []string{eventThrottleStarted}},
+		{"still throttled", 500, 100 * time.Millisecond, []string{eventThrottleSustained}},
+		{"back under the limit, not for long enough", 5, 10 * time.Second, nil},
+		{"back under the limit", 3, 10 * time.Second, []string{eventThrottleRecovered}},
+		{"under the limit", 10, 10 * time.Second, nil},
+	}
+
+	for _, step := range steps {
+		events := send(step.requests, step.interval)
+		if strings.Join(events, ",") != strings.Join(step.expected, ",") {
+			t.Fatalf("Events were not correct after %v -- expected %v but was %v", step.name, step.expected, events)
+		}
+	}
+}
+
+func Test_TrackUsageSlidingWindow_Success(t *testing.T) {
+	now := time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 10; i++ {
+		trackUsage("Events API", "events-window", "milesahead1", Events{}, 10, 10*time.Second, time.Minute, now)
+	}
+
+	// half of the previous window still counts
+	_, usage, _ := trackUsage("Events API", "events-window", "milesahead1", Events{}, 10, 10*time.Second, time.Minute, now.Add(15*time.Second))
+	if usage != 6 {
+		t.Fatalf("Usage was not correct -- expected %v but was %v", 6, usage)
+	}
+
+	_, usage, _ = trackUsage("Events API", "events-window", "milesahead1", Events{}, 10, 10*time.Second, time.Minute, now.Add(time.Minute))
+	if usage != 1 {
+		t.Fatalf("Usage was not correct -- expected %v but was %v", 1, usage)
+	}
+}
+
+func Test_ThrottlingEventSinks_Success(t *testing.T) {
+	clk := &manualClock{now: time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)}
+	previous := clock
+	clock = clk
+	t.Cleanup(func() { clock = previous })
+
+	var stdout bytes.Buffer
+	previousStdout := eventsStdout
+	eventsStdout = &stdout
+	t.Cleanup(func() { eventsStdout = previousStdout })
+
+	var webhookMutex sync.Mutex
+	var webhookEvents []throttleEvent
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-api-key") != "secret" {
+			t.Errorf("Webhook header was not set")
+		}
+		var event throttleEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		webhookMutex.Lock()
+		webhookEvents = append(webhookEvents, event)
+		webhookMutex.Unlock()
+	}))
+	t.Cleanup(webhook.Close)
+
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+
+	var configData map[string]interface{}
+	rateLimiting := BuildStruct()
+	rateLimiting.RateLimiting.Events = Events{
+		Sinks: []EventSink{
+			{Type: "webhook", Url: webhook.URL, Headers: map[string]string{"x-api-key": "secret"}},
+			{Type: "file", Path: path},
+			{Type: "stdout"},
+		},
+		DebounceSec: 30,
+		IncludeKey:  true,
+	}
+	marshalledConfig, _ := json.Marshal(rateLimiting)
+	json.Unmarshal(marshalledConfig, &configData)
+	t.Cleanup(func() { resetKeyCounters("events-api", "milesahead3::::::") })
+
+	// defaults are 2 requests every 10 seconds
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", "http://localhost:8080/resource-3/", nil)
+		req.Header.Set("x-tenant-id", "milesahead3")
+		Handle(&fakeGateway{definition: ApiDefinition{APIID: "events-api", Name: "Events API", ConfigData: configData}, rw: httptest.NewRecorder()}, req)
+		clk.Advance(100 * time.Millisecond)
+	}
+	waitForEvents()
+
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
+	if len(webhookEvents) != 1 {
+		t.Fatalf("Webhook events were not correct -- expected 1 event but was %v", webhookEvents)
+	}
+	event := webhookEvents[0]
+	if event.Type != eventThrottleStarted || event.Api != "Events API" || event.ApiID != "events-api" {
+		t.Fatalf("Event was not correct: %v", event)
+	}
+	if event.KeyID != "milesahead3::::::" || event.KeyHash != hashKeyID("milesahead3::::::") {
+		t.Fatalf("Event key was not correct: %v", event)
+	}
+	if event.Requests != 2 || event.Seconds != 10 || event.Usage != 3 {
+		t.Fatalf("Event limits were not correct: %v", event)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading events file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"type":"throttle_started"`) {
+		t.Fatalf("Events file was not correct: %v", string(content))
+	}
+
+	if strings.TrimSpace(stdout.String()) != lines[0] {
+		t.Fatalf("Stdout events were not correct -- expected %v but was %v", lines[0], stdout.String())
+	}
+}
+
+func Test_SweepRecoveredKeys_Success(t *testing.T) {
+	clk := &manualClock{now: time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)}
+	previous := clock
+	clock = clk
+	t.Cleanup(func() { clock = previous })
+
+	var stdout bytes.Buffer
+	previousStdout := eventsStdout
+	eventsStdout = &stdout
+	t.Cleanup(func() { eventsStdout = previousStdout })
+	t.Cleanup(func() { resetKeyCounters("events-sweep", "milesahead1") })
+
+	rateLimit := BuildStruct().RateLimiting
+	rateLimit.Events = Events{Sinks: []EventSink{{Type: "stdout"}}, DebounceSec: 30}
+
+	// throttled then silent
+	for i := 0; i < 5; i++ {
+		trackThrottling(rateLimit, "Events API", "events-sweep", "milesahead1", 2, 10)
+	}
+	clk.Advance(29 * time.Second)
+	sweepRecoveredKeys(clk.Now())
+	waitForEvents()
+	if strings.Contains(stdout.String(), eventThrottleRecovered) {
+		t.Fatalf("Key should still be throttled before 'debounceSec': %v", stdout.String())
+	}
+
+	clk.Advance(time.Second)
+	sweepRecoveredKeys(clk.Now())
+	sweepRecoveredKeys(clk.Now())
+	waitForEvents()
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"type":"throttle_started"`) || !strings.Contains(lines[1], `"type":"throttle_recovered"`) {
+		t.Fatalf("Events were not correct -- expected started then recovered once but was %v", stdout.String())
+	}
+	if snapshot, _ := getKeyUsage("events-sweep", "milesahead1", clk.Now()); snapshot.Throttled {
+		t.Fatalf("Key should not be throttled anymore: %v", snapshot)
+	}
+}
+
+func Test_ThrottlingEventsWithoutSinks_Success(t *testing.T) {
+	trackThrottling(RateLimit{}, "Events API", "events-no-sinks", "milesahead1", 1, 10)
+
+	usagesMutex.Lock()
+	defer usagesMutex.Unlock()
+	if _, ok := usages[outcomesKey{apiID: "events-no-sinks", keyID: "milesahead1"}]; ok {
+		t.Fatalf("Usage should not be tracked without sinks")
+	}
+}
+
+// function waits until every queued event has been published
+func waitForEvents() {
+	eventSinksMutex.Lock()
+	workers := make([]*eventSinkWorker, 0, len(eventSinks))
+	for _, worker := range eventSinks {
+		workers = append(workers, worker)
+	}
+	eventSinksMutex.Unlock()
+
+	for _, worker := range workers {
+		worker.pending.Wait()
+	}
+}
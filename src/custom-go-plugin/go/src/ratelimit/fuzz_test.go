@@ -0,0 +1,223 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// time a key extraction may take on any input, the regular expressions of the go regexp
+// package running in linear time
+const fuzzMaxDuration = time.Second
+
+// start of the bodies read by the fuzz targets, and the memory a key extraction or an override
+// lookup may allocate whatever the size of the body, a few copies of the start of the body
+const fuzzMaxBodySize = 4096
+const fuzzMaxAllocated = 64 * fuzzMaxBodySize
+
+// SOAP envelopes sent to the apis of iac/api-definitions, seeding the corpora of the body parsers
+var soapEnvelopes = []string{
+	routingSoapEnvelope,
+	`<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:web="http://xrs.com/webservices">
+      <soapenv:Header>
+          <web:AuthenticationHeader>
+              <web:Username>MILESAHEAD1|RDC_WebServices</web:Username>
+              <web:Password>secret</web:Password>
+          </web:AuthenticationHeader>
+      </soapenv:Header>
+      <soapenv:Body>
+          <web:GetDrivers/>
+      </soapenv:Body>
+  </soapenv:Envelope>`,
+	`<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:dat="http://roadnet.com/apex/DataServices/">
+      <soap:Header>
+          <dat:SessionHeader><dat:SessionGuid>33d9b8d0-58ba-4400-87af-bdf5f79c0f9b</dat:SessionGuid></dat:SessionHeader>
+      </soap:Header>
+      <soap:Body><dat:RetrieveMaps><dat:Criteria/></dat:RetrieveMaps></soap:Body>
+  </soap:Envelope>`,
+	`<Envelope><Body><Login><Username>acme</Username></Login></Body></Envelope>`,
+	`<a:SessionGuid></a:SessionGuid><b:Username>|</b:Username>`,
+	``,
+	// longer than the start of the body read by the plugin
+	strings.Repeat(`<a:SessionGuid>x</a:SessionGuid><b:Username>acme|x</b:Username>`, 1000),
+}
+
+// function runs the parsing of the request, failing the fuzz target if it reads more of the body
+// than its start or allocates more than a few copies of it, and returns the body of the request
+func checkBounded(t *testing.T, req *http.Request, parse func()) []byte {
+	var body []byte
+	var counter *countingReader
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(req.Body)
+		counter = &countingReader{reader: strings.NewReader(string(body))}
+		req.Body = ioutil.NopCloser(counter)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	parse()
+	runtime.ReadMemStats(&after)
+
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > fuzzMaxAllocated {
+		t.Fatalf("Parsing allocated %v bytes -- expected at most %v", allocated, fuzzMaxAllocated)
+	}
+	if counter != nil && counter.read > fuzzMaxBodySize+1 {
+		t.Fatalf("Parsing read %v bytes of the body -- expected at most %v", counter.read, fuzzMaxBodySize+1)
+	}
+	return body
+}
+
+// function fails the fuzz target if the key extraction is not bounded or not deterministic,
+// the body of the request being read again by the plugin and passed on to the upstream
+func checkKeyExtraction(t *testing.T, rateLimiting RateLimitingConfig, newRequest func() *http.Request) string {
+	rateLimiting.RateLimiting.MaxBodySize = fuzzMaxBodySize
+	req := newRequest()
+	start := time.Now()
+	var keyID string
+	body := checkBounded(t, req, func() { keyID = selectStrategy(rateLimiting, req) })
+	if elapsed := time.Since(start); elapsed > fuzzMaxDuration {
+		t.Fatalf("Key extraction took %v", elapsed)
+	}
+	if again := selectStrategy(rateLimiting, newRequest()); again != keyID {
+		t.Fatalf("Key extraction was not deterministic -- was %q then %q", keyID, again)
+	}
+	if req.Body != nil {
+		if remaining, _ := ioutil.ReadAll(req.Body); !bytes.Equal(remaining, body) {
+			t.Fatalf("Body was not restored -- expected %q but was %q", body, remaining)
+		}
+	}
+	return keyID
+}
+
+func FuzzRequestHeaders(f *testing.F) {
+	f.Add("milesahead1", "Bearer 12345abcd")
+	f.Add("", "Basic TUlMRVNBSEVBRDF8UkRDX1dlYlNlcnZpY2VzOlJvYWRuZXQxNE5ldA==")
+	f.Add("::", "Bearer Basic ")
+
+	rateLimiting := BuildStruct()
+	rateLimiting.RateLimiting.Strategy.Config.HeaderNames = []string{"x-tenant-id", "Authorization"}
+	f.Fuzz(func(t *testing.T, tenant string, authorization string) {
+		keyID := checkKeyExtraction(t, rateLimiting, func() *http.Request {
+			req := httptest.NewRequest("GET", "http://localhost:8080/orders/", nil)
+			req.Header["X-Tenant-Id"] = []string{tenant}
+			req.Header["Authorization"] = []string{authorization}
+			return req
+		})
+		if len(keyID) > len(tenant)+len(authorization)+len("::") {
+			t.Fatalf("Key is longer than the headers it is made of: %q", keyID)
+		}
+	})
+}
+
+func FuzzRequestHeadersXRS(f *testing.F) {
+	f.Add("Basic TUlMRVNBSEVBRDF8UkRDX1dlYlNlcnZpY2VzOlJvYWRuZXQxNE5ldA==", false)
+	f.Add("Basic "+base64.StdEncoding.EncodeToString([]byte("acme|dispatcher:secret")), true)
+	f.Add("Basic not-base64!", false)
+	f.Add("Bearer 12345abcd", true)
+	f.Add("", false)
+
+	f.Fuzz(func(t *testing.T, authorization string, combineRestWithSoap bool) {
+		rateLimiting := BuildStruct()
+		rateLimiting.RateLimiting.Strategy.Name = requestHeadersXRS
+		rateLimiting.RateLimiting.Strategy.Config.CombineRestWithSoap = combineRestWithSoap
+
+		keyID := checkKeyExtraction(t, rateLimiting, func() *http.Request {
+			req := httptest.NewRequest("GET", "http://localhost:8080/DriverWebService/drivers", nil)
+			req.Header["Authorization"] = []string{authorization}
+			return req
+		})
+		if len(keyID) > base64.StdEncoding.DecodedLen(len(authorization))+len("-rest") {
+			t.Fatalf("Key is longer than the decoded header: %q", keyID)
+		}
+		if strings.Contains(keyID, "|") {
+			t.Fatalf("Key should only hold the company id: %q", keyID)
+		}
+	})
+}
+
+func FuzzSessionGuid(f *testing.F) {
+	for _, envelope := range soapEnvelopes {
+		f.Add(envelope)
+	}
+
+	rateLimiting := BuildStruct()
+	rateLimiting.RateLimiting.Strategy.Name = sessionGuid
+	f.Fuzz(func(t *testing.T, body string) {
+		keyID := checkKeyExtraction(t, rateLimiting, func() *http.Request {
+			return httptest.NewRequest("POST", "http://localhost:8080/Routing/RoutingService.svc", strings.NewReader(body))
+		})
+		if !strings.Contains(body, keyID) {
+			t.Fatalf("Key was not found in the body: %q", keyID)
+		}
+	})
+}
+
+func FuzzSoapRequestXRS(f *testing.F) {
+	for _, envelope := range soapEnvelopes {
+		f.Add(envelope, false)
+		f.Add(envelope, true)
+	}
+
+	f.Fuzz(func(t *testing.T, body string, combineRestWithSoap bool) {
+		rateLimiting := BuildStruct()
+		rateLimiting.RateLimiting.Strategy.Name = soapRequestXRS
+		rateLimiting.RateLimiting.Strategy.Config.CombineRestWithSoap = combineRestWithSoap
+
+		keyID := checkKeyExtraction(t, rateLimiting, func() *http.Request {
+			return httptest.NewRequest("POST", "http://localhost:8080/DriverWebService.svc/soap", strings.NewReader(body))
+		})
+		if !combineRestWithSoap {
+			keyID = strings.TrimSuffix(keyID, "-soap")
+		}
+		if !strings.Contains(body, keyID) || strings.Contains(keyID, "|") {
+			t.Fatalf("Key should be the company id of the body: %q", keyID)
+		}
+	})
+}
+
+func FuzzLookForOverridesInRequest(f *testing.F) {
+	for _, envelope := range soapEnvelopes {
+		f.Add("POST", "/Routing/RoutingService.svc", "", "text/xml", envelope)
+	}
+	f.Add("POST", "/Routing/RoutingService.svc", `"http://roadnet.com/apex/DataServices/IRoutingService/RetrieveRoutes"`, "text/xml", routingSoapEnvelope)
+	f.Add("POST", "/Mapping/MappingService.svc", "", `application/soap+xml; action="http://roadnet.com/apex/DataServices/IMappingService/RetrieveMaps"`, "")
+	f.Add("GET", "/resource-2/", "", "application/json", "")
+
+	rateLimiting := BuildSoapOverridesStruct()
+	rateLimiting.RateLimiting.Overrides = append(rateLimiting.RateLimiting.Overrides, BuildMatchOverridesStruct().RateLimiting.Overrides...)
+	rateLimiting.RateLimiting.MaxBodySize = fuzzMaxBodySize
+	f.Fuzz(func(t *testing.T, method string, path string, soapAction string, contentType string, body string) {
+		newRequest := func() *http.Request {
+			req := httptest.NewRequest("GET", "http://localhost:8080/", strings.NewReader(body))
+			req.Method = method
+			req.URL.Path = path
+			req.Header["Soapaction"] = []string{soapAction}
+			req.Header["Content-Type"] = []string{contentType}
+			return req
+		}
+
+		req := newRequest()
+		req.ContentLength = -1
+		start := time.Now()
+		var override *Override
+		checkBounded(t, req, func() { override = lookForOverridesInRequest(req, rateLimiting) })
+		if elapsed := time.Since(start); elapsed > fuzzMaxDuration {
+			t.Fatalf("Override lookup took %v", elapsed)
+		}
+		if again := lookForOverridesInRequest(newRequest(), rateLimiting); again != override {
+			t.Fatalf("Override lookup was not deterministic -- was %v then %v", overrideLabel(override), overrideLabel(again))
+		}
+		if override != nil && (!strings.EqualFold(override.Method, method) || !caseInsensitiveContains(path, override.Resource)) {
+			t.Fatalf("Override %v does not match %v %v", overrideLabel(override), method, path)
+		}
+		if remaining, _ := ioutil.ReadAll(req.Body); string(remaining) != body {
+			t.Fatalf("Body was not restored -- expected %q but was %q", body, remaining)
+		}
+	})
+}
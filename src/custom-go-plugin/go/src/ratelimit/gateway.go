@@ -0,0 +1,49 @@
+// Interface between the rate limiting logic and the gateway running it.
+// The logic only sees the api definition of the request, the session it sets and the response
+// writer through a GatewayContext, so that it does not depend on the packages of a gateway:
+// the Tyk adapter (adapter/tyk) translates them from and to the Tyk types, and supporting
+// another major version of the gateway, or another gateway, only takes another adapter.
+package ratelimit
+
+import (
+	"net/http"
+)
+
+// ApiDefinition is what the rate limiting reads from the api definition of a request
+type ApiDefinition struct {
+	APIID string
+	Name  string
+	// listen path of the api, the paths of the admin endpoint starting right after it
+	ListenPath string
+	ConfigData map[string]interface{}
+	Tags       []string
+	TagHeaders []string
+}
+
+// Session is the rate limit the gateway applies to the unique key of a request
+type Session struct {
+	Alias string
+	// requests allowed per 'Per' seconds, -1 for no limit
+	Rate float64
+	Per  float64
+	// key of the counters of the gateway
+	KeyID string
+	// time to live of the counters in seconds, the rate limiting being reset once it expires
+	SessionLifetime int64
+	MetaData        map[string]interface{}
+}
+
+// SessionSink receives the session of each request handled by the rate limiting
+type SessionSink interface {
+	// SetSession makes the gateway rate limit the request with the session
+	SetSession(session Session)
+}
+
+// GatewayContext is what the rate limiting needs from the gateway for a request
+type GatewayContext interface {
+	SessionSink
+	// Definition returns the api definition the request was routed to
+	Definition() ApiDefinition
+	// ResponseWriter returns the writer of the requests answered by the plugin (denied, admin)
+	ResponseWriter() http.ResponseWriter
+}
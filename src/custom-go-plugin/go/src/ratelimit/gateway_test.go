@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// session sink of the tests, recording the sessions set by Handle
+type recordingSink struct {
+	sessions []Session
+}
+
+func (sink *recordingSink) SetSession(session Session) {
+	sink.sessions = append(sink.sessions, session)
+}
+
+// gateway context of the tests, recording the sessions set by Handle
+type fakeGateway struct {
+	recordingSink
+	definition ApiDefinition
+	rw         http.ResponseWriter
+}
+
+func (gateway *fakeGateway) Definition() ApiDefinition {
+	return gateway.definition
+}
+
+func (gateway *fakeGateway) ResponseWriter() http.ResponseWriter {
+	return gateway.rw
+}
+
+func Test_HandleSetsSession_Success(t *testing.T) {
+	var configData map[string]interface{}
+	rateLimiting := BuildStruct()
+	marshalledConfig, _ := json.Marshal(rateLimiting)
+	json.Unmarshal(marshalledConfig, &configData)
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/resource-2/", nil)
+	req.Header.Set("x-tenant-id", "milesahead2")
+	gateway := &fakeGateway{definition: ApiDefinition{APIID: "gateway-api", Name: "Gateway API", ConfigData: configData}, rw: httptest.NewRecorder()}
+	Handle(gateway, req)
+
+	if len(gateway.sessions) != 1 {
+		t.Fatalf("Session was not set -- expected 1 session but was %v", len(gateway.sessions))
+	}
+	expected := Session{
+		Alias:           "milesahead2::::::",
+		Rate:            5,
+		Per:             60,
+		KeyID:           "milesahead2::::::",
+		SessionLifetime: 120,
+		MetaData:        map[string]interface{}{"keyId": "milesahead2::::::", "meta2": "meta2"},
+	}
+	if !reflect.DeepEqual(gateway.sessions[0], expected) {
+		t.Fatalf("Session was not correct -- expected %+v but was %+v", expected, gateway.sessions[0])
+	}
+}
+
+func Test_HandleDeniedSetsNoSession_Success(t *testing.T) {
+	var configData map[string]interface{}
+	rateLimiting := BuildStruct()
+	rateLimiting.RateLimiting.AccessLists = AccessLists{Deny: AccessList{Keys: []string{"blocked::::::"}}}
+	marshalledConfig, _ := json.Marshal(rateLimiting)
+	json.Unmarshal(marshalledConfig, &configData)
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/resource-2/", nil)
+	req.Header.Set("x-tenant-id", "blocked")
+	gateway := &fakeGateway{definition: ApiDefinition{APIID: "gateway-api", Name: "Gateway API", ConfigData: configData}, rw: httptest.NewRecorder()}
+	Handle(gateway, req)
+
+	if len(gateway.sessions) != 0 {
+		t.Fatalf("No session should be set for a denied request -- was %v", gateway.sessions)
+	}
+}
+
+func Test_HandleWithoutDefinition_Success(t *testing.T) {
+	gateway := &fakeGateway{rw: httptest.NewRecorder()}
+	Handle(gateway, httptest.NewRequest("GET", "http://localhost:8080/resource-2/", nil))
+
+	if len(gateway.sessions) != 1 || gateway.sessions[0].Rate != -1 || gateway.sessions[0].KeyID != "" {
+		t.Fatalf("Session should not be limited -- expected no limit but was %v", gateway.sessions)
+	}
+}
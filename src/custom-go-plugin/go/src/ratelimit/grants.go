@@ -0,0 +1,388 @@
+// Counter resets and temporary limit grants of the rate limiting plugin.
+// the counters of the gateway are kept in Redis under the KeyID of the session, which the
+// plugin has no access to: resetting a key therefore records a reset time that is appended
+// to the KeyID of its sessions so that the gateway starts counting in a fresh bucket (the
+// previous one expiring with its session lifetime). The counters of the plugin are cleared.
+// A reset is kept until the previous bucket has expired, the key counting again under its
+// own KeyID afterwards.
+// Grants give a key other limits until they expire, taking precedence over the limits
+// resolved by getRateLimits (the adaptive limits still apply on top of a grant).
+// Resets and grants are kept in memory, or in the 'stateFile' of the 'admin' section so that
+// they survive restarts and are shared by the gateways mounting the same file.
+// Every admin operation is written to the audit log along with the user that made it.
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// a time-boxed override of the limits of a key, either a multiplier of the resolved
+// limits or explicit 'requests' and 'seconds' values
+type grant struct {
+	ApiID      string    `json:"apiId"`
+	KeyID      string    `json:"keyId"`
+	Multiplier float64   `json:"multiplier"`
+	Requests   float64   `json:"requests"`
+	Seconds    float64   `json:"seconds"`
+	Reason     string    `json:"reason"`
+	GrantedBy  string    `json:"grantedBy"`
+	Granted    time.Time `json:"granted"`
+	Expires    time.Time `json:"expires"`
+}
+
+type keyReset struct {
+	ApiID   string    `json:"apiId"`
+	KeyID   string    `json:"keyId"`
+	Time    time.Time `json:"time"`
+	Expires time.Time `json:"expires"`
+}
+
+// structure of the state file
+type adminState struct {
+	Grants []grant    `json:"grants"`
+	Resets []keyReset `json:"resets"`
+}
+
+type adminStore struct {
+	mutex sync.Mutex
+	path  string
+	state adminState
+	file  *watchedFile
+}
+
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	Action     string    `json:"action"`
+	Api        string    `json:"api"`
+	ApiID      string    `json:"apiId"`
+	KeyID      string    `json:"keyId"`
+	Grant      *grant    `json:"grant,omitempty"`
+	RemoteAddr string    `json:"remoteAddr"`
+}
+
+// actions of the audit log
+const (
+	auditReset  = "reset"
+	auditGrant  = "grant"
+	auditRevoke = "revoke"
+)
+
+// number of audit entries kept per api for the admin endpoint
+const maxAuditEntries = 100
+
+// the state file is checked for changes at most once per interval
+const adminStateFileCheckInterval = time.Second
+
+// stores by state file, the in-memory store having an empty path
+var adminStoresMutex sync.Mutex
+var adminStores = map[string]*adminStore{}
+
+// last audit entries by api id
+var auditMutex sync.Mutex
+var auditEntries = map[string][]auditEntry{}
+
+func getAdminStore(path string) *adminStore {
+	adminStoresMutex.Lock()
+	defer adminStoresMutex.Unlock()
+
+	store, ok := adminStores[path]
+	if !ok {
+		store = newAdminStore(path)
+		adminStores[path] = store
+	}
+	return store
+}
+
+func newAdminStore(path string) *adminStore {
+	store := &adminStore{path: path}
+	store.file = newWatchedFile(path, adminStateFileCheckInterval, func(content []byte) error {
+		var state adminState
+		if err := json.Unmarshal(content, &state); err != nil {
+			return err
+		}
+		store.state = state
+		return nil
+	})
+	return store
+}
+
+// function reads the state file again when it was changed by another gateway,
+// must be called with the mutex held
+func (store *adminStore) refresh() {
+	if store.path == "" {
+		return
+	}
+
+	reloaded, err := store.file.refresh()
+	if err != nil && !os.IsNotExist(err) {
+		ErrorLog("Admin state file error: ", err)
+	}
+	if reloaded {
+		DebugLog("Admin state file reloaded: " + store.path)
+	}
+}
+
+// function drops the expired grants and resets and writes the state file,
+// must be called with the mutex held
+func (store *adminStore) save(now time.Time) error {
+	grants := store.state.Grants[:0]
+	for _, g := range store.state.Grants {
+		if now.Before(g.Expires) {
+			grants = append(grants, g)
+		}
+	}
+	store.state.Grants = grants
+
+	resets := store.state.Resets[:0]
+	for _, r := range store.state.Resets {
+		if now.Before(r.Expires) {
+			resets = append(resets, r)
+		}
+	}
+	store.state.Resets = resets
+
+	if store.path == "" {
+		return nil
+	}
+
+	content, err := json.MarshalIndent(store.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(store.path, content, 0644); err != nil {
+		return err
+	}
+	store.file.written()
+	return nil
+}
+
+// function returns the grant of the key active at the given time if any
+func (store *adminStore) findGrant(apiID string, keyID string, now time.Time) (grant, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.refresh()
+
+	for _, g := range store.state.Grants {
+		if g.ApiID == apiID && g.KeyID == keyID && now.Before(g.Expires) {
+			return g, true
+		}
+	}
+	return grant{}, false
+}
+
+// function returns the grants of the api active at the given time
+func (store *adminStore) activeGrants(apiID string, now time.Time) []grant {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.refresh()
+
+	grants := []grant{}
+	for _, g := range store.state.Grants {
+		if g.ApiID == apiID && now.Before(g.Expires) {
+			grants = append(grants, g)
+		}
+	}
+	return grants
+}
+
+// function adds the grant, replacing the previous grant of the key if any
+func (store *adminStore) addGrant(newGrant grant, now time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.refresh()
+
+	store.removeGrant(newGrant.ApiID, newGrant.KeyID)
+	store.state.Grants = append(store.state.Grants, newGrant)
+	return store.save(now)
+}
+
+// function removes the grant of the key, returns false if the key had no grant
+func (store *adminStore) revokeGrant(apiID string, keyID string, now time.Time) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.refresh()
+
+	if !store.removeGrant(apiID, keyID) {
+		return false, nil
+	}
+	return true, store.save(now)
+}
+
+// must be called with the mutex held
+func (store *adminStore) removeGrant(apiID string, keyID string) bool {
+	for i, g := range store.state.Grants {
+		if g.ApiID == apiID && g.KeyID == keyID {
+			store.state.Grants = append(store.state.Grants[:i], store.state.Grants[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// function records the reset of the key, kept until it expires
+func (store *adminStore) reset(apiID string, keyID string, now time.Time, expires time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.refresh()
+
+	for i, r := range store.state.Resets {
+		if r.ApiID == apiID && r.KeyID == keyID {
+			store.state.Resets[i].Time = now
+			store.state.Resets[i].Expires = expires
+			return store.save(now)
+		}
+	}
+	store.state.Resets = append(store.state.Resets, keyReset{ApiID: apiID, KeyID: keyID, Time: now, Expires: expires})
+	return store.save(now)
+}
+
+// function returns the KeyID to set on the session of the key, suffixed with the time
+// of the last reset of the key if any so that the gateway counts in a new bucket
+func (store *adminStore) sessionKeyID(apiID string, keyID string, now time.Time) string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.refresh()
+
+	for _, r := range store.state.Resets {
+		if r.ApiID == apiID && r.KeyID == keyID && now.Before(r.Expires) {
+			return keyID + "#" + strconv.FormatInt(r.Time.UnixMilli(), 10)
+		}
+	}
+	return keyID
+}
+
+// function returns the limits of the active grant of the key if any
+// and the given limits otherwise
+func applyGrant(admin Admin, apiID string, keyID string, requests float64, seconds float64) (float64, float64) {
+	if !admin.Enabled || keyID == "" {
+		return requests, seconds
+	}
+
+	g, ok := getAdminStore(admin.StateFile).findGrant(apiID, keyID, clock.Now())
+	if !ok {
+		return requests, seconds
+	}
+	InfoLog("Grant applied for KeyID: " + keyID + " until " + g.Expires.Format(time.RFC3339))
+	return g.apply(requests, seconds)
+}
+
+// function returns the KeyID to set on the session of the key
+func getSessionKeyID(admin Admin, apiID string, keyID string) string {
+	if !admin.Enabled || keyID == "" {
+		return keyID
+	}
+	return getAdminStore(admin.StateFile).sessionKeyID(apiID, keyID, clock.Now())
+}
+
+// function returns how long the reset of the key is kept: until the bucket counted under
+// the previous KeyID has expired, i.e. the longest of the session lifetime and of the windows
+// of the limits the key may have been given
+func resetRetention(rateLimit RateLimit, apiID string, keyID string, now time.Time) time.Duration {
+	seconds := rateLimit.SessionTtlMin
+	longest := func(value int) {
+		if value > seconds {
+			seconds = value
+		}
+	}
+	longestOfSchedules := func(schedules []Schedule) {
+		for _, schedule := range schedules {
+			longest(schedule.Seconds)
+		}
+	}
+
+	longest(rateLimit.Seconds)
+	longestOfSchedules(rateLimit.Schedules)
+	for _, override := range rateLimit.Overrides {
+		longest(override.Seconds)
+		longestOfSchedules(override.Schedules)
+	}
+	if g, ok := getAdminStore(rateLimit.Admin.StateFile).findGrant(apiID, keyID, now); ok {
+		longest(int(g.Seconds))
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// function applies the grant to the resolved limits
+func (g grant) apply(requests float64, seconds float64) (float64, float64) {
+	if g.Requests != 0 || g.Seconds != 0 {
+		return g.Requests, g.Seconds
+	}
+	// unlimited stays unlimited
+	if requests < 0 {
+		return requests, seconds
+	}
+	return requests * g.Multiplier, seconds
+}
+
+func (g grant) validate() error {
+	if g.KeyID == "" {
+		return fmt.Errorf("missing 'key'")
+	}
+	if g.Multiplier < 0 || (g.Multiplier == 0 && g.Requests == 0 && g.Seconds == 0) {
+		return fmt.Errorf("a positive 'multiplier' or 'requests' and 'seconds' values are required")
+	}
+	if (g.Requests != 0 || g.Seconds != 0) && (g.Requests == 0 || g.Seconds == 0) {
+		return fmt.Errorf("'requests' and 'seconds' must be set together")
+	}
+	if !g.Expires.After(g.Granted) {
+		return fmt.Errorf("a positive 'durationSec' is required")
+	}
+	return nil
+}
+
+// function removes the counters kept by the plugin for the key
+func resetKeyCounters(apiID string, keyID string) {
+	key := outcomesKey{apiID: apiID, keyID: keyID}
+
+	usagesMutex.Lock()
+	delete(usages, key)
+	delete(throttledUsages, key)
+	usagesRecency.remove(key)
+	usagesMutex.Unlock()
+
+	outcomesMutex.Lock()
+	delete(outcomes, key)
+	outcomesRecency.remove(key)
+	outcomesMutex.Unlock()
+}
+
+// function writes the entry to the gateway log, the audit file of the config if any,
+// and keeps the last entries for the admin endpoint
+func audit(admin Admin, entry auditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		ErrorLog("Audit log error: ", err)
+		return
+	}
+	InfoLog("[AUDIT] " + string(line))
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	entries := append(auditEntries[entry.ApiID], entry)
+	if len(entries) > maxAuditEntries {
+		entries = entries[len(entries)-maxAuditEntries:]
+	}
+	auditEntries[entry.ApiID] = entries
+
+	if admin.AuditFile != "" {
+		if err := appendLine(admin.AuditFile, line); err != nil {
+			ErrorLog("Audit log error: ", err)
+		}
+	}
+}
+
+// function returns the audit entries of the api, most recent last
+func getAuditEntries(apiID string) []auditEntry {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	return append([]auditEntry{}, auditEntries[apiID]...)
+}
@@ -0,0 +1,238 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func dryRunLimits(t *testing.T, apiID string, rateLimiting RateLimitingConfig, tenant string) Decision {
+	sample := `{"method": "GET", "path": "/resource-3/", "headers": {"x-tenant-id": "` + tenant + `"}}`
+	w := runHandle(t, apiID, rateLimiting, adminRequest("POST", "/_ratelimit/dry-run", sample, "s3cr3t"))
+
+	var response Decision
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Dry run response was not valid json: %v", w.Body.String())
+	}
+	return response
+}
+
+func Test_AdminGrant_Success(t *testing.T) {
+	clk := &manualClock{now: time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)}
+	previous := clock
+	clock = clk
+	t.Cleanup(func() { clock = previous })
+
+	rateLimiting := BuildAdminStruct()
+
+	req := adminRequest("POST", "/_ratelimit/grants", `{"key": "milesahead5::::::", "multiplier": 10, "durationSec": 7200, "reason": "migration"}`, "s3cr3t")
+	req.Header.Set("X-RateLimit-Admin-User", "support-jane")
+	w := runHandle(t, "admin-grant", rateLimiting, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Status code was not correct -- expected %v but was %v: %v", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	// defaults are 2 requests every 10 seconds
+	if limits := dryRunLimits(t, "admin-grant", rateLimiting, "milesahead5"); limits.Requests != 20 || limits.Seconds != 10 {
+		t.Fatalf("Granted limits were not correct -- expected 20/10 but was %v/%v", limits.Requests, limits.Seconds)
+	}
+	if limits := dryRunLimits(t, "admin-grant", rateLimiting, "milesahead6"); limits.Requests != 2 {
+		t.Fatalf("Limits of other keys should not change -- expected 2 but was %v", limits.Requests)
+	}
+
+	w = runHandle(t, "admin-grant", rateLimiting, adminRequest("GET", "/_ratelimit/grants", "", "s3cr3t"))
+	var grants []grant
+	json.Unmarshal(w.Body.Bytes(), &grants)
+	if len(grants) != 1 || grants[0].GrantedBy != "support-jane" || grants[0].Reason != "migration" {
+		t.Fatalf("Grants were not correct: %v", w.Body.String())
+	}
+
+	clk.Advance(2*time.Hour + time.Second)
+	if limits := dryRunLimits(t, "admin-grant", rateLimiting, "milesahead5"); limits.Requests != 2 {
+		t.Fatalf("Grant should have expired -- expected 2 but was %v", limits.Requests)
+	}
+
+	w = runHandle(t, "admin-grant", rateLimiting, adminRequest("GET", "/_ratelimit/audit", "", "s3cr3t"))
+	var entries []auditEntry
+	json.Unmarshal(w.Body.Bytes(), &entries)
+	if len(entries) != 1 || entries[0].Action != auditGrant || entries[0].User != "support-jane" || entries[0].Grant == nil {
+		t.Fatalf("Audit log was not correct: %v", w.Body.String())
+	}
+}
+
+func Test_AdminGrantExplicitLimits_Success(t *testing.T) {
+	rateLimiting := BuildAdminStruct()
+
+	w := runHandle(t, "admin-grant-explicit", rateLimiting,
+		adminRequest("POST", "/_ratelimit/grants", `{"key": "milesahead7::::::", "requests": 100, "seconds": 60, "durationSec": 600}`, "s3cr3t"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Status code was not correct -- expected %v but was %v: %v", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	if limits := dryRunLimits(t, "admin-grant-explicit", rateLimiting, "milesahead7"); limits.Requests != 100 || limits.Seconds != 60 {
+		t.Fatalf("Granted limits were not correct -- expected 100/60 but was %v/%v", limits.Requests, limits.Seconds)
+	}
+}
+
+func Test_AdminGrantInvalid_Success(t *testing.T) {
+	bodies := []string{
+		`{"multiplier": 10, "durationSec": 600}`,
+		`{"key": "milesahead7::::::", "durationSec": 600}`,
+		`{"key": "milesahead7::::::", "requests": 100, "durationSec": 600}`,
+		`{"key": "milesahead7::::::", "multiplier": 10}`,
+		`not json`,
+	}
+
+	for _, body := range bodies {
+		w := runHandle(t, "admin-grant-invalid", BuildAdminStruct(), adminRequest("POST", "/_ratelimit/grants", body, "s3cr3t"))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Status code of %v was not correct -- expected %v but was %v", body, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func Test_AdminRevokeGrant_Success(t *testing.T) {
+	rateLimiting := BuildAdminStruct()
+	runHandle(t, "admin-revoke", rateLimiting,
+		adminRequest("POST", "/_ratelimit/grants", `{"key": "milesahead8::::::", "multiplier": 2, "durationSec": 600}`, "s3cr3t"))
+
+	w := runHandle(t, "admin-revoke", rateLimiting, adminRequest("DELETE", "/_ratelimit/grants?key=milesahead8::::::", "", "s3cr3t"))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Status code was not correct -- expected %v but was %v", http.StatusNoContent, w.Code)
+	}
+	if limits := dryRunLimits(t, "admin-revoke", rateLimiting, "milesahead8"); limits.Requests != 2 {
+		t.Fatalf("Grant should have been revoked -- expected 2 but was %v", limits.Requests)
+	}
+
+	w = runHandle(t, "admin-revoke", rateLimiting, adminRequest("DELETE", "/_ratelimit/grants?key=milesahead8::::::", "", "s3cr3t"))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Status code was not correct -- expected %v but was %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func Test_AdminReset_Success(t *testing.T) {
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	rateLimiting := BuildAdminStruct()
+	rateLimiting.RateLimiting.Events = Events{}
+	rateLimiting.RateLimiting.Admin.AuditFile = auditFile
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "http://localhost:8080/resource-3/", nil)
+		req.Header.Set("x-tenant-id", "milesahead9")
+		runHandle(t, "admin-reset", rateLimiting, req)
+	}
+	if usage, ok := getKeyUsage("admin-reset", "milesahead9::::::", clock.Now()); !ok || !usage.Throttled {
+		t.Fatalf("Key should be throttled before the reset: %v", usage)
+	}
+
+	req := adminRequest("POST", "/_ratelimit/reset", `{"key": "milesahead9::::::"}`, "s3cr3t")
+	req.Header.Set("X-RateLimit-Admin-User", "support-joe")
+	w := runHandle(t, "admin-reset", rateLimiting, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status code was not correct -- expected %v but was %v: %v", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var counters adminCountersResponse
+	json.Unmarshal(w.Body.Bytes(), &counters)
+	if counters.Usage != nil {
+		t.Fatalf("Counters should have been reset: %v", w.Body.String())
+	}
+	if !strings.HasPrefix(counters.SessionKeyID, "milesahead9::::::#") {
+		t.Fatalf("Session KeyID should change after a reset -- was %v", counters.SessionKeyID)
+	}
+	if getSessionKeyID(rateLimiting.RateLimiting.Admin, "admin-reset", "milesahead10::::::") != "milesahead10::::::" {
+		t.Fatalf("Session KeyID of other keys should not change")
+	}
+
+	content, err := ioutil.ReadFile(auditFile)
+	if err != nil {
+		t.Fatalf("Error reading audit file: %v", err)
+	}
+	var entry auditEntry
+	json.Unmarshal(content, &entry)
+	if entry.Action != auditReset || entry.User != "support-joe" || entry.KeyID != "milesahead9::::::" || entry.ApiID != "admin-reset" {
+		t.Fatalf("Audit entry was not correct: %v", string(content))
+	}
+}
+
+func Test_AdminStateFile_Success(t *testing.T) {
+	clk := &manualClock{now: time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)}
+	previous := clock
+	clock = clk
+	t.Cleanup(func() { clock = previous })
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	rateLimiting := BuildAdminStruct()
+	rateLimiting.RateLimiting.Admin.StateFile = stateFile
+
+	runHandle(t, "admin-state-file", rateLimiting,
+		adminRequest("POST", "/_ratelimit/grants", `{"key": "milesahead11::::::", "multiplier": 3, "durationSec": 600}`, "s3cr3t"))
+	runHandle(t, "admin-state-file", rateLimiting,
+		adminRequest("POST", "/_ratelimit/reset", `{"key": "milesahead11::::::"}`, "s3cr3t"))
+
+	// another gateway mounting the same file
+	other := newAdminStore(stateFile)
+	other.mutex.Lock()
+	other.refresh()
+	other.mutex.Unlock()
+
+	if g, ok := other.findGrant("admin-state-file", "milesahead11::::::", clk.Now()); !ok || g.Multiplier != 3 {
+		t.Fatalf("Grant was not read from the state file: %v", g)
+	}
+	if other.sessionKeyID("admin-state-file", "milesahead11::::::", clock.Now()) == "milesahead11::::::" {
+		t.Fatalf("Reset was not read from the state file")
+	}
+}
+
+func Test_AdminResetExpires_Success(t *testing.T) {
+	clk := &manualClock{now: time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)}
+	previous := clock
+	clock = clk
+	t.Cleanup(func() { clock = previous })
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	rateLimiting := BuildAdminStruct()
+	rateLimiting.RateLimiting.Admin.StateFile = stateFile
+	admin := rateLimiting.RateLimiting.Admin
+
+	runHandle(t, "admin-reset-expires", rateLimiting,
+		adminRequest("POST", "/_ratelimit/reset", `{"key": "milesahead13::::::"}`, "s3cr3t"))
+	if getSessionKeyID(admin, "admin-reset-expires", "milesahead13::::::") == "milesahead13::::::" {
+		t.Fatalf("Session KeyID should change after a reset")
+	}
+
+	// the previous bucket expired with the longest window of the config
+	clk.Advance(resetRetention(rateLimiting.RateLimiting, "admin-reset-expires", "milesahead13::::::", clk.Now()))
+	if sessionKeyID := getSessionKeyID(admin, "admin-reset-expires", "milesahead13::::::"); sessionKeyID != "milesahead13::::::" {
+		t.Fatalf("Reset should have expired -- expected milesahead13:::::: but was %v", sessionKeyID)
+	}
+
+	runHandle(t, "admin-reset-expires", rateLimiting,
+		adminRequest("POST", "/_ratelimit/reset", `{"key": "milesahead14::::::"}`, "s3cr3t"))
+	content, _ := ioutil.ReadFile(stateFile)
+	var state adminState
+	json.Unmarshal(content, &state)
+	if len(state.Resets) != 1 || state.Resets[0].KeyID != "milesahead14::::::" {
+		t.Fatalf("Expired reset should have been removed from the state file: %v", string(content))
+	}
+}
+
+func Test_AuditEntriesPerApi_Success(t *testing.T) {
+	admin := BuildAdminStruct().RateLimiting.Admin
+	audit(admin, auditEntry{Action: auditReset, ApiID: "audit-quiet", KeyID: "milesahead15::::::"})
+	for i := 0; i < maxAuditEntries+10; i++ {
+		audit(admin, auditEntry{Action: auditReset, ApiID: "audit-busy", KeyID: "milesahead16::::::"})
+	}
+
+	if entries := getAuditEntries("audit-busy"); len(entries) != maxAuditEntries {
+		t.Fatalf("Audit entries were not capped -- expected %v but was %v", maxAuditEntries, len(entries))
+	}
+	if entries := getAuditEntries("audit-quiet"); len(entries) != 1 {
+		t.Fatalf("Audit entries of other apis should be kept -- expected 1 but was %v", len(entries))
+	}
+}
@@ -0,0 +1,147 @@
+// Rate limiter of the adapters running without the gateway.
+// Tyk applies the session set by the plugin with a rolling window of 'per' seconds kept in redis,
+// the limiter does the same in memory: every attempt of a key is added to its window and the
+// request is allowed while the window holds no more than 'rate' attempts, so that a service is
+// limited the same way whether it is behind the gateway or not. Only the last rate+1 attempts
+// of a key are kept, which is enough to tell whether the key is over its rate. Above
+// maxExactRate the attempts are counted in two fixed windows instead, the number of attempts
+// in the rolling window being estimated from them (as the throttling events do) so that the
+// memory of a key does not grow with its rate.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// number of windows kept by a limiter, the expired ones being removed first (see recencyList)
+const maxLimitedKeys = 10000
+
+// rate above which the attempts of a key are counted instead of being kept
+const maxExactRate = 100
+
+// Limiter counts the requests of the keys of the sessions, it can be shared by several apis
+// as the gateway shares the sessions of the keys between the apis
+type Limiter struct {
+	mutex   sync.Mutex
+	windows map[string]*limiterWindow
+	recency *recencyList
+}
+
+// attempts of a key over the last period
+type limiterWindow struct {
+	attempts []time.Time
+	period   time.Duration
+	lastSeen time.Time
+	// counters of the keys with a rate above maxExactRate
+	counted     bool
+	windowStart time.Time
+	current     float64
+	previous    float64
+}
+
+// LimitResult is the outcome of a request for the limiter
+type LimitResult struct {
+	Allowed bool
+	// requests allowed per period, -1 if the request is not limited
+	Limit     float64
+	Remaining int
+	// time the oldest attempt leaves the window, freeing a request
+	Reset time.Time
+}
+
+// NewLimiter returns a limiter with no request counted
+func NewLimiter() *Limiter {
+	return &Limiter{windows: map[string]*limiterWindow{}, recency: newRecencyList()}
+}
+
+// Allow counts the request in the window of the key of the session and returns whether it is
+// within the rate of the session. Sessions with no key or a negative rate are not limited.
+func (limiter *Limiter) Allow(session Session) LimitResult {
+	if session.KeyID == "" || session.Rate < 0 || session.Per <= 0 {
+		return LimitResult{Allowed: true, Limit: -1}
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := clock.Now()
+	period := time.Duration(session.Per * float64(time.Second))
+	counted := session.Rate > maxExactRate
+	window, ok := limiter.windows[session.KeyID]
+	if !ok || window.counted != counted {
+		if !ok && len(limiter.windows) >= maxLimitedKeys {
+			limiter.evict(now)
+		}
+		window = &limiterWindow{counted: counted, windowStart: now}
+		limiter.windows[session.KeyID] = window
+	}
+	limiter.recency.touch(session.KeyID)
+	window.period = period
+	window.lastSeen = now
+	if counted {
+		return window.count(now, session.Rate)
+	}
+
+	window.expire(now)
+	window.attempts = append(window.attempts, now)
+	// whether there were more than 'rate' attempts in the period only depends on the last rate+1 ones
+	if excess := len(window.attempts) - int(session.Rate) - 1; excess > 0 {
+		window.attempts = window.attempts[excess:]
+	}
+
+	return LimitResult{
+		Allowed:   float64(len(window.attempts)) <= session.Rate,
+		Limit:     session.Rate,
+		Remaining: int(math.Max(0, session.Rate-float64(len(window.attempts)))),
+		Reset:     window.attempts[0].Add(period),
+	}
+}
+
+// function adds the attempt to the counters of the window, the count of the previous window
+// being weighted by how much it overlaps the last period
+func (window *limiterWindow) count(now time.Time, rate float64) LimitResult {
+	elapsed := now.Sub(window.windowStart)
+	if elapsed >= 2*window.period {
+		window.windowStart, window.current, window.previous = now, 0, 0
+	} else if elapsed >= window.period {
+		window.windowStart, window.previous, window.current = window.windowStart.Add(window.period), window.current, 0
+	}
+	window.current++
+	estimate := window.previous*(1-float64(now.Sub(window.windowStart))/float64(window.period)) + window.current
+
+	return LimitResult{
+		Allowed:   estimate <= rate,
+		Limit:     rate,
+		Remaining: int(math.Max(0, rate-estimate)),
+		Reset:     window.windowStart.Add(window.period),
+	}
+}
+
+// function removes the attempts older than the period of the window
+func (window *limiterWindow) expire(now time.Time) {
+	start := now.Add(-window.period)
+	expired := 0
+	for expired < len(window.attempts) && !window.attempts[expired].After(start) {
+		expired++
+	}
+	window.attempts = window.attempts[expired:]
+}
+
+// function removes the least recently seen windows with no attempt left in their period,
+// or the least recently seen one if none expired, must be called with the mutex held
+func (limiter *Limiter) evict(now time.Time) {
+	for {
+		oldest, ok := limiter.recency.oldest()
+		if !ok {
+			return
+		}
+		keyID := oldest.(string)
+		if window := limiter.windows[keyID]; len(limiter.windows) < maxLimitedKeys && window.lastSeen.Add(window.period).After(now) {
+			return
+		}
+		limiter.recency.removeOldest()
+		delete(limiter.windows, keyID)
+	}
+}
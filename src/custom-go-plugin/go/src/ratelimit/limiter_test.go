@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_LimiterAllow_Success(t *testing.T) {
+	clk := &manualClock{now: time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)}
+	previous := SetClock(clk)
+	defer SetClock(previous)
+	limiter := NewLimiter()
+	session := Session{KeyID: "milesahead2", Rate: 3, Per: 10}
+
+	var allowed []bool
+	for i := 0; i < 5; i++ {
+		allowed = append(allowed, limiter.Allow(session).Allowed)
+		clk.Advance(time.Second)
+	}
+	if attempts := len(limiter.windows["milesahead2"].attempts); attempts != 4 {
+		t.Fatalf("Only the last rate+1 attempts should be kept -- expected 4 but was %v", attempts)
+	}
+	// every attempt is counted, the key being throttled until the attempts leave the 10 second window
+	clk.Advance(4 * time.Second)
+	allowed = append(allowed, limiter.Allow(session).Allowed)
+	clk.Advance(6 * time.Second)
+	allowed = append(allowed, limiter.Allow(session).Allowed)
+
+	expected := "[true true true false false false true]"
+	if fmt.Sprint(allowed) != expected {
+		t.Fatalf("Allowed requests were not correct -- expected %v but was %v", expected, allowed)
+	}
+	if attempts := len(limiter.windows["milesahead2"].attempts); attempts != 2 {
+		t.Fatalf("Attempts out of the window should be removed -- expected 2 but was %v", attempts)
+	}
+
+	for _, unlimited := range []Session{{KeyID: "", Rate: 3, Per: 10}, {KeyID: "milesahead2", Rate: -1, Per: -1}} {
+		if result := limiter.Allow(unlimited); !result.Allowed || result.Limit != -1 {
+			t.Fatalf("Session should not be limited -- was %v", result)
+		}
+	}
+}
+
+func Test_LimiterEvictsKeys_Success(t *testing.T) {
+	clk := &manualClock{now: time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)}
+	previous := SetClock(clk)
+	defer SetClock(previous)
+	limiter := NewLimiter()
+
+	for i := 0; i < maxLimitedKeys; i++ {
+		limiter.Allow(Session{KeyID: fmt.Sprintf("key-%d", i), Rate: 1, Per: 10})
+	}
+	clk.Advance(time.Second)
+	limiter.Allow(Session{KeyID: "key-0", Rate: 1, Per: 10})
+	limiter.Allow(Session{KeyID: "new-key", Rate: 1, Per: 10})
+
+	if len(limiter.windows) != maxLimitedKeys || limiter.windows["key-0"] == nil || limiter.windows["new-key"] == nil {
+		t.Fatalf("Least recently seen key should be evicted -- expected %v keys but was %v", maxLimitedKeys, len(limiter.windows))
+	}
+
+	// the expired windows are removed first
+	clk.Advance(time.Minute)
+	limiter.Allow(Session{KeyID: "other-key", Rate: 1, Per: 10})
+	if len(limiter.windows) != 1 {
+		t.Fatalf("Expired keys should be removed -- expected 1 key but was %v", len(limiter.windows))
+	}
+}
+
+func Test_LimiterCountsLargeRates_Success(t *testing.T) {
+	clk := &manualClock{now: time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)}
+	previous := SetClock(clk)
+	defer SetClock(previous)
+	limiter := NewLimiter()
+	session := Session{KeyID: "milesahead2", Rate: 1000, Per: 10}
+
+	allowed := 0
+	for i := 0; i < 1200; i++ {
+		if limiter.Allow(session).Allowed {
+			allowed++
+		}
+	}
+	if allowed != 1000 {
+		t.Fatalf("Allowed requests were not correct -- expected 1000 but was %v", allowed)
+	}
+	if window := limiter.windows["milesahead2"]; len(window.attempts) != 0 || window.current != 1200 {
+		t.Fatalf("Attempts should be counted and not kept -- expected 1200 but was %v (%v kept)", window.current, len(window.attempts))
+	}
+
+	// 3/4 of the previous window still counts, 900 attempts
+	clk.Advance(12500 * time.Millisecond)
+	if result := limiter.Allow(session); !result.Allowed || result.Remaining != 99 {
+		t.Fatalf("Request should be allowed -- expected 99 remaining but was %v", result)
+	}
+}
@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// matchers of the listen paths of the admin requests, by listen path
+var listenPathMatchers sync.Map
+
+// ListenPathMatcher returns the regular expression matching the request paths starting with the
+// listen path, nil if there is none. The listen paths use the {name:pattern} variables of the
+// gateway router, e.g. "/{?:(?i)Login/LoginService.svc}", a variable without pattern matching
+// one path segment.
+func ListenPathMatcher(listenPath string) (*regexp.Regexp, error) {
+	if listenPath == "" {
+		return nil, nil
+	}
+
+	var expression strings.Builder
+	expression.WriteString("^")
+	for rest := listenPath; rest != ""; {
+		start := strings.Index(rest, "{")
+		if start < 0 {
+			expression.WriteString(regexp.QuoteMeta(rest))
+			break
+		}
+		expression.WriteString(regexp.QuoteMeta(rest[:start]))
+
+		end := variableEnd(rest, start)
+		if end < 0 {
+			return nil, fmt.Errorf("invalid listen path %q: unbalanced braces", listenPath)
+		}
+		pattern := "[^/]+"
+		if colon := strings.Index(rest[start:end], ":"); colon >= 0 {
+			pattern = rest[start+colon+1 : end]
+		}
+		expression.WriteString("(?:" + pattern + ")")
+		rest = rest[end+1:]
+	}
+
+	matcher, err := regexp.Compile(expression.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen path %q: %v", listenPath, err)
+	}
+	return matcher, nil
+}
+
+// function returns the index of the brace closing the variable opened at start, -1 if there is
+// none, the pattern of the variable may hold braces of its own (e.g. "{id:[0-9]{4}}")
+func variableEnd(path string, start int) int {
+	depth := 0
+	for i := start; i < len(path); i++ {
+		switch path[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// function returns the path of the request relative to the listen path of the api, the path
+// itself if it does not start with the listen path (e.g. already stripped by the gateway)
+func trimListenPath(path string, listenPath string) string {
+	if listenPath == "" {
+		return path
+	}
+	matcher, ok := listenPathMatchers.Load(listenPath)
+	if !ok {
+		compiled, err := ListenPathMatcher(listenPath)
+		if err != nil {
+			DebugLog("Invalid listen path: ", err)
+		}
+		matcher, _ = listenPathMatchers.LoadOrStore(listenPath, compiled)
+	}
+	if compiled := matcher.(*regexp.Regexp); compiled != nil {
+		if match := compiled.FindStringIndex(path); match != nil {
+			return "/" + strings.TrimLeft(path[match[1]:], "/")
+		}
+	}
+	return path
+}
@@ -1,6 +1,6 @@
 // Log function that allows to set what gets logged or not based on the api definition config,
 // having Info, Debug and Error levels
-package main
+package ratelimit
 
 import (
 	"fmt"
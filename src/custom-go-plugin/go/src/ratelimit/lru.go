@@ -0,0 +1,60 @@
+// Recency of the keys of the maps the plugin bounds.
+package ratelimit
+
+import "container/list"
+
+// keys of a bounded map ordered from the most to the least recently seen.
+// The keys of the counters kept by the plugin are derived from untrusted request data, their
+// maps are bounded and the least recently seen key is evicted to make room for a new one. The
+// list makes a client cycling keys cost the same as any other, the eviction not having to scan
+// the map under the lock all requests share. It is not safe for concurrent use and is guarded
+// by the mutex of its map.
+type recencyList struct {
+	order    *list.List
+	elements map[interface{}]*list.Element
+}
+
+func newRecencyList() *recencyList {
+	return &recencyList{order: list.New(), elements: map[interface{}]*list.Element{}}
+}
+
+// function marks the key as the most recently seen one, adding it if it is not in the list
+func (recency *recencyList) touch(key interface{}) {
+	if element, ok := recency.elements[key]; ok {
+		recency.order.MoveToFront(element)
+		return
+	}
+	recency.elements[key] = recency.order.PushFront(key)
+}
+
+// function removes the key from the list if it is in it
+func (recency *recencyList) remove(key interface{}) {
+	if element, ok := recency.elements[key]; ok {
+		recency.order.Remove(element)
+		delete(recency.elements, key)
+	}
+}
+
+// function returns the least recently seen key, false if the list is empty
+func (recency *recencyList) oldest() (interface{}, bool) {
+	element := recency.order.Back()
+	if element == nil {
+		return nil, false
+	}
+	return element.Value, true
+}
+
+// function removes and returns the least recently seen key, false if the list is empty
+func (recency *recencyList) removeOldest() (interface{}, bool) {
+	element := recency.order.Back()
+	if element == nil {
+		return nil, false
+	}
+	recency.order.Remove(element)
+	delete(recency.elements, element.Value)
+	return element.Value, true
+}
+
+func (recency *recencyList) len() int {
+	return recency.order.Len()
+}
@@ -0,0 +1,23 @@
+package ratelimit
+
+import "testing"
+
+func Test_RecencyList_Success(t *testing.T) {
+	recency := newRecencyList()
+	for _, key := range []string{"a", "b", "c", "a", "d"} {
+		recency.touch(key)
+	}
+	recency.remove("d")
+
+	var evicted []interface{}
+	for recency.len() > 0 {
+		key, _ := recency.removeOldest()
+		evicted = append(evicted, key)
+	}
+	if len(evicted) != 3 || evicted[0] != "b" || evicted[1] != "c" || evicted[2] != "a" {
+		t.Fatalf("Eviction order was not correct -- expected [b c a] but was %v", evicted)
+	}
+	if _, ok := recency.removeOldest(); ok {
+		t.Fatalf("Nothing should be left to evict")
+	}
+}
@@ -0,0 +1,321 @@
+// Prometheus metrics for the rate limiting decisions of the plugin.
+// the metrics are kept in a small in-process registry written out in the Prometheus text
+// exposition format rather than with the Prometheus client library: a Go plugin has to be
+// built with the exact same versions of the packages it shares with the gateway, so the
+// plugin sticks to the standard library besides Tyk itself.
+// The metrics are served on a local listener and/or pushed to a Pushgateway, both being
+// configured in the 'metrics' section of the api definition config.
+package ratelimit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Metrics struct {
+	ListenAddress   string `json:"listenAddress"`
+	Path            string `json:"path"`
+	PushgatewayUrl  string `json:"pushgatewayUrl"`
+	PushIntervalSec int    `json:"pushIntervalSec"`
+	Job             string `json:"job"`
+}
+
+// outcomes of a rate limiting decision
+const (
+	// a rate limit was set on the session of the key
+	outcomeLimited = "limited"
+	// the key is not rate limited (allow list or unlimited override)
+	outcomeAllowed = "allowed"
+	// no key could be derived from the request
+	outcomeNoKey = "no_key"
+	// the key is on the deny list
+	outcomeDenied = "denied"
+	// the config or the limits could not be resolved
+	outcomeError = "error"
+)
+
+const defaultMetricsPath = "/metrics"
+const defaultMetricsJob = "tyk-rate-limiting-plugin"
+const defaultPushIntervalSec = 15
+
+var decisionsTotal = newCounterVec("ratelimit_decisions_total",
+	"Rate limiting decisions by api, strategy, override and outcome.",
+	"api", "strategy", "override", "outcome")
+
+var strategyDuration = newHistogramVec("ratelimit_strategy_duration_seconds",
+	"Time spent deriving the unique key from the request by api and strategy.",
+	[]float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1},
+	"api", "strategy")
+
+// listeners and push loops already started, by address and url
+var metricsExportersMutex sync.Mutex
+var metricsExporters = map[string]bool{}
+
+// first and longest wait before the metrics listener tries its address again
+var metricsListenBackoff = time.Second
+
+const maxMetricsListenBackoff = 5 * time.Minute
+
+// function records a rate limiting decision
+func recordDecision(apiName string, strategyName string, override *Override, outcome string) {
+	decisionsTotal.inc(apiName, strategyName, overrideLabel(override), outcome)
+}
+
+// function returns the label identifying an override in the metrics
+func overrideLabel(override *Override) string {
+	if override == nil {
+		return "none"
+	}
+	label := override.Method + " " + override.Resource
+	if override.SoapOperation != "" {
+		label += " " + override.SoapOperation
+	}
+	return label
+}
+
+// function writes every metric in the Prometheus text exposition format
+func writeMetrics(w io.Writer) {
+	decisionsTotal.write(w)
+	strategyDuration.write(w)
+}
+
+// function starts the metrics listener and/or Pushgateway push loop of the config
+// unless they were already started by a previous request
+func startMetricsExporters(metrics Metrics) {
+	if metrics.ListenAddress == "" && metrics.PushgatewayUrl == "" {
+		return
+	}
+
+	metricsExportersMutex.Lock()
+	defer metricsExportersMutex.Unlock()
+
+	if metrics.ListenAddress != "" && !metricsExporters["listen:"+metrics.ListenAddress] {
+		metricsExporters["listen:"+metrics.ListenAddress] = true
+		go serveMetrics(metrics)
+	}
+
+	if metrics.PushgatewayUrl != "" && !metricsExporters["push:"+metrics.PushgatewayUrl] {
+		metricsExporters["push:"+metrics.PushgatewayUrl] = true
+		go pushMetricsLoop(metrics)
+	}
+}
+
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+}
+
+func serveMetrics(metrics Metrics) {
+	path := metrics.Path
+	if path == "" {
+		path = defaultMetricsPath
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, metricsHandler())
+
+	// the listener stays registered when the address is taken, the same goroutine retrying
+	// with a backoff instead of every request starting a new listener
+	backoff := metricsListenBackoff
+	for {
+		InfoLog("Serving metrics on ", metrics.ListenAddress+path)
+		err := http.ListenAndServe(metrics.ListenAddress, mux)
+		ErrorLog("Metrics listener error, retrying in ", backoff.String(), ": ", err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxMetricsListenBackoff {
+			backoff = maxMetricsListenBackoff
+		}
+	}
+}
+
+func pushMetricsLoop(metrics Metrics) {
+	interval := time.Duration(metrics.PushIntervalSec) * time.Second
+	if interval <= 0 {
+		interval = defaultPushIntervalSec * time.Second
+	}
+
+	for range time.Tick(interval) {
+		if err := pushMetrics(metrics); err != nil {
+			ErrorLog("Metrics push error: ", err)
+		}
+	}
+}
+
+// function pushes every metric to the Pushgateway, replacing the metrics of the job
+func pushMetrics(metrics Metrics) error {
+	job := metrics.Job
+	if job == "" {
+		job = defaultMetricsJob
+	}
+
+	var body bytes.Buffer
+	writeMetrics(&body)
+
+	req, err := http.NewRequest(http.MethodPut, strings.TrimSuffix(metrics.PushgatewayUrl, "/")+"/metrics/job/"+url.PathEscape(job), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status code %d from Pushgateway", res.StatusCode)
+	}
+	return nil
+}
+
+type counterVec struct {
+	mutex  sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]*counterValue{}}
+}
+
+func (counter *counterVec) inc(labelValues ...string) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	value, ok := counter.values[key]
+	if !ok {
+		value = &counterValue{labelValues: labelValues}
+		counter.values[key] = value
+	}
+	value.value++
+}
+
+func (counter *counterVec) get(labelValues ...string) float64 {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	if value, ok := counter.values[strings.Join(labelValues, "\xff")]; ok {
+		return value.value
+	}
+	return 0
+}
+
+func (counter *counterVec) write(w io.Writer) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+	keys := make([]string, 0, len(counter.values))
+	for key := range counter.values {
+		keys = append(keys, key)
+	}
+	// sorted so that the metrics are written in a stable order
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := counter.values[key]
+		fmt.Fprintf(w, "%s%s %v\n", counter.name, formatLabels(counter.labels, value.labelValues, "", ""), value.value)
+	}
+}
+
+type histogramVec struct {
+	mutex   sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogramValue{}}
+}
+
+func (histogram *histogramVec) observe(value float64, labelValues ...string) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	key := strings.Join(labelValues, "\xff")
+	observed, ok := histogram.values[key]
+	if !ok {
+		observed = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(histogram.buckets))}
+		histogram.values[key] = observed
+	}
+
+	for i, bucket := range histogram.buckets {
+		if value <= bucket {
+			observed.counts[i]++
+		}
+	}
+	observed.sum += value
+	observed.count++
+}
+
+func (histogram *histogramVec) write(w io.Writer) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", histogram.name, histogram.help, histogram.name)
+	keys := make([]string, 0, len(histogram.values))
+	for key := range histogram.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		observed := histogram.values[key]
+		for i, bucket := range histogram.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, formatLabels(histogram.labels, observed.labelValues, "le", fmt.Sprint(bucket)), observed.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, formatLabels(histogram.labels, observed.labelValues, "le", "+Inf"), observed.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", histogram.name, formatLabels(histogram.labels, observed.labelValues, "", ""), observed.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", histogram.name, formatLabels(histogram.labels, observed.labelValues, "", ""), observed.count)
+	}
+}
+
+// function formats the labels of a sample, with an optional extra label (e.g. "le" for buckets)
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabelValue(values[i])+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+escapeLabelValue(extraValue)+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
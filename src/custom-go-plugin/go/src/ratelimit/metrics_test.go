@@ -0,0 +1,203 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runs Handle for a request with the given config and api name
+func runHandle(t *testing.T, apiName string, rateLimiting RateLimitingConfig, req *http.Request) *httptest.ResponseRecorder {
+	var configData map[string]interface{}
+	marshalledConfig, err := json.Marshal(rateLimiting)
+	if err != nil {
+		t.Fatalf("Unable to marshal RateLimitingConfig struct: %v", err)
+	}
+	json.Unmarshal(marshalledConfig, &configData)
+
+	w := httptest.NewRecorder()
+	Handle(&fakeGateway{definition: ApiDefinition{APIID: apiName, Name: apiName, ListenPath: "/my-api/", ConfigData: configData}, rw: w}, req)
+	return w
+}
+
+func Test_SetRateLimitRecordsDecisions_Success(t *testing.T) {
+	apiName := "metrics-decisions"
+
+	// limited with the default values
+	req := httptest.NewRequest("GET", "http://localhost:8080/resource-3/", nil)
+	req.Header.Set("x-tenant-id", "milesahead2")
+	runHandle(t, apiName, BuildStruct(), req)
+
+	// unlimited override
+	req = httptest.NewRequest("GET", "http://localhost:8080/testing/", nil)
+	req.Header.Set("x-tenant-id", "milesahead2")
+	runHandle(t, apiName, BuildStruct(), req)
+
+	// no key
+	rateLimiting := BuildStruct()
+	rateLimiting.RateLimiting.Strategy.Name = sessionGuid
+	runHandle(t, apiName, rateLimiting, httptest.NewRequest("POST", "http://localhost:8080/resource-3/", strings.NewReader("<empty/>")))
+
+	// denied
+	rateLimiting = BuildStruct()
+	rateLimiting.RateLimiting.AccessLists.Deny.Prefixes = []string{"milesahead"}
+	req = httptest.NewRequest("GET", "http://localhost:8080/resource-3/", nil)
+	req.Header.Set("x-tenant-id", "milesahead2")
+	runHandle(t, apiName, rateLimiting, req)
+
+	// error
+	rateLimiting = BuildStruct()
+	rateLimiting.RateLimiting.Schedules = []Schedule{{Name: "broken", Cron: "broken"}}
+	req = httptest.NewRequest("GET", "http://localhost:8080/resource-3/", nil)
+	req.Header.Set("x-tenant-id", "milesahead2")
+	runHandle(t, apiName, rateLimiting, req)
+
+	tests := []struct {
+		strategy string
+		override string
+		outcome  string
+	}{
+		{requestHeaders, "none", outcomeLimited},
+		{requestHeaders, "GET /testing/", outcomeAllowed},
+		{sessionGuid, "none", outcomeNoKey},
+		{requestHeaders, "none", outcomeDenied},
+		{requestHeaders, "none", outcomeError},
+	}
+
+	for _, test := range tests {
+		if value := decisionsTotal.get(apiName, test.strategy, test.override, test.outcome); value != 1 {
+			t.Fatalf("Decisions for %v was not correct -- expected %v but was %v", test, 1, value)
+		}
+	}
+}
+
+func Test_WriteMetrics_Success(t *testing.T) {
+	counter := newCounterVec("test_total", "Test counter.", "api", "outcome")
+	counter.inc("api \"one\"", outcomeLimited)
+	counter.inc("api \"one\"", outcomeLimited)
+
+	histogram := newHistogramVec("test_seconds", "Test histogram.", []float64{0.1, 1}, "api")
+	histogram.observe(0.05, "one")
+	histogram.observe(0.5, "one")
+
+	var output bytes.Buffer
+	counter.write(&output)
+	histogram.write(&output)
+
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{api="api \"one\"",outcome="limited"} 2
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{api="one",le="0.1"} 1
+test_seconds_bucket{api="one",le="1"} 2
+test_seconds_bucket{api="one",le="+Inf"} 2
+test_seconds_sum{api="one"} 0.55
+test_seconds_count{api="one"} 2
+`
+	if output.String() != expected {
+		t.Fatalf("Metrics output was not correct -- expected\n%v\nbut was\n%v", expected, output.String())
+	}
+}
+
+func Test_PushMetrics_Success(t *testing.T) {
+	var pushedPath, pushedBody string
+	pushgateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		pushedPath, pushedBody = r.Method+" "+r.URL.Path, string(body)
+	}))
+	defer pushgateway.Close()
+
+	recordDecision("metrics-push", requestHeaders, nil, outcomeLimited)
+
+	if err := pushMetrics(Metrics{PushgatewayUrl: pushgateway.URL + "/"}); err != nil {
+		t.Fatalf("No errors were expected: %v", err)
+	}
+	if pushedPath != "PUT /metrics/job/"+defaultMetricsJob {
+		t.Fatalf("Push path was not correct -- was %v", pushedPath)
+	}
+	if !strings.Contains(pushedBody, `ratelimit_decisions_total{api="metrics-push",strategy="requestHeaders",override="none",outcome="limited"} 1`) {
+		t.Fatalf("Pushed metrics were not correct -- was %v", pushedBody)
+	}
+}
+
+func Test_PushMetricsError_Success(t *testing.T) {
+	pushgateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer pushgateway.Close()
+
+	if err := pushMetrics(Metrics{PushgatewayUrl: pushgateway.URL, Job: "job"}); err == nil {
+		t.Fatalf("An error was expected")
+	}
+}
+
+func Test_StartMetricsExportersListener_Success(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error finding a free port: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	startMetricsExporters(Metrics{ListenAddress: address, Path: "/custom-metrics"})
+	// starting the same listener again is a no-op
+	startMetricsExporters(Metrics{ListenAddress: address, Path: "/custom-metrics"})
+
+	var res *http.Response
+	for i := 0; i < 50; i++ {
+		res, err = http.Get("http://" + address + "/custom-metrics")
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Metrics listener was not reachable: %v", err)
+	}
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), "# TYPE ratelimit_decisions_total counter") {
+		t.Fatalf("Metrics response was not correct -- was %v %v", res.StatusCode, string(body))
+	}
+}
+
+func Test_StartMetricsExportersListenerRetry_Success(t *testing.T) {
+	previous := metricsListenBackoff
+	metricsListenBackoff = 10 * time.Millisecond
+	t.Cleanup(func() { metricsListenBackoff = previous })
+
+	// the address is taken when the listener starts
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error finding a free port: %v", err)
+	}
+	address := listener.Addr().String()
+	startMetricsExporters(Metrics{ListenAddress: address})
+	time.Sleep(50 * time.Millisecond)
+
+	metricsExportersMutex.Lock()
+	started := metricsExporters["listen:"+address]
+	metricsExportersMutex.Unlock()
+	if !started {
+		t.Fatalf("Listener should stay registered while its address is taken")
+	}
+	listener.Close()
+
+	for i := 0; i < 50; i++ {
+		var res *http.Response
+		if res, err = http.Get("http://" + address + defaultMetricsPath); err == nil {
+			res.Body.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Metrics listener should be retried once the address is free: %v", err)
+}
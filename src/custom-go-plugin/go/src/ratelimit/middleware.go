@@ -0,0 +1,156 @@
+// net/http middleware adapter, for the services which are not behind the gateway.
+// The middleware runs the same key strategies, access lists, overrides and admin endpoint as
+// the plugin, through Handle, with the same config data as the Tyk api definitions, and applies
+// the session Handle sets with a Limiter instead of the gateway: the requests over the rate of
+// their key are answered with a 429 and the X-RateLimit headers, as the gateway does.
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const rateLimitExceededMessage = "Rate limit exceeded"
+
+// Middleware limits the requests of an api before passing them to the next handler
+type Middleware struct {
+	definition  ApiDefinition
+	accessLists AccessLists
+	limiter     *Limiter
+	next        http.Handler
+}
+
+// gateway context of a request handled by the middleware, keeping the session set by Handle
+type middlewareContext struct {
+	definition ApiDefinition
+	rw         *responseRecorder
+	session    *Session
+}
+
+// response writer recording the status and size of the response
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	size       int64
+}
+
+// NewMiddleware returns the middleware limiting the requests with the config data of the api
+// definition, the {"rateLimiting": {...}} object of the config_data of the Tyk api definitions.
+// The limiter can be shared by the middlewares of several apis, the keys being shared by the
+// apis as the gateway shares the sessions.
+func NewMiddleware(definition ApiDefinition, limiter *Limiter, next http.Handler) (*Middleware, error) {
+	rateLimitingConfig, err := ParseConfig(definition.ConfigData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config data: %v", err)
+	}
+	if problems := Validate(rateLimitingConfig); len(problems) > 0 {
+		messages := make([]string, len(problems))
+		for i, problem := range problems {
+			messages[i] = problem.Error()
+		}
+		return nil, errors.New("invalid config data: " + strings.Join(messages, "; "))
+	}
+	if limiter == nil {
+		limiter = NewLimiter()
+	}
+	return &Middleware{definition: definition, accessLists: rateLimitingConfig.RateLimiting.AccessLists, limiter: limiter, next: next}, nil
+}
+
+// NewConfigMiddleware returns the middleware of the api limiting the requests with the config
+// data JSON of a Tyk api definition, with its own limiter
+func NewConfigMiddleware(apiID string, configData []byte, next http.Handler) (*Middleware, error) {
+	var definition ApiDefinition
+	if err := json.Unmarshal(configData, &definition.ConfigData); err != nil {
+		return nil, fmt.Errorf("invalid config data: %v", err)
+	}
+	definition.APIID, definition.Name = apiID, apiID
+	return NewMiddleware(definition, NewLimiter(), next)
+}
+
+func (middleware *Middleware) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !middleware.Check(rw, r) {
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: rw}
+	middleware.next.ServeHTTP(recorder, r)
+	if recorder.statusCode == 0 {
+		recorder.statusCode = http.StatusOK
+	}
+	RecordResponse(rw, &http.Response{StatusCode: recorder.statusCode, ContentLength: recorder.size}, r)
+}
+
+// Check applies the rate limiting to the request and returns whether it can be passed on, for the
+// adapters running the limits without proxying the request. The requests which cannot be passed on
+// are answered on rw (denied, throttled or admin endpoint), the rate limit headers being set either way.
+func (middleware *Middleware) Check(rw http.ResponseWriter, r *http.Request) bool {
+	gateway := &middlewareContext{definition: middleware.definition, rw: &responseRecorder{ResponseWriter: rw}}
+	Handle(gateway, r)
+
+	// denied by the access lists or answered by the admin endpoint
+	if gateway.rw.statusCode != 0 {
+		return false
+	}
+	if gateway.session == nil {
+		return true
+	}
+
+	result := middleware.limiter.Allow(*gateway.session)
+	if result.Limit >= 0 {
+		WriteRateLimitHeaders(rw, result)
+	}
+	if !result.Allowed {
+		InfoLog("Request throttled for KeyID: ", gateway.session.Alias)
+		rw.Header().Set("Retry-After", strconv.FormatInt(int64(result.Reset.Sub(clock.Now())/time.Second)+1, 10))
+		writeAccessDenied(rw, r, AccessLists{DenyStatusCode: http.StatusTooManyRequests, DenyMessage: rateLimitExceededMessage, DenyFormat: middleware.accessLists.DenyFormat})
+		return false
+	}
+	return true
+}
+
+// WriteRateLimitHeaders sets the headers the gateway sets on the rate limited requests
+func WriteRateLimitHeaders(rw http.ResponseWriter, result LimitResult) {
+	rw.Header().Set("X-RateLimit-Limit", strconv.FormatFloat(result.Limit, 'f', -1, 64))
+	rw.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	rw.Header().Set("X-RateLimit-Reset", strconv.FormatInt(result.Reset.Unix(), 10))
+}
+
+func (gateway *middlewareContext) Definition() ApiDefinition {
+	return gateway.definition
+}
+
+func (gateway *middlewareContext) SetSession(session Session) {
+	gateway.session = &session
+}
+
+func (gateway *middlewareContext) ResponseWriter() http.ResponseWriter {
+	return gateway.rw
+}
+
+func (recorder *responseRecorder) WriteHeader(statusCode int) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = statusCode
+	}
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (recorder *responseRecorder) Write(p []byte) (int, error) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = http.StatusOK
+	}
+	n, err := recorder.ResponseWriter.Write(p)
+	recorder.size += int64(n)
+	return n, err
+}
+
+// Flush sends the buffered response to the client if the underlying writer supports it
+func (recorder *responseRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
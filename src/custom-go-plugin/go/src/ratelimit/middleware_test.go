@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// function returns the middleware of the config in front of a handler counting the requests it receives
+func newTestMiddleware(t *testing.T, apiID string, rateLimiting RateLimitingConfig) (*Middleware, *int) {
+	configData, err := json.Marshal(rateLimiting)
+	if err != nil {
+		t.Fatalf("Unable to marshal RateLimitingConfig struct: %v", err)
+	}
+
+	received := 0
+	middleware, err := NewConfigMiddleware(apiID, configData, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		received++
+		rw.Write([]byte("upstream"))
+	}))
+	if err != nil {
+		t.Fatalf("Error creating the middleware: %v", err)
+	}
+	return middleware, &received
+}
+
+func tenantRequest(path string, tenant string) *http.Request {
+	req := httptest.NewRequest("GET", "http://localhost:8080"+path, nil)
+	req.Header.Set("x-tenant-id", tenant)
+	return req
+}
+
+func Test_MiddlewareThrottles_Success(t *testing.T) {
+	clk := &manualClock{now: time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)}
+	previous := SetClock(clk)
+	defer SetClock(previous)
+	middleware, received := newTestMiddleware(t, "middleware-throttles", BuildStruct())
+
+	// defaults are 2 requests every 10 seconds
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		middleware.ServeHTTP(w, tenantRequest("/resource-3/", "milesahead2"))
+		if w.Code != http.StatusOK || w.Body.String() != "upstream" {
+			t.Fatalf("Request %v should be proxied -- expected %v but was %v", i, http.StatusOK, w.Code)
+		}
+		if remaining := w.Header().Get("X-RateLimit-Remaining"); remaining != []string{"1", "0"}[i] || w.Header().Get("X-RateLimit-Limit") != "2" {
+			t.Fatalf("Rate limit headers were not correct -- expected %v remaining but was %v", 1-i, remaining)
+		}
+		clk.Advance(time.Second)
+	}
+
+	w := httptest.NewRecorder()
+	middleware.ServeHTTP(w, tenantRequest("/resource-3/", "milesahead2"))
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), rateLimitExceededMessage) {
+		t.Fatalf("Request should be throttled -- expected %v but was %v", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") != "9" || *received != 2 {
+		t.Fatalf("Throttled request was not correct -- expected Retry-After 9 and 2 proxied but was %v and %v", w.Header().Get("Retry-After"), *received)
+	}
+
+	// the other keys are not limited by milesahead2
+	w = httptest.NewRecorder()
+	middleware.ServeHTTP(w, tenantRequest("/resource-3/", "milesahead3"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Request of another key should be proxied -- expected %v but was %v", http.StatusOK, w.Code)
+	}
+
+	// the window rolls, 2 requests being left within the last 10 seconds
+	clk.Advance(10 * time.Second)
+	w = httptest.NewRecorder()
+	middleware.ServeHTTP(w, tenantRequest("/resource-3/", "milesahead2"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Request should be proxied once the window rolled -- expected %v but was %v", http.StatusOK, w.Code)
+	}
+}
+
+func Test_MiddlewareUnlimitedAndDenied_Success(t *testing.T) {
+	rateLimiting := BuildStruct()
+	rateLimiting.RateLimiting.AccessLists = AccessLists{Deny: AccessList{Keys: []string{"blocked::::::"}}}
+	middleware, received := newTestMiddleware(t, "middleware-denied", rateLimiting)
+
+	// '/testing/' override has no limit
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		middleware.ServeHTTP(w, tenantRequest("/testing/", "milesahead2"))
+		if w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "" {
+			t.Fatalf("Request should not be limited -- expected %v but was %v", http.StatusOK, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	middleware.ServeHTTP(w, tenantRequest("/testing/", "blocked"))
+	if w.Code != defaultDenyStatusCode || *received != 5 {
+		t.Fatalf("Request should be denied -- expected %v but was %v", defaultDenyStatusCode, w.Code)
+	}
+}
+
+func Test_MiddlewareInvalidConfig_Success(t *testing.T) {
+	tests := []string{
+		`not json`,
+		`{"rateLimiting": {"active": "yes"}}`,
+		`{"rateLimiting": {"active": true, "requests": 2, "seconds": 10, "strategy": {"name": "unknown"}}}`,
+	}
+	for _, test := range tests {
+		if _, err := NewConfigMiddleware("middleware-invalid", []byte(test), http.NotFoundHandler()); err == nil {
+			t.Fatalf("An error was expected for %v", test)
+		}
+	}
+}
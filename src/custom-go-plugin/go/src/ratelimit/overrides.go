@@ -0,0 +1,176 @@
+// Override matching for the rate limiting plugin.
+// an override applies to a request when its 'resource' is found in the request path,
+// its 'method' matches the request method and, for SOAP apis that multiplex every
+// operation through one endpoint, its optional 'soapOperation' matches the operation
+// being invoked by the request. Overrides can also require query parameters, headers,
+// a Content-Type or a body size range through their optional 'match' predicates
+package ratelimit
+
+import (
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// matches the first element inside the SOAP Body, which is the name of the operation being invoked
+var soapBodyOperationRegex = regexp.MustCompile(`(?s)<(?:[\w.-]+:)?Body\b[^>]*>\s*<(?:[\w.-]+:)?([\w.-]+)`)
+
+// function takes an HTTP request and the api definition config as input
+// loops through the 'overrides' to find the first one matching the request
+// output: a pointer to the matched override
+// if no overrides were found nil is returned
+func lookForOverridesInRequest(req *http.Request, rateLimitingConfig RateLimitingConfig) *Override {
+	soapOperation := ""
+	soapOperationResolved := false
+
+	for i, override := range rateLimitingConfig.RateLimiting.Overrides {
+		if !caseInsensitiveContains(req.URL.Path, override.Resource) || !strings.EqualFold(override.Method, req.Method) {
+			continue
+		}
+
+		if override.SoapOperation != "" {
+			// the operation is only resolved once and only when an override asks for it
+			// as it might require reading the request body
+			if !soapOperationResolved {
+				soapOperation = getSoapOperation(req, rateLimitingConfig.RateLimiting.bodyLimit())
+				soapOperationResolved = true
+			}
+			if !strings.EqualFold(override.SoapOperation, soapOperation) {
+				continue
+			}
+		}
+
+		if override.Match != nil && !requestMatches(req, *override.Match, rateLimitingConfig.RateLimiting.bodyLimit()) {
+			continue
+		}
+
+		DebugLog("Override found for request: ", override.Resource, override.SoapOperation)
+		return &rateLimitingConfig.RateLimiting.Overrides[i]
+	}
+	return nil
+}
+
+// function returns the name of the SOAP operation invoked by the request.
+// The SOAPAction header (SOAP 1.1) or the 'action' parameter of the Content-Type (SOAP 1.2)
+// is looked at first, with only its last segment being kept,
+// e.g. "http://roadnet.com/apex/IRoutingService/SaveRoutes" gives "SaveRoutes".
+// When no action is sent, the name of the first element of the SOAP Body is used instead.
+// An empty string is returned if the operation cannot be found.
+func getSoapOperation(req *http.Request, maxBodySize int64) string {
+	action := strings.Trim(strings.TrimSpace(req.Header.Get("SOAPAction")), `"`)
+	if action == "" {
+		if _, params, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err == nil {
+			action = strings.Trim(params["action"], `"`)
+		}
+	}
+
+	if action != "" {
+		operation := action[strings.LastIndexAny(action, "/#:")+1:]
+		DebugLog("SOAP operation from action: ", operation)
+		return operation
+	}
+
+	body, err := readRequestBody(req, maxBodySize)
+	if err != nil {
+		DebugLog("request body: NONE")
+		return ""
+	}
+
+	matches := soapBodyOperationRegex.FindSubmatch(body)
+	if len(matches) >= 2 {
+		DebugLog("SOAP operation from body: ", string(matches[1]))
+		return string(matches[1])
+	}
+
+	DebugLog("no SOAP operation found")
+	return ""
+}
+
+// function evaluates the 'match' predicates of an override against the request.
+// Every predicate set on the match must be satisfied, as well as every entry of 'all'
+// and at least one entry of 'any' when 'any' is not empty.
+// An empty match is always satisfied.
+func requestMatches(req *http.Request, match OverrideMatch, maxBodySize int64) bool {
+	if match.Query != "" && !valueMatches(req.URL.Query()[match.Query], match.Value) {
+		return false
+	}
+
+	if match.Header != "" && !valueMatches(req.Header.Values(match.Header), match.Value) {
+		return false
+	}
+
+	if match.ContentType != "" && !contentTypeMatches(req.Header.Get("Content-Type"), match.ContentType) {
+		return false
+	}
+
+	if match.MinBodySize > 0 || match.MaxBodySize > 0 {
+		size := getBodySize(req, maxBodySize)
+		if size < match.MinBodySize || (match.MaxBodySize > 0 && size > match.MaxBodySize) {
+			return false
+		}
+	}
+
+	for _, condition := range match.All {
+		if !requestMatches(req, condition, maxBodySize) {
+			return false
+		}
+	}
+
+	if len(match.Any) == 0 {
+		return true
+	}
+	for _, condition := range match.Any {
+		if requestMatches(req, condition, maxBodySize) {
+			return true
+		}
+	}
+	return false
+}
+
+// function checks if a query parameter or header is present and, when an expected
+// value is given, that one of its values is equal (case-insensitive) to the expected value
+func valueMatches(values []string, expected string) bool {
+	if len(values) == 0 {
+		return false
+	}
+	if expected == "" {
+		return true
+	}
+	for _, value := range values {
+		if strings.EqualFold(value, expected) {
+			return true
+		}
+	}
+	return false
+}
+
+// function compares the media type of the request Content-Type with the expected one,
+// parameters such as charset are ignored and "type/*" matches any subtype
+func contentTypeMatches(contentType string, expected string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(expected, "/*") {
+		return strings.HasPrefix(mediaType, strings.ToLower(strings.TrimSuffix(expected, "*")))
+	}
+	return strings.EqualFold(mediaType, expected)
+}
+
+// function returns the size of the request body in bytes, using the Content-Length
+// when it is known and reading the start of the body otherwise (e.g. chunked requests),
+// a body longer than maxBodySize having a size of maxBodySize + 1
+func getBodySize(req *http.Request, maxBodySize int64) int64 {
+	if req.ContentLength >= 0 {
+		return req.ContentLength
+	}
+	body, err := readRequestBody(req, maxBodySize)
+	if err != nil {
+		return 0
+	}
+	if req.Body.(*readBody).truncated {
+		return maxBodySize + 1
+	}
+	return int64(len(body))
+}
@@ -0,0 +1,233 @@
+package ratelimit
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const routingSoapEnvelope = `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:dat="http://roadnet.com/apex/DataServices/">
+      <soapenv:Header>
+          <dat:SessionHeader>
+              <dat:SessionGuid>33d9b8d0-58ba-4400-87af-bdf5f79c0f9b</dat:SessionGuid>
+          </dat:SessionHeader>
+      </soapenv:Header>
+      <soapenv:Body>
+          <dat:SaveRoutes>
+              <dat:Routes/>
+          </dat:SaveRoutes>
+      </soapenv:Body>
+  </soapenv:Envelope>`
+
+func BuildSoapOverridesStruct() RateLimitingConfig {
+	rateLimiting := BuildStruct()
+	rateLimiting.RateLimiting.Strategy.Name = sessionGuid
+	rateLimiting.RateLimiting.Overrides = []Override{
+		{
+			Method:        "POST",
+			Requests:      1,
+			Resource:      "/RoutingService.svc",
+			Seconds:       60,
+			SoapOperation: "SaveRoutes",
+		},
+		{
+			Method:        "POST",
+			Requests:      20,
+			Resource:      "/RoutingService.svc",
+			Seconds:       10,
+			SoapOperation: "RetrieveRoutes",
+		},
+	}
+	return rateLimiting
+}
+
+func Test_LookForOverridesSoapOperationFromBody_Success(t *testing.T) {
+	rateLimiting := BuildSoapOverridesStruct()
+
+	req, err := http.NewRequest("POST", "http://localhost:8080/Routing/RoutingService.svc", strings.NewReader(routingSoapEnvelope))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+
+	override := lookForOverridesInRequest(req, rateLimiting)
+	if override == nil || override.SoapOperation != "SaveRoutes" {
+		t.Fatalf("Override was not correct -- expected %v but was %v", "SaveRoutes", override)
+	}
+
+	// the body must still be readable by the strategy once the operation was resolved
+	keyID := selectStrategy(rateLimiting, req)
+	if keyID != "33d9b8d0-58ba-4400-87af-bdf5f79c0f9b" {
+		t.Fatalf("KeyId value was not correct -- expected %v but was %v", "33d9b8d0-58ba-4400-87af-bdf5f79c0f9b", keyID)
+	}
+}
+
+func Test_LookForOverridesSoapOperationFromSoapAction_Success(t *testing.T) {
+	rateLimiting := BuildSoapOverridesStruct()
+
+	req, err := http.NewRequest("POST", "http://localhost:8080/Routing/RoutingService.svc", strings.NewReader(routingSoapEnvelope))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("SOAPAction", `"http://roadnet.com/apex/DataServices/IRoutingService/RetrieveRoutes"`)
+
+	override := lookForOverridesInRequest(req, rateLimiting)
+	if override == nil || override.Requests != 20 {
+		t.Fatalf("Override was not correct -- expected %v but was %v", "RetrieveRoutes", override)
+	}
+
+	requestsValue, secondsValue, _, err := getRateLimits(rateLimiting, override, "33d9b8d0")
+	if err != nil || requestsValue != 20 || secondsValue != 10 {
+		t.Fatalf("RateLimit values was not correct -- expected 20/10 but was %v/%v", requestsValue, secondsValue)
+	}
+}
+
+func Test_LookForOverridesSoapOperationFromContentType_Success(t *testing.T) {
+	rateLimiting := BuildSoapOverridesStruct()
+
+	req, err := http.NewRequest("POST", "http://localhost:8080/Routing/RoutingService.svc", strings.NewReader(routingSoapEnvelope))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", `application/soap+xml; charset=utf-8; action="urn:RetrieveRoutes"`)
+
+	override := lookForOverridesInRequest(req, rateLimiting)
+	if override == nil || override.SoapOperation != "RetrieveRoutes" {
+		t.Fatalf("Override was not correct -- expected %v but was %v", "RetrieveRoutes", override)
+	}
+}
+
+func Test_LookForOverridesSoapOperationNotMatched_Success(t *testing.T) {
+	rateLimiting := BuildSoapOverridesStruct()
+
+	req, err := http.NewRequest("POST", "http://localhost:8080/Routing/RoutingService.svc", strings.NewReader(routingSoapEnvelope))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("SOAPAction", "http://roadnet.com/apex/DataServices/IRoutingService/DeleteRoutes")
+
+	override := lookForOverridesInRequest(req, rateLimiting)
+	if override != nil {
+		t.Fatalf("No override was expected but was %v", override)
+	}
+
+	requestsValue, secondsValue, _, _ := getRateLimits(rateLimiting, override, "33d9b8d0")
+	if requestsValue != 2 || secondsValue != 10 {
+		t.Fatalf("RateLimit values was not correct -- expected 2/10 but was %v/%v", requestsValue, secondsValue)
+	}
+}
+
+func Test_LookForOverridesResourceAndMethod_Success(t *testing.T) {
+	rateLimiting := BuildStruct()
+
+	req, err := http.NewRequest("POST", "http://localhost:8080/resource-2/", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+
+	// the resource matches but the method does not
+	if override := lookForOverridesInRequest(req, rateLimiting); override != nil {
+		t.Fatalf("No override was expected but was %v", override)
+	}
+
+	req.Method = "GET"
+	if override := lookForOverridesInRequest(req, rateLimiting); override == nil || override.Requests != 5 {
+		t.Fatalf("Override was not correct -- expected %v but was %v", rateLimiting.RateLimiting.Overrides[1], override)
+	}
+}
+
+func BuildMatchOverridesStruct() RateLimitingConfig {
+	rateLimiting := BuildStruct()
+	rateLimiting.RateLimiting.Overrides = []Override{
+		{
+			Method:   "POST",
+			Requests: 1,
+			Resource: "/orders",
+			Seconds:  60,
+			Match: &OverrideMatch{
+				Query: "bulk",
+				Value: "true",
+				Any: []OverrideMatch{
+					{ContentType: "application/json"},
+					{Header: "x-batch-id"},
+				},
+			},
+		},
+		{
+			Method:   "POST",
+			Requests: 3,
+			Resource: "/orders",
+			Seconds:  60,
+			Match: &OverrideMatch{
+				All: []OverrideMatch{
+					{ContentType: "text/*"},
+					{MinBodySize: 10, MaxBodySize: 100},
+				},
+			},
+		},
+	}
+	return rateLimiting
+}
+
+func Test_LookForOverridesMatchQueryAndContentType_Success(t *testing.T) {
+	rateLimiting := BuildMatchOverridesStruct()
+
+	req, err := http.NewRequest("POST", "http://localhost:8080/orders?bulk=TRUE", strings.NewReader(`{"orders": []}`))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	override := lookForOverridesInRequest(req, rateLimiting)
+	if override == nil || override.Requests != 1 {
+		t.Fatalf("Override was not correct -- expected %v but was %v", rateLimiting.RateLimiting.Overrides[0], override)
+	}
+}
+
+func Test_LookForOverridesMatchAnyHeader_Success(t *testing.T) {
+	rateLimiting := BuildMatchOverridesStruct()
+
+	req, err := http.NewRequest("POST", "http://localhost:8080/orders?bulk=true", strings.NewReader(`<orders/>`))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	req.Header.Set("x-batch-id", "42")
+
+	override := lookForOverridesInRequest(req, rateLimiting)
+	if override == nil || override.Requests != 1 {
+		t.Fatalf("Override was not correct -- expected %v but was %v", rateLimiting.RateLimiting.Overrides[0], override)
+	}
+
+	// none of the 'any' predicates match once the header is removed
+	req.Header.Del("x-batch-id")
+	if override := lookForOverridesInRequest(req, rateLimiting); override != nil {
+		t.Fatalf("No override was expected but was %v", override)
+	}
+}
+
+func Test_LookForOverridesMatchBodySize_Success(t *testing.T) {
+	rateLimiting := BuildMatchOverridesStruct()
+
+	req, err := http.NewRequest("POST", "http://localhost:8080/orders", strings.NewReader("order-1,order-2"))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/csv")
+
+	override := lookForOverridesInRequest(req, rateLimiting)
+	if override == nil || override.Requests != 3 {
+		t.Fatalf("Override was not correct -- expected %v but was %v", rateLimiting.RateLimiting.Overrides[1], override)
+	}
+
+	// chunked requests have an unknown length so the body gets read
+	req, err = http.NewRequest("POST", "http://localhost:8080/orders", strings.NewReader(strings.Repeat("order-1,", 20)))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "text/csv")
+	req.ContentLength = -1
+
+	if override := lookForOverridesInRequest(req, rateLimiting); override != nil {
+		t.Fatalf("No override was expected but was %v", override)
+	}
+}
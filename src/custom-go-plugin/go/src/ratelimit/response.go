@@ -0,0 +1,166 @@
+// Response hook of the rate limiting plugin.
+// SetRateLimit keeps a small state in the request context (api, unique key, time the request
+// was received) which the response hook, registered in the 'response' section of the bundle
+// manifest, reads back to correlate each upstream response with the key it was limited on.
+// The hook records the status code, latency and response size of every response per key
+// and feeds the adaptive limits of the api.
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type contextKey int
+
+const requestStateKey contextKey = iota
+
+// state kept in the request context between SetRateLimit and the response hook
+type requestState struct {
+	apiID    string
+	keyID    string
+	received time.Time
+}
+
+// outcomes of the responses recorded for a given api and key
+type keyOutcomes struct {
+	Responses      int64         `json:"responses"`
+	StatusCodes    map[int]int64 `json:"statusCodes"`
+	TotalLatencyMs int64         `json:"totalLatencyMs"`
+	MaxLatencyMs   int64         `json:"maxLatencyMs"`
+	ResponseBytes  int64         `json:"responseBytes"`
+	LastSeen       time.Time     `json:"lastSeen"`
+}
+
+type outcomesKey struct {
+	apiID string
+	keyID string
+}
+
+// number of keys whose outcomes are tracked, see recencyList
+const maxTrackedKeys = 10000
+
+var outcomesMutex sync.Mutex
+var outcomes = map[outcomesKey]*keyOutcomes{}
+var outcomesRecency = newRecencyList()
+
+// function stores the state in the request context, the request is updated in place
+// (as Tyk does for its own context values) so that later middlewares see the state
+func setRequestState(req *http.Request, state *requestState) {
+	*req = *req.WithContext(context.WithValue(req.Context(), requestStateKey, state))
+}
+
+// function returns the state stored in the request context by SetRateLimit or nil if none
+func getRequestState(req *http.Request) *requestState {
+	state, _ := req.Context().Value(requestStateKey).(*requestState)
+	return state
+}
+
+// The response hook that will be configured in the bundle manifest next to SetRateLimit.
+// Measures the time between the request being received and the upstream response and
+// records it, along with the status code and response size, for the key of the request
+// and for the adaptive limits of the api.
+func RecordResponse(rw http.ResponseWriter, res *http.Response, req *http.Request) {
+	state := getRequestState(req)
+	if state == nil {
+		DebugLog("No request state found for response")
+		return
+	}
+
+	latency := clock.Now().Sub(state.received)
+	DebugLog("Upstream response: ", state.keyID, res.StatusCode, latency.String())
+
+	if state.keyID != "" {
+		recordOutcome(state.apiID, state.keyID, res.StatusCode, latency, res.ContentLength)
+
+		// the size of chunked responses is only known once the body has been sent to the client
+		if res.ContentLength < 0 && res.Body != nil {
+			res.Body = &countingBody{ReadCloser: res.Body, apiID: state.apiID, keyID: state.keyID}
+		}
+	}
+
+	if controller := findAdaptiveController(state.apiID); controller != nil {
+		controller.observe(res.StatusCode, latency)
+	}
+}
+
+// function adds a response to the outcomes of the key, a negative size is not recorded
+func recordOutcome(apiID string, keyID string, statusCode int, latency time.Duration, size int64) {
+	outcomesMutex.Lock()
+	defer outcomesMutex.Unlock()
+
+	key := outcomesKey{apiID: apiID, keyID: keyID}
+	outcome, ok := outcomes[key]
+	if !ok {
+		if len(outcomes) >= maxTrackedKeys {
+			evictOldestOutcome()
+		}
+		outcome = &keyOutcomes{StatusCodes: map[int]int64{}}
+		outcomes[key] = outcome
+	}
+	outcomesRecency.touch(key)
+
+	latencyMs := latency.Milliseconds()
+	outcome.Responses++
+	outcome.StatusCodes[statusCode]++
+	outcome.TotalLatencyMs += latencyMs
+	if latencyMs > outcome.MaxLatencyMs {
+		outcome.MaxLatencyMs = latencyMs
+	}
+	if size > 0 {
+		outcome.ResponseBytes += size
+	}
+	outcome.LastSeen = clock.Now()
+}
+
+// function removes the least recently seen key, must be called with the mutex held
+func evictOldestOutcome() {
+	if key, ok := outcomesRecency.removeOldest(); ok {
+		delete(outcomes, key.(outcomesKey))
+	}
+}
+
+// function returns a copy of the outcomes recorded for the key
+func getKeyOutcomes(apiID string, keyID string) (keyOutcomes, bool) {
+	outcomesMutex.Lock()
+	defer outcomesMutex.Unlock()
+
+	outcome, ok := outcomes[outcomesKey{apiID: apiID, keyID: keyID}]
+	if !ok {
+		return keyOutcomes{}, false
+	}
+
+	result := *outcome
+	result.StatusCodes = make(map[int]int64, len(outcome.StatusCodes))
+	for statusCode, count := range outcome.StatusCodes {
+		result.StatusCodes[statusCode] = count
+	}
+	return result, true
+}
+
+// response body counting the bytes sent to the client, added to the key outcomes on close
+type countingBody struct {
+	io.ReadCloser
+	apiID string
+	keyID string
+	size  int64
+}
+
+func (body *countingBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.size += int64(n)
+	return n, err
+}
+
+func (body *countingBody) Close() error {
+	outcomesMutex.Lock()
+	if outcome, ok := outcomes[outcomesKey{apiID: body.apiID, keyID: body.keyID}]; ok {
+		outcome.ResponseBytes += body.size
+	}
+	body.size = 0
+	outcomesMutex.Unlock()
+	return body.ReadCloser.Close()
+}
@@ -0,0 +1,116 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_RecordResponseCorrelatesKey_Success(t *testing.T) {
+	clk := &manualClock{now: time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)}
+	previous := clock
+	clock = clk
+	t.Cleanup(func() { clock = previous })
+
+	var configData map[string]interface{}
+	marshalledConfig, _ := json.Marshal(BuildStruct())
+	json.Unmarshal(marshalledConfig, &configData)
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/resource-3/", nil)
+	req.Header.Set("x-tenant-id", "milesahead2")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer 12345abcd")
+	Handle(&fakeGateway{definition: ApiDefinition{APIID: "record-response", Name: "Record API", ConfigData: configData}, rw: httptest.NewRecorder()}, req)
+
+	keyID := getRequestState(req).keyID
+	if keyID != "milesahead2::::application/json::12345abcd" {
+		t.Fatalf("KeyId value was not correct -- was %v", keyID)
+	}
+
+	clk.Advance(120 * time.Millisecond)
+	RecordResponse(httptest.NewRecorder(), &http.Response{StatusCode: http.StatusOK, ContentLength: 42, Body: http.NoBody}, req)
+
+	clk.Advance(30 * time.Millisecond)
+	RecordResponse(httptest.NewRecorder(), &http.Response{StatusCode: http.StatusBadGateway, ContentLength: 8, Body: http.NoBody}, req)
+
+	outcome, ok := getKeyOutcomes("record-response", keyID)
+	if !ok {
+		t.Fatalf("Outcomes were expected for key %v", keyID)
+	}
+	if outcome.Responses != 2 || outcome.StatusCodes[http.StatusOK] != 1 || outcome.StatusCodes[http.StatusBadGateway] != 1 {
+		t.Fatalf("Responses were not correct: %v", outcome)
+	}
+	if outcome.TotalLatencyMs != 270 || outcome.MaxLatencyMs != 150 {
+		t.Fatalf("Latency was not correct -- expected 270/150 but was %v/%v", outcome.TotalLatencyMs, outcome.MaxLatencyMs)
+	}
+	if outcome.ResponseBytes != 50 {
+		t.Fatalf("Response size was not correct -- expected %v but was %v", 50, outcome.ResponseBytes)
+	}
+}
+
+func Test_RecordResponseChunkedSize_Success(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost:8080/resource/", nil)
+	setRequestState(req, &requestState{apiID: "record-chunked", keyID: "milesahead1", received: clock.Now()})
+
+	res := &http.Response{StatusCode: http.StatusOK, ContentLength: -1, Body: ioutil.NopCloser(strings.NewReader("chunked body"))}
+	RecordResponse(httptest.NewRecorder(), res, req)
+
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body.Close()
+
+	outcome, _ := getKeyOutcomes("record-chunked", "milesahead1")
+	if outcome.ResponseBytes != int64(len("chunked body")) {
+		t.Fatalf("Response size was not correct -- expected %v but was %v", len("chunked body"), outcome.ResponseBytes)
+	}
+}
+
+func Test_RecordResponseWithoutState_Success(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost:8080/resource/", nil)
+
+	// nothing to correlate the response with, it must be ignored
+	RecordResponse(httptest.NewRecorder(), &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, req)
+}
+
+func Test_RecordOutcomeEviction_Success(t *testing.T) {
+	outcomesMutex.Lock()
+	saved, savedRecency := outcomes, outcomesRecency
+	outcomes, outcomesRecency = map[outcomesKey]*keyOutcomes{}, newRecencyList()
+	outcomesMutex.Unlock()
+	t.Cleanup(func() {
+		outcomesMutex.Lock()
+		outcomes, outcomesRecency = saved, savedRecency
+		outcomesMutex.Unlock()
+	})
+
+	clk := &manualClock{now: time.Date(2024, time.March, 13, 12, 0, 0, 0, time.UTC)}
+	previous := clock
+	clock = clk
+	t.Cleanup(func() { clock = previous })
+
+	for i := 0; i < maxTrackedKeys; i++ {
+		recordOutcome("record-eviction", fmt.Sprintf("key-%d", i), http.StatusOK, 0, 0)
+		clk.Advance(time.Millisecond)
+	}
+	// seen again, key-1 becomes the least recently seen key
+	recordOutcome("record-eviction", "key-0", http.StatusOK, 0, 0)
+	recordOutcome("record-eviction", "newest", http.StatusOK, 0, 0)
+
+	if len(outcomes) != maxTrackedKeys || outcomesRecency.len() != maxTrackedKeys {
+		t.Fatalf("Tracked keys was not correct -- expected %v but was %v", maxTrackedKeys, len(outcomes))
+	}
+	if _, ok := getKeyOutcomes("record-eviction", "key-1"); ok {
+		t.Fatalf("Least recently seen key should have been evicted")
+	}
+	if _, ok := getKeyOutcomes("record-eviction", "key-0"); !ok {
+		t.Fatalf("Key seen again should be tracked")
+	}
+	if _, ok := getKeyOutcomes("record-eviction", "newest"); !ok {
+		t.Fatalf("Newest key should be tracked")
+	}
+}
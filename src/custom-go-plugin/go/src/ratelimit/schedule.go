@@ -0,0 +1,249 @@
+// Time-of-day and calendar based schedules for the rate limiting plugin.
+// both the api definition config and its overrides can declare 'schedules', each one
+// being a cron-like window evaluated in its own timezone that maps to its own 'requests'
+// and 'seconds' values. The first schedule (in config order) whose window contains the
+// current time wins, when none does the regular values are applied.
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// the gateway image may have no tz database, the timezones validated by the pipeline
+	// must be found in production as well
+	_ "time/tzdata"
+)
+
+type Schedule struct {
+	Name     string `json:"name"`
+	Cron     string `json:"cron"`
+	Timezone string `json:"timezone"`
+	Requests int    `json:"requests"`
+	Seconds  int    `json:"seconds"`
+
+	// window of the cron expression in the timezone, parsed when the config is decoded
+	window *scheduleWindow
+}
+
+// parsed cron expression and timezone of a schedule, or the error parsing them
+type scheduleWindow struct {
+	location    *time.Location
+	minutes     map[int]bool
+	hours       map[int]bool
+	daysOfMonth map[int]bool
+	months      map[int]bool
+	daysOfWeek  map[int]bool
+	// both day fields are restricted
+	eitherDay bool
+	err       error
+}
+
+// Clock provides the current time used to resolve schedules
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// clock used by getRateLimits, tests replace it to resolve schedules deterministically
+var clock Clock = systemClock{}
+
+// the config data is decoded for each request, the windows are cached by cron expression
+// and timezone so that they are only parsed once
+var scheduleWindows sync.Map
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var weekdayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// function returns the 'requests' and 'seconds' values of the first schedule active at the given time
+// or the provided default values if no schedule is active.
+// An error is returned if a schedule has an invalid cron expression or timezone.
+func resolveSchedule(schedules []Schedule, requests int, seconds int, now time.Time) (int, int, error) {
+	for _, schedule := range schedules {
+		active, err := schedule.isActive(now)
+		if err != nil {
+			return requests, seconds, err
+		}
+		if active {
+			DebugLog("Schedule active: ", schedule.Name)
+			return schedule.Requests, schedule.Seconds, nil
+		}
+	}
+	return requests, seconds, nil
+}
+
+// UnmarshalJSON decodes the schedule and parses its cron expression and timezone, an invalid
+// one being reported when the schedule is resolved
+func (schedule *Schedule) UnmarshalJSON(data []byte) error {
+	type fields Schedule
+	if err := json.Unmarshal(data, (*fields)(schedule)); err != nil {
+		return err
+	}
+	schedule.window = parseScheduleWindow(schedule.Cron, schedule.Timezone)
+	return nil
+}
+
+// function checks if the given time is within the schedule window.
+// The cron expression has the standard five fields "minute hour day-of-month month day-of-week"
+// and the time is converted to the schedule timezone (UTC if none is set) before being matched,
+// e.g. "* 0-5 * * MON-FRI" is active every minute from midnight to 5:59am on weekdays.
+func (schedule Schedule) isActive(now time.Time) (bool, error) {
+	window := schedule.window
+	if window == nil {
+		window = parseScheduleWindow(schedule.Cron, schedule.Timezone)
+	}
+	if window.err != nil {
+		return false, fmt.Errorf("schedule %q: %v", schedule.Name, window.err)
+	}
+
+	local := now.In(window.location)
+	if !window.minutes[local.Minute()] || !window.hours[local.Hour()] || !window.months[int(local.Month())] {
+		return false, nil
+	}
+
+	// as in cron, when both day fields are restricted a day matching either of them is active
+	dayOfMonthMatch := window.daysOfMonth[local.Day()]
+	dayOfWeekMatch := window.daysOfWeek[int(local.Weekday())]
+	if window.eitherDay {
+		return dayOfMonthMatch || dayOfWeekMatch, nil
+	}
+	return dayOfMonthMatch && dayOfWeekMatch, nil
+}
+
+// function returns the window of the cron expression in the timezone, from the cache
+// if it was already parsed
+func parseScheduleWindow(cron string, timezone string) *scheduleWindow {
+	key := timezone + " " + cron
+	if window, ok := scheduleWindows.Load(key); ok {
+		return window.(*scheduleWindow)
+	}
+	window := &scheduleWindow{}
+	window.parse(cron, timezone)
+	scheduleWindows.Store(key, window)
+	return window
+}
+
+// function parses the cron expression and the timezone, setting the error of the window
+// if either is invalid
+func (window *scheduleWindow) parse(cron string, timezone string) {
+	var err error
+	if window.location, err = loadLocation(timezone); err != nil {
+		window.err = err
+		return
+	}
+
+	fields := strings.Fields(cron)
+	if len(fields) != 5 {
+		window.err = fmt.Errorf("cron expression %q must have 5 fields", cron)
+		return
+	}
+
+	if window.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		window.err = fmt.Errorf("minute: %v", err)
+		return
+	}
+	if window.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		window.err = fmt.Errorf("hour: %v", err)
+		return
+	}
+	if window.daysOfMonth, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		window.err = fmt.Errorf("day of month: %v", err)
+		return
+	}
+	if window.months, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		window.err = fmt.Errorf("month: %v", err)
+		return
+	}
+	if window.daysOfWeek, err = parseCronField(fields[4], 0, 7, weekdayNames); err != nil {
+		window.err = fmt.Errorf("day of week: %v", err)
+		return
+	}
+	// both 0 and 7 stand for sunday
+	window.daysOfWeek[0] = window.daysOfWeek[0] || window.daysOfWeek[7]
+	window.eitherDay = fields[2] != "*" && fields[4] != "*"
+}
+
+// function parses a single cron field made of comma separated values, ranges ("a-b")
+// and steps ("*/n", "a/n" or "a-b/n") into the set of values it matches
+func parseCronField(field string, min int, max int, names map[string]int) (map[int]bool, error) {
+	values := make(map[int]bool)
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		hasStep := false
+		if i := strings.Index(part, "/"); i >= 0 {
+			hasStep = true
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			start, err = parseCronValue(bounds[0], names)
+			if err != nil {
+				return nil, err
+			}
+			end = start
+			if hasStep {
+				// "a/n" runs from a to the end of the range
+				end = max
+			}
+			if len(bounds) == 2 {
+				end, err = parseCronValue(bounds[1], names)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+
+	return values, nil
+}
+
+// function parses a single cron value which is either a number or a month/weekday name
+func parseCronValue(value string, names map[string]int) (int, error) {
+	if named, ok := names[strings.ToLower(value)]; ok {
+		return named, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	return number, nil
+}
+
+// function returns the timezone for the given IANA name, UTC being used when no name is provided
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(name)
+}
@@ -0,0 +1,168 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+type fixedClock struct {
+	now time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.now
+}
+
+// sets the clock used by getRateLimits for the duration of the test
+func setClock(t *testing.T, now time.Time) {
+	previous := clock
+	clock = fixedClock{now: now}
+	t.Cleanup(func() { clock = previous })
+}
+
+func BuildScheduleStruct() RateLimitingConfig {
+	rateLimiting := BuildStruct()
+	rateLimiting.RateLimiting.Schedules = []Schedule{
+		{
+			Name:     "overnight-batch",
+			Cron:     "* 0-5 * * MON-FRI",
+			Timezone: "America/New_York",
+			Requests: 50,
+			Seconds:  10,
+		},
+		{
+			Name:     "weekend",
+			Cron:     "* * * * SAT,0",
+			Timezone: "America/New_York",
+			Requests: 20,
+			Seconds:  10,
+		},
+	}
+	rateLimiting.RateLimiting.Overrides[1].Schedules = []Schedule{
+		{
+			Name:     "month-end",
+			Cron:     "*/15 * 28-31 * *",
+			Requests: 1,
+			Seconds:  60,
+		},
+	}
+	return rateLimiting
+}
+
+func Test_GetRateLimitsScheduleActive_Success(t *testing.T) {
+	rateLimiting := BuildScheduleStruct()
+
+	// wednesday 3:30am in New York
+	setClock(t, time.Date(2024, time.March, 13, 7, 30, 0, 0, time.UTC))
+
+	requestsValue, secondsValue, sessionTtl, err := getRateLimits(rateLimiting, nil, "milesahead1")
+	if err != nil {
+		t.Fatalf("No errors were expected: %v", err)
+	}
+	if requestsValue != 50 || secondsValue != 10 || sessionTtl != 120 {
+		t.Fatalf("RateLimit values was not correct -- expected 50/10/120 but was %v/%v/%v", requestsValue, secondsValue, sessionTtl)
+	}
+}
+
+func Test_GetRateLimitsScheduleInactive_Success(t *testing.T) {
+	rateLimiting := BuildScheduleStruct()
+
+	// wednesday 10:30am in New York
+	setClock(t, time.Date(2024, time.March, 13, 14, 30, 0, 0, time.UTC))
+
+	requestsValue, secondsValue, _, err := getRateLimits(rateLimiting, nil, "milesahead1")
+	if err != nil {
+		t.Fatalf("No errors were expected: %v", err)
+	}
+	if requestsValue != 2 || secondsValue != 10 {
+		t.Fatalf("RateLimit values was not correct -- expected 2/10 but was %v/%v", requestsValue, secondsValue)
+	}
+}
+
+func Test_GetRateLimitsScheduleTimezone_Success(t *testing.T) {
+	rateLimiting := BuildScheduleStruct()
+
+	// saturday 2am in UTC is still friday 9pm in New York
+	setClock(t, time.Date(2024, time.March, 16, 2, 0, 0, 0, time.UTC))
+
+	requestsValue, _, _, _ := getRateLimits(rateLimiting, nil, "milesahead1")
+	if requestsValue != 2 {
+		t.Fatalf("RateLimit values was not correct -- expected %v but was %v", 2, requestsValue)
+	}
+
+	// sunday (0) 9pm in New York
+	setClock(t, time.Date(2024, time.March, 18, 1, 0, 0, 0, time.UTC))
+
+	requestsValue, _, _, _ = getRateLimits(rateLimiting, nil, "milesahead1")
+	if requestsValue != 20 {
+		t.Fatalf("RateLimit values was not correct -- expected %v but was %v", 20, requestsValue)
+	}
+}
+
+func Test_GetRateLimitsOverrideSchedule_Success(t *testing.T) {
+	rateLimiting := BuildScheduleStruct()
+	override := &rateLimiting.RateLimiting.Overrides[1]
+
+	setClock(t, time.Date(2024, time.March, 29, 12, 45, 0, 0, time.UTC))
+
+	requestsValue, secondsValue, _, _ := getRateLimits(rateLimiting, override, "milesahead1")
+	if requestsValue != 1 || secondsValue != 60 {
+		t.Fatalf("RateLimit values was not correct -- expected 1/60 but was %v/%v", requestsValue, secondsValue)
+	}
+
+	// not on a quarter hour
+	setClock(t, time.Date(2024, time.March, 29, 12, 46, 0, 0, time.UTC))
+
+	requestsValue, secondsValue, _, _ = getRateLimits(rateLimiting, override, "milesahead1")
+	if requestsValue != 5 || secondsValue != 60 {
+		t.Fatalf("RateLimit values was not correct -- expected 5/60 but was %v/%v", requestsValue, secondsValue)
+	}
+}
+
+func Test_GetRateLimitsInvalidSchedule_Success(t *testing.T) {
+	for _, schedule := range []Schedule{
+		{Name: "fields", Cron: "* * * *"},
+		{Name: "range", Cron: "* 25 * * *"},
+		{Name: "step", Cron: "*/0 * * * *"},
+		{Name: "name", Cron: "* * * * WEEKDAY"},
+		{Name: "timezone", Cron: "* * * * *", Timezone: "Mars/Olympus_Mons"},
+	} {
+		rateLimiting := BuildStruct()
+		rateLimiting.RateLimiting.Schedules = []Schedule{schedule}
+
+		if _, _, _, err := getRateLimits(rateLimiting, nil, "milesahead1"); err == nil {
+			t.Fatalf("An error was expected for schedule %v", schedule)
+		}
+	}
+}
+
+func Test_ParseCronField_Success(t *testing.T) {
+	values, err := parseCronField("5/20,1-3", 0, 59, nil)
+	if err != nil {
+		t.Fatalf("No errors were expected: %v", err)
+	}
+	for _, expected := range []int{1, 2, 3, 5, 25, 45} {
+		if !values[expected] {
+			t.Fatalf("Value %v was expected in %v", expected, values)
+		}
+	}
+	if len(values) != 6 {
+		t.Fatalf("Values was not correct -- expected 6 values but was %v", values)
+	}
+}
+
+func Test_DecodeSchedule_Success(t *testing.T) {
+	configData := map[string]interface{}{"rateLimiting": map[string]interface{}{
+		"schedules": []interface{}{map[string]interface{}{"name": "overnight-batch", "cron": "* 0-5 * * MON-FRI", "timezone": "America/New_York"}},
+	}}
+
+	first, err := ParseConfig(configData)
+	if err != nil {
+		t.Fatalf("No errors were expected: %v", err)
+	}
+	second, _ := ParseConfig(configData)
+	window := first.RateLimiting.Schedules[0].window
+	if window == nil || window.err != nil || window != second.RateLimiting.Schedules[0].window {
+		t.Fatalf("Schedule should be parsed once when decoded -- expected the same window but was %v and %v", window, second.RateLimiting.Schedules[0].window)
+	}
+}
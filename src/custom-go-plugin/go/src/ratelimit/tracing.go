@@ -0,0 +1,368 @@
+// OpenTelemetry tracing for the rate limiting plugin.
+// spans are created around SetRateLimit and its main steps (strategy execution, override lookup,
+// limit resolution and session set) and exported in batches to an OTLP/HTTP collector using
+// the OTLP json encoding. As for the metrics, the OpenTelemetry SDK is not used so that the
+// plugin does not share package versions with the gateway beyond Tyk itself.
+// The W3C trace context of the incoming request ('traceparent' header) is used as the parent
+// of the SetRateLimit span and replaced by it so that the upstream spans are linked. The sampling
+// decision of the caller and its 'tracestate' are kept, the spans of a request which is not
+// sampled not being exported.
+package ratelimit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Tracing struct {
+	Enabled          bool   `json:"enabled"`
+	OtlpEndpoint     string `json:"otlpEndpoint"`
+	ServiceName      string `json:"serviceName"`
+	FlushIntervalSec int    `json:"flushIntervalSec"`
+}
+
+const defaultOtlpEndpoint = "http://localhost:4318/v1/traces"
+const defaultTracingServiceName = "tyk-rate-limiting-plugin"
+const defaultTracingFlushIntervalSec = 5
+const tracingScopeName = "tyk-rate-limiting-plugin"
+
+// spans are exported once the batch is full or every flush interval,
+// spans are dropped if the collector cannot keep up
+const tracingBatchSize = 512
+const tracingMaxQueuedSpans = 4096
+
+// W3C trace flag of the sampled requests, the only flag of version 00
+const traceFlagSampled = 0x01
+
+// OTLP span kinds
+const spanKindInternal = 1
+const spanKindServer = 2
+
+type span struct {
+	traceID      [16]byte
+	spanID       [8]byte
+	parentSpanID [8]byte
+	traceFlags   byte
+	traceState   string
+	name         string
+	kind         int
+	startTime    time.Time
+	endTime      time.Time
+	attributes   map[string]string
+	errorMessage string
+	exporter     *traceExporter
+}
+
+type traceExporter struct {
+	mutex       sync.Mutex
+	endpoint    string
+	serviceName string
+	spans       []*span
+	flushing    bool
+}
+
+var traceExportersMutex sync.Mutex
+var traceExporters = map[string]*traceExporter{}
+
+// function starts the span of SetRateLimit for the request, its parent being the trace context
+// of the incoming 'traceparent' header if any. Returns nil when tracing is not enabled,
+// every span function accepting a nil span so that callers do not need to check.
+func startRequestSpan(tracing Tracing, req *http.Request, name string) *span {
+	if !tracing.Enabled {
+		return nil
+	}
+
+	root := &span{
+		name:       name,
+		kind:       spanKindServer,
+		startTime:  time.Now(),
+		attributes: map[string]string{},
+		exporter:   getTraceExporter(tracing),
+	}
+
+	if traceID, parentSpanID, traceFlags, ok := parseTraceparent(req.Header.Get("traceparent")); ok {
+		root.traceID = traceID
+		root.parentSpanID = parentSpanID
+		root.traceFlags = traceFlags & traceFlagSampled
+		root.traceState = strings.Join(req.Header.Values("tracestate"), ",")
+	} else {
+		rand.Read(root.traceID[:])
+		root.traceFlags = traceFlagSampled
+		// the trace state belongs to the trace of the caller
+		req.Header.Del("tracestate")
+	}
+	rand.Read(root.spanID[:])
+
+	req.Header.Set("traceparent", "00-"+hex.EncodeToString(root.traceID[:])+"-"+hex.EncodeToString(root.spanID[:])+"-"+hex.EncodeToString([]byte{root.traceFlags}))
+	return root
+}
+
+// function starts a child span of the given span
+func (parent *span) startChild(name string) *span {
+	if parent == nil {
+		return nil
+	}
+	child := &span{
+		traceID:      parent.traceID,
+		parentSpanID: parent.spanID,
+		traceFlags:   parent.traceFlags,
+		traceState:   parent.traceState,
+		name:         name,
+		kind:         spanKindInternal,
+		startTime:    time.Now(),
+		attributes:   map[string]string{},
+		exporter:     parent.exporter,
+	}
+	rand.Read(child.spanID[:])
+	return child
+}
+
+func (s *span) setAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.attributes[key] = value
+}
+
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.errorMessage = err.Error()
+}
+
+// function ends the span and queues it for export if the request is sampled
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.endTime = time.Now()
+	if s.traceFlags&traceFlagSampled == 0 {
+		return
+	}
+	s.exporter.enqueue(s)
+}
+
+// function returns a hash of the key so that tenants can be correlated across spans
+// without the key (which can hold credentials) being exported
+func hashKeyID(keyID string) string {
+	if keyID == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(keyID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// function parses a W3C 'traceparent' header ("00-{trace-id}-{parent-id}-{flags}")
+func parseTraceparent(traceparent string) ([16]byte, [8]byte, byte, bool) {
+	var traceID [16]byte
+	var spanID [8]byte
+	var traceFlags [1]byte
+
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, spanID, 0, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, spanID, 0, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil || spanID == [8]byte{} {
+		return traceID, spanID, 0, false
+	}
+	if _, err := hex.Decode(traceFlags[:], []byte(parts[3])); err != nil {
+		return traceID, spanID, 0, false
+	}
+	return traceID, spanID, traceFlags[0], true
+}
+
+// function returns the exporter for the collector endpoint of the config,
+// starting its flush loop the first time it is requested
+func getTraceExporter(tracing Tracing) *traceExporter {
+	endpoint := tracing.OtlpEndpoint
+	if endpoint == "" {
+		endpoint = defaultOtlpEndpoint
+	}
+	serviceName := tracing.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+
+	traceExportersMutex.Lock()
+	defer traceExportersMutex.Unlock()
+
+	key := endpoint + "|" + serviceName
+	exporter, ok := traceExporters[key]
+	if !ok {
+		exporter = &traceExporter{endpoint: endpoint, serviceName: serviceName}
+		traceExporters[key] = exporter
+
+		interval := time.Duration(tracing.FlushIntervalSec) * time.Second
+		if interval <= 0 {
+			interval = defaultTracingFlushIntervalSec * time.Second
+		}
+		go exporter.flushLoop(interval)
+	}
+	return exporter
+}
+
+func (exporter *traceExporter) enqueue(s *span) {
+	exporter.mutex.Lock()
+	if len(exporter.spans) >= tracingMaxQueuedSpans {
+		exporter.mutex.Unlock()
+		DebugLog("Trace queue full, span dropped: ", s.name)
+		return
+	}
+	exporter.spans = append(exporter.spans, s)
+	full := len(exporter.spans) >= tracingBatchSize && !exporter.flushing
+	exporter.mutex.Unlock()
+
+	if full {
+		go exporter.flush()
+	}
+}
+
+func (exporter *traceExporter) flushLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		exporter.flush()
+	}
+}
+
+// function exports the queued spans to the collector
+func (exporter *traceExporter) flush() error {
+	exporter.mutex.Lock()
+	if exporter.flushing || len(exporter.spans) == 0 {
+		exporter.mutex.Unlock()
+		return nil
+	}
+	spans := exporter.spans
+	exporter.spans = nil
+	exporter.flushing = true
+	exporter.mutex.Unlock()
+
+	defer func() {
+		exporter.mutex.Lock()
+		exporter.flushing = false
+		exporter.mutex.Unlock()
+	}()
+
+	body, err := json.Marshal(exporter.buildRequest(spans))
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Post(exporter.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		ErrorLog("Trace export error: ", err)
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusMultipleChoices {
+		err = fmt.Errorf("unexpected status code %d from collector", res.StatusCode)
+		ErrorLog("Trace export error: ", err)
+		return err
+	}
+	return nil
+}
+
+// structures of the OTLP json encoding (ExportTraceServiceRequest)
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func (exporter *traceExporter) buildRequest(spans []*span) otlpRequest {
+	exported := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		exportedSpan := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			TraceState:        s.traceState,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.startTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.endTime.UnixNano(), 10),
+		}
+		if s.parentSpanID != [8]byte{} {
+			exportedSpan.ParentSpanID = hex.EncodeToString(s.parentSpanID[:])
+		}
+		for key, value := range s.attributes {
+			exportedSpan.Attributes = append(exportedSpan.Attributes, otlpAttribute{Key: key, Value: otlpValue{StringValue: value}})
+		}
+		if s.errorMessage != "" {
+			// STATUS_CODE_ERROR
+			exportedSpan.Status = otlpStatus{Code: 2, Message: s.errorMessage}
+		}
+		exported = append(exported, exportedSpan)
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: exporter.serviceName}}},
+				},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: tracingScopeName},
+						Spans: exported,
+					},
+				},
+			},
+		},
+	}
+}
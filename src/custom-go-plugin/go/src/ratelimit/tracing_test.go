@@ -0,0 +1,195 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// collector stub keeping the spans of every export request it receives
+type fakeCollector struct {
+	*httptest.Server
+	mutex sync.Mutex
+	spans []otlpSpan
+	names []string
+}
+
+func newFakeCollector(t *testing.T) *fakeCollector {
+	collector := &fakeCollector{}
+	collector.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var request otlpRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Errorf("Export request was not valid json: %v", err)
+		}
+
+		collector.mutex.Lock()
+		defer collector.mutex.Unlock()
+		for _, resourceSpans := range request.ResourceSpans {
+			collector.names = append(collector.names, resourceSpans.Resource.Attributes[0].Value.StringValue)
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				collector.spans = append(collector.spans, scopeSpans.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(collector.Close)
+	return collector
+}
+
+func (collector *fakeCollector) span(name string) *otlpSpan {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	for i := range collector.spans {
+		if collector.spans[i].Name == name {
+			return &collector.spans[i]
+		}
+	}
+	return nil
+}
+
+func spanAttribute(s *otlpSpan, key string) string {
+	for _, attribute := range s.Attributes {
+		if attribute.Key == key {
+			return attribute.Value.StringValue
+		}
+	}
+	return ""
+}
+
+func Test_SetRateLimitTracing_Success(t *testing.T) {
+	collector := newFakeCollector(t)
+	tracing := Tracing{Enabled: true, OtlpEndpoint: collector.URL + "/v1/traces", ServiceName: "tracing-test", FlushIntervalSec: 3600}
+
+	var configData map[string]interface{}
+	rateLimiting := BuildStruct()
+	rateLimiting.RateLimiting.Tracing = tracing
+	marshalledConfig, _ := json.Marshal(rateLimiting)
+	json.Unmarshal(marshalledConfig, &configData)
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/resource-2/", nil)
+	req.Header.Set("x-tenant-id", "milesahead2")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("tracestate", "congo=t61rcWkgMzE")
+	Handle(&fakeGateway{definition: ApiDefinition{APIID: "tracing-api", Name: "Tracing API", ConfigData: configData}, rw: httptest.NewRecorder()}, req)
+
+	if err := getTraceExporter(tracing).flush(); err != nil {
+		t.Fatalf("Error exporting spans: %v", err)
+	}
+
+	root := collector.span("SetRateLimit")
+	if root == nil {
+		t.Fatalf("SetRateLimit span was not exported: %v", collector.spans)
+	}
+	if root.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || root.ParentSpanID != "00f067aa0ba902b7" {
+		t.Fatalf("Trace context was not propagated -- was %v/%v", root.TraceID, root.ParentSpanID)
+	}
+	if root.TraceState != "congo=t61rcWkgMzE" || req.Header.Get("tracestate") != "congo=t61rcWkgMzE" {
+		t.Fatalf("Trace state was not propagated -- was %v/%v", root.TraceState, req.Header.Get("tracestate"))
+	}
+	if root.Kind != spanKindServer {
+		t.Fatalf("Span kind was not correct -- expected %v but was %v", spanKindServer, root.Kind)
+	}
+	if spanAttribute(root, "api.name") != "Tracing API" || spanAttribute(root, "ratelimit.strategy") != "requestHeaders" {
+		t.Fatalf("Span attributes were not correct: %v", root.Attributes)
+	}
+	if spanAttribute(root, "ratelimit.override") != "GET /resource-2/" || spanAttribute(root, "ratelimit.outcome") != outcomeLimited {
+		t.Fatalf("Span attributes were not correct: %v", root.Attributes)
+	}
+
+	keyHash := spanAttribute(root, "ratelimit.key_hash")
+	if keyHash != hashKeyID("milesahead2::::::") {
+		t.Fatalf("Key hash was not correct -- expected %v but was %v", hashKeyID("milesahead2::::::"), keyHash)
+	}
+	for _, s := range collector.spans {
+		for _, attribute := range s.Attributes {
+			if strings.Contains(attribute.Value.StringValue, "milesahead2") {
+				t.Fatalf("Key should not be exported in clear: %v", attribute)
+			}
+		}
+	}
+
+	for _, name := range []string{"selectStrategy", "lookForOverridesInRequest", "getRateLimits"} {
+		child := collector.span(name)
+		if child == nil {
+			t.Fatalf("%v span was not exported", name)
+		}
+		if child.TraceID != root.TraceID || child.ParentSpanID != root.SpanID {
+			t.Fatalf("%v span was not a child of SetRateLimit", name)
+		}
+	}
+
+	if traceparent := req.Header.Get("traceparent"); traceparent != "00-"+root.TraceID+"-"+root.SpanID+"-01" {
+		t.Fatalf("Upstream traceparent was not correct -- was %v", traceparent)
+	}
+	if collector.names[0] != "tracing-test" {
+		t.Fatalf("Service name was not correct -- expected %v but was %v", "tracing-test", collector.names[0])
+	}
+}
+
+func Test_SetRateLimitTracingNotSampled_Success(t *testing.T) {
+	collector := newFakeCollector(t)
+	tracing := Tracing{Enabled: true, OtlpEndpoint: collector.URL + "/v1/traces", ServiceName: "tracing-not-sampled", FlushIntervalSec: 3600}
+
+	req := httptest.NewRequest("GET", "http://localhost:8080/resource-2/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	root := startRequestSpan(tracing, req, "SetRateLimit")
+	root.startChild("selectStrategy").end()
+	root.end()
+
+	if err := getTraceExporter(tracing).flush(); err != nil {
+		t.Fatalf("Error exporting spans: %v", err)
+	}
+	if len(collector.spans) != 0 {
+		t.Fatalf("Spans of a request which is not sampled should not be exported: %v", collector.spans)
+	}
+	if traceparent := req.Header.Get("traceparent"); !strings.HasSuffix(traceparent, "-00") || strings.Contains(traceparent, "00f067aa0ba902b7") {
+		t.Fatalf("Upstream traceparent should keep the sampling decision -- was %v", traceparent)
+	}
+}
+
+func Test_SetRateLimitTracingDisabled_Success(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost:8080/resource-2/", nil)
+
+	s := startRequestSpan(Tracing{}, req, "SetRateLimit")
+	if s != nil {
+		t.Fatalf("No span should be started when tracing is disabled")
+	}
+
+	// spans functions accept a nil span
+	s.startChild("child").end()
+	s.setAttribute("key", "value")
+	s.end()
+
+	if req.Header.Get("traceparent") != "" {
+		t.Fatalf("Traceparent should not be set when tracing is disabled")
+	}
+}
+
+func Test_ParseTraceparent_Success(t *testing.T) {
+	tests := []struct {
+		traceparent string
+		valid       bool
+		traceFlags  byte
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, 0x01},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, 0x00},
+		{"", false, 0},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, 0},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, 0},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, 0},
+		{"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false, 0},
+		{"00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, 0},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz", false, 0},
+	}
+
+	for _, test := range tests {
+		_, _, traceFlags, ok := parseTraceparent(test.traceparent)
+		if ok != test.valid || traceFlags != test.traceFlags {
+			t.Fatalf("Traceparent %q was not correct -- expected %v (%v) but was %v (%v)", test.traceparent, test.valid, test.traceFlags, ok, traceFlags)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Validation of the rate limiting config of an api definition.
+// The plugin itself is lenient and falls back to no rate limit when the config cannot be used,
+// Validate reports those mistakes before the api definition is deployed.
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// methods an override can be set on
+var overrideMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// Validate returns the problems found in the rate limiting config, none if it is valid
+func Validate(rateLimitingConfig RateLimitingConfig) []error {
+	var problems []error
+	rateLimit := rateLimitingConfig.RateLimiting
+
+	switch rateLimit.Strategy.Name {
+	case requestHeaders, requestHeadersXRS:
+		if len(rateLimit.Strategy.Config.HeaderNames) == 0 {
+			problems = append(problems, fmt.Errorf("strategy %q requires 'headerNames'", rateLimit.Strategy.Name))
+		}
+	case sessionGuid, soapRequestXRS:
+	case "":
+		if rateLimit.Active {
+			problems = append(problems, errors.New("strategy name is required when active"))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("unknown strategy name %q", rateLimit.Strategy.Name))
+	}
+
+	if rateLimit.SessionTtlMin < 0 {
+		problems = append(problems, errors.New("sessionTtlMin must not be negative"))
+	}
+	if rateLimit.MaxBodySize < 0 {
+		problems = append(problems, errors.New("maxBodySize must not be negative"))
+	}
+
+	problems = append(problems, validateLimits("rateLimiting", rateLimit.Requests, rateLimit.Seconds)...)
+	problems = append(problems, validateSchedules("rateLimiting", rateLimit.Schedules)...)
+
+	seen := map[string]bool{}
+	for i, override := range rateLimit.Overrides {
+		name := fmt.Sprintf("override %d (%v)", i, overrideLabel(&rateLimit.Overrides[i]))
+
+		if !overrideMethods[strings.ToUpper(override.Method)] {
+			problems = append(problems, fmt.Errorf("%v: unknown method %q", name, override.Method))
+		}
+		if override.Resource == "" {
+			problems = append(problems, fmt.Errorf("%v: resource is required", name))
+		}
+		problems = append(problems, validateLimits(name, override.Requests, override.Seconds)...)
+		problems = append(problems, validateSchedules(name, override.Schedules)...)
+
+		// an override with the same method, resource and operation as a previous one
+		// and no other predicate can never be matched
+		key := strings.ToUpper(override.Method) + " " + strings.ToLower(override.Resource) + " " + strings.ToLower(override.SoapOperation)
+		if override.Match == nil {
+			if seen[key] {
+				problems = append(problems, fmt.Errorf("%v: duplicates a previous override", name))
+			}
+			seen[key] = true
+		}
+	}
+
+	for _, list := range []AccessList{rateLimit.AccessLists.Allow, rateLimit.AccessLists.Deny} {
+		for _, cidr := range list.Cidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				problems = append(problems, fmt.Errorf("accessLists: invalid cidr %q", cidr))
+			}
+		}
+	}
+
+	for _, sink := range rateLimit.Events.Sinks {
+		switch sink.Type {
+		case "webhook":
+			if sink.Url == "" {
+				problems = append(problems, errors.New("events: webhook sink requires 'url'"))
+			}
+		case "file":
+			if sink.Path == "" {
+				problems = append(problems, errors.New("events: file sink requires 'path'"))
+			}
+		case "stdout":
+		default:
+			problems = append(problems, fmt.Errorf("events: unknown sink type %q", sink.Type))
+		}
+	}
+
+	names := map[string]bool{}
+	for _, user := range rateLimit.Admin.Users {
+		if user.Name == "" || (user.Secret == "" && user.SecretEnv == "") {
+			problems = append(problems, errors.New("admin: users require a 'name' and a 'secret' or 'secretEnv'"))
+		} else if names[user.Name] {
+			problems = append(problems, fmt.Errorf("admin: duplicate user %q", user.Name))
+		}
+		names[user.Name] = true
+	}
+
+	return problems
+}
+
+// function checks the limits, -1 for both values meaning no rate limit
+func validateLimits(name string, requests int, seconds int) []error {
+	if requests == -1 && seconds == -1 {
+		return nil
+	}
+	if requests < 0 || seconds <= 0 {
+		return []error{fmt.Errorf("%v: requests must be positive and seconds greater than 0, or both -1 for no limit", name)}
+	}
+	return nil
+}
+
+func validateSchedules(name string, schedules []Schedule) []error {
+	var problems []error
+	for _, schedule := range schedules {
+		// the cron expression and the timezone are parsed when checking whether it is active
+		if _, err := schedule.isActive(time.Now()); err != nil {
+			problems = append(problems, fmt.Errorf("%v: %v", name, err))
+		}
+		problems = append(problems, validateLimits(fmt.Sprintf("%v: schedule %q", name, schedule.Name), schedule.Requests, schedule.Seconds)...)
+	}
+	return problems
+}
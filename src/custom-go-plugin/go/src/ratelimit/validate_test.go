@@ -0,0 +1,48 @@
+package ratelimit
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_ValidateValidConfig_Success(t *testing.T) {
+	for _, rateLimitingConfig := range []RateLimitingConfig{BuildStruct(), BuildScheduleStruct()} {
+		if problems := Validate(rateLimitingConfig); len(problems) != 0 {
+			t.Fatalf("Config should be valid -- expected no problems but was %v", problems)
+		}
+	}
+}
+
+func Test_ValidateInvalidConfig_Success(t *testing.T) {
+	tests := []struct {
+		name     string
+		update   func(rateLimit *RateLimit)
+		expected string
+	}{
+		{"unknown strategy", func(rateLimit *RateLimit) { rateLimit.Strategy.Name = "requestHeader" }, `unknown strategy name "requestHeader"`},
+		{"missing header names", func(rateLimit *RateLimit) { rateLimit.Strategy.Config.HeaderNames = nil }, "requires 'headerNames'"},
+		{"negative body size", func(rateLimit *RateLimit) { rateLimit.MaxBodySize = -1 }, "maxBodySize must not be negative"},
+		{"missing limit", func(rateLimit *RateLimit) { rateLimit.Seconds = 0 }, "rateLimiting: requests must be positive"},
+		{"unknown method", func(rateLimit *RateLimit) { rateLimit.Overrides[1].Method = "FETCH" }, `unknown method "FETCH"`},
+		{"duplicate override", func(rateLimit *RateLimit) { rateLimit.Overrides[1].Resource = "/TESTING/" }, "duplicates a previous override"},
+		{"invalid cron", func(rateLimit *RateLimit) {
+			rateLimit.Schedules = []Schedule{{Name: "nightly", Cron: "* 25 * * *", Requests: 1, Seconds: 1}}
+		}, `schedule "nightly": hour`},
+		{"invalid cidr", func(rateLimit *RateLimit) { rateLimit.AccessLists.Deny.Cidrs = []string{"10.0.0.1"} }, `invalid cidr "10.0.0.1"`},
+		{"admin user without secret", func(rateLimit *RateLimit) { rateLimit.Admin.Users = []AdminUser{{Name: "support-ann"}} }, "users require a 'name'"},
+		{"duplicate admin user", func(rateLimit *RateLimit) {
+			rateLimit.Admin.Users = []AdminUser{{Name: "support-ann", Secret: "a"}, {Name: "support-ann", Secret: "b"}}
+		}, `duplicate user "support-ann"`},
+		{"unknown sink", func(rateLimit *RateLimit) { rateLimit.Events.Sinks = []EventSink{{Type: "kafka"}} }, `unknown sink type "kafka"`},
+	}
+
+	for _, test := range tests {
+		rateLimitingConfig := BuildStruct()
+		test.update(&rateLimitingConfig.RateLimiting)
+
+		problems := Validate(rateLimitingConfig)
+		if len(problems) != 1 || !strings.Contains(problems[0].Error(), test.expected) {
+			t.Fatalf("%v -- expected a problem containing %q but was %v", test.name, test.expected, problems)
+		}
+	}
+}
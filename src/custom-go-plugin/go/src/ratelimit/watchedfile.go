@@ -0,0 +1,61 @@
+// Files of the plugin reloaded when they change.
+// the access lists file and the admin state file can be updated without redeploying the apis,
+// they are checked for changes at most once per interval and read again only when their
+// modification time changed.
+package ratelimit
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// a file decoded again whenever its modification time changes
+type watchedFile struct {
+	path        string
+	interval    time.Duration
+	decode      func(content []byte) error
+	modTime     time.Time
+	lastChecked time.Time
+}
+
+func newWatchedFile(path string, interval time.Duration, decode func(content []byte) error) *watchedFile {
+	return &watchedFile{path: path, interval: interval, decode: decode}
+}
+
+// function decodes the file again when it changed since it was last decoded, returns true
+// when it was. The previous content is kept when the file cannot be read or decoded, decode
+// having to leave it unchanged on error.
+func (file *watchedFile) refresh() (bool, error) {
+	now := time.Now()
+	if now.Sub(file.lastChecked) < file.interval {
+		return false, nil
+	}
+	file.lastChecked = now
+
+	info, err := os.Stat(file.path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(file.modTime) {
+		return false, nil
+	}
+
+	content, err := ioutil.ReadFile(file.path)
+	if err != nil {
+		return false, err
+	}
+	if err := file.decode(content); err != nil {
+		return false, err
+	}
+	file.modTime = info.ModTime()
+	return true, nil
+}
+
+// function records the modification time of the file written by the plugin itself,
+// so that it is not read again
+func (file *watchedFile) written() {
+	if info, err := os.Stat(file.path); err == nil {
+		file.modTime = info.ModTime()
+	}
+}